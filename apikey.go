@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"pixerver/database/apikeys"
+)
+
+const apikeyUsage = `usage:
+  pixerver apikey create <tenant>   issue a new key for tenant
+  pixerver apikey revoke <id>       revoke the key with id
+  pixerver apikey rotate <id>       issue a replacement key and revoke id
+  pixerver apikey list [tenant]     list keys (hashes only)`
+
+// runAPIKeyCommand implements the "apikey" admin subcommand. Plaintext keys
+// are printed exactly once, on create and rotate.
+func runAPIKeyCommand(args []string) int {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, apikeyUsage)
+		return 2
+	}
+	if _, err := apikeys.CreateDB(); err != nil {
+		fmt.Fprintf(os.Stderr, "open api key store: %v\n", err)
+		return 1
+	}
+	defer apikeys.CloseDB()
+
+	arg := func() (string, bool) {
+		if len(args) < 2 || args[1] == "" {
+			fmt.Fprintln(os.Stderr, apikeyUsage)
+			return "", false
+		}
+		return args[1], true
+	}
+
+	switch args[0] {
+	case "create", "rotate":
+		a, ok := arg()
+		if !ok {
+			return 2
+		}
+		var (
+			plaintext string
+			k         apikeys.Key
+			err       error
+		)
+		if args[0] == "create" {
+			plaintext, k, err = apikeys.Create(a)
+		} else {
+			plaintext, k, err = apikeys.Rotate(a)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+			return 1
+		}
+		fmt.Printf("id:     %s\ntenant: %s\nkey:    %s\n", k.ID, k.Tenant, plaintext)
+	case "revoke":
+		a, ok := arg()
+		if !ok {
+			return 2
+		}
+		if err := apikeys.Revoke(a); err != nil {
+			fmt.Fprintf(os.Stderr, "revoke: %v\n", err)
+			return 1
+		}
+		fmt.Printf("revoked %s\n", a)
+	case "list":
+		tenantID := ""
+		if len(args) > 1 {
+			tenantID = args[1]
+		}
+		keys, err := apikeys.List(tenantID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "list: %v\n", err)
+			return 1
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(keys)
+	default:
+		fmt.Fprintln(os.Stderr, apikeyUsage)
+		return 2
+	}
+	return 0
+}
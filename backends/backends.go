@@ -0,0 +1,151 @@
+package backends
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"pixerver/database/credentials"
+)
+
+// ErrNotFound is returned by Get when the key does not exist.
+var ErrNotFound = errors.New("object not found")
+
+// Backend is a place originals are read from and variants are written to.
+// Keys are slash-separated and relative to the backend's root or bucket.
+type Backend interface {
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string, meta map[string]string) error
+	// List returns keys starting with prefix; with limit > 0 it stops
+	// after limit keys.
+	List(ctx context.Context, prefix string, limit int) ([]string, error)
+}
+
+// Config is the JSON stored in the credentials store under the key a token
+// names in its "backends" map, e.g.
+//
+//	{"kind":"directory","root":"/srv/images"}
+//	{"kind":"s3","bucket":"img","region":"eu-west-1","accessKey":"..","secretKey":".."}
+type Config struct {
+	Kind string `json:"kind"`
+	// directory
+	Root string `json:"root,omitempty"`
+	// s3
+	Bucket    string `json:"bucket,omitempty"`
+	Region    string `json:"region,omitempty"`
+	Endpoint  string `json:"endpoint,omitempty"`
+	AccessKey string `json:"accessKey,omitempty"`
+	SecretKey string `json:"secretKey,omitempty"`
+	PathStyle bool   `json:"pathStyle,omitempty"`
+	// Prefix is prepended to every key, for sharing a bucket or directory.
+	Prefix string `json:"prefix,omitempty"`
+	// PublicURL, if set, is the base URL the backend's keys are served
+	// under (after Prefix), e.g. a CDN in front of the bucket.
+	PublicURL string `json:"publicUrl,omitempty"`
+}
+
+// Open builds the backend described by cfg.
+func Open(cfg Config) (Backend, error) {
+	var b Backend
+	switch cfg.Kind {
+	case "directory":
+		d, err := NewDirectory(cfg.Root)
+		if err != nil {
+			return nil, err
+		}
+		b = d
+	case "s3":
+		s, err := NewS3(cfg)
+		if err != nil {
+			return nil, err
+		}
+		b = s
+	default:
+		return nil, fmt.Errorf("backends: unsupported kind %q", cfg.Kind)
+	}
+	if cfg.Prefix != "" {
+		b = &prefixed{Backend: b, prefix: strings.TrimSuffix(cfg.Prefix, "/") + "/"}
+	}
+	if cfg.PublicURL != "" {
+		b = &public{Backend: b, base: strings.TrimSuffix(cfg.PublicURL, "/") + "/"}
+	}
+	return b, nil
+}
+
+// URL returns the public URL of key in b, or "" when b has no PublicURL.
+func URL(b Backend, key string) string {
+	if p, ok := b.(*public); ok {
+		return p.base + (&url.URL{Path: key}).EscapedPath()
+	}
+	return ""
+}
+
+// Resolve opens the backend whose config is stored under credKey in
+// tenantID's credentials.
+func Resolve(tenantID, credKey string) (Backend, error) {
+	raw, err := credentials.Get(tenantID, []byte(credKey))
+	if err != nil {
+		return nil, fmt.Errorf("backends: loading credentials %q: %w", credKey, err)
+	}
+	var cfg Config
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("backends: invalid config %q: %w", credKey, err)
+	}
+	return Open(cfg)
+}
+
+// prefixed scopes a backend to a key prefix.
+type prefixed struct {
+	Backend
+	prefix string
+}
+
+func (p *prefixed) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return p.Backend.Get(ctx, p.prefix+key)
+}
+
+func (p *prefixed) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string, meta map[string]string) error {
+	return p.Backend.Put(ctx, p.prefix+key, r, size, contentType, meta)
+}
+
+func (p *prefixed) List(ctx context.Context, prefix string, limit int) ([]string, error) {
+	keys, err := p.Backend.List(ctx, p.prefix+prefix, limit)
+	if err != nil {
+		return nil, err
+	}
+	for i, k := range keys {
+		keys[i] = strings.TrimPrefix(k, p.prefix)
+	}
+	return keys, nil
+}
+
+// public records the base URL a backend's keys are served under.
+type public struct {
+	Backend
+	base string
+}
+
+// Ref is a "backend:key" reference to an object in one of a token's
+// backends.
+type Ref struct {
+	Backend string
+	Key     string
+}
+
+// ParseRef splits "backend:key". Both parts must be non-empty.
+func ParseRef(s string) (Ref, error) {
+	b, k, ok := strings.Cut(s, ":")
+	if !ok || b == "" || k == "" {
+		return Ref{}, fmt.Errorf("backends: invalid source reference %q", s)
+	}
+	return Ref{Backend: b, Key: k}, nil
+}
+
+// String formats the reference as "backend:key".
+func (r Ref) String() string {
+	return r.Backend + ":" + r.Key
+}
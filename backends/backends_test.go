@@ -0,0 +1,210 @@
+package backends
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseRef(t *testing.T) {
+	r, err := ParseRef("archive:2024/cat.jpg")
+	if err != nil || r.Backend != "archive" || r.Key != "2024/cat.jpg" {
+		t.Fatalf("unexpected ref %+v err=%v", r, err)
+	}
+	if r.String() != "archive:2024/cat.jpg" {
+		t.Fatalf("unexpected string %q", r.String())
+	}
+	for _, bad := range []string{"", "archive", "archive:", ":key"} {
+		if _, err := ParseRef(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestDirectoryRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	b, err := Open(Config{Kind: "directory", Root: t.TempDir(), Prefix: "tenant-a"})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	for _, k := range []string{"img/a.jpg", "img/b.jpg", "other/c.jpg"} {
+		if err := b.Put(ctx, k, strings.NewReader("data-"+k), -1, "image/jpeg", map[string]string{"k": k}); err != nil {
+			t.Fatalf("put %s: %v", k, err)
+		}
+	}
+	rc, err := b.Get(ctx, "img/a.jpg")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	got, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(got) != "data-img/a.jpg" {
+		t.Fatalf("unexpected content %q", got)
+	}
+	if _, err := b.Get(ctx, "img/missing.jpg"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	keys, err := b.List(ctx, "img/", 0)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if !reflect.DeepEqual(keys, []string{"img/a.jpg", "img/b.jpg"}) {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+}
+
+func TestPublicURL(t *testing.T) {
+	b, err := Open(Config{Kind: "directory", Root: t.TempDir(), Prefix: "p", PublicURL: "https://cdn.example.com/img/"})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if got := URL(b, "cats/tom cat.jpg"); got != "https://cdn.example.com/img/cats/tom%20cat.jpg" {
+		t.Fatalf("unexpected url %q", got)
+	}
+	plain, _ := Open(Config{Kind: "directory", Root: t.TempDir()})
+	if got := URL(plain, "a.jpg"); got != "" {
+		t.Fatalf("backend without publicUrl should have no url, got %q", got)
+	}
+}
+
+func TestDirectoryRejectsEscapingKeys(t *testing.T) {
+	root := t.TempDir()
+	d, _ := NewDirectory(root + "/inner")
+	if err := d.Put(context.Background(), "../../outside.jpg", strings.NewReader("x"), 1, "", nil); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	// the key is cleaned into the root rather than escaping it
+	keys, _ := d.List(context.Background(), "", 0)
+	if !reflect.DeepEqual(keys, []string{"outside.jpg"}) {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+	if _, err := d.Get(context.Background(), "dir/"); err == nil {
+		t.Fatalf("expected error for directory key")
+	}
+}
+
+// fakeS3 is a minimal path-style S3 endpoint for GET/PUT and paginated
+// ListObjectsV2.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]string
+	meta    map[string]http.Header
+	// raw is the escaped request path each object was put with
+	raw map[string]string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AK/") ||
+		r.Header.Get("X-Amz-Date") == "" {
+		http.Error(w, "unsigned", http.StatusForbidden)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	switch {
+	case r.Method == http.MethodPut:
+		b, _ := io.ReadAll(r.Body)
+		f.objects[key] = string(b)
+		f.meta[key] = r.Header.Clone()
+		f.raw[key] = r.URL.EscapedPath()
+	case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		// one key per page to exercise continuation
+		prefix := r.URL.Query().Get("prefix")
+		after := r.URL.Query().Get("continuation-token")
+		var match []string
+		for k := range f.objects {
+			if strings.HasPrefix(k, prefix) && k > after {
+				match = append(match, k)
+			}
+		}
+		if len(match) == 0 {
+			fmt.Fprint(w, `<ListBucketResult></ListBucketResult>`)
+			return
+		}
+		first := match[0]
+		for _, k := range match {
+			if k < first {
+				first = k
+			}
+		}
+		fmt.Fprintf(w, `<ListBucketResult><Contents><Key>%s</Key></Contents><IsTruncated>%t</IsTruncated><NextContinuationToken>%s</NextContinuationToken></ListBucketResult>`,
+			first, len(match) > 1, first)
+	case r.Method == http.MethodGet:
+		v, ok := f.objects[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, v)
+	}
+}
+
+func TestS3AgainstFakeEndpoint(t *testing.T) {
+	fake := &fakeS3{objects: map[string]string{}, meta: map[string]http.Header{}, raw: map[string]string{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	ctx := context.Background()
+	b, err := Open(Config{Kind: "s3", Bucket: "bucket", Endpoint: srv.URL, AccessKey: "AK", SecretKey: "SK"})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	for _, k := range []string{"p/1.jpg", "p/2.jpg", "q/3.jpg"} {
+		if err := b.Put(ctx, k, strings.NewReader(k), int64(len(k)), "image/jpeg", map[string]string{"source-sha256": "abc"}); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+	if got := fake.meta["p/1.jpg"].Get("X-Amz-Meta-Source-Sha256"); got != "abc" {
+		t.Fatalf("metadata not sent, got %q", got)
+	}
+	keys, err := b.List(ctx, "p/", 0)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if !reflect.DeepEqual(keys, []string{"p/1.jpg", "p/2.jpg"}) {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+	if keys, err := b.List(ctx, "", 2); err != nil || !reflect.DeepEqual(keys, []string{"p/1.jpg", "p/2.jpg"}) {
+		t.Fatalf("limited list: %v %v", keys, err)
+	}
+	rc, err := b.Get(ctx, "q/3.jpg")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	got, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(got) != "q/3.jpg" {
+		t.Fatalf("unexpected body %q", got)
+	}
+	if _, err := b.Get(ctx, "nope"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	// density variants carry "@"; SigV4 wants it and "+" escaped on the
+	// wire exactly as they were signed
+	odd := "v/tom_800_600@2x+a b.webp"
+	if err := b.Put(ctx, odd, strings.NewReader("x"), 1, "image/webp", nil); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if got := fake.raw[odd]; got != "/bucket/v/tom_800_600%402x%2Ba%20b.webp" {
+		t.Fatalf("unexpected wire path %q", got)
+	}
+	if rc, err := b.Get(ctx, odd); err != nil {
+		t.Fatalf("get %q: %v", odd, err)
+	} else {
+		rc.Close()
+	}
+}
+
+func TestURIEncodePath(t *testing.T) {
+	if got := uriEncodePath("/b/a@2x+c=d,e;f:g~h_i-j.k/ü"); got != "/b/a%402x%2Bc%3Dd%2Ce%3Bf%3Ag~h_i-j.k/%C3%BC" {
+		t.Fatalf("unexpected encoding %q", got)
+	}
+}
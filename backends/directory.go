@@ -0,0 +1,139 @@
+package backends
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// metaSuffix names the JSON sidecar holding an object's content type and
+// metadata, since plain files have nowhere else to keep them.
+const metaSuffix = ".meta.json"
+
+// Directory stores objects as files under Root.
+type Directory struct {
+	Root string
+}
+
+// objectMeta is the sidecar content written next to each object.
+type objectMeta struct {
+	ContentType string            `json:"contentType"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+// NewDirectory returns a directory backend rooted at root.
+func NewDirectory(root string) (*Directory, error) {
+	if root == "" {
+		return nil, errors.New("backends: directory root is required")
+	}
+	return &Directory{Root: root}, nil
+}
+
+// path maps key to a file under Root, refusing keys that escape it.
+func (d *Directory) path(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if clean == "/" || strings.HasSuffix(key, "/") {
+		return "", fmt.Errorf("backends: invalid key %q", key)
+	}
+	return filepath.Join(d.Root, filepath.FromSlash(clean[1:])), nil
+}
+
+// Get opens the object stored under key.
+func (d *Directory) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	p, err := d.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// Put writes r to key atomically and records contentType and meta in a
+// sidecar file.
+func (d *Directory) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string, meta map[string]string) error {
+	p, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return err
+	}
+	b, err := json.Marshal(objectMeta{ContentType: contentType, Metadata: meta})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p+metaSuffix, b, 0o644)
+}
+
+// Meta returns the content type and metadata recorded for key.
+func (d *Directory) Meta(key string) (string, map[string]string, error) {
+	p, err := d.path(key)
+	if err != nil {
+		return "", nil, err
+	}
+	b, err := os.ReadFile(p + metaSuffix)
+	if err != nil {
+		return "", nil, err
+	}
+	var m objectMeta
+	if err := json.Unmarshal(b, &m); err != nil {
+		return "", nil, err
+	}
+	return m.ContentType, m.Metadata, nil
+}
+
+// List returns every key starting with prefix, sorted. With limit > 0 the
+// walk stops after limit keys.
+func (d *Directory) List(ctx context.Context, prefix string, limit int) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(d.Root, func(p string, e fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == d.Root {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if e.IsDir() || strings.HasSuffix(p, metaSuffix) || strings.HasPrefix(e.Name(), ".put-") {
+			return nil
+		}
+		rel, err := filepath.Rel(d.Root, p)
+		if err != nil {
+			return err
+		}
+		if k := filepath.ToSlash(rel); strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+			if limit > 0 && len(keys) >= limit {
+				return fs.SkipAll
+			}
+		}
+		return ctx.Err()
+	})
+	sort.Strings(keys)
+	return keys, err
+}
@@ -0,0 +1,261 @@
+package backends
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// unsignedPayload lets requests stream bodies without hashing them first.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// S3 reads and writes objects in an S3-compatible bucket, signing requests
+// with AWS Signature Version 4.
+type S3 struct {
+	Bucket    string
+	Region    string
+	Endpoint  string // scheme://host; empty means AWS
+	AccessKey string
+	SecretKey string
+	PathStyle bool
+	Client    *http.Client
+
+	now func() time.Time
+}
+
+// NewS3 returns an S3 backend for cfg. A custom Endpoint (MinIO, R2, ...)
+// implies path-style addressing.
+func NewS3(cfg Config) (*S3, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("backends: s3 bucket is required")
+	}
+	region := cfg.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := strings.TrimSuffix(cfg.Endpoint, "/")
+	return &S3{
+		Bucket:    cfg.Bucket,
+		Region:    region,
+		Endpoint:  endpoint,
+		AccessKey: cfg.AccessKey,
+		SecretKey: cfg.SecretKey,
+		PathStyle: cfg.PathStyle || endpoint != "",
+		Client:    &http.Client{Timeout: 5 * time.Minute},
+		now:       time.Now,
+	}, nil
+}
+
+// objectURL returns the URL for key (which may be empty for bucket-level
+// requests) with the given query.
+func (s *S3) objectURL(key string, query url.Values) *url.URL {
+	u := &url.URL{Scheme: "https"}
+	base := s.Endpoint
+	if base == "" {
+		base = "https://s3." + s.Region + ".amazonaws.com"
+	}
+	if p, err := url.Parse(base); err == nil {
+		u.Scheme, u.Host = p.Scheme, p.Host
+	}
+	if s.PathStyle {
+		u.Path = "/" + s.Bucket + "/" + key
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawQuery = query.Encode()
+	return u
+}
+
+// get signs and sends a GET for key.
+func (s *S3) get(ctx context.Context, key string, query url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL(key, query).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req)
+	return s.Client.Do(req)
+}
+
+// sign adds SigV4 headers to req. Its path is sent exactly as it is
+// signed, with every byte outside RFC 3986's unreserved set escaped.
+func (s *S3) sign(req *http.Request) {
+	t := s.now().UTC()
+	amzDate := t.Format("20060102T150405Z")
+	day := t.Format("20060102")
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+
+	var names []string
+	for k := range req.Header {
+		lk := strings.ToLower(k)
+		if lk == "host" || lk == "content-type" || strings.HasPrefix(lk, "x-amz-") {
+			names = append(names, lk)
+		}
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, n := range names {
+		canonHeaders.WriteString(n + ":" + strings.TrimSpace(req.Header.Get(n)) + "\n")
+	}
+	signed := strings.Join(names, ";")
+	req.URL.RawPath = uriEncodePath(req.URL.Path)
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.RawPath,
+		canonicalQuery(req.URL.Query()),
+		canonHeaders.String(),
+		signed,
+		unsignedPayload,
+	}, "\n")
+	scope := day + "/" + s.Region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	k := hmacSHA256([]byte("AWS4"+s.SecretKey), day)
+	k = hmacSHA256(k, s.Region)
+	k = hmacSHA256(k, "s3")
+	k = hmacSHA256(k, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(k, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signed, sig))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// uriEncodePath escapes each segment of p as SigV4's UriEncode does, which
+// unlike url.PathEscape also escapes sub-delimiters such as "@", "+" and
+// "=".
+func uriEncodePath(p string) string {
+	segs := strings.Split(p, "/")
+	for i, seg := range segs {
+		var b strings.Builder
+		for j := 0; j < len(seg); j++ {
+			c := seg[j]
+			if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+				b.WriteByte(c)
+			} else {
+				fmt.Fprintf(&b, "%%%02X", c)
+			}
+		}
+		segs[i] = b.String()
+	}
+	return strings.Join(segs, "/")
+}
+
+// canonicalQuery encodes q with SigV4's escaping (%20, not +).
+func canonicalQuery(q url.Values) string {
+	return strings.ReplaceAll(q.Encode(), "+", "%20")
+}
+
+// s3Error turns a non-2xx response into an error.
+func s3Error(resp *http.Response) error {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("backends: s3 %s: %s", resp.Status, strings.TrimSpace(string(b)))
+}
+
+// Get fetches the object stored under key.
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := s.get(ctx, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNotFound
+	case resp.StatusCode/100 != 2:
+		defer resp.Body.Close()
+		return nil, s3Error(resp)
+	}
+	return resp.Body, nil
+}
+
+// Put uploads r as key; meta becomes x-amz-meta-* headers.
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string, meta map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(key, nil).String(), r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for k, v := range meta {
+		req.Header.Set("X-Amz-Meta-"+k, v)
+	}
+	s.sign(req)
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+// listResult is the subset of a ListObjectsV2 response we need.
+type listResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List returns every key starting with prefix, following continuation
+// tokens across pages. With limit > 0 it stops after limit keys.
+func (s *S3) List(ctx context.Context, prefix string, limit int) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := s.get(ctx, "", q)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode/100 != 2 {
+			err := s3Error(resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		var lr listResult
+		err = xml.NewDecoder(resp.Body).Decode(&lr)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range lr.Contents {
+			keys = append(keys, c.Key)
+			if limit > 0 && len(keys) >= limit {
+				return keys, nil
+			}
+		}
+		if !lr.IsTruncated || lr.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = lr.NextContinuationToken
+	}
+}
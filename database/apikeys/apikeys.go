@@ -0,0 +1,232 @@
+package apikeys
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"pixerver/internal/tenant"
+	"pixerver/store"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	ApiKeyDbPath = "apikeys:" // interpreted as key prefix
+	keyPrefix    = "pxv_"
+)
+
+var (
+	// KeyDB maps sha256(api key) -> Key record.
+	KeyDB *store.Store
+	// IDDB maps key id -> sha256(api key) so keys can be revoked by id
+	// without ever storing the plaintext.
+	IDDB *store.Store
+)
+
+var (
+	ErrInvalidKey = errors.New("invalid api key")
+	ErrRevoked    = errors.New("api key revoked")
+	ErrNotFound   = errors.New("api key not found")
+)
+
+// Key is the stored record for an API key. Only the hash of the key is kept.
+type Key struct {
+	ID        string     `json:"id"`
+	Tenant    string     `json:"tenant"`
+	Hash      string     `json:"hash"`
+	CreatedAt time.Time  `json:"createdAt"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+// Revoked reports whether the key has been revoked.
+func (k Key) Revoked() bool {
+	return k.RevokedAt != nil
+}
+
+// CreateDB opens the api key stores.
+func CreateDB() (*store.Store, error) {
+	var err error
+	KeyDB, err = store.New(ApiKeyDbPath)
+	if err != nil {
+		return nil, err
+	}
+	IDDB = KeyDB.WithPrefix(ApiKeyDbPath + "id:")
+	return KeyDB, nil
+}
+
+// CloseDB closes the api key stores.
+func CloseDB() error {
+	return KeyDB.Close()
+}
+
+// hashKey returns the sha256 of the plaintext key.
+func hashKey(plaintext string) []byte {
+	sum := sha256.Sum256([]byte(plaintext))
+	return sum[:]
+}
+
+// generate returns a new key id and plaintext key of the form
+// pxv_<id>_<secret>.
+func generate() (id, plaintext string, err error) {
+	var idb [8]byte
+	var secret [32]byte
+	if _, err := rand.Read(idb[:]); err != nil {
+		return "", "", err
+	}
+	if _, err := rand.Read(secret[:]); err != nil {
+		return "", "", err
+	}
+	id = hex.EncodeToString(idb[:])
+	return id, keyPrefix + id + "_" + hex.EncodeToString(secret[:]), nil
+}
+
+func put(k Key) error {
+	b, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+	h, err := hex.DecodeString(k.Hash)
+	if err != nil {
+		return err
+	}
+	if err := KeyDB.Set(h, b); err != nil {
+		return err
+	}
+	return IDDB.Set([]byte(k.ID), h)
+}
+
+// Create issues a new API key for tenant. The plaintext key is returned once
+// and never stored.
+func Create(tenantID string) (string, Key, error) {
+	if KeyDB == nil {
+		return "", Key{}, errors.New("api key db not open")
+	}
+	if err := tenant.Validate(tenantID); err != nil {
+		return "", Key{}, err
+	}
+	id, plaintext, err := generate()
+	if err != nil {
+		return "", Key{}, err
+	}
+	k := Key{
+		ID:        id,
+		Tenant:    tenantID,
+		Hash:      hex.EncodeToString(hashKey(plaintext)),
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := put(k); err != nil {
+		return "", Key{}, err
+	}
+	return plaintext, k, nil
+}
+
+// Get returns the key record with the given id.
+func Get(id string) (Key, error) {
+	if KeyDB == nil {
+		return Key{}, errors.New("api key db not open")
+	}
+	h, err := IDDB.Get([]byte(id))
+	if err == redis.Nil {
+		return Key{}, ErrNotFound
+	}
+	if err != nil {
+		return Key{}, err
+	}
+	b, err := KeyDB.Get(h)
+	if err != nil {
+		return Key{}, err
+	}
+	var k Key
+	if err := json.Unmarshal(b, &k); err != nil {
+		return Key{}, err
+	}
+	return k, nil
+}
+
+// Revoke marks the key with the given id as revoked. The record is kept so
+// revoked keys still show up in listings.
+func Revoke(id string) error {
+	k, err := Get(id)
+	if err != nil {
+		return err
+	}
+	if k.Revoked() {
+		return nil
+	}
+	now := time.Now().UTC()
+	k.RevokedAt = &now
+	return put(k)
+}
+
+// Rotate issues a new key for the same tenant and revokes the old one.
+func Rotate(id string) (string, Key, error) {
+	old, err := Get(id)
+	if err != nil {
+		return "", Key{}, err
+	}
+	if old.Revoked() {
+		return "", Key{}, ErrRevoked
+	}
+	plaintext, k, err := Create(old.Tenant)
+	if err != nil {
+		return "", Key{}, err
+	}
+	if err := Revoke(old.ID); err != nil {
+		return "", Key{}, err
+	}
+	return plaintext, k, nil
+}
+
+// Authenticate resolves a plaintext key to its record, rejecting unknown and
+// revoked keys.
+func Authenticate(plaintext string) (Key, error) {
+	if KeyDB == nil {
+		return Key{}, errors.New("api key db not open")
+	}
+	if !strings.HasPrefix(plaintext, keyPrefix) {
+		return Key{}, ErrInvalidKey
+	}
+	b, err := KeyDB.Get(hashKey(plaintext))
+	if err == redis.Nil {
+		return Key{}, ErrInvalidKey
+	}
+	if err != nil {
+		return Key{}, err
+	}
+	var k Key
+	if err := json.Unmarshal(b, &k); err != nil {
+		return Key{}, err
+	}
+	if k.Revoked() {
+		return Key{}, ErrRevoked
+	}
+	return k, nil
+}
+
+// List returns every key record for tenant, or all keys when tenant is "".
+func List(tenantID string) ([]Key, error) {
+	if KeyDB == nil {
+		return nil, errors.New("api key db not open")
+	}
+	kvs, err := KeyDB.List()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Key, 0, len(kvs))
+	for _, kv := range kvs {
+		var k Key
+		if err := json.Unmarshal(kv.Value, &k); err != nil {
+			continue
+		}
+		if tenantID != "" && k.Tenant != tenantID {
+			continue
+		}
+		out = append(out, k)
+	}
+	return out, nil
+}
@@ -0,0 +1,46 @@
+package apikeys
+
+import (
+	"testing"
+)
+
+// Integration test; skips if Redis is not available.
+func TestCreateAuthenticateRotateRevoke(t *testing.T) {
+	if _, err := CreateDB(); err != nil {
+		t.Skipf("redis not available: %v", err)
+	}
+	defer CloseDB()
+
+	plaintext, k, err := Create("test-tenant")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if k.Hash == "" || k.Hash == plaintext {
+		t.Fatalf("expected only the hash to be stored, got %+v", k)
+	}
+	got, err := Authenticate(plaintext)
+	if err != nil || got.Tenant != "test-tenant" {
+		t.Fatalf("Authenticate: %+v %v", got, err)
+	}
+
+	rotated, k2, err := Rotate(k.ID)
+	if err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	if _, err := Authenticate(plaintext); err != ErrRevoked {
+		t.Fatalf("expected old key to be revoked, got %v", err)
+	}
+	if _, err := Authenticate(rotated); err != nil {
+		t.Fatalf("rotated key should authenticate: %v", err)
+	}
+
+	if err := Revoke(k2.ID); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	if _, err := Authenticate(rotated); err != ErrRevoked {
+		t.Fatalf("expected revoked key to fail, got %v", err)
+	}
+	if _, err := Authenticate("pxv_nope"); err != ErrInvalidKey {
+		t.Fatalf("expected unknown key to be invalid, got %v", err)
+	}
+}
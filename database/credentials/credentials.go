@@ -0,0 +1,69 @@
+package credentials
+
+import (
+	"errors"
+
+	"pixerver/internal/tenant"
+	"pixerver/store"
+)
+
+const (
+	CredentialsDbPath = "credentials:" // interpreted as key prefix
+)
+
+var CredentialsDB *store.Store
+
+// CreateDB opens the credentials store.
+func CreateDB() (*store.Store, error) {
+	var err error
+	CredentialsDB, err = store.New(CredentialsDbPath)
+	return CredentialsDB, err
+}
+
+// CloseDB closes the credentials store.
+func CloseDB() error {
+	return CredentialsDB.Close()
+}
+
+// ForTenant returns the credentials store scoped to tenant. Backend keys in
+// a tenant's token are resolved here, so a token can only reference
+// credentials owned by the tenant that submitted it.
+func ForTenant(id string) (*store.Store, error) {
+	if CredentialsDB == nil {
+		return nil, errors.New("credentials db not open")
+	}
+	if err := tenant.Validate(id); err != nil {
+		return nil, err
+	}
+	return CredentialsDB.WithPrefix(CredentialsDbPath + "tenant:" + id + ":"), nil
+}
+
+// storeFor returns the tenant's credentials store, or the shared store for
+// anonymous work.
+func storeFor(tenantID string) (*store.Store, error) {
+	if tenantID == "" {
+		if CredentialsDB == nil {
+			return nil, errors.New("credentials db not open")
+		}
+		return CredentialsDB, nil
+	}
+	return ForTenant(tenantID)
+}
+
+// Get returns the credentials stored under key for tenant.
+func Get(tenantID string, key []byte) ([]byte, error) {
+	s, err := storeFor(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return s.Get(key)
+}
+
+// Set stores credentials under key for tenant.
+func Set(tenantID string, key, value []byte) error {
+	s, err := storeFor(tenantID)
+	if err != nil {
+		return err
+	}
+	return s.Set(key, value)
+}
@@ -0,0 +1,311 @@
+package dedup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"pixerver/store"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	DedupDbPath = "dedup:" // interpreted as key prefix
+)
+
+var (
+	// OriginalDB maps tenant/sha256 -> Original for stored uploads.
+	OriginalDB *store.Store
+	// RefDB holds the reference count for each entry in OriginalDB.
+	RefDB *store.Store
+	// ResultDB maps ResultKey(spec) -> Result for finished variants.
+	ResultDB *store.Store
+)
+
+// Original is the index entry for a stored upload. Entries are scoped to
+// Tenant, so one tenant's upload is never reused for, or revealed to,
+// another.
+type Original struct {
+	Tenant      string `json:"tenant,omitempty"`
+	SHA256      string `json:"sha256"`
+	Path        string `json:"path"`
+	ContentType string `json:"contentType"`
+}
+
+// Result is a cached encoder output. SHA256 is the hash of the output file
+// when it was recorded, so a file that was since overwritten by another
+// spec is never served as a cache hit.
+type Result struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+// Spec is everything that determines an encoder's output for a source.
+type Spec struct {
+	SourceSHA256 string            `json:"sourceSha256"`
+	Encoder      string            `json:"encoder"`
+	Width        int               `json:"width"`
+	Height       int               `json:"height"`
+	Transformers []string          `json:"transformers"`
+	Settings     map[string]string `json:"settings"`
+}
+
+// CreateDB opens the dedup stores.
+func CreateDB() (*store.Store, error) {
+	var err error
+	OriginalDB, err = store.New(DedupDbPath + "orig:")
+	if err != nil {
+		return nil, err
+	}
+	RefDB = OriginalDB.WithPrefix(DedupDbPath + "refs:")
+	ResultDB = OriginalDB.WithPrefix(DedupDbPath + "results:")
+	return OriginalDB, nil
+}
+
+// CloseDB closes the dedup stores.
+func CloseDB() error {
+	return OriginalDB.Close()
+}
+
+// Open reports whether the dedup stores have been created.
+func Open() bool {
+	return OriginalDB != nil
+}
+
+// FileSHA256 returns the hex sha256 of the file at path.
+func FileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// GetOriginal returns tenantID's index entry for sha.
+func GetOriginal(tenantID, sha string) (Original, bool, error) {
+	if OriginalDB == nil {
+		return Original{}, false, errors.New("dedup db not open")
+	}
+	b, err := OriginalDB.Get(indexKey(tenantID, sha))
+	if err == redis.Nil {
+		return Original{}, false, nil
+	}
+	if err != nil {
+		return Original{}, false, err
+	}
+	var o Original
+	if err := json.Unmarshal(b, &o); err != nil {
+		return Original{}, false, err
+	}
+	return o, true, nil
+}
+
+// claimScript takes a reference on the upload indexed at KEYS[1], or
+// indexes ARGV[1] there with one reference when there is none. KEYS: index
+// entry, refcount, their index sets; ARGV: new entry, hex key. Returns
+// {0} when ARGV[1] was indexed, {1, entry} when a reference was taken on
+// entry, and {2, entry} when entry holds no references and must be
+// replaced.
+var claimScript = redis.NewScript(`
+local cur = redis.call("GET", KEYS[1])
+if not cur then
+  redis.call("SET", KEYS[1], ARGV[1])
+  redis.call("SET", KEYS[2], 1)
+  redis.call("SADD", KEYS[3], ARGV[2])
+  redis.call("SADD", KEYS[4], ARGV[2])
+  return {0}
+end
+if (tonumber(redis.call("GET", KEYS[2])) or 0) > 0 then
+  redis.call("INCR", KEYS[2])
+  return {1, cur}
+end
+return {2, cur}
+`)
+
+// replaceScript indexes ARGV[2] with one reference if the entry is still
+// ARGV[1]. KEYS as for claimScript; ARGV[3] is the hex key. Returns 1 when
+// replaced.
+var replaceScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+  return 0
+end
+redis.call("SET", KEYS[1], ARGV[2])
+redis.call("SET", KEYS[2], 1)
+redis.call("SADD", KEYS[3], ARGV[3])
+redis.call("SADD", KEYS[4], ARGV[3])
+return 1
+`)
+
+// releaseScript drops a reference and, in the same step, removes the index
+// entry once none are left, so no Claim can take a reference on an entry
+// whose file is about to go. With ARGV[2] set it only acts on an entry for
+// that path. KEYS as for claimScript; ARGV: hex key, path. Returns the
+// removed entry, or "" when the file is still referenced.
+var releaseScript = redis.NewScript(`
+local cur = redis.call("GET", KEYS[1])
+if not cur or (ARGV[2] ~= "" and cjson.decode(cur).path ~= ARGV[2]) then
+  return ""
+end
+if redis.call("DECR", KEYS[2]) > 0 then
+  return ""
+end
+redis.call("DEL", KEYS[1], KEYS[2])
+redis.call("SREM", KEYS[3], ARGV[1])
+redis.call("SREM", KEYS[4], ARGV[1])
+return cur
+`)
+
+// claimRetries bounds how often Claim retries after the entry it looked at
+// was replaced or released underneath it.
+const claimRetries = 5
+
+// indexKey is the index key for tenantID's upload of sha. Tenant ids
+// can't contain "/", so keys of different tenants never collide.
+func indexKey(tenantID, sha string) []byte {
+	if tenantID == "" {
+		return []byte(sha)
+	}
+	return []byte(tenantID + "/" + sha)
+}
+
+// refKeys are the Redis keys claimScript and friends operate on for key.
+func refKeys(key []byte) []string {
+	return []string{OriginalDB.Key(key), RefDB.Key(key), OriginalDB.IndexKey(), RefDB.IndexKey()}
+}
+
+// Claim registers o as o.Tenant's stored copy of o.SHA256. When another
+// upload of the same tenant already holds that hash and its file still exists, Claim takes a reference
+// on it and returns it with deduped=true; the caller should discard its own
+// copy. Otherwise o becomes the canonical copy with one reference. Taking
+// the reference and Release dropping the last one are atomic, so a claimed
+// copy is never deleted under its new holder.
+func Claim(o Original) (Original, bool, error) {
+	if OriginalDB == nil {
+		return Original{}, false, errors.New("dedup db not open")
+	}
+	b, err := json.Marshal(o)
+	if err != nil {
+		return Original{}, false, err
+	}
+	key := indexKey(o.Tenant, o.SHA256)
+	keys, hexk := refKeys(key), hex.EncodeToString(key)
+	for range claimRetries {
+		res, err := OriginalDB.Run(claimScript, keys, b, hexk).Slice()
+		if err != nil {
+			return Original{}, false, err
+		}
+		status, _ := res[0].(int64)
+		if status == 0 {
+			return o, false, nil
+		}
+		cur, _ := res[1].(string)
+		var existing Original
+		if err := json.Unmarshal([]byte(cur), &existing); err != nil {
+			return Original{}, false, err
+		}
+		if status == 1 {
+			if _, err := os.Stat(existing.Path); err == nil {
+				return existing, true, nil
+			}
+		}
+		// the indexed file is gone; this upload replaces it and the stale
+		// references with it
+		ok, err := OriginalDB.Run(replaceScript, keys, cur, b, hexk).Bool()
+		if err != nil {
+			return Original{}, false, err
+		}
+		if ok {
+			return o, false, nil
+		}
+	}
+	return Original{}, false, fmt.Errorf("dedup: claim of %s kept racing", o.SHA256)
+}
+
+// Release drops one reference to tenantID's upload of sha. When the last
+// reference goes the file and its index entry are removed.
+func Release(tenantID, sha string) error {
+	return ReleasePath(tenantID, sha, "")
+}
+
+// ReleasePath is Release for the upload stored at path. It does nothing
+// when path isn't the indexed copy of sha, e.g. one kept after its Claim
+// failed, so such a copy never drops references it doesn't hold. An empty
+// path matches any copy.
+func ReleasePath(tenantID, sha, path string) error {
+	if OriginalDB == nil {
+		return errors.New("dedup db not open")
+	}
+	key := indexKey(tenantID, sha)
+	cur, err := OriginalDB.Run(releaseScript, refKeys(key), hex.EncodeToString(key), path).Text()
+	if err != nil || cur == "" {
+		return err
+	}
+	var o Original
+	if err := json.Unmarshal([]byte(cur), &o); err != nil {
+		return err
+	}
+	if err := os.Remove(o.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ResultKey returns the cache key for spec. Settings maps are marshalled
+// with sorted keys, so equal specs always produce the same key.
+func ResultKey(spec Spec) []byte {
+	b, _ := json.Marshal(spec)
+	sum := sha256.Sum256(b)
+	return sum[:]
+}
+
+// LookupResult returns the cached output for key if it still exists on disk
+// with the content that was recorded.
+func LookupResult(key []byte) (Result, bool, error) {
+	if ResultDB == nil {
+		return Result{}, false, errors.New("dedup db not open")
+	}
+	b, err := ResultDB.Get(key)
+	if err == redis.Nil {
+		return Result{}, false, nil
+	}
+	if err != nil {
+		return Result{}, false, err
+	}
+	var r Result
+	if err := json.Unmarshal(b, &r); err != nil {
+		return Result{}, false, err
+	}
+	sum, err := FileSHA256(r.Path)
+	if err != nil || sum != r.SHA256 {
+		_ = ResultDB.Del(key)
+		return Result{}, false, nil
+	}
+	return r, true, nil
+}
+
+// StoreResult records the output at path for key.
+func StoreResult(key []byte, path string) (Result, error) {
+	if ResultDB == nil {
+		return Result{}, errors.New("dedup db not open")
+	}
+	sum, err := FileSHA256(path)
+	if err != nil {
+		return Result{}, err
+	}
+	r := Result{Path: path, SHA256: sum}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return Result{}, err
+	}
+	return r, ResultDB.Set(key, b)
+}
@@ -0,0 +1,82 @@
+package dedup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"pixerver/internal/uuidv7"
+)
+
+// Integration test; skips if Redis is not available.
+func TestClaimAndRelease(t *testing.T) {
+	if _, err := CreateDB(); err != nil {
+		t.Skipf("redis not available: %v", err)
+	}
+	defer CloseDB()
+
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.png")
+	second := filepath.Join(dir, "second.png")
+	_ = os.WriteFile(first, []byte("same"), 0o644)
+	_ = os.WriteFile(second, []byte("same"), 0o644)
+	sha := uuidv7.New() // any unique key works for the index
+
+	o, dup, err := Claim(Original{Tenant: "a", SHA256: sha, Path: first})
+	if err != nil || dup || o.Path != first {
+		t.Fatalf("first claim: %+v %v %v", o, dup, err)
+	}
+	o, dup, err = Claim(Original{Tenant: "a", SHA256: sha, Path: second})
+	if err != nil || !dup || o.Path != first {
+		t.Fatalf("second claim should reuse first: %+v %v %v", o, dup, err)
+	}
+	// another tenant's upload of the same bytes is never matched
+	o, dup, err = Claim(Original{Tenant: "b", SHA256: sha, Path: second})
+	if err != nil || dup || o.Path != second {
+		t.Fatalf("claim by another tenant should not reuse first: %+v %v %v", o, dup, err)
+	}
+	if err := Release("b", sha); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if _, err := os.Stat(first); err != nil {
+		t.Fatalf("another tenant's release removed the file")
+	}
+	_ = os.WriteFile(second, []byte("same"), 0o644)
+
+	// a copy that isn't the indexed one holds no reference
+	if err := ReleasePath("a", sha, second); err != nil {
+		t.Fatalf("ReleasePath: %v", err)
+	}
+	if err := ReleasePath("a", sha, first); err != nil {
+		t.Fatalf("ReleasePath: %v", err)
+	}
+	if _, err := os.Stat(first); err != nil {
+		t.Fatalf("file removed while still referenced")
+	}
+	if err := Release("a", sha); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if _, err := os.Stat(first); !os.IsNotExist(err) {
+		t.Fatalf("expected file to be removed with the last reference")
+	}
+	// the released entry is gone, so the next upload becomes canonical
+	if o, dup, err := Claim(Original{Tenant: "a", SHA256: sha, Path: second}); err != nil || dup || o.Path != second {
+		t.Fatalf("claim after release: %+v %v %v", o, dup, err)
+	}
+	if err := Release("a", sha); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	_ = os.WriteFile(second, []byte("same"), 0o644)
+
+	key := ResultKey(Spec{SourceSHA256: sha, Encoder: "webp"})
+	if _, err := StoreResult(key, second); err != nil {
+		t.Fatalf("StoreResult: %v", err)
+	}
+	if r, ok, _ := LookupResult(key); !ok || r.Path != second {
+		t.Fatalf("expected cache hit, got %+v %v", r, ok)
+	}
+	_ = os.WriteFile(second, []byte("changed"), 0o644)
+	if _, ok, _ := LookupResult(key); ok {
+		t.Fatalf("expected overwritten output to miss")
+	}
+}
@@ -2,6 +2,7 @@ package history
 
 import (
 	"errors"
+	"pixerver/internal/tenant"
 	"pixerver/store"
 )
 
@@ -133,3 +134,27 @@ func ListSuccesses() ([]HistoryKV, error) {
 func ListFailures() ([]HistoryKV, error) {
 	return ListHistory("failure")
 }
+
+// TenantStores groups the history stores scoped to a single tenant.
+type TenantStores struct {
+	Base    *store.Store
+	Success *store.Store
+	Failure *store.Store
+}
+
+// ForTenant returns the history stores scoped to tenant, namespaced under
+// "history:tenant:<tenant>:" with the same success/failure layout as the globals.
+func ForTenant(id string) (*TenantStores, error) {
+	if HistoryBase == nil {
+		return nil, errors.New("history not open")
+	}
+	if err := tenant.Validate(id); err != nil {
+		return nil, err
+	}
+	p := HistoryDbPath + "tenant:" + id + ":"
+	return &TenantStores{
+		Base:    HistoryBase.WithPrefix(p),
+		Success: HistoryBase.WithPrefix(p + "success:"),
+		Failure: HistoryBase.WithPrefix(p + "failure:"),
+	}, nil
+}
@@ -0,0 +1,180 @@
+package tasks
+
+import (
+	"encoding/json"
+	"errors"
+
+	"pixerver/models"
+	"pixerver/store"
+)
+
+// storeFor returns the task store for tenantID, or the shared store for
+// anonymous work.
+func storeFor(tenantID string) (*store.Store, error) {
+	if tenantID == "" {
+		if TaskDB == nil {
+			return nil, errors.New("task db not open")
+		}
+		return TaskDB, nil
+	}
+	return ForTenant(tenantID)
+}
+
+// requestStore returns the store holding request records for tenantID. It
+// sits under the task prefix so tenant scoping applies to requests as well.
+func requestStore(tenantID string) (*store.Store, error) {
+	s, err := storeFor(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return s.WithPrefix(s.Prefix() + "req:"), nil
+}
+
+// pendingStore holds the number of unfinished jobs per request.
+func pendingStore(tenantID string) (*store.Store, error) {
+	s, err := requestStore(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return s.WithPrefix(s.Prefix() + "pending:"), nil
+}
+
+// CompleteJob marks one job of the request as finished and returns how
+// many are still outstanding. The worker that sees zero owns request-level
+// cleanup.
+func CompleteJob(tenantID, requestID string) (int64, error) {
+	s, err := pendingStore(tenantID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := s.IncrBy([]byte(requestID), -1)
+	if err != nil {
+		return 0, err
+	}
+	if n <= 0 {
+		_ = s.Del([]byte(requestID))
+	}
+	return n, nil
+}
+
+// SaveJob stores job under its ID in the owning tenant's task store.
+func SaveJob(job models.Job) error {
+	s, err := storeFor(job.Tenant)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return s.Set([]byte(job.ID), b)
+}
+
+// GetJob loads a job record for tenantID.
+func GetJob(tenantID, id string) (models.Job, error) {
+	s, err := storeFor(tenantID)
+	if err != nil {
+		return models.Job{}, err
+	}
+	b, err := s.Get([]byte(id))
+	if err != nil {
+		return models.Job{}, err
+	}
+	var job models.Job
+	err = json.Unmarshal(b, &job)
+	return job, err
+}
+
+// SaveRequest stores req under its ID in the owning tenant's request store.
+func SaveRequest(req models.Request) error {
+	s, err := requestStore(req.Tenant)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return s.Set([]byte(req.ID), b)
+}
+
+// GetRequest loads a request record for tenantID.
+func GetRequest(tenantID, id string) (models.Request, error) {
+	s, err := requestStore(tenantID)
+	if err != nil {
+		return models.Request{}, err
+	}
+	b, err := s.Get([]byte(id))
+	if err != nil {
+		return models.Request{}, err
+	}
+	var req models.Request
+	err = json.Unmarshal(b, &req)
+	return req, err
+}
+
+// Submit records req and its jobs and enqueues them for the workers,
+// grouped by groupJobs. Jobs are stored before they are enqueued so a worker
+// never picks up a job whose record doesn't exist yet. The groups are
+// enqueued in one transaction, so on error no job reached a worker and the
+// request is recorded as failed.
+func Submit(req models.Request, jobs []models.Job) error {
+	if QueueClient == nil {
+		return ErrQueueNotOpen
+	}
+	req.JobIDs = req.JobIDs[:0]
+	for _, j := range jobs {
+		req.JobIDs = append(req.JobIDs, j.ID)
+	}
+	if err := SaveRequest(req); err != nil {
+		return err
+	}
+	ps, err := pendingStore(req.Tenant)
+	if err != nil {
+		return err
+	}
+	if _, err := ps.IncrBy([]byte(req.ID), int64(len(jobs))); err != nil {
+		return err
+	}
+	for _, j := range jobs {
+		if err := SaveJob(j); err != nil {
+			return err
+		}
+	}
+	groups := groupJobs(jobs)
+	msgs := make([]map[string]interface{}, len(groups))
+	for i, g := range groups {
+		b, err := json.Marshal(g)
+		if err != nil {
+			return err
+		}
+		msgs[i] = map[string]interface{}{"jobs": string(b)}
+	}
+	if _, err := EnqueueAll(msgs); err != nil {
+		req.Status = "failed"
+		if serr := SaveRequest(req); serr != nil {
+			return errors.Join(err, serr)
+		}
+		return err
+	}
+	return nil
+}
+
+// groupJobs splits jobs into queue messages, one per encoder type and
+// transformer, so a worker can decode the shared source once and produce
+// every resolution of a format from it.
+func groupJobs(jobs []models.Job) [][]models.Job {
+	idx := map[string]int{}
+	var groups [][]models.Job
+	for _, j := range jobs {
+		k := j.Type + "\x00" + j.TransformerID
+		i, ok := idx[k]
+		if !ok {
+			i = len(groups)
+			idx[k] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], j)
+	}
+	return groups
+}
@@ -0,0 +1,31 @@
+package tasks
+
+import (
+	"testing"
+
+	"pixerver/models"
+)
+
+func TestGroupJobsByTypeAndTransformer(t *testing.T) {
+	jobs := []models.Job{
+		{ID: "1", Type: "jpg"},
+		{ID: "2", Type: "webp"},
+		{ID: "3", Type: "jpg"},
+		{ID: "4", Type: "jpg", TransformerID: "blur"},
+		{ID: "5", Type: "webp"},
+	}
+	groups := groupJobs(jobs)
+	if len(groups) != 3 {
+		t.Fatalf("expected 3 groups, got %d", len(groups))
+	}
+	ids := func(g []models.Job) string {
+		s := ""
+		for _, j := range g {
+			s += j.ID
+		}
+		return s
+	}
+	if ids(groups[0]) != "13" || ids(groups[1]) != "25" || ids(groups[2]) != "4" {
+		t.Fatalf("unexpected grouping %s %s %s", ids(groups[0]), ids(groups[1]), ids(groups[2]))
+	}
+}
@@ -43,6 +43,15 @@ func Enqueue(values map[string]interface{}) (string, error) {
 	return QueueClient.Produce(values)
 }
 
+// EnqueueAll appends every message to the configured queue atomically:
+// either all are enqueued or none are. Returns the message ids.
+func EnqueueAll(values []map[string]interface{}) ([]string, error) {
+	if QueueClient == nil {
+		return nil, ErrQueueNotOpen
+	}
+	return QueueClient.ProduceAll(values)
+}
+
 // ReadNext reads messages from the queue for the configured consumer.
 func ReadNext(block time.Duration, count int) ([]TaskMessage, error) {
 	if QueueClient == nil {
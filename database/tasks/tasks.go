@@ -2,6 +2,7 @@ package tasks
 
 import (
 	"errors"
+	"pixerver/internal/tenant"
 	"pixerver/store"
 )
 
@@ -59,3 +60,15 @@ func ListTasks() ([]TaskKV, error) {
 	}
 	return out, nil
 }
+
+// ForTenant returns the task store scoped to tenant. Keys are stored under
+// "tasks:tenant:<tenant>:" so one tenant can never list or read another's tasks.
+func ForTenant(id string) (*store.Store, error) {
+	if TaskDB == nil {
+		return nil, errors.New("task db not open")
+	}
+	if err := tenant.Validate(id); err != nil {
+		return nil, err
+	}
+	return TaskDB.WithPrefix(TaskDbPath + "tenant:" + id + ":"), nil
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+
+	"pixerver/logger"
+	"pixerver/ratelimit"
+)
+
+// AdminOnly guards next with the bearer token from ADMIN_TOKEN. When the
+// variable is unset every admin request is refused.
+func AdminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		want := os.Getenv("ADMIN_TOKEN")
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if want == "" || subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// QuotaHandler reports quota counters. With ?tenant=<id> it returns that
+// tenant's usage, otherwise the usage of every known tenant.
+func QuotaHandler(l *ratelimit.Limiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if l == nil {
+			http.Error(w, "rate limiting disabled", http.StatusNotFound)
+			return
+		}
+		var tenants []string
+		if t := r.URL.Query().Get("tenant"); t != "" {
+			tenants = []string{t}
+		} else {
+			var err error
+			tenants, err = l.Tenants()
+			if err != nil {
+				http.Error(w, "server error", http.StatusInternalServerError)
+				logger.Errorf("admin: list tenants failed: %v", err)
+				return
+			}
+		}
+
+		out := make([]ratelimit.Usage, 0, len(tenants))
+		for _, t := range tenants {
+			u, err := l.Usage(t)
+			if err != nil {
+				http.Error(w, "server error", http.StatusInternalServerError)
+				logger.Errorf("admin: usage for %s failed: %v", t, err)
+				return
+			}
+			out = append(out, u)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+	}
+}
+
+// LimitsHandler stores per-tenant limits from a JSON ratelimit.Limits body
+// for the tenant named by ?tenant=<id>.
+func LimitsHandler(l *ratelimit.Limiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if l == nil {
+			http.Error(w, "rate limiting disabled", http.StatusNotFound)
+			return
+		}
+		tenant := r.URL.Query().Get("tenant")
+		if tenant == "" {
+			http.Error(w, "missing tenant", http.StatusBadRequest)
+			return
+		}
+		var lim ratelimit.Limits
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&lim); err != nil {
+			http.Error(w, "invalid limits", http.StatusBadRequest)
+			return
+		}
+		if err := l.SetLimits(tenant, lim); err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			logger.Errorf("admin: set limits for %s failed: %v", tenant, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
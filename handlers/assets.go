@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"pixerver/backends"
+	"pixerver/internal/tenant"
+	"pixerver/logger"
+	"pixerver/worker"
+)
+
+// assetFormats are the formats /assets negotiates between, most preferred
+// first. Formats in explicitAccept are only served to clients that list
+// them by name, since "*/*" doesn't promise support for them.
+var (
+	assetFormats   = []string{"avif", "webp", "jpeg", "png", "gif"}
+	explicitAccept = map[string]bool{"avif": true, "webp": true}
+)
+
+// acceptQ returns the quality an Accept header gives mimeType, falling back
+// to image/* and */* unless exact is set. An empty header accepts anything
+// but the exact types.
+func acceptQ(accept, mimeType string, exact bool) float64 {
+	if strings.TrimSpace(accept) == "" {
+		if exact {
+			return 0
+		}
+		return 1
+	}
+	qs := map[string]float64{}
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		qs[mt] = q
+	}
+	if q, ok := qs[mimeType]; ok || exact {
+		return q
+	}
+	if q, ok := qs["image/*"]; ok {
+		return q
+	}
+	return qs["*/*"]
+}
+
+// negotiateVariant picks the variant to serve to a client sending accept:
+// the most preferred format it accepts among those produced.
+func negotiateVariant(accept string, variants []worker.ManifestVariant) (worker.ManifestVariant, bool) {
+	for _, f := range assetFormats {
+		for _, v := range variants {
+			if v.Format == f && acceptQ(accept, v.ContentType, explicitAccept[f]) > 0 {
+				return v, true
+			}
+		}
+	}
+	return worker.ManifestVariant{}, false
+}
+
+// assetVariants returns the variants of m rendering resolution at density
+// that were delivered to backend, with the key each is stored under there.
+func assetVariants(m *worker.Manifest, resolution string, density float64, backend string) ([]worker.ManifestVariant, map[string]string) {
+	var out []worker.ManifestVariant
+	keys := map[string]string{}
+	for _, v := range m.Variants {
+		d := v.Density
+		if d == 0 {
+			d = 1
+		}
+		if v.Resolution != resolution || d != density {
+			continue
+		}
+		for _, o := range v.Outputs {
+			if o.Backend == backend {
+				out = append(out, v)
+				keys[v.Format] = o.Key
+				break
+			}
+		}
+	}
+	return out, keys
+}
+
+// AssetsHandler serves an uploaded source's variant for a token resolution
+// (GET /assets/{sha}/{resolution}, or /assets/{tenant}/{sha}/{resolution}
+// for a tenant's requests), choosing AVIF, WebP or JPEG from what was
+// produced and what the client's Accept header allows. Variants come from
+// the newest request whose manifest renders the resolution, read from the
+// backend whose config is stored under ASSETS_BACKEND in the shared
+// credentials; ?dpr= selects another density.
+// Responses carry a strong ETag of the variant's hash, Vary: Accept and
+// ASSETS_CACHE_CONTROL, and support conditional and range requests.
+func AssetsHandler(w http.ResponseWriter, r *http.Request) {
+	name := os.Getenv("ASSETS_BACKEND")
+	if name == "" {
+		http.Error(w, "assets endpoint not configured", http.StatusNotFound)
+		return
+	}
+	b, err := backends.Resolve("", name)
+	if err != nil {
+		logger.Errorf("assets: backend %q unavailable: %v", name, err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	serveAsset(w, r, b, name)
+}
+
+// serveAsset answers an /assets request from backend b, named name.
+func serveAsset(w http.ResponseWriter, r *http.Request, b backends.Backend, name string) {
+	tid, sha, resolution := r.PathValue("tenant"), r.PathValue("sha"), r.PathValue("resolution")
+	if !isHexSHA256(sha) {
+		http.Error(w, "invalid sha", http.StatusBadRequest)
+		return
+	}
+	if tid != "" && tenant.Validate(tid) != nil {
+		http.Error(w, "invalid tenant", http.StatusBadRequest)
+		return
+	}
+	density := 1.0
+	if v := r.URL.Query().Get("dpr"); v != "" {
+		d, err := strconv.ParseFloat(v, 64)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid dpr", http.StatusBadRequest)
+			return
+		}
+		density = d
+	}
+
+	variants, keys, err := findAsset(r.Context(), b, name, tid, sha, resolution, density)
+	if err != nil {
+		logger.Errorf("assets: reading manifests of %s failed: %v", sha, err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if len(variants) == 0 {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	// the answer depends on Accept even when only one format exists, as
+	// another may be produced later
+	w.Header().Set("Vary", "Accept")
+	v, ok := negotiateVariant(r.Header.Get("Accept"), variants)
+	if !ok {
+		http.Error(w, "no acceptable format", http.StatusNotAcceptable)
+		return
+	}
+
+	rc, err := b.Get(r.Context(), keys[v.Format])
+	if err != nil {
+		logger.Errorf("assets: reading %s failed: %v", keys[v.Format], err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+	content, ok := rc.(io.ReadSeeker)
+	if !ok {
+		// variants are small; buffer them so ranges can be served
+		data, err := io.ReadAll(rc)
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		content = bytes.NewReader(data)
+	}
+
+	if v.SHA256 != "" {
+		w.Header().Set("ETag", `"`+v.SHA256+`"`)
+	}
+	w.Header().Set("Content-Type", v.ContentType)
+	cc := os.Getenv("ASSETS_CACHE_CONTROL")
+	if cc == "" {
+		cc = "public, max-age=86400"
+	}
+	w.Header().Set("Cache-Control", cc)
+	http.ServeContent(w, r, "", time.Time{}, content)
+}
+
+// findAsset returns the variants of the newest manifest tenantID's
+// requests wrote for sha that renders resolution at density in backend,
+// with the key each is stored under; none when no manifest does.
+func findAsset(ctx context.Context, b backends.Backend, backend, tenantID, sha, resolution string, density float64) ([]worker.ManifestVariant, map[string]string, error) {
+	keys, err := worker.UploadManifests(ctx, b, tenantID, sha)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, k := range keys {
+		m, err := worker.ReadManifest(ctx, b, k)
+		if errors.Is(err, backends.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		if variants, vkeys := assetVariants(m, resolution, density, backend); len(variants) > 0 {
+			return variants, vkeys, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// isHexSHA256 reports whether s is a lowercase hex SHA-256.
+func isHexSHA256(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
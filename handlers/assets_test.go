@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"pixerver/backends"
+	"pixerver/models"
+	"pixerver/worker"
+)
+
+func TestAcceptQ(t *testing.T) {
+	chrome := "image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8"
+	cases := []struct {
+		accept, mime string
+		exact        bool
+		want         float64
+	}{
+		{chrome, "image/avif", true, 1},
+		{chrome, "image/jpeg", false, 1},
+		{"*/*", "image/webp", true, 0},
+		{"*/*", "image/jpeg", false, 1},
+		{"image/webp;q=0.5,image/jpeg;q=0", "image/jpeg", false, 0},
+		{"image/webp;q=0.5", "image/webp", true, 0.5},
+		{"", "image/avif", true, 0},
+		{"", "image/jpeg", false, 1},
+	}
+	for _, c := range cases {
+		if got := acceptQ(c.accept, c.mime, c.exact); got != c.want {
+			t.Errorf("acceptQ(%q, %q) = %v, want %v", c.accept, c.mime, got, c.want)
+		}
+	}
+}
+
+func TestServeAsset(t *testing.T) {
+	b, err := backends.NewDirectory(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	sha := strings.Repeat("ab", 32)
+	put := func(key string, data []byte) {
+		if err := b.Put(ctx, key, bytes.NewReader(data), int64(len(data)), "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	variant := func(format, mime, hash, key string) worker.ManifestVariant {
+		return worker.ManifestVariant{
+			Variant:    models.Variant{Format: format, ContentType: mime, SHA256: hash},
+			Resolution: "thumb",
+			Outputs:    []models.Output{{Backend: "assets", Key: key}},
+		}
+	}
+	m := worker.Manifest{SourceSHA256: sha, Variants: []worker.ManifestVariant{
+		variant("webp", "image/webp", "w1", sha+"/thumb.webp"),
+		variant("jpeg", "image/jpeg", "j1", sha+"/thumb.jpg"),
+	}}
+	body, _ := json.Marshal(m)
+	put(worker.ManifestKey(models.Request{ID: "r1", SourceSHA256: sha}), body)
+	put(sha+"/thumb.webp", []byte("webp-bytes"))
+	put(sha+"/thumb.jpg", []byte("jpeg-bytes"))
+	// a later request for another resolution must not hide thumb, and
+	// another tenant's manifests stay separate
+	later := worker.Manifest{SourceSHA256: sha, Variants: []worker.ManifestVariant{variant("png", "image/png", "p1", sha+"/hero.png")}}
+	later.Variants[0].Resolution = "hero"
+	body, _ = json.Marshal(later)
+	put(worker.ManifestKey(models.Request{ID: "r2", SourceSHA256: sha}), body)
+	put(worker.ManifestKey(models.Request{ID: "r3", Tenant: "acme", SourceSHA256: sha}), body)
+	put(sha+"/hero.png", []byte("png-bytes"))
+
+	mux := http.NewServeMux()
+	serve := func(w http.ResponseWriter, r *http.Request) {
+		serveAsset(w, r, b, "assets")
+	}
+	mux.HandleFunc("GET /assets/{sha}/{resolution}", serve)
+	mux.HandleFunc("GET /assets/{tenant}/{sha}/{resolution}", serve)
+	get := func(url string, hdr map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", url, nil)
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/assets/"+sha+"/thumb", map[string]string{"Accept": "image/avif,image/webp,*/*"})
+	if rec.Code != http.StatusOK || rec.Body.String() != "webp-bytes" || rec.Header().Get("ETag") != `"w1"` ||
+		rec.Header().Get("Vary") != "Accept" || rec.Header().Get("Content-Type") != "image/webp" {
+		t.Fatalf("webp: %d %q %v", rec.Code, rec.Body.String(), rec.Header())
+	}
+	if rec := get("/assets/"+sha+"/thumb", map[string]string{"Accept": "*/*"}); rec.Body.String() != "jpeg-bytes" {
+		t.Fatalf("fallback: got %q", rec.Body.String())
+	}
+	if rec := get("/assets/"+sha+"/thumb", map[string]string{"Accept": "image/webp", "If-None-Match": `"w1"`}); rec.Code != http.StatusNotModified {
+		t.Fatalf("conditional: got %d", rec.Code)
+	}
+	rec = get("/assets/"+sha+"/thumb", map[string]string{"Accept": "image/jpeg", "Range": "bytes=0-3"})
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "jpeg" {
+		t.Fatalf("range: %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := get("/assets/"+sha+"/thumb", map[string]string{"Accept": "image/png"}); rec.Code != http.StatusNotAcceptable {
+		t.Fatalf("not acceptable: got %d", rec.Code)
+	}
+	if rec := get("/assets/"+sha+"/large", nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("unknown resolution: got %d", rec.Code)
+	}
+	if rec := get("/assets/"+sha+"/hero", nil); rec.Body.String() != "png-bytes" {
+		t.Fatalf("later request: %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := get("/assets/acme/"+sha+"/thumb", nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("other tenant's variant served: got %d", rec.Code)
+	}
+	if rec := get("/assets/acme/"+sha+"/hero", nil); rec.Body.String() != "png-bytes" {
+		t.Fatalf("tenant: %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := get("/assets/nothex/thumb", nil); rec.Code != http.StatusBadRequest {
+		t.Fatalf("bad sha: got %d", rec.Code)
+	}
+}
@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	"pixerver/database/apikeys"
+	"pixerver/internal/tenant"
+	"pixerver/logger"
+)
+
+// apiKey extracts the caller's key from X-API-Key or an Authorization
+// bearer header.
+func apiKey(r *http.Request) string {
+	if k := r.Header.Get("X-API-Key"); k != "" {
+		return k
+	}
+	if a := r.Header.Get("Authorization"); strings.HasPrefix(a, "Bearer ") {
+		return strings.TrimPrefix(a, "Bearer ")
+	}
+	return ""
+}
+
+// Authenticate requires a valid, unrevoked API key and stores the key's
+// tenant in the request context for downstream handlers.
+func Authenticate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := apiKey(r)
+		if key == "" {
+			http.Error(w, "missing api key", http.StatusUnauthorized)
+			return
+		}
+		k, err := apikeys.Authenticate(key)
+		if err != nil {
+			if err != apikeys.ErrInvalidKey && err != apikeys.ErrRevoked {
+				logger.Errorf("auth: key lookup failed: %v", err)
+				http.Error(w, "server error", http.StatusInternalServerError)
+				return
+			}
+			http.Error(w, "invalid api key", http.StatusUnauthorized)
+			return
+		}
+		next(w, r.WithContext(tenant.WithTenant(r.Context(), k.Tenant)))
+	}
+}
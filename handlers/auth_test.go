@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthenticateRequiresKey(t *testing.T) {
+	called := false
+	h := Authenticate(func(w http.ResponseWriter, r *http.Request) { called = true })
+
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest("GET", "/tasks", nil))
+	if rec.Code != http.StatusUnauthorized || called {
+		t.Fatalf("expected 401 without key, got %d called=%v", rec.Code, called)
+	}
+}
+
+func TestAPIKeyHeaders(t *testing.T) {
+	req := httptest.NewRequest("GET", "/tasks", nil)
+	req.Header.Set("Authorization", "Bearer pxv_a_b")
+	if got := apiKey(req); got != "pxv_a_b" {
+		t.Fatalf("expected bearer key, got %q", got)
+	}
+	req.Header.Set("X-API-Key", "pxv_c_d")
+	if got := apiKey(req); got != "pxv_c_d" {
+		t.Fatalf("expected X-API-Key to win, got %q", got)
+	}
+}
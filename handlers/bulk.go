@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"pixerver/backends"
+	"pixerver/internal/env"
+	"pixerver/internal/tenant"
+	"pixerver/logger"
+	"pixerver/models"
+	"pixerver/worker"
+)
+
+// bulkBody is the JSON payload accepted by POST /bulk.
+type bulkBody struct {
+	Token  json.RawMessage `json:"token"`
+	Source string          `json:"source"` // name of one of the token's backends
+	Prefix string          `json:"prefix"`
+}
+
+// BulkHandler re-processes originals already stored in one of the token's
+// backends (POST /bulk with {"token": {...}, "source": "<backend>",
+// "prefix": "..."}). Every key under prefix becomes its own request whose
+// jobs reference the original as "backend:key"; the worker fetches it.
+// Variants and manifests from earlier runs are skipped. A prefix matching
+// more than BULK_MAX_KEYS keys, outputs included, is refused.
+func BulkHandler(w http.ResponseWriter, r *http.Request) {
+	var body bulkBody
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&body); err != nil {
+		http.Error(w, "invalid json body", http.StatusBadRequest)
+		return
+	}
+	if len(body.Token) == 0 {
+		http.Error(w, "missing token", http.StatusBadRequest)
+		return
+	}
+	token, err := parseToken(body.Token)
+	if err != nil {
+		writeUploadError(w, err, "bulk")
+		return
+	}
+	credKey, ok := token.GetBackend(body.Source)
+	if !ok {
+		http.Error(w, "source must name one of the token's backends", http.StatusBadRequest)
+		return
+	}
+
+	tid, _ := tenant.FromContext(r.Context())
+	b, err := backends.Resolve(tid, credKey)
+	if err != nil {
+		http.Error(w, "source backend unavailable", http.StatusBadRequest)
+		logger.Warnf("bulk: resolving backend %q failed: %v", body.Source, err)
+		return
+	}
+	// one key past the limit is enough to refuse the prefix
+	limit := env.Int("BULK_MAX_KEYS", 1000)
+	keys, err := b.List(r.Context(), body.Prefix, limit+1)
+	if err != nil {
+		http.Error(w, "failed to list source backend", http.StatusBadGateway)
+		logger.Warnf("bulk: listing %s:%s failed: %v", body.Source, body.Prefix, err)
+		return
+	}
+	if len(keys) > limit {
+		http.Error(w, fmt.Sprintf("prefix matches more than %d keys", limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	keys = slices.DeleteFunc(keys, worker.IsOutputKey)
+
+	submitted := make([]map[string]string, 0, len(keys))
+	for i, key := range keys {
+		ref := backends.Ref{Backend: body.Source, Key: key}
+		req, err := submitSource(r, token, models.Request{Source: ref.String()})
+		if err != nil {
+			if i == 0 {
+				writeUploadError(w, err, "bulk")
+				return
+			}
+			// report what was enqueued so the client can resume from the rest
+			logger.Warnf("bulk: stopped after %d of %d keys: %v", i, len(keys), err)
+			writeJSON(w, http.StatusAccepted, map[string]any{
+				"requests": submitted,
+				"skipped":  keys[i:],
+				"error":    err.Error(),
+			})
+			return
+		}
+		submitted = append(submitted, map[string]string{"source": ref.String(), "requestId": req.ID})
+	}
+	writeJSON(w, http.StatusAccepted, map[string]any{"requests": submitted})
+}
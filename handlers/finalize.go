@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"pixerver/database/dedup"
+	"pixerver/internal/imagetype"
+	"pixerver/internal/uuidv7"
+	"pixerver/logger"
+	"pixerver/ratelimit"
+)
+
+// uploadDir is where finalized originals (and staged partial uploads) live.
+const uploadDir = "uploads"
+
+// storedUpload describes an original after finalization.
+type storedUpload struct {
+	Filename     string         `json:"filename"`
+	Path         string         `json:"path"`
+	ContentType  string         `json:"contentType"`
+	SHA256       string         `json:"sha256"`
+	Deduplicated bool           `json:"deduplicated"`
+	Info         imagetype.Info `json:"info"`
+	Tenant       string         `json:"-"`
+}
+
+// uploadError is a rejected finalization together with the HTTP status
+// the client should see.
+type uploadError struct {
+	status     int
+	msg        string
+	retryAfter time.Duration
+}
+
+func (e *uploadError) Error() string {
+	return e.msg
+}
+
+// finalizeUpload validates the fully staged file at tmpPath and moves it
+// into uploadDir as <sha256>_<uuidv7>_<base32(originalName)>.extension.
+// Every upload path (form, tus, ingest) funnels through here so they share
+// content sniffing, the allowlist, header limits and deduplication. The
+// extension comes from the sniffed type, never origName. On error tmpPath is
+// left for the caller to clean up. Only uploads of the same tenant are
+// deduplicated against each other.
+func finalizeUpload(tmpPath, shaHex, origName, tenantID string) (storedUpload, error) {
+	f, err := os.Open(tmpPath)
+	if err != nil {
+		return storedUpload{}, err
+	}
+	defer f.Close()
+
+	head := make([]byte, imagetype.SniffLen)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return storedUpload{}, err
+	}
+	typ, ok := imagetype.Detect(head[:n])
+	if !ok || !imagetype.AllowlistFromEnv().Allows(typ) {
+		logger.Warnf("upload: rejected %q (detected=%q)", origName, typ.Name)
+		return storedUpload{}, &uploadError{status: http.StatusUnsupportedMediaType, msg: "unsupported media type"}
+	}
+
+	info, err := imagetype.Probe(f, typ)
+	if err != nil {
+		logger.Warnf("upload: probing %s upload failed: %v", typ.Name, err)
+		return storedUpload{}, &uploadError{status: http.StatusUnprocessableEntity, msg: "unreadable image header"}
+	}
+	if err := imagetype.LimitsFromEnv().Check(info); err != nil {
+		logger.Warnf("upload: rejected %s upload: %v", typ.Name, err)
+		return storedUpload{}, &uploadError{status: http.StatusUnprocessableEntity, msg: "image too large: " + err.Error()}
+	}
+	f.Close()
+
+	// build base32-encoded original name (without extension)
+	nameOnly := strings.TrimSuffix(origName, filepath.Ext(origName))
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	b32 := enc.EncodeToString([]byte(nameOnly))
+
+	finalName := fmt.Sprintf("%s_%s_%s%s", shaHex, uuidv7.New(), b32, typ.Ext)
+	finalPath := filepath.Join(uploadDir, finalName)
+
+	// atomically move temp -> final
+	if err := os.Rename(tmpPath, finalPath); err != nil {
+		return storedUpload{}, fmt.Errorf("rename temp to final: %w", err)
+	}
+
+	su := storedUpload{Filename: finalName, Path: finalPath, ContentType: typ.MIME, SHA256: shaHex, Info: info, Tenant: tenantID}
+
+	// identical bytes already stored? reuse that copy and drop ours
+	if dedup.Open() {
+		o, dup, err := dedup.Claim(dedup.Original{Tenant: tenantID, SHA256: shaHex, Path: finalPath, ContentType: typ.MIME})
+		if err != nil {
+			// dedup is an optimisation; keep the fresh copy on index errors
+			logger.Errorf("upload: dedup claim for %s failed: %v", shaHex, err)
+		} else if dup {
+			_ = os.Remove(finalPath)
+			su.Path = o.Path
+			su.Filename = filepath.Base(o.Path)
+			su.Deduplicated = true
+		}
+	}
+
+	if su.Deduplicated {
+		logger.Infof("upload: %s deduplicated to %s", shaHex, su.Path)
+	} else {
+		logger.Infof("upload: stored as %s", su.Path)
+	}
+	return su, nil
+}
+
+// writeUploadError reports a finalizeUpload failure to the client.
+func writeUploadError(w http.ResponseWriter, err error, scope string) {
+	if ue, ok := err.(*uploadError); ok {
+		if ue.retryAfter > 0 {
+			reject(w, ratelimit.Decision{RetryAfter: ue.retryAfter, Reason: ue.msg})
+			return
+		}
+		http.Error(w, ue.msg, ue.status)
+		return
+	}
+	http.Error(w, "server error", http.StatusInternalServerError)
+	logger.Errorf("%s: finalizing upload failed: %v", scope, err)
+}
+
+// uploadResponse is the JSON body returned for a stored upload.
+func uploadResponse(su storedUpload) map[string]string {
+	return map[string]string{
+		"filename":     su.Filename,
+		"path":         su.Path,
+		"contentType":  su.ContentType,
+		"sha256":       su.SHA256,
+		"deduplicated": strconv.FormatBool(su.Deduplicated),
+	}
+}
+
+// writeJSON writes v as a JSON response.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
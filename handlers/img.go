@@ -0,0 +1,278 @@
+package handlers
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"pixerver/backends"
+	"pixerver/internal/env"
+	"pixerver/internal/imagetype"
+	"pixerver/internal/uuidv7"
+	"pixerver/logger"
+	"pixerver/models"
+	"pixerver/worker"
+)
+
+// imgOptionKeys maps the short option names accepted in /img URLs to the
+// setting or resolution field they set. Other options are passed to the
+// encoder as settings unchanged.
+var imgOptionKeys = map[string]string{
+	"w":   "width",
+	"h":   "height",
+	"m":   "mode",
+	"g":   "gravity",
+	"bg":  "background",
+	"up":  "upscale",
+	"dpr": "density",
+	"f":   "format",
+	"q":   "quality",
+}
+
+// parseImgOptions turns an /img options segment such as
+// "w:400,h:300,m:cover,f:webp,q:70" into the job that renders it. The
+// output format defaults to jpg.
+func parseImgOptions(opts string) (models.Job, error) {
+	job := models.Job{Type: "jpg", Settings: map[string]string{}}
+	density := 1.0
+	for _, part := range strings.Split(opts, ",") {
+		if part == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(part, ":")
+		if !ok || k == "" || v == "" {
+			return models.Job{}, fmt.Errorf("malformed option %q", part)
+		}
+		if long, ok := imgOptionKeys[k]; ok {
+			k = long
+		}
+		var err error
+		switch k {
+		case "width":
+			job.Resolution.Width, err = strconv.Atoi(v)
+		case "height":
+			job.Resolution.Height, err = strconv.Atoi(v)
+		case "mode":
+			job.Resolution.Mode = v
+		case "gravity":
+			job.Resolution.Gravity = v
+		case "background":
+			job.Resolution.Background = v
+		case "upscale":
+			job.Resolution.AllowUpscale, err = strconv.ParseBool(v)
+		case "density":
+			density, err = strconv.ParseFloat(v, 64)
+			if err == nil && (density <= 0 || density > models.MaxDensity) {
+				err = errors.New("out of range")
+			}
+		case "format":
+			job.Type = v
+		default:
+			job.Settings[k] = v
+		}
+		if err != nil {
+			return models.Job{}, fmt.Errorf("invalid %s %q: %v", k, v, err)
+		}
+	}
+	if job.Resolution.Width < 0 || job.Resolution.Height < 0 {
+		return models.Job{}, errors.New("negative size")
+	}
+	if density != 1 {
+		job.Resolution = job.Resolution.Scale(density)
+		job.Density = density
+	}
+	return job, nil
+}
+
+// imgSigningKey returns IMG_KEY (hex) decoded; nil when unset or invalid.
+func imgSigningKey() []byte {
+	key, err := hex.DecodeString(os.Getenv("IMG_KEY"))
+	if err != nil {
+		logger.Errorf("img: IMG_KEY is not valid hex")
+		return nil
+	}
+	return key
+}
+
+// signImgPath returns the signature of the path that follows it in an /img
+// URL ("/<options>/<sourceKey>"): unpadded base64url HMAC-SHA256.
+func signImgPath(key []byte, p string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(p))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyImgSignature reports whether sig signs p under key.
+func verifyImgSignature(key []byte, sig, p string) bool {
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(p))
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// ImageHandler renders a variant on demand (GET
+// /img/{signature}/{options}/{sourceKey...}). The signature must be the
+// HMAC of "/<options>/<sourceKey>" under IMG_KEY. Sources are read from the
+// backend whose config is stored under IMG_SOURCE_BACKEND in the shared
+// credentials, and results are cached in IMG_CACHE_BACKEND when set, so a
+// URL is only encoded once. Rendered images are cacheable for IMG_MAX_AGE
+// seconds; errors are sent with no-store.
+func ImageHandler(w http.ResponseWriter, r *http.Request) {
+	key := imgSigningKey()
+	if len(key) == 0 {
+		imgError(w, "image endpoint not configured", http.StatusNotFound)
+		return
+	}
+	opts, sourceKey := r.PathValue("options"), r.PathValue("sourceKey")
+	signed := "/" + opts + "/" + sourceKey
+	if !verifyImgSignature(key, r.PathValue("signature"), signed) {
+		imgError(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+	job, err := parseImgOptions(opts)
+	if err != nil {
+		imgError(w, "invalid options: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sum := sha256.Sum256([]byte(signed))
+	id := hex.EncodeToString(sum[:])
+	etag := `"` + id + `"`
+	// only a rendered image is cacheable; errors go out with no-store
+	cacheable := func() {
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", env.Int("IMG_MAX_AGE", 365*24*3600)))
+	}
+	if r.Header.Get("If-None-Match") == etag {
+		cacheable()
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	cacheKey := path.Join("img", id[:2], id)
+	var cache backends.Backend
+	if name := os.Getenv("IMG_CACHE_BACKEND"); name != "" {
+		if cache, err = backends.Resolve("", name); err != nil {
+			logger.Errorf("img: cache backend %q unavailable: %v", name, err)
+		} else if rc, err := cache.Get(r.Context(), cacheKey); err == nil {
+			defer rc.Close()
+			cacheable()
+			w.Header().Set("X-Cache", "HIT")
+			serveImage(w, rc, job.Type)
+			return
+		} else if !errors.Is(err, backends.ErrNotFound) {
+			logger.Warnf("img: cache lookup %s failed: %v", cacheKey, err)
+		}
+	}
+
+	out, cleanup, err := renderImage(r, job, sourceKey)
+	defer cleanup()
+	if err != nil {
+		logger.Warnf("img: rendering %s failed: %v", signed, err)
+		switch {
+		case errors.Is(err, backends.ErrNotFound):
+			imgError(w, "source not found", http.StatusNotFound)
+		case errors.Is(err, worker.ErrSourceTooLarge):
+			imgError(w, "source too large", http.StatusRequestEntityTooLarge)
+		case errors.Is(err, worker.ErrUnsupportedSource):
+			imgError(w, "unsupported source", http.StatusUnsupportedMediaType)
+		default:
+			imgError(w, "failed to render image", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	f, err := os.Open(out)
+	if err != nil {
+		imgError(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	if cache != nil {
+		if st, err := f.Stat(); err == nil {
+			if err := cache.Put(r.Context(), cacheKey, f, st.Size(), contentTypeOf(out), map[string]string{"source": sourceKey}); err != nil {
+				logger.Warnf("img: caching %s failed: %v", cacheKey, err)
+			}
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			imgError(w, "server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	cacheable()
+	w.Header().Set("X-Cache", "MISS")
+	serveImage(w, f, job.Type)
+}
+
+// imgError replies with an uncacheable error, so a CDN never keeps a
+// transient failure, or a source that isn't uploaded yet, in place of the
+// image.
+func imgError(w http.ResponseWriter, msg string, code int) {
+	w.Header().Set("Cache-Control", "no-store")
+	http.Error(w, msg, code)
+}
+
+// renderImage fetches sourceKey from IMG_SOURCE_BACKEND into a scratch
+// directory and encodes job from it. cleanup removes the directory.
+func renderImage(r *http.Request, job models.Job, sourceKey string) (string, func(), error) {
+	cleanup := func() {}
+	name := os.Getenv("IMG_SOURCE_BACKEND")
+	if name == "" {
+		return "", cleanup, errors.New("IMG_SOURCE_BACKEND not set")
+	}
+	src, err := backends.Resolve("", name)
+	if err != nil {
+		return "", cleanup, err
+	}
+	opts := worker.OptionsFromEnv(nil)
+	dir := filepath.Join(opts.ScratchDir, "img-"+uuidv7.New())
+	cleanup = func() { _ = os.RemoveAll(dir) }
+
+	input := filepath.Join(dir, path.Base(sourceKey))
+	if _, err := worker.Fetch(r.Context(), src, sourceKey, input, opts.MaxSourceBytes); err != nil {
+		return "", cleanup, err
+	}
+	job.ID = uuidv7.New()
+	// no SourceSHA256: the output goes with the scratch directory, so it
+	// must stay out of the result cache
+	job.SourceFileName = input
+	out, err := worker.Process(job)
+	return out, cleanup, err
+}
+
+// contentTypeOf returns the MIME type for the extension of p.
+func contentTypeOf(p string) string {
+	if t, ok := imagetype.ByExt(filepath.Ext(p)); ok {
+		return t.MIME
+	}
+	return "application/octet-stream"
+}
+
+// serveImage streams an encoded image, taking its content type from its
+// magic bytes, or from the requested format for ones that can't be sniffed.
+func serveImage(w http.ResponseWriter, r io.Reader, format string) {
+	br := bufio.NewReaderSize(r, imagetype.SniffLen)
+	head, _ := br.Peek(imagetype.SniffLen)
+	ct := contentTypeOf("." + format)
+	if t, ok := imagetype.Detect(head); ok {
+		ct = t.MIME
+	}
+	w.Header().Set("Content-Type", ct)
+	if _, err := io.Copy(w, br); err != nil {
+		logger.Debugf("img: writing response failed: %v", err)
+	}
+}
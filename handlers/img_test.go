@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseImgOptions(t *testing.T) {
+	job, err := parseImgOptions("w:400,h:300,m:cover,g:north,bg:fff,up:true,dpr:2,f:webp,q:70,effort:4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := job.Resolution
+	if job.Type != "webp" || res.Width != 800 || res.Height != 600 || res.Mode != "cover" || res.Gravity != "north" ||
+		res.Background != "fff" || !res.AllowUpscale || job.Density != 2 {
+		t.Fatalf("unexpected job %+v", job)
+	}
+	if job.Settings["quality"] != "70" || job.Settings["effort"] != "4" {
+		t.Fatalf("unexpected settings %+v", job.Settings)
+	}
+	if job, _ := parseImgOptions(""); job.Type != "jpg" {
+		t.Fatalf("default format should be jpg, got %q", job.Type)
+	}
+	for _, bad := range []string{"w", "w:abc", "dpr:9", "h:-1"} {
+		if _, err := parseImgOptions(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestImageHandlerSignature(t *testing.T) {
+	t.Setenv("IMG_KEY", "736563726574")
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /img/{signature}/{options}/{sourceKey...}", ImageHandler)
+	get := func(url string, hdr map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", url, nil)
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := get("/img/bogus/w:10/cats/tom.jpg", nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("bad signature: got %d", rec.Code)
+	}
+	sig := signImgPath([]byte("secret"), "/w:abc/cats/tom.jpg")
+	if rec := get("/img/"+sig+"/w:abc/cats/tom.jpg", nil); rec.Code != http.StatusBadRequest {
+		t.Fatalf("bad options: got %d", rec.Code)
+	}
+	// a signature for other options must not verify
+	if rec := get("/img/"+sig+"/w:500/cats/tom.jpg", nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("reused signature: got %d", rec.Code)
+	}
+
+	sig = signImgPath([]byte("secret"), "/w:10/cats/tom.jpg")
+	// no source backend is configured, so rendering fails; the error must
+	// not be cacheable
+	rec := get("/img/"+sig+"/w:10/cats/tom.jpg", map[string]string{"If-None-Match": "x"})
+	if rec.Code < 400 || rec.Header().Get("ETag") != "" || rec.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("failed render: status %d, headers %v", rec.Code, rec.Header())
+	}
+	sum := sha256.Sum256([]byte("/w:10/cats/tom.jpg"))
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	rec = get("/img/"+sig+"/w:10/cats/tom.jpg", map[string]string{"If-None-Match": etag})
+	if rec.Code != http.StatusNotModified || rec.Header().Get("ETag") != etag {
+		t.Fatalf("conditional request: got %d", rec.Code)
+	}
+
+	t.Setenv("IMG_KEY", "")
+	if rec := get("/img/"+sig+"/w:10/cats/tom.jpg", nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("unconfigured endpoint: got %d", rec.Code)
+	}
+}
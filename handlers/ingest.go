@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	"pixerver/internal/env"
+	"pixerver/internal/safehttp"
+	"pixerver/internal/tenant"
+	"pixerver/logger"
+)
+
+// ingestBody is the JSON payload accepted by POST /ingest.
+type ingestBody struct {
+	URL   string          `json:"url"`
+	Token json.RawMessage `json:"token"`
+}
+
+// ingestClient builds the outbound client from INGEST_TIMEOUT (seconds),
+// INGEST_MAX_REDIRECTS and INGEST_ALLOW_CIDRS (internal ranges that may be
+// fetched despite the SSRF guard).
+func ingestClient() (*http.Client, error) {
+	allow, err := safehttp.ParsePrefixes(env.List("INGEST_ALLOW_CIDRS", nil))
+	if err != nil {
+		return nil, err
+	}
+	return safehttp.NewClient(safehttp.Options{
+		Timeout:      time.Duration(env.Int("INGEST_TIMEOUT", 30)) * time.Second,
+		MaxRedirects: env.Int("INGEST_MAX_REDIRECTS", 5),
+		Allow:        allow,
+	}), nil
+}
+
+// errTooLarge marks a download that exceeded INGEST_MAX_BYTES.
+var errTooLarge = errors.New("source exceeds size limit")
+
+// fetchToStaging downloads src into a temp file under uploadDir, hashing it
+// on the way. The caller owns (and must remove) the returned file.
+func fetchToStaging(ctx context.Context, client *http.Client, src string, maxBytes int64) (string, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	if err != nil {
+		return "", "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("origin returned %s", resp.Status)
+	}
+	if resp.ContentLength > maxBytes {
+		return "", "", errTooLarge
+	}
+
+	if err := os.MkdirAll(uploadDir, 0o755); err != nil {
+		return "", "", err
+	}
+	tmp, err := os.CreateTemp(uploadDir, "ingest-*.tmp")
+	if err != nil {
+		return "", "", err
+	}
+	defer tmp.Close()
+
+	hasher := sha256.New()
+	// read one byte past the limit to tell "exactly max" from "too big"
+	n, err := io.Copy(io.MultiWriter(hasher, tmp), io.LimitReader(resp.Body, maxBytes+1))
+	if err == nil && n > maxBytes {
+		err = errTooLarge
+	}
+	if err != nil {
+		tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return "", "", err
+	}
+	return tmp.Name(), fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+// IngestHandler downloads an image from a URL and processes it like an
+// upload (POST /ingest with {"url": ..., "token": {...}}). Downloads are
+// bounded by INGEST_MAX_BYTES, time out, cap redirects and refuse private
+// and loopback destinations unless allowlisted.
+func IngestHandler(w http.ResponseWriter, r *http.Request) {
+	var body ingestBody
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&body); err != nil {
+		http.Error(w, "invalid json body", http.StatusBadRequest)
+		return
+	}
+	u, err := url.Parse(body.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		http.Error(w, "url must be absolute http(s)", http.StatusBadRequest)
+		return
+	}
+	if len(body.Token) == 0 {
+		http.Error(w, "missing token", http.StatusBadRequest)
+		return
+	}
+	token, err := parseToken(body.Token)
+	if err != nil {
+		writeUploadError(w, err, "ingest")
+		return
+	}
+
+	client, err := ingestClient()
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		logger.Errorf("ingest: invalid INGEST_ALLOW_CIDRS: %v", err)
+		return
+	}
+	tmpPath, shaHex, err := fetchToStaging(r.Context(), client, u.String(), env.Int64("INGEST_MAX_BYTES", 100<<20))
+	if err != nil {
+		logger.Warnf("ingest: fetching %s failed: %v", u.Redacted(), err)
+		switch {
+		case errors.Is(err, errTooLarge):
+			http.Error(w, "source too large", http.StatusRequestEntityTooLarge)
+		case errors.Is(err, safehttp.ErrForbiddenAddress):
+			http.Error(w, "source address not allowed", http.StatusForbidden)
+		default:
+			http.Error(w, "failed to fetch source", http.StatusBadGateway)
+		}
+		return
+	}
+	defer os.Remove(tmpPath)
+
+	tid, _ := tenant.FromContext(r.Context())
+	su, err := finalizeUpload(tmpPath, shaHex, path.Base(u.Path), tid)
+	if err != nil {
+		writeUploadError(w, err, "ingest")
+		return
+	}
+	req, err := submitRequest(r, token, su)
+	if err != nil {
+		writeUploadError(w, err, "ingest")
+		return
+	}
+
+	resp := uploadResponse(su)
+	resp["requestId"] = req.ID
+	resp["sourceUrl"] = u.Redacted()
+	writeJSON(w, http.StatusAccepted, resp)
+}
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+const ingestTestToken = `{"callbackUrl":"http://localhost/cb","backends":{"b":"k"},"resolutions":{"s":{"width":10,"height":10}},"conversionJobs":[{"type":"webp","resolutions":["s"]}]}`
+
+func postIngest(t *testing.T, url string) *httptest.ResponseRecorder {
+	t.Helper()
+	body, _ := json.Marshal(map[string]any{"url": url, "token": json.RawMessage(ingestTestToken)})
+	req := httptest.NewRequest("POST", "/ingest", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+	IngestHandler(rec, req)
+	return rec
+}
+
+func TestIngestFetchToStaging(t *testing.T) {
+	dir := t.TempDir()
+	cwd, _ := os.Getwd()
+	defer os.Chdir(cwd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("chdir: %v", err)
+	}
+	img := testPNG(t, 8, 8)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/img.png", http.StatusFound)
+			return
+		}
+		_, _ = w.Write(img)
+	}))
+	defer origin.Close()
+
+	t.Setenv("INGEST_ALLOW_CIDRS", "127.0.0.0/8,::1")
+	client, err := ingestClient()
+	if err != nil {
+		t.Fatalf("ingestClient: %v", err)
+	}
+	p, sha, err := fetchToStaging(context.Background(), client, origin.URL+"/redirect", 1<<20)
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	defer os.Remove(p)
+	want := sha256.Sum256(img)
+	if sha != hex.EncodeToString(want[:]) {
+		t.Fatalf("sha mismatch: %s", sha)
+	}
+	got, _ := os.ReadFile(p)
+	if !bytes.Equal(got, img) {
+		t.Fatalf("staged content mismatch")
+	}
+
+	if _, _, err := fetchToStaging(context.Background(), client, origin.URL+"/img.png", int64(len(img)-1)); err != errTooLarge {
+		t.Fatalf("expected errTooLarge, got %v", err)
+	}
+}
+
+func TestIngestHandlerRejections(t *testing.T) {
+	dir := t.TempDir()
+	cwd, _ := os.Getwd()
+	defer os.Chdir(cwd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("chdir: %v", err)
+	}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(testPNG(t, 8, 8))
+	}))
+	defer origin.Close()
+
+	// loopback origin without an allowlist is an SSRF attempt
+	if rec := postIngest(t, origin.URL+"/img.png"); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for loopback origin, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := postIngest(t, "file:///etc/passwd"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for non-http url, got %d", rec.Code)
+	}
+
+	t.Setenv("INGEST_ALLOW_CIDRS", "127.0.0.0/8,::1")
+	t.Setenv("INGEST_MAX_BYTES", "16")
+	if rec := postIngest(t, origin.URL+"/img.png"); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for oversized source, got %d", rec.Code)
+	}
+}
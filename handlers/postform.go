@@ -2,22 +2,25 @@ package handlers
 
 import (
 	"crypto/sha256"
-	"encoding/base32"
-	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
-	"path/filepath"
-	"strings"
 
-	"pixerver/internal/uuidv7"
+	"pixerver/internal/tenant"
 	"pixerver/logger"
+	"pixerver/models"
 )
 
 // PostFormHandler handles multipart file uploads from the form field "file".
 // It stores the uploaded file under ./uploads with the filename pattern:
 // <sha256>_<uuidv7>_<base32(originalName)>.extension
+// The extension comes from the sniffed content type, never the client
+// filename; uploads that aren't an allowed image type get a 415. Image
+// headers are probed (without decoding pixels) and oversized images are
+// refused with a 422 before anything reaches ImageMagick. When the form also
+// carries a JSON InputToken in "token", its conversion jobs are enqueued and
+// the response includes the requestId.
 func PostFormHandler(w http.ResponseWriter, r *http.Request) {
 	// limit request body size to 100MB to avoid OOM from huge uploads
 	r.Body = http.MaxBytesReader(w, r.Body, 100<<20)
@@ -36,16 +39,26 @@ func PostFormHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
+	// an optional "token" field turns the upload into a processing request
+	var token *models.InputToken
+	if raw := r.FormValue("token"); raw != "" {
+		t, err := parseToken([]byte(raw))
+		if err != nil {
+			writeUploadError(w, err, "postform")
+			return
+		}
+		token = &t
+	}
+
 	// ensure uploads dir
-	outDir := "uploads"
-	if err := os.MkdirAll(outDir, 0o755); err != nil {
+	if err := os.MkdirAll(uploadDir, 0o755); err != nil {
 		http.Error(w, "server error", http.StatusInternalServerError)
 		logger.Errorf("postform: mkdir uploads failed: %v", err)
 		return
 	}
 
 	// create a temp file to stream data into
-	tmp, err := os.CreateTemp(outDir, "upload-*.tmp")
+	tmp, err := os.CreateTemp(uploadDir, "upload-*.tmp")
 	if err != nil {
 		http.Error(w, "server error", http.StatusInternalServerError)
 		logger.Errorf("postform: create temp file failed: %v", err)
@@ -66,32 +79,26 @@ func PostFormHandler(w http.ResponseWriter, r *http.Request) {
 		logger.Errorf("postform: copying uploaded data failed: %v", err)
 		return
 	}
+	tmp.Close()
 
-	sum := hasher.Sum(nil)
-	shaHex := fmt.Sprintf("%x", sum)
-
-	// build base32-encoded original name (without extension)
-	orig := header.Filename
-	ext := filepath.Ext(orig)
-	nameOnly := strings.TrimSuffix(orig, ext)
-	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
-	b32 := enc.EncodeToString([]byte(nameOnly))
-
-	id := uuidv7.New()
-	finalName := fmt.Sprintf("%s_%s_%s%s", shaHex, id, b32, ext)
-	finalPath := filepath.Join(outDir, finalName)
-
-	// atomically move temp -> final
-	if err := os.Rename(tmpPath, finalPath); err != nil {
-		http.Error(w, "server error", http.StatusInternalServerError)
-		logger.Errorf("postform: rename temp to final failed: %v", err)
+	shaHex := fmt.Sprintf("%x", hasher.Sum(nil))
+	tid, _ := tenant.FromContext(r.Context())
+	su, err := finalizeUpload(tmpPath, shaHex, header.Filename, tid)
+	if err != nil {
+		writeUploadError(w, err, "postform")
 		return
 	}
 
-	logger.Infof("postform: stored upload as %s", finalPath)
+	resp := uploadResponse(su)
+	if token != nil {
+		req, err := submitRequest(r, *token, su)
+		if err != nil {
+			writeUploadError(w, err, "postform")
+			return
+		}
+		resp["requestId"] = req.ID
+	}
 
 	// Respond with JSON containing the stored filename
-	w.Header().Set("Content-Type", "application/json")
-	resp := map[string]string{"filename": finalName, "path": finalPath}
-	_ = json.NewEncoder(w).Encode(resp)
+	writeJSON(w, http.StatusOK, resp)
 }
@@ -4,8 +4,12 @@ import (
 	"bytes"
 	"encoding/base32"
 	"encoding/json"
+	"image"
+	"image/jpeg"
+	"image/png"
 	"io"
 	"mime/multipart"
+	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
@@ -28,7 +32,7 @@ func TestPostFormHandler(t *testing.T) {
 	if err != nil {
 		t.Fatalf("create form file: %v", err)
 	}
-	if _, err := io.Copy(fw, strings.NewReader("dummycontent")); err != nil {
+	if _, err := io.Copy(fw, bytes.NewReader(testPNG(t, 4, 4))); err != nil {
 		t.Fatalf("write content: %v", err)
 	}
 	w.Close()
@@ -74,3 +78,95 @@ func TestPostFormHandler(t *testing.T) {
 		t.Fatalf("decoded base32 mismatch: %s", string(dec))
 	}
 }
+
+// testPNG returns a small encoded PNG image.
+func testPNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatalf("encode png: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// postUpload sends content as the "file" form field named filename.
+func postUpload(t *testing.T, filename string, content []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	fw, err := w.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatalf("create form file: %v", err)
+	}
+	if _, err := fw.Write(content); err != nil {
+		t.Fatalf("write content: %v", err)
+	}
+	w.Close()
+	req := httptest.NewRequest("POST", "/upload", &b)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	rec := httptest.NewRecorder()
+	PostFormHandler(rec, req)
+	return rec
+}
+
+func TestPostFormHandlerSniffing(t *testing.T) {
+	dir := t.TempDir()
+	cwd, _ := os.Getwd()
+	defer os.Chdir(cwd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("chdir: %v", err)
+	}
+
+	// a zip archive renamed to .png must be refused
+	if rec := postUpload(t, "evil.png", []byte("PK\x03\x04zipdata")); rec.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected 415 for zip, got %d", rec.Code)
+	}
+	// so must HTML
+	if rec := postUpload(t, "page.png", []byte("<html><script>alert(1)</script></html>")); rec.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected 415 for html, got %d", rec.Code)
+	}
+
+	// a JPEG named .png is stored with the detected extension
+	var jb bytes.Buffer
+	if err := jpeg.Encode(&jb, image.NewRGBA(image.Rect(0, 0, 4, 4)), nil); err != nil {
+		t.Fatalf("encode jpeg: %v", err)
+	}
+	rec := postUpload(t, "photo.png", jb.Bytes())
+	if rec.Code != 200 {
+		t.Fatalf("expected 200 got %d body=%s", rec.Code, rec.Body.String())
+	}
+	var resp map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid json response: %v", err)
+	}
+	if filepath.Ext(resp["filename"]) != ".jpg" || resp["contentType"] != "image/jpeg" {
+		t.Fatalf("expected detected jpeg, got %+v", resp)
+	}
+
+	// the allowlist is configurable
+	t.Setenv("UPLOAD_ALLOWED_TYPES", "png")
+	if rec := postUpload(t, "photo.jpg", jb.Bytes()); rec.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected 415 for jpeg outside allowlist, got %d", rec.Code)
+	}
+}
+
+func TestPostFormHandlerRejectsOversizedImage(t *testing.T) {
+	dir := t.TempDir()
+	cwd, _ := os.Getwd()
+	defer os.Chdir(cwd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("chdir: %v", err)
+	}
+
+	t.Setenv("UPLOAD_MAX_PIXELS", "10000")
+	if rec := postUpload(t, "big.png", testPNG(t, 200, 100)); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 for 20000 pixel image, got %d", rec.Code)
+	}
+	if rec := postUpload(t, "ok.png", testPNG(t, 100, 100)); rec.Code != 200 {
+		t.Fatalf("expected 200 for image within limits, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	entries, _ := os.ReadDir("uploads")
+	if len(entries) != 1 {
+		t.Fatalf("expected only the accepted upload to be stored, got %d files", len(entries))
+	}
+}
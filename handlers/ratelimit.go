@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+
+	"pixerver/internal/tenant"
+	"pixerver/logger"
+	"pixerver/ratelimit"
+)
+
+// tenantKey identifies the caller for rate limiting: the authenticated
+// tenant when Authenticate ran first, otherwise the client IP.
+func tenantKey(r *http.Request) string {
+	if id, ok := tenant.FromContext(r.Context()); ok {
+		return "tenant:" + id
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// reject writes a 429 with a Retry-After header rounded up to whole seconds.
+func reject(w http.ResponseWriter, d ratelimit.Decision) {
+	secs := int(math.Ceil(d.RetryAfter.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	http.Error(w, d.Reason, http.StatusTooManyRequests)
+}
+
+// countingReader charges bytes read from an upload body whose length was
+// not known up front.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// RateLimit wraps next with per-tenant request, byte and outstanding-job
+// limits. A nil limiter disables limiting. Limiter errors fail open so a
+// Redis hiccup doesn't take uploads down with it.
+func RateLimit(l *ratelimit.Limiter, next http.HandlerFunc) http.HandlerFunc {
+	if l == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		tenant := tenantKey(r)
+		r = r.WithContext(withQuota(r.Context(), quota{limiter: l, key: tenant}))
+
+		d, err := l.AllowRequest(tenant)
+		if err != nil {
+			logger.Errorf("ratelimit: request check for %s failed: %v", tenant, err)
+		} else if !d.Allowed {
+			reject(w, d)
+			return
+		}
+
+		d, err = l.CheckOutstanding(tenant)
+		if err != nil {
+			logger.Errorf("ratelimit: outstanding check for %s failed: %v", tenant, err)
+		} else if !d.Allowed {
+			reject(w, d)
+			return
+		}
+
+		if r.ContentLength > 0 {
+			d, err = l.AllowBytes(tenant, r.ContentLength)
+			if err != nil {
+				logger.Errorf("ratelimit: byte check for %s failed: %v", tenant, err)
+			} else if !d.Allowed {
+				reject(w, d)
+				return
+			}
+			next(w, r)
+			return
+		}
+
+		// unknown length: charge what was actually read once the handler is done
+		cr := &countingReader{ReadCloser: r.Body}
+		r.Body = cr
+		next(w, r)
+		if cr.n > 0 {
+			if _, err := l.AllowBytes(tenant, cr.n); err != nil {
+				logger.Errorf("ratelimit: charging %d bytes to %s failed: %v", cr.n, tenant, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"pixerver/internal/tenant"
+	"pixerver/ratelimit"
+)
+
+func TestTenantKey(t *testing.T) {
+	req := httptest.NewRequest("POST", "/upload", nil)
+	req.RemoteAddr = "10.1.2.3:5555"
+	if got := tenantKey(req); got != "ip:10.1.2.3" {
+		t.Fatalf("expected ip fallback, got %s", got)
+	}
+	req = req.WithContext(tenant.WithTenant(req.Context(), "acme"))
+	if got := tenantKey(req); got != "tenant:acme" {
+		t.Fatalf("expected tenant, got %s", got)
+	}
+}
+
+func TestRejectSetsRetryAfter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	reject(rec, ratelimit.Decision{RetryAfter: 1500 * time.Millisecond, Reason: "slow down"})
+	if rec.Code != 429 {
+		t.Fatalf("expected 429 got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "2" {
+		t.Fatalf("expected Retry-After 2, got %q", got)
+	}
+}
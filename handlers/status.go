@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"pixerver/database/tasks"
+	"pixerver/internal/tenant"
+	"pixerver/logger"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// TaskStatusHandler returns the stored task record for GET /tasks/{id}. The
+// lookup only ever touches the caller's tenant-scoped task store.
+func TaskStatusHandler(w http.ResponseWriter, r *http.Request) {
+	tid, ok := tenant.FromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	db, err := tasks.ForTenant(tid)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		logger.Errorf("status: tenant store for %s: %v", tid, err)
+		return
+	}
+	v, err := db.Get([]byte(r.PathValue("id")))
+	if err == redis.Nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		logger.Errorf("status: get task failed: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(v)
+}
+
+// TaskListHandler lists every task record belonging to the caller's tenant.
+func TaskListHandler(w http.ResponseWriter, r *http.Request) {
+	tid, ok := tenant.FromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	db, err := tasks.ForTenant(tid)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		logger.Errorf("status: tenant store for %s: %v", tid, err)
+		return
+	}
+	kvs, err := db.List()
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		logger.Errorf("status: list tasks failed: %v", err)
+		return
+	}
+	out := make([]json.RawMessage, 0, len(kvs))
+	for _, kv := range kvs {
+		if json.Valid(kv.Value) {
+			out = append(out, json.RawMessage(kv.Value))
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// RequestStatusHandler returns the stored request record for
+// GET /requests/{id}, scoped to the caller's tenant.
+func RequestStatusHandler(w http.ResponseWriter, r *http.Request) {
+	tid, ok := tenant.FromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	req, err := tasks.GetRequest(tid, r.PathValue("id"))
+	if err == redis.Nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		logger.Errorf("status: get request failed: %v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, req)
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"time"
+
+	"pixerver/database/dedup"
+	"pixerver/database/tasks"
+	"pixerver/internal/tenant"
+	"pixerver/internal/uuidv7"
+	"pixerver/logger"
+	"pixerver/models"
+	"pixerver/ratelimit"
+)
+
+type quotaCtxKey struct{}
+
+// quota is what RateLimit leaves in the request context so job submission
+// can reserve outstanding-job slots against the same tenant key.
+type quota struct {
+	limiter *ratelimit.Limiter
+	key     string
+}
+
+func withQuota(ctx context.Context, q quota) context.Context {
+	return context.WithValue(ctx, quotaCtxKey{}, q)
+}
+
+func quotaFromContext(ctx context.Context) (quota, bool) {
+	q, ok := ctx.Value(quotaCtxKey{}).(quota)
+	return q, ok && q.limiter != nil
+}
+
+// parseToken decodes and validates a JSON InputToken.
+func parseToken(raw []byte) (models.InputToken, error) {
+	var token models.InputToken
+	if err := json.Unmarshal(raw, &token); err != nil {
+		return models.InputToken{}, &uploadError{status: http.StatusBadRequest, msg: "invalid token: " + err.Error()}
+	}
+	if err := token.Validate(); err != nil {
+		return models.InputToken{}, &uploadError{status: http.StatusBadRequest, msg: "invalid token: " + err.Error()}
+	}
+	return token, nil
+}
+
+// submitRequest expands token into jobs for the stored upload su, reserves
+// outstanding-job quota and enqueues them. The returned request id is what
+// clients poll and callbacks refer to. The worker drops the request's
+// reference to su when it finishes; if nothing was enqueued it is dropped
+// here.
+func submitRequest(r *http.Request, token models.InputToken, su storedUpload) (models.Request, error) {
+	req, err := submitSource(r, token, models.Request{
+		SourceFileName: su.Path,
+		SourceSHA256:   su.SHA256,
+		ContentType:    su.ContentType,
+	})
+	if err != nil && dedup.Open() {
+		if rerr := dedup.ReleasePath(su.Tenant, su.SHA256, su.Path); rerr != nil {
+			logger.Warnf("submit: releasing upload %s failed: %v", su.Path, rerr)
+		}
+	}
+	return req, err
+}
+
+// submitSource is submitRequest for any source: src carries either a local
+// file (SourceFileName/SourceSHA256) or a backend reference in Source.
+func submitSource(r *http.Request, token models.InputToken, src models.Request) (models.Request, error) {
+	jobs := models.ConversionJobs(token.ConversionJobs).ToJobs(token.Resolutions)
+	if len(jobs) == 0 {
+		return models.Request{}, &uploadError{status: http.StatusBadRequest, msg: "token produced no jobs"}
+	}
+
+	tid, _ := tenant.FromContext(r.Context())
+	req := src
+	req.ID = uuidv7.New()
+	req.Tenant = tid
+	req.Token = token
+	req.Status = "pending"
+	req.CreatedAt = time.Now().UTC()
+
+	q, hasQuota := quotaFromContext(r.Context())
+	if hasQuota {
+		d, err := q.limiter.AcquireJobs(q.key, int64(len(jobs)))
+		if err != nil {
+			logger.Errorf("submit: reserving %d jobs for %s failed: %v", len(jobs), q.key, err)
+			hasQuota = false
+		} else if !d.Allowed {
+			return models.Request{}, &uploadError{status: http.StatusTooManyRequests, msg: d.Reason, retryAfter: d.RetryAfter}
+		}
+	}
+
+	for i := range jobs {
+		jobs[i].RequestID = req.ID
+		jobs[i].Tenant = tid
+		jobs[i].SourceFileName = req.SourceFileName
+		jobs[i].SourceSHA256 = req.SourceSHA256
+		jobs[i].Source = req.Source
+		if token.Copyright != "" && jobs[i].Settings["copyright"] == "" {
+			// conversion jobs share their settings map between resolutions
+			jobs[i].Settings = maps.Clone(jobs[i].Settings)
+			if jobs[i].Settings == nil {
+				jobs[i].Settings = map[string]string{}
+			}
+			jobs[i].Settings["copyright"] = token.Copyright
+		}
+		if hasQuota {
+			jobs[i].QuotaKey = q.key
+		}
+	}
+
+	if err := tasks.Submit(req, jobs); err != nil {
+		if hasQuota {
+			_ = q.limiter.ReleaseJobs(q.key, int64(len(jobs)))
+		}
+		return models.Request{}, err
+	}
+	req.JobIDs = make([]string, len(jobs))
+	for i, j := range jobs {
+		req.JobIDs[i] = j.ID
+	}
+	source := req.Source
+	if source == "" {
+		source = req.SourceFileName
+	}
+	logger.Infof("submit: request %s enqueued %d jobs for %s", req.ID, len(jobs), source)
+	return req, nil
+}
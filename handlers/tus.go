@@ -0,0 +1,501 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"pixerver/internal/env"
+	"pixerver/internal/tenant"
+	"pixerver/internal/uuidv7"
+	"pixerver/logger"
+	"pixerver/models"
+)
+
+// tus 1.0 resumable uploads (https://tus.io/protocols/resumable-upload).
+// Supported extensions: creation, termination and checksum. Partial uploads
+// are staged under uploads/tus as <id>.part with a JSON <id>.info sidecar
+// carrying the offset and the serialized SHA-256 state, so the whole-file
+// hash is computed incrementally across PATCH requests and server restarts.
+// Both are removed once the upload is finalized, and uploads left idle for
+// TUS_EXPIRY are removed by RunTusExpiry.
+
+const (
+	tusVersion    = "1.0.0"
+	tusBasePath   = "/files/"
+	tusExtensions = "creation,termination,checksum"
+	tusAlgorithms = "sha1,sha256,md5"
+	// statusChecksumMismatch is the tus checksum extension's status code.
+	statusChecksumMismatch = 460
+)
+
+var tusDir = filepath.Join(uploadDir, "tus")
+
+// tusMaxSize returns the largest accepted Upload-Length (TUS_MAX_SIZE).
+func tusMaxSize() int64 {
+	return env.Int64("TUS_MAX_SIZE", 2<<30)
+}
+
+// tusExpiry returns how long an upload may sit without a chunk arriving
+// before it is removed (TUS_EXPIRY, seconds; 0 keeps uploads forever).
+func tusExpiry() time.Duration {
+	return time.Duration(env.Int("TUS_EXPIRY", 24*60*60)) * time.Second
+}
+
+// tusInfo is the persisted state of one resumable upload.
+type tusInfo struct {
+	ID        string            `json:"id"`
+	Tenant    string            `json:"tenant,omitempty"`
+	Length    int64             `json:"length"`
+	Offset    int64             `json:"offset"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	HashState []byte            `json:"hashState,omitempty"`
+}
+
+// uploadLock serializes requests touching the same upload. refs counts
+// the requests holding or waiting for it, so it can be dropped once idle.
+type uploadLock struct {
+	sync.Mutex
+	refs int
+}
+
+var (
+	tusLocksMu sync.Mutex
+	tusLocks   = map[string]*uploadLock{}
+)
+
+func lockUpload(id string) func() {
+	tusLocksMu.Lock()
+	l := tusLocks[id]
+	if l == nil {
+		l = &uploadLock{}
+		tusLocks[id] = l
+	}
+	l.refs++
+	tusLocksMu.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		tusLocksMu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(tusLocks, id)
+		}
+		tusLocksMu.Unlock()
+	}
+}
+
+func tusPaths(id string) (part, info string) {
+	return filepath.Join(tusDir, id+".part"), filepath.Join(tusDir, id+".info")
+}
+
+func loadTusInfo(id string) (*tusInfo, error) {
+	_, ip := tusPaths(id)
+	b, err := os.ReadFile(ip)
+	if err != nil {
+		return nil, err
+	}
+	var ti tusInfo
+	if err := json.Unmarshal(b, &ti); err != nil {
+		return nil, err
+	}
+	return &ti, nil
+}
+
+// save writes the sidecar atomically so a crash never leaves a torn offset.
+func (ti *tusInfo) save() error {
+	_, ip := tusPaths(ti.ID)
+	b, err := json.Marshal(ti)
+	if err != nil {
+		return err
+	}
+	tmp := ip + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ip)
+}
+
+func (ti *tusInfo) remove() {
+	pp, ip := tusPaths(ti.ID)
+	_ = os.Remove(pp)
+	_ = os.Remove(ip)
+	_ = os.Remove(ip + ".tmp")
+}
+
+// ExpireTusUploads removes uploads that have had no chunk for longer than
+// maxAge, including ones whose creation never got as far as a sidecar.
+func ExpireTusUploads(maxAge time.Duration) {
+	entries, err := os.ReadDir(tusDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warnf("tus: listing staged uploads failed: %v", err)
+		}
+		return
+	}
+	cutoff := time.Now().Add(-maxAge)
+	seen := map[string]bool{}
+	for _, e := range entries {
+		id, _, _ := strings.Cut(e.Name(), ".")
+		if seen[id] || !validUploadID(id) {
+			continue
+		}
+		seen[id] = true
+		expireUpload(id, cutoff)
+	}
+}
+
+// expireUpload removes upload id if nothing was written to it since cutoff.
+func expireUpload(id string, cutoff time.Time) {
+	unlock := lockUpload(id)
+	defer unlock()
+	pp, ip := tusPaths(id)
+	for _, p := range []string{ip, pp} {
+		if st, err := os.Stat(p); err == nil && st.ModTime().After(cutoff) {
+			return
+		}
+	}
+	(&tusInfo{ID: id}).remove()
+	logger.Infof("tus: expired upload %s", id)
+}
+
+// RunTusExpiry calls ExpireTusUploads with tusExpiry every hour until ctx
+// is done.
+func RunTusExpiry(ctx context.Context) {
+	maxAge := tusExpiry()
+	if maxAge <= 0 {
+		return
+	}
+	t := time.NewTicker(time.Hour)
+	defer t.Stop()
+	for {
+		ExpireTusUploads(maxAge)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// parseTusMetadata decodes "key base64value,key2 base64value2".
+func parseTusMetadata(s string) (map[string]string, error) {
+	md := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(pair, " ")
+		dec, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, err
+		}
+		md[k] = string(dec)
+	}
+	return md, nil
+}
+
+// parseUploadChecksum parses an Upload-Checksum header into a fresh hash and
+// the expected digest.
+func parseUploadChecksum(s string) (hash.Hash, []byte, error) {
+	algo, enc, ok := strings.Cut(strings.TrimSpace(s), " ")
+	if !ok {
+		return nil, nil, errors.New("malformed Upload-Checksum")
+	}
+	want, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch algo {
+	case "sha1":
+		return sha1.New(), want, nil
+	case "sha256":
+		return sha256.New(), want, nil
+	case "md5":
+		return md5.New(), want, nil
+	}
+	return nil, nil, errors.New("unsupported checksum algorithm")
+}
+
+// tusPreamble sets the headers every tus response carries and rejects
+// clients speaking another protocol version.
+func tusPreamble(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Method != http.MethodOptions && r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "unsupported tus version", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// loadOwnedUpload loads the upload named in the path, hiding uploads that
+// belong to another tenant.
+func loadOwnedUpload(w http.ResponseWriter, r *http.Request) (*tusInfo, bool) {
+	id := r.PathValue("id")
+	if !validUploadID(id) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return nil, false
+	}
+	ti, err := loadTusInfo(id)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Errorf("tus: loading upload %s failed: %v", id, err)
+		}
+		http.Error(w, "not found", http.StatusNotFound)
+		return nil, false
+	}
+	caller, _ := tenant.FromContext(r.Context())
+	if ti.Tenant != caller {
+		http.Error(w, "not found", http.StatusNotFound)
+		return nil, false
+	}
+	return ti, true
+}
+
+// validUploadID rejects ids that could traverse out of the staging dir.
+func validUploadID(id string) bool {
+	return len(id) == 36 && strings.Trim(id, "0123456789abcdef-") == ""
+}
+
+// TusOptionsHandler advertises server capabilities (OPTIONS /files/).
+func TusOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	tusPreamble(w, r)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Checksum-Algorithm", tusAlgorithms)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(tusMaxSize(), 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TusCreateHandler creates a new upload (POST /files/). The original file
+// name is taken from the "filename" metadata key when present. A JSON
+// InputToken in the "token" key turns the upload into a processing request
+// once it completes.
+func TusCreateHandler(w http.ResponseWriter, r *http.Request) {
+	if !tusPreamble(w, r) {
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length > tusMaxSize() {
+		http.Error(w, "upload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	md, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, "invalid Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+	// refuse a bad token now rather than after the whole upload
+	if raw, ok := md["token"]; ok {
+		if _, err := parseToken([]byte(raw)); err != nil {
+			writeUploadError(w, err, "tus")
+			return
+		}
+	}
+
+	if err := os.MkdirAll(tusDir, 0o755); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		logger.Errorf("tus: mkdir staging failed: %v", err)
+		return
+	}
+	ti := &tusInfo{ID: uuidv7.New(), Length: length, Metadata: md}
+	ti.Tenant, _ = tenant.FromContext(r.Context())
+	pp, _ := tusPaths(ti.ID)
+	f, err := os.OpenFile(pp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		logger.Errorf("tus: create staging file failed: %v", err)
+		return
+	}
+	f.Close()
+	if err := ti.save(); err != nil {
+		ti.remove()
+		http.Error(w, "server error", http.StatusInternalServerError)
+		logger.Errorf("tus: save upload info failed: %v", err)
+		return
+	}
+
+	logger.Infof("tus: created upload %s length=%d", ti.ID, length)
+	w.Header().Set("Location", tusBasePath+ti.ID)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// TusHeadHandler reports the current offset (HEAD /files/{id}).
+func TusHeadHandler(w http.ResponseWriter, r *http.Request) {
+	if !tusPreamble(w, r) {
+		return
+	}
+	ti, ok := loadOwnedUpload(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(ti.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(ti.Length, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// TusPatchHandler appends a chunk at Upload-Offset (PATCH /files/{id}). When
+// the final byte arrives the file goes through the same finalization as a
+// form upload, the stored name is returned in Upload-Filename and the
+// upload's staging state is removed. Uploads created with a token have its
+// jobs enqueued, and the request id is returned in Upload-Request-Id.
+func TusPatchHandler(w http.ResponseWriter, r *http.Request) {
+	if !tusPreamble(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "invalid Content-Type", http.StatusUnsupportedMediaType)
+		return
+	}
+	unlock := lockUpload(r.PathValue("id"))
+	defer unlock()
+	ti, ok := loadOwnedUpload(w, r)
+	if !ok {
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != ti.Offset {
+		http.Error(w, "offset mismatch", http.StatusConflict)
+		return
+	}
+	var (
+		sum  hash.Hash
+		want []byte
+	)
+	if c := r.Header.Get("Upload-Checksum"); c != "" {
+		if sum, want, err = parseUploadChecksum(c); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// resume the whole-file hash where the last chunk left it
+	fileHash := sha256.New()
+	if len(ti.HashState) > 0 {
+		if err := fileHash.(encoding.BinaryUnmarshaler).UnmarshalBinary(ti.HashState); err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			logger.Errorf("tus: restoring hash state for %s failed: %v", ti.ID, err)
+			return
+		}
+	}
+
+	pp, _ := tusPaths(ti.ID)
+	f, err := os.OpenFile(pp, os.O_WRONLY, 0o644)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		logger.Errorf("tus: open staging file failed: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Seek(ti.Offset, io.SeekStart); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	writers := []io.Writer{f, fileHash}
+	if sum != nil {
+		writers = append(writers, sum)
+	}
+	// never accept more than the declared length
+	body := http.MaxBytesReader(w, r.Body, ti.Length-ti.Offset)
+	n, copyErr := io.Copy(io.MultiWriter(writers...), body)
+
+	if sum != nil {
+		if copyErr != nil || !bytes.Equal(sum.Sum(nil), want) {
+			// discard the chunk; the saved state still describes the old offset
+			_ = f.Truncate(ti.Offset)
+			if copyErr != nil {
+				http.Error(w, "failed to read chunk", http.StatusBadRequest)
+				return
+			}
+			http.Error(w, "checksum mismatch", statusChecksumMismatch)
+			return
+		}
+	}
+	// without a checksum, keep whatever arrived before a dropped connection;
+	// that's the point of resumable uploads
+
+	ti.Offset += n
+	state, err := fileHash.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	ti.HashState = state
+	if err := ti.save(); err != nil {
+		_ = f.Truncate(ti.Offset - n)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		logger.Errorf("tus: save upload info failed: %v", err)
+		return
+	}
+	if copyErr != nil {
+		logger.Warnf("tus: upload %s interrupted at offset %d: %v", ti.ID, ti.Offset, copyErr)
+		http.Error(w, "failed to read chunk", http.StatusBadRequest)
+		return
+	}
+
+	if ti.Offset == ti.Length {
+		f.Close()
+		su, err := finalizeUpload(pp, hex.EncodeToString(fileHash.Sum(nil)), ti.Metadata["filename"], ti.Tenant)
+		ti.remove()
+		if err != nil {
+			writeUploadError(w, err, "tus")
+			return
+		}
+		w.Header().Set("Upload-Filename", su.Filename)
+		if raw, ok := ti.Metadata["token"]; ok {
+			token, err := parseToken([]byte(raw))
+			if err == nil {
+				var req models.Request
+				if req, err = submitRequest(r, token, su); err == nil {
+					w.Header().Set("Upload-Request-Id", req.ID)
+				}
+			}
+			if err != nil {
+				writeUploadError(w, err, "tus")
+				return
+			}
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(ti.Offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TusDeleteHandler terminates an upload and removes its staged data
+// (DELETE /files/{id}).
+func TusDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if !tusPreamble(w, r) {
+		return
+	}
+	unlock := lockUpload(r.PathValue("id"))
+	defer unlock()
+	ti, ok := loadOwnedUpload(w, r)
+	if !ok {
+		return
+	}
+	ti.remove()
+	w.WriteHeader(http.StatusNoContent)
+}
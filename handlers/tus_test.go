@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tusMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("OPTIONS /files/", TusOptionsHandler)
+	mux.HandleFunc("POST /files/", TusCreateHandler)
+	mux.HandleFunc("HEAD /files/{id}", TusHeadHandler)
+	mux.HandleFunc("PATCH /files/{id}", TusPatchHandler)
+	mux.HandleFunc("DELETE /files/{id}", TusDeleteHandler)
+	return mux
+}
+
+func tusDo(mux http.Handler, method, path string, body []byte, hdr map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	for k, v := range hdr {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func sha1b64(b []byte) string {
+	s := sha1.Sum(b)
+	return "sha1 " + base64.StdEncoding.EncodeToString(s[:])
+}
+
+func TestTusUploadLifecycle(t *testing.T) {
+	dir := t.TempDir()
+	cwd, _ := os.Getwd()
+	defer os.Chdir(cwd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("chdir: %v", err)
+	}
+	mux := tusMux()
+	data := testPNG(t, 64, 48)
+	half := len(data) / 2
+
+	rec := tusDo(mux, "OPTIONS", "/files/", nil, nil)
+	if rec.Code != http.StatusNoContent || !strings.Contains(rec.Header().Get("Tus-Extension"), "checksum") {
+		t.Fatalf("options: %d %v", rec.Code, rec.Header())
+	}
+
+	if rec := tusDo(mux, "POST", "/files/", nil, map[string]string{"Tus-Resumable": "0.2.0", "Upload-Length": "1"}); rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("expected 412 for wrong version, got %d", rec.Code)
+	}
+
+	rec = tusDo(mux, "POST", "/files/", nil, map[string]string{
+		"Upload-Length":   strconv.Itoa(len(data)),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("raw.png")),
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", rec.Code, rec.Body.String())
+	}
+	loc := rec.Header().Get("Location")
+	patch := map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": "0"}
+
+	// a corrupted chunk is rejected and not applied
+	patch["Upload-Checksum"] = sha1b64([]byte("something else"))
+	if rec := tusDo(mux, "PATCH", loc, data[:half], patch); rec.Code != statusChecksumMismatch {
+		t.Fatalf("expected 460 for checksum mismatch, got %d", rec.Code)
+	}
+	if rec := tusDo(mux, "HEAD", loc, nil, nil); rec.Header().Get("Upload-Offset") != "0" {
+		t.Fatalf("offset should be unchanged after bad chunk: %v", rec.Header())
+	}
+
+	patch["Upload-Checksum"] = sha1b64(data[:half])
+	if rec := tusDo(mux, "PATCH", loc, data[:half], patch); rec.Code != http.StatusNoContent || rec.Header().Get("Upload-Offset") != strconv.Itoa(half) {
+		t.Fatalf("first chunk: %d %v", rec.Code, rec.Header())
+	}
+
+	// resuming at a stale offset is a conflict
+	if rec := tusDo(mux, "PATCH", loc, data[half:], patch); rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for stale offset, got %d", rec.Code)
+	}
+
+	patch["Upload-Offset"] = strconv.Itoa(half)
+	delete(patch, "Upload-Checksum")
+	rec = tusDo(mux, "PATCH", loc, data[half:], patch)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("final chunk: %d %s", rec.Code, rec.Body.String())
+	}
+	fname := rec.Header().Get("Upload-Filename")
+	sum := sha256.Sum256(data)
+	if !strings.HasPrefix(fname, hex.EncodeToString(sum[:])+"_") || filepath.Ext(fname) != ".png" {
+		t.Fatalf("unexpected final filename %q", fname)
+	}
+	stored, err := os.ReadFile(filepath.Join("uploads", fname))
+	if err != nil || !bytes.Equal(stored, data) {
+		t.Fatalf("stored file mismatch: %v", err)
+	}
+
+	// a finalized upload leaves no staging state or lock behind
+	if rec := tusDo(mux, "HEAD", loc, nil, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 after finalize, got %d", rec.Code)
+	}
+	if left, _ := filepath.Glob(filepath.Join(tusDir, "*")); len(left) != 0 {
+		t.Fatalf("staging files left after finalize: %v", left)
+	}
+	if len(tusLocks) != 0 {
+		t.Fatalf("upload locks left after finalize: %d", len(tusLocks))
+	}
+}
+
+func TestTusRejectsBadToken(t *testing.T) {
+	dir := t.TempDir()
+	cwd, _ := os.Getwd()
+	defer os.Chdir(cwd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("chdir: %v", err)
+	}
+	rec := tusDo(tusMux(), "POST", "/files/", nil, map[string]string{
+		"Upload-Length":   "10",
+		"Upload-Metadata": "token " + base64.StdEncoding.EncodeToString([]byte(`{"conversionJobs": 3}`)),
+	})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid token, got %d", rec.Code)
+	}
+	if left, _ := filepath.Glob(filepath.Join(tusDir, "*")); len(left) != 0 {
+		t.Fatalf("rejected upload left staging files: %v", left)
+	}
+}
+
+func TestTusExpiryAndDelete(t *testing.T) {
+	dir := t.TempDir()
+	cwd, _ := os.Getwd()
+	defer os.Chdir(cwd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("chdir: %v", err)
+	}
+	mux := tusMux()
+	create := func() string {
+		rec := tusDo(mux, "POST", "/files/", nil, map[string]string{"Upload-Length": "10"})
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("create: %d %s", rec.Code, rec.Body.String())
+		}
+		return rec.Header().Get("Location")
+	}
+	stale, fresh := create(), create()
+	old := time.Now().Add(-48 * time.Hour)
+	pp, ip := tusPaths(strings.TrimPrefix(stale, tusBasePath))
+	for _, p := range []string{pp, ip} {
+		if err := os.Chtimes(p, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ExpireTusUploads(24 * time.Hour)
+	if rec := tusDo(mux, "HEAD", stale, nil, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected idle upload to expire, got %d", rec.Code)
+	}
+	if rec := tusDo(mux, "HEAD", fresh, nil, nil); rec.Code != http.StatusOK {
+		t.Fatalf("expected active upload to survive, got %d", rec.Code)
+	}
+
+	if rec := tusDo(mux, "DELETE", fresh, nil, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d", rec.Code)
+	}
+	if rec := tusDo(mux, "HEAD", fresh, nil, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 after delete, got %d", rec.Code)
+	}
+	if left, _ := filepath.Glob(filepath.Join(tusDir, "*")); len(left) != 0 {
+		t.Fatalf("staging files left: %v", left)
+	}
+	if len(tusLocks) != 0 {
+		t.Fatalf("upload locks left: %d", len(tusLocks))
+	}
+}
+
+func TestTusRejectsNonImage(t *testing.T) {
+	dir := t.TempDir()
+	cwd, _ := os.Getwd()
+	defer os.Chdir(cwd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("chdir: %v", err)
+	}
+	mux := tusMux()
+	data := []byte("PK\x03\x04 not an image")
+	rec := tusDo(mux, "POST", "/files/", nil, map[string]string{"Upload-Length": strconv.Itoa(len(data))})
+	loc := rec.Header().Get("Location")
+	rec = tusDo(mux, "PATCH", loc, data, map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": "0"})
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected 415, got %d", rec.Code)
+	}
+	if rec := tusDo(mux, "HEAD", loc, nil, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected rejected upload to be removed, got %d", rec.Code)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"errors"
 	"os"
+	"strconv"
 	"strings"
 )
 
@@ -64,3 +65,40 @@ func Load(path string) (map[string]string, error) {
 	}
 	return m, nil
 }
+
+// Int returns the integer value of the environment variable key, or def when
+// the variable is unset or not a valid integer.
+func Int(key string, def int) int {
+	if s := os.Getenv(key); s != "" {
+		if v, err := strconv.Atoi(s); err == nil {
+			return v
+		}
+	}
+	return def
+}
+
+// Int64 is like Int but for 64-bit values (byte counts and similar).
+func Int64(key string, def int64) int64 {
+	if s := os.Getenv(key); s != "" {
+		if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return v
+		}
+	}
+	return def
+}
+
+// List returns the comma-separated values of key with surrounding spaces
+// trimmed and empty entries dropped, or def when the variable is unset.
+func List(key string, def []string) []string {
+	s := os.Getenv(key)
+	if s == "" {
+		return def
+	}
+	var out []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
@@ -0,0 +1,206 @@
+// Package geometry plans how a source is scaled, cropped and padded to a
+// requested size, so every encoder and engine lays out the same pixels for the same resolution.
+package geometry
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Modes accepted in Spec.Mode.
+const (
+	Fit     = "fit"     // scale to fit inside the box, keeping aspect
+	Cover   = "cover"   // scale to cover the box, then crop at Gravity
+	Pad     = "pad"     // fit, then pad to the box with Background
+	Stretch = "stretch" // scale to exactly the box, ignoring aspect
+)
+
+// gravities maps accepted gravity names to their anchor as fractions of the
+// free space (0 = left/top, 0.5 = center, 1 = right/bottom).
+var gravities = map[string][2]float64{
+	"center":    {0.5, 0.5},
+	"north":     {0.5, 0},
+	"south":     {0.5, 1},
+	"east":      {1, 0.5},
+	"west":      {0, 0.5},
+	"northeast": {1, 0},
+	"northwest": {0, 0},
+	"southeast": {1, 1},
+	"southwest": {0, 1},
+}
+
+// Spec is a requested output size. Zero Width or Height leaves that axis
+// to follow the aspect ratio; cover and pad need both.
+type Spec struct {
+	Width        int
+	Height       int
+	Mode         string
+	Gravity      string
+	Background   color.NRGBA
+	AllowUpscale bool
+}
+
+// FromSettings reads a Spec from encoder settings: "width", "height",
+// "resize" (mode, default fit), "gravity" (default center), "background"
+// (default transparent) and "upscale". "scaledWidth" and "scaledHeight",
+// set by a maxBytes search that shrinks the output, replace the size while
+// the variant keeps the name of the one requested.
+func FromSettings(settings map[string]string) (Spec, error) {
+	s := Spec{Mode: Fit, Gravity: "center"}
+	s.Width, _ = strconv.Atoi(settings["width"])
+	s.Height, _ = strconv.Atoi(settings["height"])
+	if settings["scaledWidth"] != "" || settings["scaledHeight"] != "" {
+		s.Width, _ = strconv.Atoi(settings["scaledWidth"])
+		s.Height, _ = strconv.Atoi(settings["scaledHeight"])
+	}
+	if s.Width < 0 || s.Height < 0 {
+		return Spec{}, fmt.Errorf("geometry: negative size %dx%d", s.Width, s.Height)
+	}
+	if m := settings["resize"]; m != "" {
+		switch m {
+		case Fit, Cover, Pad, Stretch:
+			s.Mode = m
+		case "fill":
+			s.Mode = Cover
+		case "exact":
+			s.Mode = Stretch
+		default:
+			return Spec{}, fmt.Errorf("geometry: unknown resize mode %q", m)
+		}
+	}
+	if g := strings.ToLower(settings["gravity"]); g != "" {
+		if _, ok := gravities[g]; !ok {
+			return Spec{}, fmt.Errorf("geometry: unknown gravity %q", g)
+		}
+		s.Gravity = g
+	}
+	if b := settings["background"]; b != "" {
+		c, err := ParseColor(b)
+		if err != nil {
+			return Spec{}, err
+		}
+		s.Background = c
+	}
+	s.AllowUpscale = settings["upscale"] == "true" || settings["upscale"] == "1"
+	if (s.Mode == Cover || s.Mode == Pad) && (s.Width == 0 || s.Height == 0) {
+		// nothing to crop or pad against on a free axis
+		s.Mode = Fit
+	}
+	return s, nil
+}
+
+// ParseColor accepts "transparent", "white", "black", "#rgb", "#rrggbb" and
+// "#rrggbbaa".
+func ParseColor(s string) (color.NRGBA, error) {
+	switch strings.ToLower(s) {
+	case "transparent", "none":
+		return color.NRGBA{}, nil
+	case "white":
+		return color.NRGBA{255, 255, 255, 255}, nil
+	case "black":
+		return color.NRGBA{0, 0, 0, 255}, nil
+	}
+	h := strings.TrimPrefix(s, "#")
+	if len(h) == 3 {
+		h = string([]byte{h[0], h[0], h[1], h[1], h[2], h[2]})
+	}
+	if len(h) == 6 {
+		h += "ff"
+	}
+	v, err := strconv.ParseUint(h, 16, 32)
+	if len(h) != 8 || err != nil {
+		return color.NRGBA{}, fmt.Errorf("geometry: invalid color %q", s)
+	}
+	return color.NRGBA{uint8(v >> 24), uint8(v >> 16), uint8(v >> 8), uint8(v)}, nil
+}
+
+// Hex formats c as "#rrggbbaa".
+func Hex(c color.NRGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x%02x", c.R, c.G, c.B, c.A)
+}
+
+// Plan is the result of applying a Spec to a source size: scale the source
+// to ScaleW x ScaleH, then take the Crop rectangle from it, then place that
+// on a CanvasW x CanvasH canvas at OffsetX, OffsetY.
+type Plan struct {
+	ScaleW, ScaleH   int
+	CropX, CropY     int
+	CropW, CropH     int
+	CanvasW, CanvasH int
+	OffsetX, OffsetY int
+}
+
+// Scaled reports whether the plan resizes the source.
+func (p Plan) Scaled(srcW, srcH int) bool { return p.ScaleW != srcW || p.ScaleH != srcH }
+
+// Cropped reports whether the plan crops the scaled image.
+func (p Plan) Cropped() bool {
+	return p.CropX != 0 || p.CropY != 0 || p.CropW != p.ScaleW || p.CropH != p.ScaleH
+}
+
+// Padded reports whether the plan places the image on a larger canvas.
+func (p Plan) Padded() bool { return p.CanvasW != p.CropW || p.CanvasH != p.CropH }
+
+func round(v float64) int { return max(1, int(math.Round(v))) }
+
+// Plan computes the geometry for a srcW x srcH source.
+func (s Spec) Plan(srcW, srcH int) Plan {
+	fw, fh := float64(srcW), float64(srcH)
+	W, H := s.Width, s.Height
+	var sw, sh int
+	switch s.Mode {
+	case Stretch:
+		sw, sh = W, H
+		if sw == 0 {
+			sw = srcW
+		}
+		if sh == 0 {
+			sh = srcH
+		}
+		if !s.AllowUpscale {
+			sw, sh = min(sw, srcW), min(sh, srcH)
+		}
+	case Cover:
+		scale := math.Max(float64(W)/fw, float64(H)/fh)
+		if !s.AllowUpscale {
+			scale = math.Min(scale, 1)
+		}
+		sw, sh = round(fw*scale), round(fh*scale)
+	default: // fit, pad
+		scale := 1.0
+		switch {
+		case W == 0 && H == 0:
+		case W == 0:
+			scale = float64(H) / fh
+		case H == 0:
+			scale = float64(W) / fw
+		default:
+			scale = math.Min(float64(W)/fw, float64(H)/fh)
+		}
+		if !s.AllowUpscale {
+			scale = math.Min(scale, 1)
+		}
+		sw, sh = round(fw*scale), round(fh*scale)
+	}
+
+	p := Plan{ScaleW: sw, ScaleH: sh, CropW: sw, CropH: sh}
+	g, ok := gravities[s.Gravity]
+	if !ok {
+		g = gravities["center"]
+	}
+	if s.Mode == Cover {
+		p.CropW, p.CropH = min(sw, W), min(sh, H)
+		p.CropX = int(math.Round(float64(sw-p.CropW) * g[0]))
+		p.CropY = int(math.Round(float64(sh-p.CropH) * g[1]))
+	}
+	p.CanvasW, p.CanvasH = p.CropW, p.CropH
+	if s.Mode == Pad {
+		p.CanvasW, p.CanvasH = W, H
+		p.OffsetX = int(math.Round(float64(W-p.CropW) * g[0]))
+		p.OffsetY = int(math.Round(float64(H-p.CropH) * g[1]))
+	}
+	return p
+}
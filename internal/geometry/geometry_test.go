@@ -0,0 +1,66 @@
+package geometry
+
+import (
+	"image/color"
+	"testing"
+)
+
+func TestFromSettings(t *testing.T) {
+	s, err := FromSettings(map[string]string{"width": "400", "height": "300", "resize": "fill", "gravity": "North", "background": "#fff", "upscale": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Mode != Cover || s.Gravity != "north" || s.Background != (color.NRGBA{255, 255, 255, 255}) || !s.AllowUpscale {
+		t.Fatalf("unexpected spec %+v", s)
+	}
+	// cover needs both axes
+	if s, _ := FromSettings(map[string]string{"width": "400", "resize": "cover"}); s.Mode != Fit {
+		t.Fatalf("single-axis cover should fall back to fit, got %q", s.Mode)
+	}
+	// a budget search's scaled size replaces the requested one
+	if s, _ := FromSettings(map[string]string{"width": "400", "height": "300", "scaledWidth": "320", "scaledHeight": "240"}); s.Width != 320 || s.Height != 240 {
+		t.Fatalf("expected scaled size 320x240, got %dx%d", s.Width, s.Height)
+	}
+	for _, bad := range []map[string]string{
+		{"resize": "zoom"},
+		{"gravity": "up"},
+		{"background": "#12345"},
+		{"width": "-1"},
+	} {
+		if _, err := FromSettings(bad); err == nil {
+			t.Fatalf("expected error for %v", bad)
+		}
+	}
+}
+
+func TestPlan(t *testing.T) {
+	cases := []struct {
+		name string
+		spec Spec
+		want Plan
+	}{
+		{"fit", Spec{Width: 100, Height: 100, Mode: Fit}, Plan{ScaleW: 100, ScaleH: 50, CropW: 100, CropH: 50, CanvasW: 100, CanvasH: 50}},
+		{"width only", Spec{Width: 50, Mode: Fit}, Plan{ScaleW: 50, ScaleH: 25, CropW: 50, CropH: 25, CanvasW: 50, CanvasH: 25}},
+		{"no upscale", Spec{Width: 800, Height: 800, Mode: Fit}, Plan{ScaleW: 200, ScaleH: 100, CropW: 200, CropH: 100, CanvasW: 200, CanvasH: 100}},
+		{"upscale", Spec{Width: 400, Mode: Fit, AllowUpscale: true}, Plan{ScaleW: 400, ScaleH: 200, CropW: 400, CropH: 200, CanvasW: 400, CanvasH: 200}},
+		{"cover center", Spec{Width: 50, Height: 50, Mode: Cover, Gravity: "center"}, Plan{ScaleW: 100, ScaleH: 50, CropX: 25, CropW: 50, CropH: 50, CanvasW: 50, CanvasH: 50}},
+		{"cover east", Spec{Width: 50, Height: 50, Mode: Cover, Gravity: "east"}, Plan{ScaleW: 100, ScaleH: 50, CropX: 50, CropW: 50, CropH: 50, CanvasW: 50, CanvasH: 50}},
+		{"pad south", Spec{Width: 100, Height: 100, Mode: Pad, Gravity: "south"}, Plan{ScaleW: 100, ScaleH: 50, CropW: 100, CropH: 50, CanvasW: 100, CanvasH: 100, OffsetY: 50}},
+		{"stretch", Spec{Width: 60, Height: 60, Mode: Stretch}, Plan{ScaleW: 60, ScaleH: 60, CropW: 60, CropH: 60, CanvasW: 60, CanvasH: 60}},
+	}
+	for _, c := range cases {
+		if got := c.spec.Plan(200, 100); got != c.want {
+			t.Errorf("%s: got %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestParseColorAndHex(t *testing.T) {
+	c, err := ParseColor("#11223344")
+	if err != nil || Hex(c) != "#11223344" {
+		t.Fatalf("round trip failed: %v %v", Hex(c), err)
+	}
+	if c, _ := ParseColor("transparent"); c.A != 0 {
+		t.Fatalf("transparent should have zero alpha")
+	}
+}
@@ -0,0 +1,182 @@
+package imagetype
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// DisplaySize returns the size of the image a decoder shows for r, before
+// any EXIF orientation: the first page of a TIFF, and the primary item of an
+// AVIF/HEIC with its irot rotation applied. Other types report Probe's size.
+// Unlike Probe, which bounds what decoding may allocate, it returns zeros
+// when the shown size can't be resolved, e.g. for a cropped (clap) item.
+func DisplaySize(r io.ReadSeeker, t Type) (int, int, error) {
+	switch t.Name {
+	case "tiff":
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return 0, 0, err
+		}
+		info, err := probeTIFF(r, 1)
+		return info.Width, info.Height, err
+	case "avif", "heic":
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return 0, 0, err
+		}
+		b, err := io.ReadAll(io.LimitReader(r, isobmffScanLimit))
+		if err != nil {
+			return 0, 0, err
+		}
+		w, h := primaryItemSize(b)
+		return w, h, nil
+	}
+	info, err := Probe(r, t)
+	return info.Width, info.Height, err
+}
+
+// isoBox is one ISOBMFF box: its four-character type and its payload.
+type isoBox struct {
+	typ  string
+	body []byte
+}
+
+// isoBoxes splits b into boxes, stopping at the first truncated one.
+func isoBoxes(b []byte) []isoBox {
+	var out []isoBox
+	for len(b) >= 8 {
+		size, hdr := uint64(binary.BigEndian.Uint32(b)), uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(b))
+		case 1:
+			if len(b) < 16 {
+				return out
+			}
+			size, hdr = binary.BigEndian.Uint64(b[8:]), 16
+		}
+		if size < hdr || size > uint64(len(b)) {
+			return out
+		}
+		out = append(out, isoBox{typ: string(b[4:8]), body: b[hdr:size]})
+		b = b[size:]
+	}
+	return out
+}
+
+func findBox(boxes []isoBox, typ string) ([]byte, bool) {
+	for _, bx := range boxes {
+		if bx.typ == typ {
+			return bx.body, true
+		}
+	}
+	return nil, false
+}
+
+// primaryItemSize resolves the ispe and irot properties associated with
+// the primary item (pitm) of an AVIF/HEIC meta box. It returns zeros when
+// any of them is missing or the item carries a clean-aperture crop.
+func primaryItemSize(b []byte) (int, int) {
+	meta, ok := findBox(isoBoxes(b), "meta")
+	if !ok || len(meta) < 4 {
+		return 0, 0
+	}
+	children := isoBoxes(meta[4:]) // meta is a full box
+	pitm, ok := findBox(children, "pitm")
+	if !ok || len(pitm) < 6 {
+		return 0, 0
+	}
+	primary := uint32(binary.BigEndian.Uint16(pitm[4:]))
+	if pitm[0] != 0 {
+		if len(pitm) < 8 {
+			return 0, 0
+		}
+		primary = binary.BigEndian.Uint32(pitm[4:])
+	}
+	iprp, ok := findBox(children, "iprp")
+	if !ok {
+		return 0, 0
+	}
+	var props []isoBox
+	var assoc []int
+	for _, bx := range isoBoxes(iprp) {
+		switch bx.typ {
+		case "ipco":
+			props = isoBoxes(bx.body)
+		case "ipma":
+			assoc = append(assoc, itemProperties(bx.body, primary)...)
+		}
+	}
+	w, h, rot := 0, 0, 0
+	for _, idx := range assoc {
+		if idx < 1 || idx > len(props) {
+			continue
+		}
+		p := props[idx-1]
+		switch p.typ {
+		case "ispe":
+			if len(p.body) < 12 {
+				return 0, 0
+			}
+			w = int(binary.BigEndian.Uint32(p.body[4:]))
+			h = int(binary.BigEndian.Uint32(p.body[8:]))
+		case "irot":
+			if len(p.body) < 1 {
+				return 0, 0
+			}
+			rot = int(p.body[0] & 3)
+		case "clap":
+			return 0, 0
+		}
+	}
+	if rot%2 == 1 {
+		w, h = h, w
+	}
+	return w, h
+}
+
+// itemProperties returns the 1-based property indices an ipma box
+// associates with item.
+func itemProperties(ipma []byte, item uint32) []int {
+	if len(ipma) < 8 {
+		return nil
+	}
+	version, wide := ipma[0], ipma[3]&1 == 1
+	n := binary.BigEndian.Uint32(ipma[4:])
+	p := 8
+	for ; n > 0; n-- {
+		var id uint32
+		if version < 1 {
+			if p+2 > len(ipma) {
+				return nil
+			}
+			id, p = uint32(binary.BigEndian.Uint16(ipma[p:])), p+2
+		} else {
+			if p+4 > len(ipma) {
+				return nil
+			}
+			id, p = binary.BigEndian.Uint32(ipma[p:]), p+4
+		}
+		if p >= len(ipma) {
+			return nil
+		}
+		count := int(ipma[p])
+		p++
+		var idx []int
+		for ; count > 0; count-- {
+			if wide {
+				if p+2 > len(ipma) {
+					return nil
+				}
+				idx, p = append(idx, int(binary.BigEndian.Uint16(ipma[p:])&0x7fff)), p+2
+			} else {
+				if p >= len(ipma) {
+					return nil
+				}
+				idx, p = append(idx, int(ipma[p]&0x7f)), p+1
+			}
+		}
+		if id == item {
+			return idx
+		}
+	}
+	return nil
+}
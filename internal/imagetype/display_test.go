@@ -0,0 +1,102 @@
+package imagetype
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// box builds an ISOBMFF box of typ around body.
+func box(typ string, body ...[]byte) []byte {
+	b := bytes.Join(body, nil)
+	out := binary.BigEndian.AppendUint32(nil, uint32(8+len(b)))
+	return append(append(out, typ...), b...)
+}
+
+func u32s(vs ...uint32) []byte {
+	var b []byte
+	for _, v := range vs {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+func displaySize(t *testing.T, b []byte) (int, int) {
+	t.Helper()
+	typ, ok := Detect(b)
+	if !ok {
+		t.Fatalf("Detect failed for %q", b[:min(len(b), 16)])
+	}
+	w, h, err := DisplaySize(bytes.NewReader(b), typ)
+	if err != nil {
+		t.Fatalf("DisplaySize(%s): %v", typ.Name, err)
+	}
+	return w, h
+}
+
+func TestDisplaySizeAVIF(t *testing.T) {
+	heif := func(props ...[]byte) []byte {
+		// item 1 is a larger auxiliary image with property 1; item 2 is
+		// primary and gets properties 2 and up
+		ipma := []byte{0, 0, 0, 0}
+		ipma = append(ipma, u32s(2)...)
+		ipma = append(ipma, 0, 1, 1, 1)
+		ipma = append(ipma, 0, 2, byte(len(props)))
+		for i := range props {
+			ipma = append(ipma, 0x80|byte(i+2))
+		}
+		ipco := append([][]byte{box("ispe", u32s(0, 8000, 6000))}, props...)
+		return bytes.Join([][]byte{
+			box("ftyp", []byte("avif\x00\x00\x00\x00avifmif1")),
+			box("meta", []byte{0, 0, 0, 0},
+				box("pitm", []byte{0, 0, 0, 0, 0, 2}),
+				box("iprp", box("ipco", ipco...), box("ipma", ipma))),
+		}, nil)
+	}
+	ispe := box("ispe", u32s(0, 400, 300))
+	cases := []struct {
+		props [][]byte
+		w, h  int
+	}{
+		{[][]byte{ispe}, 400, 300},
+		{[][]byte{ispe, box("irot", []byte{1})}, 300, 400},
+		{[][]byte{ispe, box("irot", []byte{2})}, 400, 300},
+		{[][]byte{ispe, box("clap", make([]byte, 32))}, 0, 0},
+	}
+	for _, c := range cases {
+		if w, h := displaySize(t, heif(c.props...)); w != c.w || h != c.h {
+			t.Errorf("%d props: got %dx%d, want %dx%d", len(c.props), w, h, c.w, c.h)
+		}
+	}
+	// Probe still reports the largest item for the bomb limits
+	if info := probeBytes(t, heif(ispe)); info.Width != 8000 {
+		t.Fatalf("probe: %+v", info)
+	}
+}
+
+func TestDisplaySizeTIFF(t *testing.T) {
+	// two pages, 300x200 then 100x500
+	var tb bytes.Buffer
+	tb.WriteString("II*\x00")
+	_ = binary.Write(&tb, binary.LittleEndian, uint32(8))
+	for i, page := range [][2]uint32{{300, 200}, {100, 500}} {
+		_ = binary.Write(&tb, binary.LittleEndian, uint16(2))
+		for j, tag := range []uint16{256, 257} {
+			_ = binary.Write(&tb, binary.LittleEndian, tag)
+			_ = binary.Write(&tb, binary.LittleEndian, uint16(4))
+			_ = binary.Write(&tb, binary.LittleEndian, uint32(1))
+			_ = binary.Write(&tb, binary.LittleEndian, page[j])
+		}
+		next := uint32(0)
+		if i == 0 {
+			next = uint32(tb.Len() + 4)
+		}
+		_ = binary.Write(&tb, binary.LittleEndian, next)
+	}
+	if w, h := displaySize(t, tb.Bytes()); w != 300 || h != 200 {
+		t.Fatalf("tiff: got %dx%d, want the first page's 300x200", w, h)
+	}
+	if info := probeBytes(t, tb.Bytes()); info.Width != 300 || info.Height != 500 || info.Frames != 2 {
+		t.Fatalf("probe: %+v", info)
+	}
+}
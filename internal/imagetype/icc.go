@@ -0,0 +1,228 @@
+package imagetype
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"sort"
+)
+
+// maxICCSize bounds an embedded profile; real ones are a few KB, LUT-based
+// print profiles rarely exceed a couple of MB.
+const maxICCSize = 8 << 20
+
+// ICCProfile returns the ICC profile embedded in r, or nil when it has none
+// or t can't carry one. Only container headers are read.
+func ICCProfile(r io.ReadSeeker, t Type) ([]byte, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var (
+		p   []byte
+		err error
+	)
+	switch t.Name {
+	case "jpeg":
+		p, err = jpegICC(r)
+	case "png":
+		p, err = pngICC(r)
+	case "webp":
+		p, err = webpICC(r)
+	case "avif", "heic":
+		p, err = isobmffICC(io.LimitReader(r, isobmffScanLimit))
+	default:
+		return nil, nil
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = ErrMalformed
+	}
+	return p, err
+}
+
+// jpegICC joins the ICC_PROFILE chunks of the APP2 segments before the
+// first scan.
+func jpegICC(r io.ReadSeeker) ([]byte, error) {
+	chunks := map[byte][]byte{}
+	total := 0
+	err := jpegSegments(r, func(m byte) bool { return m == 0xE2 }, func(m byte, seg []byte) error {
+		if len(seg) < 14 || !bytes.HasPrefix(seg, []byte("ICC_PROFILE\x00")) {
+			return nil
+		}
+		if total += len(seg) - 14; total > maxICCSize {
+			return ErrMalformed
+		}
+		chunks[seg[12]] = seg[14:]
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return joinICCChunks(chunks), nil
+}
+
+// jpegSegments calls fn with the payload of every marker segment before
+// the first scan whose marker want accepts; other segments are skipped.
+func jpegSegments(r io.ReadSeeker, want func(m byte) bool, fn func(m byte, seg []byte) error) error {
+	var b [2]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return err
+	}
+	for {
+		if _, err := io.ReadFull(r, b[:1]); err != nil {
+			return err
+		}
+		if b[0] != 0xFF {
+			continue
+		}
+		if _, err := io.ReadFull(r, b[1:2]); err != nil {
+			return err
+		}
+		m := b[1]
+		switch {
+		case m == 0xFF || m == 0x00:
+			continue
+		case m == 0xD8 || m == 0x01 || (m >= 0xD0 && m <= 0xD7):
+			continue
+		case m == 0xD9 || m == 0xDA:
+			return nil
+		}
+		var l [2]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return err
+		}
+		n := int64(binary.BigEndian.Uint16(l[:])) - 2
+		if n < 0 {
+			return ErrMalformed
+		}
+		if !want(m) {
+			if _, err := r.Seek(n, io.SeekCurrent); err != nil {
+				return err
+			}
+			continue
+		}
+		seg := make([]byte, n)
+		if _, err := io.ReadFull(r, seg); err != nil {
+			return err
+		}
+		if err := fn(m, seg); err != nil {
+			return err
+		}
+	}
+}
+
+// joinICCChunks concatenates APP2 chunks in sequence order.
+func joinICCChunks(chunks map[byte][]byte) []byte {
+	if len(chunks) == 0 {
+		return nil
+	}
+	seqs := make([]int, 0, len(chunks))
+	for s := range chunks {
+		seqs = append(seqs, int(s))
+	}
+	sort.Ints(seqs)
+	var p []byte
+	for _, s := range seqs {
+		p = append(p, chunks[byte(s)]...)
+	}
+	return p
+}
+
+// pngICC inflates the iCCP chunk, which must precede the image data.
+func pngICC(r io.ReadSeeker) ([]byte, error) {
+	if _, err := r.Seek(8, io.SeekStart); err != nil {
+		return nil, err
+	}
+	for {
+		var ch [8]byte
+		if _, err := io.ReadFull(r, ch[:]); err != nil {
+			return nil, err
+		}
+		n := int64(binary.BigEndian.Uint32(ch[0:4]))
+		switch string(ch[4:8]) {
+		case "iCCP":
+			if n > maxICCSize {
+				return nil, ErrMalformed
+			}
+			d := make([]byte, n)
+			if _, err := io.ReadFull(r, d); err != nil {
+				return nil, err
+			}
+			// profile name, NUL, compression method, zlib stream
+			i := bytes.IndexByte(d, 0)
+			if i < 0 || i+2 > len(d) {
+				return nil, ErrMalformed
+			}
+			zr, err := zlib.NewReader(bytes.NewReader(d[i+2:]))
+			if err != nil {
+				return nil, ErrMalformed
+			}
+			defer zr.Close()
+			p, err := io.ReadAll(io.LimitReader(zr, maxICCSize))
+			if err != nil {
+				return nil, ErrMalformed
+			}
+			return p, nil
+		case "IDAT", "IEND":
+			return nil, nil
+		}
+		if _, err := r.Seek(n+4, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// webpICC returns the ICCP chunk of an extended WebP.
+func webpICC(r io.ReadSeeker) ([]byte, error) {
+	if _, err := r.Seek(12, io.SeekStart); err != nil {
+		return nil, err
+	}
+	for {
+		var ch [8]byte
+		if _, err := io.ReadFull(r, ch[:]); err != nil {
+			if err == io.EOF {
+				return nil, nil
+			}
+			return nil, err
+		}
+		n := int64(binary.LittleEndian.Uint32(ch[4:8]))
+		switch string(ch[0:4]) {
+		case "ICCP":
+			if n > maxICCSize {
+				return nil, ErrMalformed
+			}
+			p := make([]byte, n)
+			_, err := io.ReadFull(r, p)
+			return p, err
+		case "VP8 ", "VP8L", "ANIM":
+			// the profile chunk comes before any image data
+			return nil, nil
+		}
+		if _, err := r.Seek(n+n&1, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// isobmffICC finds a colr property carrying an ICC profile ("prof" or
+// "rICC") in an AVIF/HEIC file, scanning the same way probeISOBMFF does.
+func isobmffICC(r io.Reader) ([]byte, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	for i := 4; i+8 <= len(b); i++ {
+		if string(b[i:i+4]) != "colr" {
+			continue
+		}
+		if kind := string(b[i+4 : i+8]); kind != "prof" && kind != "rICC" {
+			continue
+		}
+		end := i - 4 + int(binary.BigEndian.Uint32(b[i-4:i]))
+		if end <= i+8 || end > len(b) {
+			continue
+		}
+		return b[i+8 : end], nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,185 @@
+package imagetype
+
+import (
+	"bytes"
+	"strings"
+
+	"pixerver/internal/env"
+)
+
+// SniffLen is the number of leading bytes Detect needs to see.
+const SniffLen = 512
+
+// Type describes a detected image format.
+type Type struct {
+	Name string // canonical short name, e.g. "jpeg"
+	Ext  string // extension used for stored files, including the dot
+	MIME string
+}
+
+var (
+	JPEG = Type{"jpeg", ".jpg", "image/jpeg"}
+	PNG  = Type{"png", ".png", "image/png"}
+	GIF  = Type{"gif", ".gif", "image/gif"}
+	WEBP = Type{"webp", ".webp", "image/webp"}
+	AVIF = Type{"avif", ".avif", "image/avif"}
+	HEIC = Type{"heic", ".heic", "image/heic"}
+	TIFF = Type{"tiff", ".tiff", "image/tiff"}
+	BMP  = Type{"bmp", ".bmp", "image/bmp"}
+	SVG  = Type{"svg", ".svg", "image/svg+xml"}
+	JXL  = Type{"jxl", ".jxl", "image/jxl"}
+)
+
+// All lists every type Detect can return.
+var All = []Type{JPEG, PNG, GIF, WEBP, AVIF, HEIC, TIFF, BMP, SVG}
+
+// outputOnly are types the encoders write but uploads are never sniffed as.
+var outputOnly = []Type{JXL}
+
+// DefaultAllowed is the upload allowlist used when none is configured. SVG
+// is left out because it can carry scripts and external references.
+var DefaultAllowed = []string{"jpeg", "png", "gif", "webp", "avif", "heic", "tiff", "bmp"}
+
+// ByName returns the type with the given canonical name.
+func ByName(name string) (Type, bool) {
+	for _, t := range All {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return Type{}, false
+}
+
+// ByExt returns the type whose stored-file extension is ext (with the dot).
+// ".jpeg" is accepted as an alias for ".jpg".
+func ByExt(ext string) (Type, bool) {
+	ext = strings.ToLower(ext)
+	if ext == ".jpeg" {
+		ext = ".jpg"
+	}
+	for _, t := range append(All, outputOnly...) {
+		if t.Ext == ext {
+			return t, true
+		}
+	}
+	return Type{}, false
+}
+
+// Detect identifies the image format from magic bytes. It needs at most
+// SniffLen leading bytes of the file.
+func Detect(b []byte) (Type, bool) {
+	switch {
+	case bytes.HasPrefix(b, []byte{0xFF, 0xD8, 0xFF}):
+		return JPEG, true
+	case bytes.HasPrefix(b, []byte("\x89PNG\r\n\x1a\n")):
+		return PNG, true
+	case bytes.HasPrefix(b, []byte("GIF87a")), bytes.HasPrefix(b, []byte("GIF89a")):
+		return GIF, true
+	case len(b) >= 12 && string(b[0:4]) == "RIFF" && string(b[8:12]) == "WEBP":
+		return WEBP, true
+	case bytes.HasPrefix(b, []byte("II*\x00")), bytes.HasPrefix(b, []byte("MM\x00*")):
+		return TIFF, true
+	case len(b) >= 14 && string(b[0:2]) == "BM" && b[6] == 0 && b[7] == 0 && b[8] == 0 && b[9] == 0:
+		// BITMAPFILEHEADER: "BM", size, two reserved zero words
+		return BMP, true
+	}
+	if t, ok := detectISOBMFF(b); ok {
+		return t, true
+	}
+	if isSVG(b) {
+		return SVG, true
+	}
+	return Type{}, false
+}
+
+// detectISOBMFF recognises AVIF and HEIC from the ftyp box brands.
+func detectISOBMFF(b []byte) (Type, bool) {
+	if len(b) < 16 || string(b[4:8]) != "ftyp" {
+		return Type{}, false
+	}
+	size := int(b[0])<<24 | int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+	if size < 16 || size > len(b) {
+		size = len(b)
+	}
+	brands := []string{string(b[8:12])}
+	for i := 16; i+4 <= size; i += 4 {
+		brands = append(brands, string(b[i:i+4]))
+	}
+	heic := false
+	for _, br := range brands {
+		switch br {
+		case "avif", "avis":
+			return AVIF, true
+		case "heic", "heix", "hevc", "hevx", "heim", "heis":
+			heic = true
+		}
+	}
+	if heic {
+		return HEIC, true
+	}
+	return Type{}, false
+}
+
+// isSVG reports whether b looks like an SVG document: optional BOM, XML
+// declaration, comments and doctype followed by an <svg root element.
+func isSVG(b []byte) bool {
+	s := strings.TrimPrefix(string(b), "\ufeff")
+	for {
+		s = strings.TrimLeft(s, " \t\r\n")
+		switch {
+		case strings.HasPrefix(s, "<?"):
+			i := strings.Index(s, "?>")
+			if i < 0 {
+				return false
+			}
+			s = s[i+2:]
+		case strings.HasPrefix(s, "<!--"):
+			i := strings.Index(s, "-->")
+			if i < 0 {
+				return false
+			}
+			s = s[i+3:]
+		case strings.HasPrefix(s, "<!DOCTYPE"), strings.HasPrefix(s, "<!doctype"):
+			i := strings.Index(s, ">")
+			if i < 0 {
+				return false
+			}
+			s = s[i+1:]
+		default:
+			return strings.HasPrefix(s, "<svg") && len(s) > 4 && strings.ContainsRune(" \t\r\n>/", rune(s[4]))
+		}
+	}
+}
+
+// Allowlist is a set of permitted canonical type names.
+type Allowlist map[string]bool
+
+// NewAllowlist builds an allowlist from type names. "jpg" and "heif" are
+// accepted as aliases of "jpeg" and "heic".
+func NewAllowlist(names []string) Allowlist {
+	a := make(Allowlist)
+	for _, n := range names {
+		n = strings.ToLower(strings.TrimSpace(n))
+		switch n {
+		case "jpg":
+			n = "jpeg"
+		case "heif":
+			n = "heic"
+		}
+		if n != "" {
+			a[n] = true
+		}
+	}
+	return a
+}
+
+// AllowlistFromEnv returns the allowlist from UPLOAD_ALLOWED_TYPES
+// (comma-separated type names), defaulting to DefaultAllowed.
+func AllowlistFromEnv() Allowlist {
+	return NewAllowlist(env.List("UPLOAD_ALLOWED_TYPES", DefaultAllowed))
+}
+
+// Allows reports whether t is in the allowlist.
+func (a Allowlist) Allows(t Type) bool {
+	return a[t.Name]
+}
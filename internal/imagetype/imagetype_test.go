@@ -0,0 +1,43 @@
+package imagetype
+
+import (
+	"testing"
+)
+
+func TestDetect(t *testing.T) {
+	cases := []struct {
+		data string
+		want string
+	}{
+		{"\xff\xd8\xff\xe0\x00\x10JFIF", "jpeg"},
+		{"\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", "png"},
+		{"GIF89a\x01\x00\x01\x00", "gif"},
+		{"RIFF\x24\x00\x00\x00WEBPVP8 ", "webp"},
+		{"\x00\x00\x00\x1cftypavif\x00\x00\x00\x00avifmif1", "avif"},
+		{"\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic", "heic"},
+		{"\x00\x00\x00\x18ftypmif1\x00\x00\x00\x00mif1heic", "heic"},
+		{"II*\x00\x08\x00\x00\x00", "tiff"},
+		{"MM\x00*\x00\x00\x00\x08", "tiff"},
+		{"BM\x3a\x00\x00\x00\x00\x00\x00\x00\x36\x00\x00\x00", "bmp"},
+		{"<?xml version=\"1.0\"?>\n<!-- c -->\n<svg xmlns=\"http://www.w3.org/2000/svg\"/>", "svg"},
+	}
+	for _, c := range cases {
+		got, ok := Detect([]byte(c.data))
+		if !ok || got.Name != c.want {
+			t.Fatalf("Detect(%q): want %s got %+v ok=%v", c.data, c.want, got, ok)
+		}
+	}
+
+	for _, bad := range []string{"PK\x03\x04", "<html><body>", "<svgfoo>", "plain text", ""} {
+		if got, ok := Detect([]byte(bad)); ok {
+			t.Fatalf("Detect(%q): expected no match, got %+v", bad, got)
+		}
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	a := NewAllowlist([]string{" JPG ", "heif"})
+	if !a.Allows(JPEG) || !a.Allows(HEIC) || a.Allows(SVG) {
+		t.Fatalf("unexpected allowlist %+v", a)
+	}
+}
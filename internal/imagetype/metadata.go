@@ -0,0 +1,192 @@
+package imagetype
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+)
+
+// maxMetadataSize bounds each metadata block read by ReadMetadata.
+const maxMetadataSize = 4 << 20
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	psHeader   = []byte("Photoshop 3.0\x00")
+)
+
+// RawMetadata holds the metadata blocks embedded in an image: EXIF as a
+// TIFF structure (without the "Exif\0\0" header), the XMP packet and the
+// IPTC-IIM records. Missing blocks are nil.
+type RawMetadata struct {
+	EXIF []byte
+	XMP  []byte
+	IPTC []byte
+}
+
+// ReadMetadata returns the EXIF, XMP and IPTC blocks of a JPEG, PNG or
+// WebP. Other types report none.
+func ReadMetadata(r io.ReadSeeker, t Type) (RawMetadata, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return RawMetadata{}, err
+	}
+	var (
+		md  RawMetadata
+		err error
+	)
+	switch t.Name {
+	case "jpeg":
+		md, err = jpegMetadata(r)
+	case "png":
+		md, err = pngMetadata(r)
+	case "webp":
+		md, err = webpMetadata(r)
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = ErrMalformed
+	}
+	return md, err
+}
+
+func jpegMetadata(r io.ReadSeeker) (RawMetadata, error) {
+	var md RawMetadata
+	want := func(m byte) bool { return m == 0xE1 || m == 0xED }
+	err := jpegSegments(r, want, func(m byte, seg []byte) error {
+		switch {
+		case m == 0xE1 && bytes.HasPrefix(seg, exifHeader) && md.EXIF == nil:
+			md.EXIF = seg[len(exifHeader):]
+		case m == 0xE1 && bytes.HasPrefix(seg, xmpHeader) && md.XMP == nil:
+			md.XMP = seg[len(xmpHeader):]
+		case m == 0xED && bytes.HasPrefix(seg, psHeader):
+			md.IPTC = append(md.IPTC, photoshopIPTC(seg[len(psHeader):])...)
+		}
+		return nil
+	})
+	return md, err
+}
+
+// photoshopIPTC returns the IPTC-IIM resource (ID 0x0404) of a run of
+// Photoshop image resource blocks.
+func photoshopIPTC(b []byte) []byte {
+	for len(b) >= 12 && string(b[:4]) == "8BIM" {
+		id := binary.BigEndian.Uint16(b[4:6])
+		// Pascal-string name, padded to an even length
+		nameLen := int(b[6]) + 1
+		nameLen += nameLen & 1
+		at := 6 + nameLen
+		if at+4 > len(b) {
+			return nil
+		}
+		size := int(binary.BigEndian.Uint32(b[at:]))
+		at += 4
+		if size < 0 || at+size > len(b) {
+			return nil
+		}
+		if id == 0x0404 {
+			return b[at : at+size]
+		}
+		b = b[min(at+size+size&1, len(b)):]
+	}
+	return nil
+}
+
+func pngMetadata(r io.ReadSeeker) (RawMetadata, error) {
+	var md RawMetadata
+	if _, err := r.Seek(8, io.SeekStart); err != nil {
+		return md, err
+	}
+	for {
+		var ch [8]byte
+		if _, err := io.ReadFull(r, ch[:]); err != nil {
+			return md, err
+		}
+		n := int64(binary.BigEndian.Uint32(ch[0:4]))
+		switch string(ch[4:8]) {
+		case "eXIf", "iTXt":
+			if n > maxMetadataSize {
+				return md, ErrMalformed
+			}
+			d := make([]byte, n)
+			if _, err := io.ReadFull(r, d); err != nil {
+				return md, err
+			}
+			if string(ch[4:8]) == "eXIf" {
+				md.EXIF = d
+			} else if x, ok := pngXMP(d); ok {
+				md.XMP = x
+			}
+			n = 0
+		case "IEND":
+			return md, nil
+		}
+		if _, err := r.Seek(n+4, io.SeekCurrent); err != nil {
+			return md, err
+		}
+	}
+}
+
+// pngXMP returns the text of an iTXt chunk keyed "XML:com.adobe.xmp".
+func pngXMP(d []byte) ([]byte, bool) {
+	key := []byte("XML:com.adobe.xmp\x00")
+	if !bytes.HasPrefix(d, key) || len(d) < len(key)+2 {
+		return nil, false
+	}
+	compressed := d[len(key)] == 1
+	rest := d[len(key)+2:]
+	// language tag and translated keyword, both NUL-terminated
+	for range 2 {
+		i := bytes.IndexByte(rest, 0)
+		if i < 0 {
+			return nil, false
+		}
+		rest = rest[i+1:]
+	}
+	if !compressed {
+		return rest, true
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(rest))
+	if err != nil {
+		return nil, false
+	}
+	defer zr.Close()
+	x, err := io.ReadAll(io.LimitReader(zr, maxMetadataSize))
+	return x, err == nil
+}
+
+func webpMetadata(r io.ReadSeeker) (RawMetadata, error) {
+	var md RawMetadata
+	if _, err := r.Seek(12, io.SeekStart); err != nil {
+		return md, err
+	}
+	for {
+		var ch [8]byte
+		if _, err := io.ReadFull(r, ch[:]); err != nil {
+			if err == io.EOF {
+				return md, nil
+			}
+			return md, err
+		}
+		n := int64(binary.LittleEndian.Uint32(ch[4:8]))
+		pad := n & 1
+		switch string(ch[0:4]) {
+		case "EXIF", "XMP ":
+			if n > maxMetadataSize {
+				return md, ErrMalformed
+			}
+			d := make([]byte, n)
+			if _, err := io.ReadFull(r, d); err != nil {
+				return md, err
+			}
+			if ch[0] == 'E' {
+				md.EXIF = bytes.TrimPrefix(d, exifHeader)
+			} else {
+				md.XMP = d
+			}
+			n = 0
+		}
+		if _, err := r.Seek(n+pad, io.SeekCurrent); err != nil {
+			return md, err
+		}
+	}
+}
@@ -0,0 +1,457 @@
+package imagetype
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"pixerver/internal/env"
+)
+
+// Info holds the header fields read by Probe. Frames is 1 for still images.
+// BitDepth is bits per channel (per pixel for BMP); 0 when unknown.
+type Info struct {
+	Width    int `json:"width"`
+	Height   int `json:"height"`
+	Frames   int `json:"frames"`
+	BitDepth int `json:"bitDepth"`
+}
+
+// Pixels returns the pixel count of a single frame.
+func (i Info) Pixels() int64 {
+	return int64(i.Width) * int64(i.Height)
+}
+
+// ErrMalformed is returned when a header cannot be parsed.
+var ErrMalformed = errors.New("malformed image header")
+
+// isobmffScanLimit bounds how far into an AVIF/HEIC file we look for the
+// property boxes; they live in the meta box near the start of the file.
+const isobmffScanLimit = 1 << 20
+
+// Probe reads only the container headers of r (no pixel data is decoded)
+// and reports dimensions, frame count and bit depth. SVG has no intrinsic
+// raster size and returns a zero Info.
+func Probe(r io.ReadSeeker, t Type) (Info, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return Info{}, err
+	}
+	var (
+		info Info
+		err  error
+	)
+	switch t.Name {
+	case "png":
+		info, err = probePNG(r)
+	case "gif":
+		info, err = probeGIF(r)
+	case "jpeg":
+		info, err = probeJPEG(r)
+	case "webp":
+		info, err = probeWEBP(r)
+	case "bmp":
+		info, err = probeBMP(r)
+	case "tiff":
+		info, err = probeTIFF(r, maxTIFFPages)
+	case "avif", "heic":
+		info, err = probeISOBMFF(io.LimitReader(r, isobmffScanLimit))
+	case "svg":
+		return Info{}, nil
+	default:
+		return Info{}, fmt.Errorf("probe: unsupported type %q", t.Name)
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = ErrMalformed
+	}
+	if err != nil {
+		return Info{}, err
+	}
+	if info.Width <= 0 || info.Height <= 0 {
+		return Info{}, ErrMalformed
+	}
+	if info.Frames == 0 {
+		info.Frames = 1
+	}
+	return info, nil
+}
+
+func probePNG(r io.ReadSeeker) (Info, error) {
+	var hdr [8 + 8 + 13]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return Info{}, err
+	}
+	if string(hdr[12:16]) != "IHDR" {
+		return Info{}, ErrMalformed
+	}
+	info := Info{
+		Width:    int(binary.BigEndian.Uint32(hdr[16:20])),
+		Height:   int(binary.BigEndian.Uint32(hdr[20:24])),
+		BitDepth: int(hdr[24]),
+		Frames:   1,
+	}
+	if _, err := r.Seek(4, io.SeekCurrent); err != nil { // IHDR crc
+		return Info{}, err
+	}
+	// walk chunks until image data looking for an APNG acTL frame count
+	for {
+		var ch [8]byte
+		if _, err := io.ReadFull(r, ch[:]); err != nil {
+			return info, nil
+		}
+		n := int64(binary.BigEndian.Uint32(ch[0:4]))
+		switch string(ch[4:8]) {
+		case "acTL":
+			var b [4]byte
+			if _, err := io.ReadFull(r, b[:]); err != nil {
+				return Info{}, err
+			}
+			info.Frames = int(binary.BigEndian.Uint32(b[:]))
+			return info, nil
+		case "IDAT", "IEND":
+			return info, nil
+		}
+		if _, err := r.Seek(n+4, io.SeekCurrent); err != nil {
+			return Info{}, err
+		}
+	}
+}
+
+func probeGIF(r io.ReadSeeker) (Info, error) {
+	var hdr [13]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return Info{}, err
+	}
+	info := Info{
+		Width:    int(binary.LittleEndian.Uint16(hdr[6:8])),
+		Height:   int(binary.LittleEndian.Uint16(hdr[8:10])),
+		BitDepth: int((hdr[10]>>4)&0x07) + 1,
+	}
+	if hdr[10]&0x80 != 0 {
+		if _, err := r.Seek(3<<((hdr[10]&0x07)+1), io.SeekCurrent); err != nil {
+			return Info{}, err
+		}
+	}
+	// count image descriptors, skipping over data sub-blocks without decoding
+	var b [1]byte
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return Info{}, err
+		}
+		switch b[0] {
+		case 0x3B: // trailer
+			return info, nil
+		case 0x21: // extension: label then sub-blocks
+			if _, err := io.ReadFull(r, b[:]); err != nil {
+				return Info{}, err
+			}
+			if err := skipGIFBlocks(r); err != nil {
+				return Info{}, err
+			}
+		case 0x2C: // image descriptor
+			info.Frames++
+			var d [9]byte
+			if _, err := io.ReadFull(r, d[:]); err != nil {
+				return Info{}, err
+			}
+			if d[8]&0x80 != 0 {
+				if _, err := r.Seek(3<<((d[8]&0x07)+1), io.SeekCurrent); err != nil {
+					return Info{}, err
+				}
+			}
+			if _, err := io.ReadFull(r, b[:]); err != nil { // LZW min code size
+				return Info{}, err
+			}
+			if err := skipGIFBlocks(r); err != nil {
+				return Info{}, err
+			}
+		default:
+			return Info{}, ErrMalformed
+		}
+	}
+}
+
+func skipGIFBlocks(r io.ReadSeeker) error {
+	var b [1]byte
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return err
+		}
+		if b[0] == 0 {
+			return nil
+		}
+		if _, err := r.Seek(int64(b[0]), io.SeekCurrent); err != nil {
+			return err
+		}
+	}
+}
+
+func probeJPEG(r io.ReadSeeker) (Info, error) {
+	var b [2]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return Info{}, err
+	}
+	for {
+		if _, err := io.ReadFull(r, b[:1]); err != nil {
+			return Info{}, err
+		}
+		if b[0] != 0xFF {
+			continue
+		}
+		if _, err := io.ReadFull(r, b[1:2]); err != nil {
+			return Info{}, err
+		}
+		m := b[1]
+		switch {
+		case m == 0xFF || m == 0x00:
+			continue
+		case m == 0xD8 || m == 0x01 || (m >= 0xD0 && m <= 0xD7):
+			continue // markers without a length
+		case m == 0xD9 || m == 0xDA:
+			return Info{}, ErrMalformed // no frame header before scan data
+		}
+		var l [2]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return Info{}, err
+		}
+		n := int64(binary.BigEndian.Uint16(l[:])) - 2
+		if m >= 0xC0 && m <= 0xCF && m != 0xC4 && m != 0xC8 && m != 0xCC {
+			var sof [5]byte
+			if _, err := io.ReadFull(r, sof[:]); err != nil {
+				return Info{}, err
+			}
+			return Info{
+				BitDepth: int(sof[0]),
+				Height:   int(binary.BigEndian.Uint16(sof[1:3])),
+				Width:    int(binary.BigEndian.Uint16(sof[3:5])),
+				Frames:   1,
+			}, nil
+		}
+		if _, err := r.Seek(n, io.SeekCurrent); err != nil {
+			return Info{}, err
+		}
+	}
+}
+
+func probeWEBP(r io.ReadSeeker) (Info, error) {
+	var hdr [12]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return Info{}, err
+	}
+	info := Info{BitDepth: 8}
+	for {
+		var ch [8]byte
+		if _, err := io.ReadFull(r, ch[:]); err != nil {
+			if info.Width > 0 {
+				return info, nil
+			}
+			return Info{}, err
+		}
+		n := int64(binary.LittleEndian.Uint32(ch[4:8]))
+		pad := n & 1
+		switch string(ch[0:4]) {
+		case "VP8X":
+			var d [10]byte
+			if _, err := io.ReadFull(r, d[:]); err != nil {
+				return Info{}, err
+			}
+			info.Width = int(uint32(d[4])|uint32(d[5])<<8|uint32(d[6])<<16) + 1
+			info.Height = int(uint32(d[7])|uint32(d[8])<<8|uint32(d[9])<<16) + 1
+			if d[0]&0x02 == 0 { // not animated; canvas size is all we need
+				return info, nil
+			}
+			n -= int64(len(d))
+		case "VP8 ":
+			var d [10]byte
+			if _, err := io.ReadFull(r, d[:]); err != nil {
+				return Info{}, err
+			}
+			if d[3] != 0x9d || d[4] != 0x01 || d[5] != 0x2a {
+				return Info{}, ErrMalformed
+			}
+			info.Width = int(binary.LittleEndian.Uint16(d[6:8]) & 0x3fff)
+			info.Height = int(binary.LittleEndian.Uint16(d[8:10]) & 0x3fff)
+			return info, nil
+		case "VP8L":
+			var d [5]byte
+			if _, err := io.ReadFull(r, d[:]); err != nil {
+				return Info{}, err
+			}
+			if d[0] != 0x2f {
+				return Info{}, ErrMalformed
+			}
+			bits := binary.LittleEndian.Uint32(d[1:5])
+			info.Width = int(bits&0x3fff) + 1
+			info.Height = int((bits>>14)&0x3fff) + 1
+			return info, nil
+		case "ANMF":
+			info.Frames++
+		}
+		if _, err := r.Seek(n+pad, io.SeekCurrent); err != nil {
+			return Info{}, err
+		}
+	}
+}
+
+func probeBMP(r io.ReadSeeker) (Info, error) {
+	var hdr [30]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return Info{}, err
+	}
+	size := binary.LittleEndian.Uint32(hdr[14:18])
+	if size == 12 { // BITMAPCOREHEADER
+		return Info{
+			Width:    int(binary.LittleEndian.Uint16(hdr[18:20])),
+			Height:   int(binary.LittleEndian.Uint16(hdr[20:22])),
+			BitDepth: int(binary.LittleEndian.Uint16(hdr[24:26])),
+			Frames:   1,
+		}, nil
+	}
+	w := int32(binary.LittleEndian.Uint32(hdr[18:22]))
+	h := int32(binary.LittleEndian.Uint32(hdr[22:26]))
+	if h < 0 { // top-down bitmap
+		h = -h
+	}
+	return Info{Width: int(w), Height: int(h), BitDepth: int(binary.LittleEndian.Uint16(hdr[28:30])), Frames: 1}, nil
+}
+
+// maxTIFFPages bounds IFD traversal so a looping IFD chain can't spin forever.
+const maxTIFFPages = 100000
+
+// probeTIFF reports the largest width and height across the first
+// maxPages pages.
+func probeTIFF(r io.ReadSeeker, maxPages int) (Info, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return Info{}, err
+	}
+	var bo binary.ByteOrder = binary.LittleEndian
+	if hdr[0] == 'M' {
+		bo = binary.BigEndian
+	}
+	off := int64(bo.Uint32(hdr[4:8]))
+	var info Info
+	seen := map[int64]bool{}
+	for off != 0 && !seen[off] && info.Frames < maxPages {
+		seen[off] = true
+		if _, err := r.Seek(off, io.SeekStart); err != nil {
+			return Info{}, err
+		}
+		var cnt [2]byte
+		if _, err := io.ReadFull(r, cnt[:]); err != nil {
+			return Info{}, err
+		}
+		entries := make([]byte, 12*int(bo.Uint16(cnt[:])))
+		if _, err := io.ReadFull(r, entries); err != nil {
+			return Info{}, err
+		}
+		for i := 0; i+12 <= len(entries); i += 12 {
+			e := entries[i : i+12]
+			tag, typ := bo.Uint16(e[0:2]), bo.Uint16(e[2:4])
+			val := int(bo.Uint32(e[8:12]))
+			if typ == 3 { // SHORT, left-justified in the value field
+				val = int(bo.Uint16(e[8:10]))
+			}
+			// keep the largest page; that's what bounds decoder memory
+			switch tag {
+			case 256:
+				if val > info.Width {
+					info.Width = val
+				}
+			case 257:
+				if val > info.Height {
+					info.Height = val
+				}
+			case 258:
+				if bo.Uint32(e[4:8]) == 1 && val > info.BitDepth {
+					info.BitDepth = val
+				}
+			}
+		}
+		info.Frames++
+		var next [4]byte
+		if _, err := io.ReadFull(r, next[:]); err != nil {
+			return Info{}, err
+		}
+		off = int64(bo.Uint32(next[:]))
+	}
+	if info.BitDepth == 0 {
+		info.BitDepth = 8
+	}
+	return info, nil
+}
+
+// probeISOBMFF finds the ispe (spatial extent) and pixi (bit depth) item
+// properties of an AVIF/HEIC file. Containers can hold several images
+// (thumbnails, grid tiles); the largest extent bounds what a decoder would
+// allocate, so that is what we report.
+func probeISOBMFF(r io.Reader) (Info, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return Info{}, err
+	}
+	info := Info{Frames: 1}
+	for i := 4; i+4 <= len(b); i++ {
+		switch string(b[i : i+4]) {
+		case "ispe":
+			if i+16 > len(b) {
+				continue
+			}
+			w := int(binary.BigEndian.Uint32(b[i+8 : i+12]))
+			h := int(binary.BigEndian.Uint32(b[i+12 : i+16]))
+			if int64(w)*int64(h) > info.Pixels() {
+				info.Width, info.Height = w, h
+			}
+		case "pixi":
+			if i+10 > len(b) || b[i+8] == 0 {
+				continue
+			}
+			if d := int(b[i+9]); d > info.BitDepth {
+				info.BitDepth = d
+			}
+		}
+	}
+	if info.Width == 0 && bytes.Contains(b, []byte("moov")) {
+		// image sequences without item properties fall back to the decoder
+		return Info{}, ErrMalformed
+	}
+	return info, nil
+}
+
+// LimitsFromEnv returns the decompression-bomb limits from
+// UPLOAD_MAX_WIDTH, UPLOAD_MAX_HEIGHT, UPLOAD_MAX_PIXELS and
+// UPLOAD_MAX_FRAMES.
+func LimitsFromEnv() Limits {
+	return Limits{
+		MaxWidth:  env.Int("UPLOAD_MAX_WIDTH", 0),
+		MaxHeight: env.Int("UPLOAD_MAX_HEIGHT", 0),
+		MaxPixels: env.Int64("UPLOAD_MAX_PIXELS", 100_000_000),
+		MaxFrames: env.Int("UPLOAD_MAX_FRAMES", 1000),
+	}
+}
+
+// Limits bounds what Probe results are acceptable. Zero means unlimited.
+type Limits struct {
+	MaxWidth  int
+	MaxHeight int
+	MaxPixels int64 // per frame
+	MaxFrames int
+}
+
+// Check returns an error describing the first limit info exceeds.
+func (l Limits) Check(info Info) error {
+	if l.MaxWidth > 0 && info.Width > l.MaxWidth {
+		return fmt.Errorf("width %d exceeds limit %d", info.Width, l.MaxWidth)
+	}
+	if l.MaxHeight > 0 && info.Height > l.MaxHeight {
+		return fmt.Errorf("height %d exceeds limit %d", info.Height, l.MaxHeight)
+	}
+	if l.MaxPixels > 0 && info.Pixels() > l.MaxPixels {
+		return fmt.Errorf("%d pixels exceeds limit %d", info.Pixels(), l.MaxPixels)
+	}
+	if l.MaxFrames > 0 && info.Frames > l.MaxFrames {
+		return fmt.Errorf("%d frames exceeds limit %d", info.Frames, l.MaxFrames)
+	}
+	return nil
+}
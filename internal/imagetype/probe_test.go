@@ -0,0 +1,162 @@
+package imagetype
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func probeBytes(t *testing.T, b []byte) Info {
+	t.Helper()
+	typ, ok := Detect(b)
+	if !ok {
+		t.Fatalf("Detect failed for %q", b[:min(len(b), 16)])
+	}
+	info, err := Probe(bytes.NewReader(b), typ)
+	if err != nil {
+		t.Fatalf("Probe(%s): %v", typ.Name, err)
+	}
+	return info
+}
+
+func TestProbeStdlibFormats(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 37, 21))
+
+	var pb bytes.Buffer
+	_ = png.Encode(&pb, img)
+	if info := probeBytes(t, pb.Bytes()); info.Width != 37 || info.Height != 21 || info.Frames != 1 || info.BitDepth != 8 {
+		t.Fatalf("png: %+v", info)
+	}
+
+	var jb bytes.Buffer
+	_ = jpeg.Encode(&jb, img, nil)
+	if info := probeBytes(t, jb.Bytes()); info.Width != 37 || info.Height != 21 || info.BitDepth != 8 {
+		t.Fatalf("jpeg: %+v", info)
+	}
+
+	frame := image.NewPaletted(image.Rect(0, 0, 37, 21), palette.Plan9)
+	var gb bytes.Buffer
+	_ = gif.EncodeAll(&gb, &gif.GIF{Image: []*image.Paletted{frame, frame, frame}, Delay: []int{1, 1, 1}})
+	if info := probeBytes(t, gb.Bytes()); info.Width != 37 || info.Height != 21 || info.Frames != 3 {
+		t.Fatalf("gif: %+v", info)
+	}
+}
+
+func TestProbeDeclaredBomb(t *testing.T) {
+	// a PNG header claiming 50000x50000 with no pixel data at all
+	var b bytes.Buffer
+	b.WriteString("\x89PNG\r\n\x1a\n")
+	_ = binary.Write(&b, binary.BigEndian, uint32(13))
+	b.WriteString("IHDR")
+	_ = binary.Write(&b, binary.BigEndian, uint32(50000))
+	_ = binary.Write(&b, binary.BigEndian, uint32(50000))
+	b.Write([]byte{8, 6, 0, 0, 0})
+	b.Write([]byte{0, 0, 0, 0})
+
+	info := probeBytes(t, b.Bytes())
+	if info.Width != 50000 || info.Height != 50000 {
+		t.Fatalf("unexpected info %+v", info)
+	}
+	if err := (Limits{MaxPixels: 100_000_000}).Check(info); err == nil {
+		t.Fatalf("expected pixel limit to reject the bomb")
+	}
+	if err := (Limits{MaxFrames: 1}).Check(Info{Width: 1, Height: 1, Frames: 2}); err == nil {
+		t.Fatalf("expected frame limit to trigger")
+	}
+}
+
+func TestProbeHandRolledHeaders(t *testing.T) {
+	// WebP lossless: 14-bit width-1 / height-1 after the 0x2f signature
+	var wb bytes.Buffer
+	wb.WriteString("RIFF\x1a\x00\x00\x00WEBPVP8L\x0d\x00\x00\x00\x2f")
+	_ = binary.Write(&wb, binary.LittleEndian, uint32(99)|uint32(49)<<14)
+	wb.Write(make([]byte, 8))
+	if info := probeBytes(t, wb.Bytes()); info.Width != 100 || info.Height != 50 {
+		t.Fatalf("webp: %+v", info)
+	}
+
+	// BMP with BITMAPINFOHEADER, top-down
+	bmp := make([]byte, 54)
+	copy(bmp, "BM")
+	binary.LittleEndian.PutUint32(bmp[14:], 40)
+	binary.LittleEndian.PutUint32(bmp[18:], 640)
+	binary.LittleEndian.PutUint32(bmp[22:], uint32(0xFFFFFFFF-479)) // -480
+	binary.LittleEndian.PutUint16(bmp[28:], 24)
+	if info := probeBytes(t, bmp); info.Width != 640 || info.Height != 480 || info.BitDepth != 24 {
+		t.Fatalf("bmp: %+v", info)
+	}
+
+	// little-endian TIFF with one IFD of three entries
+	var tb bytes.Buffer
+	tb.WriteString("II*\x00")
+	_ = binary.Write(&tb, binary.LittleEndian, uint32(8))
+	_ = binary.Write(&tb, binary.LittleEndian, uint16(3))
+	for _, e := range [][3]uint32{{256, 4, 300}, {257, 4, 200}, {258, 3, 16}} {
+		_ = binary.Write(&tb, binary.LittleEndian, uint16(e[0]))
+		_ = binary.Write(&tb, binary.LittleEndian, uint16(e[1]))
+		_ = binary.Write(&tb, binary.LittleEndian, uint32(1))
+		_ = binary.Write(&tb, binary.LittleEndian, e[2])
+	}
+	_ = binary.Write(&tb, binary.LittleEndian, uint32(0))
+	if info := probeBytes(t, tb.Bytes()); info.Width != 300 || info.Height != 200 || info.BitDepth != 16 || info.Frames != 1 {
+		t.Fatalf("tiff: %+v", info)
+	}
+
+	// AVIF: ftyp then an ispe and pixi property somewhere in meta
+	var ab bytes.Buffer
+	ab.WriteString("\x00\x00\x00\x18ftypavif\x00\x00\x00\x00avifmif1")
+	ab.WriteString("\x00\x00\x00\x14ispe\x00\x00\x00\x00")
+	_ = binary.Write(&ab, binary.BigEndian, uint32(4032))
+	_ = binary.Write(&ab, binary.BigEndian, uint32(3024))
+	ab.WriteString("\x00\x00\x00\x10pixi\x00\x00\x00\x00\x03\x0a\x0a\x0a")
+	if info := probeBytes(t, ab.Bytes()); info.Width != 4032 || info.Height != 3024 || info.BitDepth != 10 {
+		t.Fatalf("avif: %+v", info)
+	}
+}
+
+func TestICCProfileContainers(t *testing.T) {
+	profile := []byte("fake-icc-profile")
+	read := func(name string, b []byte) []byte {
+		t.Helper()
+		typ, ok := Detect(b)
+		if !ok {
+			t.Fatalf("%s: not detected", name)
+		}
+		p, err := ICCProfile(bytes.NewReader(b), typ)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		return p
+	}
+
+	// WebP: VP8X, then ICCP before the image data
+	var wb bytes.Buffer
+	wb.WriteString("RIFF\x00\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00\x20\x00\x00\x00\x00\x00\x00\x00\x00\x00")
+	wb.WriteString("ICCP")
+	_ = binary.Write(&wb, binary.LittleEndian, uint32(len(profile)))
+	wb.Write(profile)
+	wb.WriteString("VP8L\x00\x00\x00\x00")
+	if p := read("webp", wb.Bytes()); !bytes.Equal(p, profile) {
+		t.Fatalf("webp: got %q", p)
+	}
+
+	// AVIF: a colr property of type prof inside meta
+	var ab bytes.Buffer
+	ab.WriteString("\x00\x00\x00\x18ftypavif\x00\x00\x00\x00avifmif1")
+	_ = binary.Write(&ab, binary.BigEndian, uint32(12+len(profile)))
+	ab.WriteString("colrprof")
+	ab.Write(profile)
+	if p := read("avif", ab.Bytes()); !bytes.Equal(p, profile) {
+		t.Fatalf("avif: got %q", p)
+	}
+
+	// a colr box with nclx signalling carries no profile
+	if p := read("avif nclx", []byte("\x00\x00\x00\x18ftypavif\x00\x00\x00\x00avifmif1\x00\x00\x00\x13colrnclx\x00\x01\x00\x0d\x00\x06\x80")); p != nil {
+		t.Fatalf("nclx: got %q", p)
+	}
+}
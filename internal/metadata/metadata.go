@@ -0,0 +1,589 @@
+// Package metadata decides which of a source's metadata survives into its
+// variants. Orientation is applied to the pixels and dropped, and so is
+// everything else except the IPTC Core descriptive and rights fields
+// (creator, copyright, credit, source, title, headline, caption, keywords,
+// ...), which are written back as XMP, as EXIF artist and copyright, and
+// as IPTC-IIM in JPEGs. GPS positions, camera and lens serial numbers and
+// maker notes never reach a variant.
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"pixerver/internal/imagetype"
+)
+
+// Info is the metadata of a source that matters to its variants.
+type Info struct {
+	// Orientation is the source's EXIF orientation (1-8), 0 when absent.
+	Orientation int
+	Creator     []string
+	Copyright   string
+	Credit      string
+	Source      string
+
+	Title           string
+	Headline        string
+	Caption         string
+	CaptionWriter   string
+	Keywords        []string
+	Instructions    string
+	AuthorsPosition string
+	City            string
+	Sublocation     string
+	State           string
+	Country         string
+}
+
+// XMP namespaces of the properties Info maps to.
+const (
+	nsRDF       = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	nsDC        = "http://purl.org/dc/elements/1.1/"
+	nsPhotoshop = "http://ns.adobe.com/photoshop/1.0/"
+	nsRights    = "http://ns.adobe.com/xap/1.0/rights/"
+	nsIptcCore  = "http://iptc.org/std/Iptc4xmpCore/1.0/xmlns/"
+)
+
+// field maps one Info field to its IPTC-IIM dataset (record 2) and XMP
+// property. Array is the RDF container of array-valued properties ("Seq",
+// "Bag" or "Alt"); list fields are the repeatable ones.
+type field struct {
+	iim   byte
+	xmp   xml.Name
+	array string
+	text  func(*Info) *string
+	list  func(*Info) *[]string
+}
+
+// fields are the IPTC Core fields a variant keeps, in IIM dataset order.
+var fields = []field{
+	{iim: 5, xmp: xml.Name{Space: nsDC, Local: "title"}, array: "Alt", text: func(i *Info) *string { return &i.Title }},
+	{iim: 25, xmp: xml.Name{Space: nsDC, Local: "subject"}, array: "Bag", list: func(i *Info) *[]string { return &i.Keywords }},
+	{iim: 40, xmp: xml.Name{Space: nsPhotoshop, Local: "Instructions"}, text: func(i *Info) *string { return &i.Instructions }},
+	{iim: 80, xmp: xml.Name{Space: nsDC, Local: "creator"}, array: "Seq", list: func(i *Info) *[]string { return &i.Creator }},
+	{iim: 85, xmp: xml.Name{Space: nsPhotoshop, Local: "AuthorsPosition"}, text: func(i *Info) *string { return &i.AuthorsPosition }},
+	{iim: 90, xmp: xml.Name{Space: nsPhotoshop, Local: "City"}, text: func(i *Info) *string { return &i.City }},
+	{iim: 92, xmp: xml.Name{Space: nsIptcCore, Local: "Location"}, text: func(i *Info) *string { return &i.Sublocation }},
+	{iim: 95, xmp: xml.Name{Space: nsPhotoshop, Local: "State"}, text: func(i *Info) *string { return &i.State }},
+	{iim: 101, xmp: xml.Name{Space: nsPhotoshop, Local: "Country"}, text: func(i *Info) *string { return &i.Country }},
+	{iim: 105, xmp: xml.Name{Space: nsPhotoshop, Local: "Headline"}, text: func(i *Info) *string { return &i.Headline }},
+	{iim: 110, xmp: xml.Name{Space: nsPhotoshop, Local: "Credit"}, text: func(i *Info) *string { return &i.Credit }},
+	{iim: 115, xmp: xml.Name{Space: nsPhotoshop, Local: "Source"}, text: func(i *Info) *string { return &i.Source }},
+	{iim: 116, xmp: xml.Name{Space: nsDC, Local: "rights"}, array: "Alt", text: func(i *Info) *string { return &i.Copyright }},
+	{iim: 120, xmp: xml.Name{Space: nsDC, Local: "description"}, array: "Alt", text: func(i *Info) *string { return &i.Caption }},
+	{iim: 122, xmp: xml.Name{Space: nsPhotoshop, Local: "CaptionWriter"}, text: func(i *Info) *string { return &i.CaptionWriter }},
+}
+
+// values returns f's value in i as a list, empty when unset.
+func (f field) values(i *Info) []string {
+	if f.list != nil {
+		return *f.list(i)
+	}
+	if v := *f.text(i); v != "" {
+		return []string{v}
+	}
+	return nil
+}
+
+// set stores vs as f's value in i; single-valued fields take the first.
+func (f field) set(i *Info, vs []string) {
+	if f.list != nil {
+		*f.list(i) = vs
+	} else if len(vs) > 0 {
+		*f.text(i) = vs[0]
+	}
+}
+
+// Empty reports whether i has no field worth writing to a variant.
+func (i Info) Empty() bool {
+	for _, f := range fields {
+		if len(f.values(&i)) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Read sniffs and parses the metadata of the file at path.
+func Read(path string) (Info, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Info{}, err
+	}
+	defer f.Close()
+	head := make([]byte, imagetype.SniffLen)
+	n, _ := f.Read(head)
+	t, ok := imagetype.Detect(head[:n])
+	if !ok {
+		return Info{}, nil
+	}
+	raw, err := imagetype.ReadMetadata(f, t)
+	if err != nil {
+		return Info{}, err
+	}
+	return Parse(raw), nil
+}
+
+// Parse extracts Info from raw metadata blocks. Where blocks disagree XMP
+// wins over IPTC, and IPTC over EXIF.
+func Parse(raw imagetype.RawMetadata) Info {
+	var i Info
+	exif := parseEXIF(raw.EXIF)
+	i.Orientation = exif.Orientation
+	for _, src := range []Info{parseXMP(raw.XMP), parseIPTC(raw.IPTC), exif} {
+		for _, f := range fields {
+			if len(f.values(&i)) == 0 {
+				f.set(&i, f.values(&src))
+			}
+		}
+	}
+	return i
+}
+
+// EXIF tags read from and written to IFD0.
+const (
+	tagOrientation = 0x0112
+	tagArtist      = 0x013B
+	tagCopyright   = 0x8298
+)
+
+// parseEXIF reads the orientation, artist and copyright of a TIFF-structured
+// EXIF block. Only IFD0 is looked at.
+func parseEXIF(b []byte) Info {
+	var i Info
+	if len(b) < 8 {
+		return i
+	}
+	var bo binary.ByteOrder
+	switch string(b[:4]) {
+	case "II*\x00":
+		bo = binary.LittleEndian
+	case "MM\x00*":
+		bo = binary.BigEndian
+	default:
+		return i
+	}
+	ifd := int(bo.Uint32(b[4:]))
+	if ifd < 8 || ifd+2 > len(b) {
+		return i
+	}
+	n := int(bo.Uint16(b[ifd:]))
+	for k := 0; k < n; k++ {
+		e := ifd + 2 + 12*k
+		if e+12 > len(b) {
+			break
+		}
+		tag, typ, count := bo.Uint16(b[e:]), bo.Uint16(b[e+2:]), int(bo.Uint32(b[e+4:]))
+		switch {
+		case tag == tagOrientation && typ == 3:
+			i.Orientation = int(bo.Uint16(b[e+8:]))
+		case (tag == tagArtist || tag == tagCopyright) && typ == 2:
+			val := b[e+8 : e+12]
+			if count > 4 {
+				off := int(bo.Uint32(b[e+8:]))
+				if off < 0 || count < 0 || off+count > len(b) {
+					continue
+				}
+				val = b[off : off+count]
+			} else if count >= 0 {
+				val = val[:count]
+			}
+			// copyright may hold "photographer\0editor"; keep the first
+			s, _, _ := strings.Cut(string(val), "\x00")
+			s = strings.TrimSpace(s)
+			if s == "" {
+				continue
+			}
+			if tag == tagArtist {
+				i.Creator = []string{s}
+			} else {
+				i.Copyright = s
+			}
+		}
+	}
+	return i
+}
+
+// parseIPTC reads the datasets of fields from IPTC-IIM records.
+func parseIPTC(b []byte) Info {
+	var i Info
+	values := map[byte][]string{}
+	for len(b) >= 5 && b[0] == 0x1C {
+		rec, ds := b[1], b[2]
+		size := int(binary.BigEndian.Uint16(b[3:5]))
+		if size&0x8000 != 0 || 5+size > len(b) {
+			// extended-length datasets only carry binary data
+			break
+		}
+		v := strings.TrimSpace(iptcText(b[5 : 5+size]))
+		b = b[5+size:]
+		if rec == 2 && v != "" {
+			values[ds] = append(values[ds], v)
+		}
+	}
+	for _, f := range fields {
+		f.set(&i, values[f.iim])
+	}
+	return i
+}
+
+// iptcText decodes an IIM string: UTF-8 when valid, Latin-1 otherwise.
+func iptcText(b []byte) string {
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	r := make([]rune, len(b))
+	for k, c := range b {
+		r[k] = rune(c)
+	}
+	return string(r)
+}
+
+var (
+	rdfLi          = xml.Name{Space: nsRDF, Local: "li"}
+	rdfDescription = xml.Name{Space: nsRDF, Local: "Description"}
+)
+
+// parseXMP reads the properties of fields from an XMP packet, as elements
+// or as attributes of rdf:Description.
+func parseXMP(b []byte) Info {
+	props := map[xml.Name]bool{}
+	for _, f := range fields {
+		props[f.xmp] = true
+	}
+	values := map[xml.Name][]string{}
+	d := xml.NewDecoder(bytes.NewReader(b))
+	d.Strict = false
+	var (
+		prop xml.Name
+		text strings.Builder
+		lis  int
+	)
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch {
+			case prop.Local == "" && props[t.Name]:
+				prop, lis = t.Name, 0
+				text.Reset()
+			case prop.Local != "" && t.Name == rdfLi:
+				text.Reset()
+			case t.Name == rdfDescription:
+				for _, a := range t.Attr {
+					if props[a.Name] && strings.TrimSpace(a.Value) != "" {
+						values[a.Name] = append(values[a.Name], strings.TrimSpace(a.Value))
+					}
+				}
+			}
+		case xml.CharData:
+			if prop.Local != "" {
+				text.Write(t)
+			}
+		case xml.EndElement:
+			switch {
+			case prop.Local != "" && t.Name == rdfLi:
+				if v := strings.TrimSpace(text.String()); v != "" {
+					values[prop] = append(values[prop], v)
+				}
+				lis++
+				text.Reset()
+			case t.Name == prop:
+				if v := strings.TrimSpace(text.String()); lis == 0 && v != "" {
+					values[prop] = append(values[prop], v)
+				}
+				prop = xml.Name{}
+			}
+		}
+	}
+	var i Info
+	for _, f := range fields {
+		f.set(&i, values[f.xmp])
+	}
+	return i
+}
+
+// EXIF returns a big-endian TIFF block holding i's creator and copyright in
+// IFD0, or nil when it has neither; the other fields only exist in XMP and
+// IPTC. It carries no orientation: variants
+// are always upright.
+func (i Info) EXIF() []byte {
+	return i.exif(0)
+}
+
+// exif is EXIF with an orientation tag added when orientation is above 1.
+func (i Info) exif(orientation int) []byte {
+	type entry struct {
+		tag uint16
+		val string
+	}
+	var entries []entry
+	if orientation > 1 {
+		entries = append(entries, entry{tag: tagOrientation})
+	}
+	if len(i.Creator) > 0 {
+		entries = append(entries, entry{tagArtist, strings.Join(i.Creator, "; ")})
+	}
+	if i.Copyright != "" {
+		entries = append(entries, entry{tagCopyright, i.Copyright})
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	be := binary.BigEndian
+	dataAt := 8 + 2 + 12*len(entries) + 4
+	b := []byte("MM\x00*\x00\x00\x00\x08")
+	b = be.AppendUint16(b, uint16(len(entries)))
+	var data []byte
+	for _, e := range entries {
+		if e.tag == tagOrientation {
+			b = be.AppendUint16(b, e.tag)
+			b = be.AppendUint16(b, 3) // SHORT
+			b = be.AppendUint32(b, 1)
+			b = be.AppendUint16(b, uint16(orientation))
+			b = append(b, 0, 0)
+			continue
+		}
+		v := append([]byte(e.val), 0)
+		b = be.AppendUint16(b, e.tag)
+		b = be.AppendUint16(b, 2) // ASCII
+		b = be.AppendUint32(b, uint32(len(v)))
+		if len(v) <= 4 {
+			b = append(b, append(v, make([]byte, 4-len(v))...)...)
+			continue
+		}
+		b = be.AppendUint32(b, uint32(dataAt+len(data)))
+		data = append(data, v...)
+		if len(data)%2 == 1 {
+			data = append(data, 0)
+		}
+	}
+	b = be.AppendUint32(b, 0) // no next IFD
+	return append(b, data...)
+}
+
+// XMP returns an XMP packet with i's fields, or nil when i is Empty.
+func (i Info) XMP() []byte {
+	if i.Empty() {
+		return nil
+	}
+	esc := func(s string) string {
+		var b bytes.Buffer
+		_ = xml.EscapeText(&b, []byte(s))
+		return b.String()
+	}
+	prefixes := map[string]string{nsDC: "dc", nsPhotoshop: "photoshop", nsIptcCore: "Iptc4xmpCore"}
+	var b strings.Builder
+	b.WriteString("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	b.WriteString(`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="` + nsRDF + `">`)
+	b.WriteString(`<rdf:Description rdf:about="" xmlns:dc="` + nsDC + `" xmlns:photoshop="` + nsPhotoshop +
+		`" xmlns:Iptc4xmpCore="` + nsIptcCore + `" xmlns:xmpRights="` + nsRights + `">`)
+	for _, f := range fields {
+		vs := f.values(&i)
+		if len(vs) == 0 {
+			continue
+		}
+		name := prefixes[f.xmp.Space] + ":" + f.xmp.Local
+		b.WriteString("<" + name + ">")
+		switch f.array {
+		case "":
+			b.WriteString(esc(vs[0]))
+		case "Alt":
+			b.WriteString(`<rdf:Alt><rdf:li xml:lang="x-default">` + esc(vs[0]) + "</rdf:li></rdf:Alt>")
+		default:
+			b.WriteString("<rdf:" + f.array + ">")
+			for _, v := range vs {
+				b.WriteString("<rdf:li>" + esc(v) + "</rdf:li>")
+			}
+			b.WriteString("</rdf:" + f.array + ">")
+		}
+		b.WriteString("</" + name + ">")
+	}
+	if i.Copyright != "" {
+		b.WriteString("<xmpRights:Marked>True</xmpRights:Marked>")
+	}
+	b.WriteString("</rdf:Description></rdf:RDF></x:xmpmeta>\n<?xpacket end=\"w\"?>")
+	return []byte(b.String())
+}
+
+// iimMaxValue bounds a standard IIM dataset; longer values are dropped
+// from the IIM block (XMP still carries them).
+const iimMaxValue = 0x7FFF
+
+// IPTC returns i's fields as IPTC-IIM records, declaring UTF-8, or nil when
+// i is Empty.
+func (i Info) IPTC() []byte {
+	if i.Empty() {
+		return nil
+	}
+	// 1:90 coded character set: ESC % G is UTF-8
+	b := []byte{0x1C, 1, 90, 0, 3, 0x1B, '%', 'G'}
+	for _, f := range fields {
+		for _, v := range f.values(&i) {
+			if len(v) > iimMaxValue {
+				continue
+			}
+			b = append(b, 0x1C, 2, f.iim)
+			b = binary.BigEndian.AppendUint16(b, uint16(len(v)))
+			b = append(b, v...)
+		}
+	}
+	return b
+}
+
+// Photoshop returns i's IPTC records wrapped as the IPTC-NAA (0x0404)
+// Photoshop image resource, the payload of a JPEG APP13 segment after its
+// "Photoshop 3.0" header; nil when i is Empty.
+func (i Info) Photoshop() []byte {
+	iptc := i.IPTC()
+	if iptc == nil {
+		return nil
+	}
+	b := []byte("8BIM\x04\x04\x00\x00") // resource id, empty padded name
+	b = binary.BigEndian.AppendUint32(b, uint32(len(iptc)))
+	b = append(b, iptc...)
+	if len(iptc)%2 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// Embed returns an encoded JPEG, PNG or GIF with i's EXIF and XMP added:
+// as APP1 segments after SOI (with IPTC-IIM in an APP13 segment), eXIf and
+// iTXt chunks after IHDR, or an XMP application extension before the GIF
+// trailer (GIF has no EXIF). data must carry no metadata of its own.
+func Embed(data []byte, format string, i Info) ([]byte, error) {
+	return embed(data, format, i, i.EXIF())
+}
+
+// embed is Embed writing exif as the EXIF block.
+func embed(data []byte, format string, i Info, exif []byte) ([]byte, error) {
+	xmp := i.XMP()
+	if exif == nil && xmp == nil {
+		return data, nil
+	}
+	switch format {
+	case "jpeg", "jpg":
+		if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+			return nil, fmt.Errorf("metadata: not a jpeg")
+		}
+		out := append([]byte{}, data[:2]...)
+		for _, seg := range []struct {
+			marker byte
+			data   []byte
+		}{
+			{0xE1, appendNonNil([]byte("Exif\x00\x00"), exif)},
+			{0xE1, appendNonNil([]byte("http://ns.adobe.com/xap/1.0/\x00"), xmp)},
+			{0xED, appendNonNil([]byte("Photoshop 3.0\x00"), i.Photoshop())},
+		} {
+			if seg.data == nil {
+				continue
+			}
+			if len(seg.data) > 65533 {
+				return nil, fmt.Errorf("metadata: block too large for a jpeg segment")
+			}
+			out = append(out, 0xFF, seg.marker)
+			out = binary.BigEndian.AppendUint16(out, uint16(len(seg.data)+2))
+			out = append(out, seg.data...)
+		}
+		return append(out, data[2:]...), nil
+	case "png":
+		const ihdrEnd = 8 + 25
+		if len(data) < ihdrEnd || string(data[12:16]) != "IHDR" {
+			return nil, fmt.Errorf("metadata: not a png")
+		}
+		out := append([]byte{}, data[:ihdrEnd]...)
+		if exif != nil {
+			out = appendPNGChunk(out, "eXIf", exif)
+		}
+		if xmp != nil {
+			// keyword, uncompressed, no language tag or translated keyword
+			out = appendPNGChunk(out, "iTXt", append([]byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00"), xmp...))
+		}
+		return append(out, data[ihdrEnd:]...), nil
+	case "gif":
+		if len(data) < 7 || data[len(data)-1] != 0x3B || !bytes.HasPrefix(data, []byte("GIF8")) {
+			return nil, fmt.Errorf("metadata: not a gif")
+		}
+		if xmp == nil {
+			return data, nil
+		}
+		out := append([]byte{}, data[:len(data)-1]...)
+		out = append(out, 0x21, 0xFF, 0x0B)
+		out = append(out, "XMP DataXMP"...)
+		out = append(out, xmp...)
+		// the "magic trailer" lets readers that walk sub-blocks skip the
+		// raw packet: 0x01, 0xFF down to 0x00, then the block terminator
+		out = append(out, 0x01)
+		for c := 0xFF; c >= 0; c-- {
+			out = append(out, byte(c))
+		}
+		out = append(out, 0x00)
+		return append(out, 0x3B), nil
+	}
+	return nil, fmt.Errorf("metadata: can't embed metadata in %s", format)
+}
+
+// RewriteJPEG replaces the EXIF, XMP, IPTC and comment segments (APP1,
+// APP13 and COM) of the JPEG data with i's fields, for lossless transcodes
+// that keep the source's pixels. Their pixels aren't rotated, so unlike
+// Embed it keeps i.Orientation. The ICC profile and other segments stay.
+func RewriteJPEG(data []byte, i Info) ([]byte, error) {
+	stripped, err := stripJPEG(data)
+	if err != nil {
+		return nil, err
+	}
+	return embed(stripped, "jpeg", i, i.exif(i.Orientation))
+}
+
+// stripJPEG returns the JPEG data without its APP1, APP13 and COM segments.
+func stripJPEG(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, fmt.Errorf("metadata: not a jpeg")
+	}
+	out := append([]byte{}, data[:2]...)
+	b := data[2:]
+	for {
+		if len(b) < 4 || b[0] != 0xFF {
+			return nil, fmt.Errorf("metadata: malformed jpeg")
+		}
+		m := b[1]
+		if m == 0xDA { // start of scan: the rest is image data
+			return append(out, b...), nil
+		}
+		n := 2 + int(binary.BigEndian.Uint16(b[2:]))
+		if n < 4 || n > len(b) {
+			return nil, fmt.Errorf("metadata: malformed jpeg")
+		}
+		if m != 0xE1 && m != 0xED && m != 0xFE {
+			out = append(out, b[:n]...)
+		}
+		b = b[n:]
+	}
+}
+
+// appendNonNil returns prefix+b, or nil when b is nil.
+func appendNonNil(prefix, b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append(prefix, b...)
+}
+
+// appendPNGChunk appends a PNG chunk of type typ holding data to b.
+func appendPNGChunk(b []byte, typ string, data []byte) []byte {
+	body := append([]byte(typ), data...)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(data)))
+	b = append(b, body...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(body))
+}
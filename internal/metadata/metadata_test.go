@@ -0,0 +1,122 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"pixerver/internal/imagetype"
+)
+
+// testEXIF builds a little-endian EXIF block with an orientation, an
+// artist, a copyright and a GPS IFD pointer.
+func testEXIF(orientation int) []byte {
+	le := binary.LittleEndian
+	b := []byte("II*\x00\x08\x00\x00\x00")
+	b = le.AppendUint16(b, 4)
+	dataAt := uint32(8 + 2 + 4*12 + 4)
+	entry := func(tag, typ uint16, count, val uint32) {
+		b = le.AppendUint16(b, tag)
+		b = le.AppendUint16(b, typ)
+		b = le.AppendUint32(b, count)
+		b = le.AppendUint32(b, val)
+	}
+	entry(tagOrientation, 3, 1, uint32(orientation))
+	entry(tagArtist, 2, 4, le.Uint32([]byte("Ann\x00")))
+	entry(tagCopyright, 2, 13, dataAt)
+	entry(0x8825, 4, 1, dataAt+14)
+	b = le.AppendUint32(b, 0)
+	b = append(b, "(c) Ann 2024\x00\x00"...)
+	// GPS IFD with a latitude ref only
+	b = le.AppendUint16(b, 1)
+	entry(0x0001, 2, 2, le.Uint32([]byte("N\x00\x00\x00")))
+	return le.AppendUint32(b, 0)
+}
+
+func TestParse(t *testing.T) {
+	iptc := []byte{0x1C, 2, 80, 0, 5}
+	iptc = append(iptc, "Bobby"...)
+	iptc = append(iptc, 0x1C, 2, 110, 0, 4)
+	iptc = append(iptc, "Wire"...)
+	iptc = append(iptc, 0x1C, 2, 120, 0, 7)
+	iptc = append(iptc, "A quiet"...)
+	for _, k := range []string{"cat", "sofa"} {
+		iptc = append(iptc, 0x1C, 2, 25, 0, byte(len(k)))
+		iptc = append(iptc, k...)
+	}
+	xmp := []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+<rdf:Description rdf:about="" xmlns:photoshop="http://ns.adobe.com/photoshop/1.0/" xmlns:dc="http://purl.org/dc/elements/1.1/" photoshop:Source="Archive">
+<dc:rights><rdf:Alt><rdf:li xml:lang="x-default">XMP rights</rdf:li></rdf:Alt></dc:rights>
+</rdf:Description></rdf:RDF></x:xmpmeta>`)
+
+	got := Parse(imagetype.RawMetadata{EXIF: testEXIF(6), IPTC: iptc, XMP: xmp})
+	want := Info{Orientation: 6, Creator: []string{"Bobby"}, Copyright: "XMP rights", Credit: "Wire", Source: "Archive",
+		Caption: "A quiet", Keywords: []string{"cat", "sofa"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	if got := Parse(imagetype.RawMetadata{EXIF: testEXIF(1)}); got.Copyright != "(c) Ann 2024" || !reflect.DeepEqual(got.Creator, []string{"Ann"}) {
+		t.Fatalf("exif only: %+v", got)
+	}
+}
+
+func TestEmbedRoundTrip(t *testing.T) {
+	info := Info{Creator: []string{"Ann", "Bo"}, Copyright: "© Ann & Bo", Credit: "Wire", Source: "Archive",
+		Title: "Tom", Headline: "Cat naps", Caption: "Tom <asleep>", Keywords: []string{"cat", "sofa"}, City: "Oslo"}
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	encoders := map[string]func(*bytes.Buffer) error{
+		"jpeg": func(b *bytes.Buffer) error { return jpeg.Encode(b, img, nil) },
+		"png":  func(b *bytes.Buffer) error { return png.Encode(b, img) },
+		"gif":  func(b *bytes.Buffer) error { return gif.Encode(b, img, nil) },
+	}
+	dir := t.TempDir()
+	for format, encode := range encoders {
+		var buf bytes.Buffer
+		if err := encode(&buf); err != nil {
+			t.Fatal(err)
+		}
+		data, err := Embed(buf.Bytes(), format, info)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if _, _, err := image.Decode(bytes.NewReader(data)); err != nil {
+			t.Fatalf("%s: embedding broke the file: %v", format, err)
+		}
+		if format == "gif" {
+			if !bytes.Contains(data, info.XMP()) {
+				t.Fatalf("gif: xmp packet missing")
+			}
+			continue
+		}
+		p := filepath.Join(dir, "out."+format)
+		if err := os.WriteFile(p, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := Read(p)
+		if err != nil || !reflect.DeepEqual(got, info) {
+			t.Fatalf("%s: read back %+v (%v)", format, got, err)
+		}
+		if format == "jpeg" {
+			f, _ := os.Open(p)
+			raw, err := imagetype.ReadMetadata(f, imagetype.JPEG)
+			f.Close()
+			if got := parseIPTC(raw.IPTC); err != nil || !reflect.DeepEqual(got, info) {
+				t.Fatalf("jpeg iptc: read back %+v (%v)", got, err)
+			}
+		}
+	}
+
+	if got := parseEXIF(info.EXIF()); got.Copyright != info.Copyright || !reflect.DeepEqual(got.Creator, []string{"Ann; Bo"}) || got.Orientation != 0 {
+		t.Fatalf("exif: %+v", got)
+	}
+	if (Info{Orientation: 6}).EXIF() != nil || (Info{}).XMP() != nil || (Info{Orientation: 6}).IPTC() != nil {
+		t.Fatalf("empty info should produce no blocks")
+	}
+}
@@ -0,0 +1,63 @@
+package safehttp
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestAllowed(t *testing.T) {
+	for _, s := range []string{"127.0.0.1", "10.0.0.5", "169.254.169.254", "::1", "fd00::1", "::ffff:192.168.1.1"} {
+		if Allowed(netip.MustParseAddr(s), nil) {
+			t.Fatalf("expected %s to be denied", s)
+		}
+	}
+	for _, s := range []string{"93.184.216.34", "2606:4700::1"} {
+		if !Allowed(netip.MustParseAddr(s), nil) {
+			t.Fatalf("expected %s to be allowed", s)
+		}
+	}
+	allow, err := ParsePrefixes([]string{"127.0.0.0/8", "10.0.0.5"})
+	if err != nil {
+		t.Fatalf("ParsePrefixes: %v", err)
+	}
+	if !Allowed(netip.MustParseAddr("127.0.0.1"), allow) || !Allowed(netip.MustParseAddr("10.0.0.5"), allow) {
+		t.Fatalf("expected allowlisted addresses to pass")
+	}
+	if Allowed(netip.MustParseAddr("10.0.0.6"), allow) {
+		t.Fatalf("expected non-allowlisted private address to be denied")
+	}
+}
+
+func TestClientBlocksLoopback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	_, err := NewClient(Options{Timeout: 5 * time.Second}).Get(srv.URL)
+	if !errors.Is(err, ErrForbiddenAddress) {
+		t.Fatalf("expected forbidden address error, got %v", err)
+	}
+
+	allow, _ := ParsePrefixes([]string{"127.0.0.0/8", "::1"})
+	resp, err := NewClient(Options{Timeout: 5 * time.Second, Allow: allow}).Get(srv.URL)
+	if err != nil {
+		t.Fatalf("allowlisted request failed: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestClientRedirectCap(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, srv.URL+"/again", http.StatusFound)
+	}))
+	defer srv.Close()
+
+	allow, _ := ParsePrefixes([]string{"127.0.0.0/8", "::1"})
+	if _, err := NewClient(Options{Timeout: 5 * time.Second, MaxRedirects: 2, Allow: allow}).Get(srv.URL); err == nil {
+		t.Fatalf("expected redirect loop to be stopped")
+	}
+}
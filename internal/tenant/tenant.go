@@ -0,0 +1,34 @@
+package tenant
+
+import (
+	"context"
+	"errors"
+	"regexp"
+)
+
+type ctxKey struct{}
+
+var validID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// ErrInvalidID is returned for tenant ids that could escape their key prefix.
+var ErrInvalidID = errors.New("invalid tenant id")
+
+// Validate checks that id is safe to embed in a storage key prefix. Ids are
+// limited to letters, digits, '-' and '_' so "a" can never read "a:b".
+func Validate(id string) error {
+	if !validID.MatchString(id) {
+		return ErrInvalidID
+	}
+	return nil
+}
+
+// WithTenant returns a copy of ctx carrying the authenticated tenant id.
+func WithTenant(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, id)
+}
+
+// FromContext returns the tenant id stored by WithTenant, if any.
+func FromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(ctxKey{}).(string)
+	return id, ok && id != ""
+}
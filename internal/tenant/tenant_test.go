@@ -0,0 +1,29 @@
+package tenant
+
+import (
+	"context"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	for _, id := range []string{"acme", "acme-eu_1"} {
+		if err := Validate(id); err != nil {
+			t.Fatalf("expected %q to be valid: %v", id, err)
+		}
+	}
+	for _, id := range []string{"", "a:b", "a/b", "a b"} {
+		if err := Validate(id); err == nil {
+			t.Fatalf("expected %q to be rejected", id)
+		}
+	}
+}
+
+func TestContextRoundTrip(t *testing.T) {
+	if _, ok := FromContext(context.Background()); ok {
+		t.Fatalf("expected no tenant on empty context")
+	}
+	ctx := WithTenant(context.Background(), "acme")
+	if id, ok := FromContext(ctx); !ok || id != "acme" {
+		t.Fatalf("unexpected tenant %q %v", id, ok)
+	}
+}
@@ -0,0 +1,134 @@
+package encoders
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"strings"
+
+	"pixerver/logger"
+)
+
+// autoFormats are the candidates "auto" tries when no "formats" setting is
+// given.
+var autoFormats = []string{"avif", "webp", "jpg"}
+
+// HandleAuto encodes input in several formats and keeps the smallest.
+// Settings are passed to every candidate, so a "targetSSIM" setting (rather
+// than a per-format quality) is the way to hold them to the same visual
+// quality; candidates whose search fell short of the target only win when
+// none reached it. Supported settings, besides those of the candidates:
+//   - formats: comma-separated candidate encoders (default avif,webp,jpg)
+//   - fallback: an encoder whose output is always kept as well (default
+//     jpg, "none" to keep only the winner)
+//
+// It returns the winner's path. Candidate sizes and the fallback's path
+// are recorded for ReadOutcome.
+func HandleAuto(input string, settings map[string]string) (string, error) {
+	formats := autoFormats
+	if f := settings["formats"]; f != "" {
+		formats = strings.Split(f, ",")
+	}
+	fallback := "jpg"
+	if f, ok := settings["fallback"]; ok {
+		fallback = f
+	}
+	if fallback == "none" {
+		fallback = ""
+	}
+	fallback = canonical(fallback)
+	if fallback != "" && !containsFormat(formats, fallback) {
+		formats = append(formats, fallback)
+	}
+
+	type candidate struct {
+		name, out string
+		bytes     int64
+		short     bool
+	}
+	_, targeted := settings["targetSSIM"]
+	var cands []candidate
+	sizes := map[string]int64{}
+	for _, f := range formats {
+		f = canonical(strings.TrimSpace(f))
+		h, ok := encoders[f]
+		if !ok || f == "auto" {
+			return "", fmt.Errorf("auto: unknown candidate format %q", f)
+		}
+		s := maps.Clone(settings)
+		s["label"] = "auto"
+		delete(s, "format")
+		out, err := h(input, s)
+		if err != nil {
+			// a missing delegate shouldn't sink the whole job
+			logger.Warnf("auto: %s candidate failed: %v", f, err)
+			continue
+		}
+		n, err := fileSize(out)
+		if err != nil {
+			return "", err
+		}
+		o, _ := ReadOutcome(out)
+		cands = append(cands, candidate{name: f, out: out, bytes: n, short: targeted && o.SSIM < targetOf(settings)})
+		sizes[f] = n
+	}
+	if len(cands) == 0 {
+		return "", fmt.Errorf("auto: no candidate format could be encoded")
+	}
+
+	best := -1
+	for i, c := range cands {
+		if best < 0 || (cands[best].short && !c.short) || (c.short == cands[best].short && c.bytes < cands[best].bytes) {
+			best = i
+		}
+	}
+	var alternates []string
+	for i, c := range cands {
+		switch {
+		case i == best:
+		case c.name == fallback:
+			alternates = append(alternates, c.out)
+		default:
+			_ = os.Remove(c.out)
+			_ = os.Remove(outcomePath(c.out))
+		}
+	}
+	win := cands[best]
+	logger.Debugf("auto: kept %s (%d bytes) of %v", win.name, win.bytes, sizes)
+
+	o, _ := ReadOutcome(win.out)
+	o.Candidates = sizes
+	o.Alternates = alternates
+	if err := writeOutcome(win.out, o); err != nil {
+		return "", err
+	}
+	return win.out, nil
+}
+
+func containsFormat(formats []string, name string) bool {
+	for _, f := range formats {
+		if canonical(strings.TrimSpace(f)) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// targetOf returns the targetSSIM setting, 0 when unset or invalid.
+func targetOf(settings map[string]string) float64 {
+	t, _, _ := targetSetting(settings)
+	return t
+}
+
+// eachBatch runs h once per variant, for encoders that can't share a
+// decode.
+func eachBatch(h Handler) BatchHandler {
+	return func(input string, settings []map[string]string) ([]string, []error) {
+		outs := make([]string, len(settings))
+		errs := make([]error, len(settings))
+		for i, s := range settings {
+			outs[i], errs[i] = h(input, s)
+		}
+		return outs, errs
+	}
+}
@@ -0,0 +1,224 @@
+package encoders
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"strconv"
+
+	"pixerver/internal/geometry"
+	"pixerver/logger"
+)
+
+// ErrOverBudget is returned when no allowed quality and size brings a
+// variant under its "maxBytes" budget.
+var ErrOverBudget = errors.New("output exceeds maxBytes")
+
+// defaultQuality is the quality each lossy encoder uses when none is set;
+// these are the encoders a "maxBytes" budget applies to.
+var defaultQuality = map[string]int{"jpg": 80, "webp": 80, "avif": 50, "heic": 50, "jxl": 90}
+
+// budgetSetting parses "maxBytes"; ok is false when it is unset.
+func budgetSetting(settings map[string]string) (int64, bool, error) {
+	v := settings["maxBytes"]
+	if v == "" {
+		return 0, false, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, false, fmt.Errorf("invalid maxBytes %q", v)
+	}
+	return n, true, nil
+}
+
+// startQuality is the quality settings ask name to encode at.
+func startQuality(name string, settings map[string]string) int {
+	q := intSetting(settings, "quality", defaultQuality[name], 0, 100)
+	if name == "jxl" {
+		if boolSetting(settings, "lossless", false) {
+			return 100
+		}
+		if d, err := strconv.ParseFloat(settings["distance"], 64); err == nil {
+			return distanceToQuality(d)
+		}
+	}
+	return q
+}
+
+// withBudget wraps first so variants with a "maxBytes" setting are
+// re-encoded through h at lower quality, and optionally smaller, until
+// they fit.
+func withBudget(name string, first, h Handler) Handler {
+	return func(input string, settings map[string]string) (string, error) {
+		limit, ok, err := budgetSetting(settings)
+		switch {
+		case err != nil:
+			return "", err
+		case !ok:
+			return first(input, settings)
+		}
+		if _, lossy := defaultQuality[name]; !lossy {
+			return "", fmt.Errorf("maxBytes is not supported by the %s encoder", name)
+		}
+		return fitBudget(name, input, settings, limit, first, h)
+	}
+}
+
+// fitBudget encodes input through first and, when the result is over
+// limit bytes, searches for the highest quality between the "minQuality"
+// setting (default 30) and the starting quality that fits. With
+// "maxBytesResize" set, the output size is then stepped down by 10% at a
+// time to the "minScale" setting (percent, default 50) until some quality
+// fits. The final quality and scale are recorded for ReadOutcome; if
+// nothing fits, every candidate is removed and ErrOverBudget is returned.
+func fitBudget(name, input string, settings map[string]string, limit int64, first, encode Handler) (string, error) {
+	out, err := first(input, settings)
+	if err != nil {
+		return "", err
+	}
+	start := startQuality(name, settings)
+	prev, _ := ReadOutcome(out)
+	if prev.Quality > 0 {
+		start = prev.Quality
+	}
+	size, err := fileSize(out)
+	if err != nil {
+		return "", err
+	}
+	if size <= limit {
+		return out, writeOutcome(out, Outcome{Quality: start, SSIM: prev.SSIM})
+	}
+
+	candidates := map[string]bool{out: true}
+	discard := func(keep string) {
+		for c := range candidates {
+			if c != keep {
+				_ = os.Remove(c)
+				_ = os.Remove(outcomePath(c))
+			}
+		}
+	}
+
+	base := maps.Clone(settings)
+	// the search sets quality directly
+	for _, k := range []string{"targetSSIM", "distance", "lossless"} {
+		delete(base, k)
+	}
+	floor := intSetting(settings, "minQuality", 30, 1, 100)
+	failQ := start
+	try := func(s map[string]string, q int) (string, int64, error) {
+		s["quality"] = strconv.Itoa(q)
+		out, err := encode(input, s)
+		if err != nil {
+			return "", 0, err
+		}
+		candidates[out] = true
+		n, err := fileSize(out)
+		logger.Debugf("%s byte budget: quality=%d size=%d limit=%d", name, q, n, limit)
+		return out, n, err
+	}
+
+	for _, scale := range budgetScales(input, base) {
+		s := maps.Clone(base)
+		hi := start - 1
+		if scale.factor != 1 {
+			// the variant keeps its requested size's name
+			s["scaledWidth"], s["scaledHeight"] = strconv.Itoa(scale.width), strconv.Itoa(scale.height)
+			hi = start
+		}
+		if hi < floor {
+			continue
+		}
+		if _, size, err = try(s, floor); err != nil {
+			discard("")
+			return "", err
+		}
+		failQ = floor
+		if size > limit {
+			continue
+		}
+		best, last := floor, floor
+		for l, h := floor+1, hi; l <= h; {
+			q := (l + h) / 2
+			if _, size, err = try(s, q); err != nil {
+				discard("")
+				return "", err
+			}
+			last = q
+			if size <= limit {
+				best, l = q, q+1
+			} else {
+				h = q - 1
+			}
+		}
+		// every candidate is written to the variant's file, so re-encode
+		// the winner
+		if last != best {
+			if out, _, err = try(s, best); err != nil {
+				discard("")
+				return "", err
+			}
+		} else {
+			out, _ = VariantPath(name, input, s)
+		}
+		discard(out)
+		o := Outcome{Quality: best}
+		if scale.factor != 1 {
+			o.Scale = scale.factor
+		}
+		return out, writeOutcome(out, o)
+	}
+	discard("")
+	return "", fmt.Errorf("cannot fit %s variant into %d bytes: %d bytes at quality %d: %w", name, limit, size, failQ, ErrOverBudget)
+}
+
+// budgetScale is one output size a maxBytes search may fall back to.
+type budgetScale struct {
+	factor        float64
+	width, height int
+}
+
+// budgetScales lists the sizes fitBudget tries: the requested one, then,
+// with "maxBytesResize" set, 10% steps down to "minScale" percent of the
+// planned output size.
+func budgetScales(input string, settings map[string]string) []budgetScale {
+	scales := []budgetScale{{factor: 1}}
+	if !boolSetting(settings, "maxBytesResize", false) {
+		return scales
+	}
+	spec, err := geometry.FromSettings(settings)
+	if err != nil {
+		return scales
+	}
+	in, cleanup, err := decodeInput(input)
+	if err != nil {
+		return scales
+	}
+	srcW, srcH := sourceSize(in)
+	cleanup()
+	if srcW == 0 || srcH == 0 {
+		logger.Warnf("byte budget: size of %s unknown, not resizing", input)
+		return scales
+	}
+	p := spec.Plan(srcW, srcH)
+	minScale := intSetting(settings, "minScale", 50, 1, 100)
+	for pct := 90; pct >= minScale; pct -= 10 {
+		f := float64(pct) / 100
+		scales = append(scales, budgetScale{
+			factor: f,
+			width:  max(1, int(math.Round(float64(p.CanvasW)*f))),
+			height: max(1, int(math.Round(float64(p.CanvasH)*f))),
+		})
+	}
+	return scales
+}
+
+func fileSize(p string) (int64, error) {
+	st, err := os.Stat(p)
+	if err != nil {
+		return 0, err
+	}
+	return st.Size(), nil
+}
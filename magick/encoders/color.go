@@ -0,0 +1,171 @@
+package encoders
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"pixerver/internal/imagetype"
+	"pixerver/logger"
+	"pixerver/native"
+)
+
+// wideGamutFormats are the encoders that can keep a source's own profile
+// when "colorProfile" is "preserve".
+var wideGamutFormats = map[string]bool{"avif": true, "webp": true}
+
+// colorMode validates the "colorProfile" setting: "srgb" (default) converts
+// every variant to sRGB, "preserve" keeps the source's profile on formats
+// in wideGamutFormats and converts the rest.
+func colorMode(settings map[string]string) (string, error) {
+	switch m := settings["colorProfile"]; m {
+	case "", "srgb":
+		return "srgb", nil
+	case "preserve":
+		return m, nil
+	default:
+		return "", fmt.Errorf("invalid colorProfile %q: want srgb or preserve", m)
+	}
+}
+
+// sourceProfile returns the ICC profile embedded in an ImageMagick input
+// argument, ignoring any frame selector; nil when it has none.
+func sourceProfile(input string) []byte {
+	if i := strings.LastIndexByte(input, '['); i > 0 && strings.HasSuffix(input, "]") {
+		input = input[:i]
+	}
+	t, ok := sourceType(input)
+	if !ok {
+		return nil
+	}
+	f, err := os.Open(input)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	p, err := imagetype.ICCProfile(f, t)
+	if err != nil {
+		logger.Warnf("reading icc profile of %s failed: %v", input, err)
+		return nil
+	}
+	return p
+}
+
+var (
+	srgbFileOnce sync.Once
+	srgbFile     string
+	srgbFileErr  error
+)
+
+// srgbProfilePath writes native.SRGBProfile to the temp directory once and
+// returns its path, for ImageMagick's -profile.
+func srgbProfilePath() (string, error) {
+	srgbFileOnce.Do(func() {
+		p := native.SRGBProfile()
+		name := filepath.Join(os.TempDir(), fmt.Sprintf("pixerver-srgb-%08x.icc", crc32.ChecksumIEEE(p)))
+		if st, err := os.Stat(name); err == nil && st.Size() == int64(len(p)) {
+			srgbFile = name
+			return
+		}
+		tmp, err := os.CreateTemp(filepath.Dir(name), "pixerver-srgb-*.tmp")
+		if err != nil {
+			srgbFileErr = err
+			return
+		}
+		_, err = tmp.Write(p)
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), name)
+		}
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+			srgbFileErr = err
+			return
+		}
+		srgbFile = name
+	})
+	return srgbFile, srgbFileErr
+}
+
+// colorArgs returns the ImageMagick operators that bring input to the color
+// space settings ask for: before go right after decoding, after follow the
+// format options (and so any -strip). Sources with a profile are converted
+// through it; ones without are assumed sRGB, except CMYK, which is
+// converted without one. The result carries the compact sRGB profile only
+// when "embedProfile" is set.
+func colorArgs(name, input string, settings map[string]string) (before, after []string, err error) {
+	mode, err := colorMode(settings)
+	if err != nil {
+		return nil, nil, err
+	}
+	p := sourceProfile(input)
+	if mode == "preserve" && p != nil {
+		if wideGamutFormats[name] {
+			return nil, nil, nil
+		}
+		logger.Debugf("%s encoder can't preserve the source profile, converting to sRGB", name)
+	}
+	srgb, err := srgbProfilePath()
+	if err != nil {
+		return nil, nil, fmt.Errorf("writing srgb profile: %w", err)
+	}
+	if p != nil {
+		before = []string{"-profile", srgb}
+	} else {
+		before = []string{"-colorspace", "sRGB"}
+	}
+	if boolSetting(settings, "embedProfile", false) {
+		after = []string{"-profile", srgb}
+	} else {
+		after = []string{"+profile", "icc"}
+	}
+	return before, after, nil
+}
+
+// nativeToSRGB converts a decoded native source to sRGB through the ICC
+// profile embedded in input. Profiles ToSRGB can't apply leave img as the
+// standard decoders returned it, which for CMYK is a naive conversion.
+func nativeToSRGB(input string, img image.Image) image.Image {
+	p := sourceProfile(input)
+	if p == nil {
+		return img
+	}
+	out, err := native.ToSRGB(img, p)
+	if errors.Is(err, native.ErrUnsupportedProfile) {
+		logger.Debugf("native: %s profile of %s not applied", native.ProfileColorSpace(p), input)
+		return img
+	} else if err != nil {
+		logger.Warnf("native: applying icc profile of %s failed: %v", input, err)
+		return img
+	}
+	return out
+}
+
+// withProfile wraps a native encode so the compact sRGB profile is embedded
+// in its output when "embedProfile" is set.
+func withProfile(format string, settings map[string]string, encode func(io.Writer) error) func(io.Writer) error {
+	if !boolSetting(settings, "embedProfile", false) {
+		return encode
+	}
+	return func(w io.Writer) error {
+		var buf bytes.Buffer
+		if err := encode(&buf); err != nil {
+			return err
+		}
+		data, err := native.EmbedICC(buf.Bytes(), format, native.SRGBProfile())
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+}
@@ -0,0 +1,125 @@
+package encoders
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"pixerver/logger"
+)
+
+// magickBin finds the ImageMagick binary (magick v7, falling back to
+// convert).
+func magickBin() (string, error) {
+	bin, err := exec.LookPath("magick")
+	if err != nil {
+		bin, err = exec.LookPath("convert")
+		if err != nil {
+			return "", fmt.Errorf("image magick not found (tried 'magick' and 'convert'): %w", err)
+		}
+	}
+	return bin, nil
+}
+
+// intSetting parses settings[key], returning def when it is missing or not
+// an integer within [min, max].
+func intSetting(settings map[string]string, key string, def, min, max int) int {
+	v, ok := settings[key]
+	if !ok {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < min || n > max {
+		logger.Warnf("invalid %s %q, using %d", key, v, def)
+		return def
+	}
+	return n
+}
+
+// boolSetting reports settings[key] as a boolean, def when unset.
+func boolSetting(settings map[string]string, key string, def bool) bool {
+	switch settings[key] {
+	case "true", "1":
+		return true
+	case "false", "0":
+		return false
+	}
+	return def
+}
+
+// size returns the requested width and height (0 when unset).
+func size(settings map[string]string) (int, int) {
+	w, _ := strconv.Atoi(settings["width"])
+	h, _ := strconv.Atoi(settings["height"])
+	return w, h
+}
+
+// ditherOn reports whether the "dither" setting asks for dithering; it
+// defaults to on.
+func ditherOn(settings map[string]string) bool {
+	switch settings["dither"] {
+	case "none", "false", "0":
+		return false
+	}
+	return true
+}
+
+// ditherArgs maps the "dither" setting to ImageMagick options:
+// "none", "floyd-steinberg" (default) or "riemersma".
+func ditherArgs(settings map[string]string) []string {
+	if !ditherOn(settings) {
+		return []string{"+dither"}
+	}
+	switch settings["dither"] {
+	case "riemersma":
+		return []string{"-dither", "Riemersma"}
+	default:
+		return []string{"-dither", "FloydSteinberg"}
+	}
+}
+
+// execMagick runs bin with args.
+func execMagick(format, bin string, args []string) error {
+	out, err := exec.Command(bin, args...).CombinedOutput()
+	if err != nil {
+		logger.Errorf("%s conversion failed: %v output=%s", format, err, string(out))
+		return fmt.Errorf("%s conversion failed: %v: %s", format, err, string(out))
+	}
+	return nil
+}
+
+// tmpFor reserves a uniquely named temp file next to outName for a tool to
+// write the variant into, so concurrent encodes of the same variant never
+// share one.
+func tmpFor(outName string) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(outName), filepath.Base(outName)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// moveIntoPlace renames tmp to outName with src's file mode.
+func moveIntoPlace(format, src, tmp, outName string) (string, error) {
+	if st, err := os.Stat(src); err == nil {
+		_ = os.Chmod(tmp, st.Mode())
+	}
+	if err := os.Rename(tmp, outName); err != nil {
+		_ = os.Remove(tmp)
+		return "", fmt.Errorf("failed to move %s output into place: %v", format, err)
+	}
+	logger.Debugf("%s created: %s", format, outName)
+	return outName, nil
+}
+
+// runMagick runs bin with args, whose last element must write tmp, then
+// moves tmp to outName with src's file mode.
+func runMagick(format, bin string, args []string, src, tmp, outName string) (string, error) {
+	if err := execMagick(format, bin, args); err != nil {
+		_ = os.Remove(tmp)
+		return "", err
+	}
+	return moveIntoPlace(format, src, tmp, outName)
+}
@@ -1,7 +1,24 @@
 package encoders
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+
+	"pixerver/internal/imagetype"
+	"pixerver/internal/metadata"
+	"pixerver/native"
 )
 
 // Quick compile-time check: ensure the encoder package exposes handlers.
@@ -10,3 +27,759 @@ func TestEncoderSymbols(t *testing.T) {
 	// and are present. We won't execute ImageMagick during tests.
 	_ = HandleJPEG
 }
+
+func TestLimitArgs(t *testing.T) {
+	t.Setenv("MAGICK_LIMIT_MEMORY", "64MiB")
+	args := limitArgs()
+	if len(args) != 3*len(resourceLimits) {
+		t.Fatalf("unexpected args: %v", args)
+	}
+	if args[0] != "-limit" || args[1] != "memory" || args[2] != "64MiB" {
+		t.Fatalf("expected env override for memory, got %v", args[:3])
+	}
+}
+
+func TestGetAndVariantPath(t *testing.T) {
+	if _, ok := Get("jpeg"); !ok {
+		t.Fatalf("expected jpeg alias to resolve")
+	}
+	if _, ok := Get("bmp"); ok {
+		t.Fatalf("expected unknown encoder to be missing")
+	}
+	p, ok := VariantPath("webp", "uploads/abc.png", map[string]string{"width": "400", "height": "300"})
+	if !ok || p != "uploads/abc_400_300.webp" {
+		t.Fatalf("unexpected variant path %q", p)
+	}
+	p, _ = VariantPath("jpeg", "uploads/abc.png", nil)
+	if p != "uploads/abc_orig.jpg" {
+		t.Fatalf("unexpected variant path %q", p)
+	}
+}
+
+// requireMagick skips the test when no ImageMagick binary is installed.
+func requireMagick(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("magick"); err == nil {
+		return
+	}
+	if _, err := exec.LookPath("convert"); err != nil {
+		t.Skip("imagemagick not installed")
+	}
+}
+
+// requireDelegate skips the test unless ImageMagick can write format.
+func requireDelegate(t *testing.T, format string) {
+	t.Helper()
+	requireMagick(t)
+	if !magickCan(format, 'w') {
+		t.Skipf("imagemagick has no %s write delegate", format)
+	}
+}
+
+// writeTestJPEG writes a w x h gradient JPEG to dir and returns its path.
+func writeTestJPEG(t *testing.T, dir string, w, h int) string {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), uint8(x + y), 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	p := filepath.Join(dir, "source.jpg")
+	if err := os.WriteFile(p, buf.Bytes(), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	return p
+}
+
+// Regression: HandleJPEG used to rename its output over the source, so later
+// jobs for the same upload encoded from an already downscaled copy.
+func TestHandleJPEGLeavesSourceUntouched(t *testing.T) {
+	requireMagick(t)
+	src := writeTestJPEG(t, t.TempDir(), 256, 192)
+	orig, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sizes := [][2]string{{"64", "48"}, {"128", "96"}, {"200", "150"}}
+	seen := map[string]bool{}
+	for _, sz := range sizes {
+		settings := map[string]string{"width": sz[0], "height": sz[1], "quality": "70"}
+		out, err := HandleJPEG(src, settings)
+		if err != nil {
+			t.Fatalf("HandleJPEG %sx%s: %v", sz[0], sz[1], err)
+		}
+		want, _ := VariantPath("jpg", src, settings)
+		if out != want {
+			t.Fatalf("output %q, want %q", out, want)
+		}
+		if out == src || seen[out] {
+			t.Fatalf("output %q is not a distinct variant", out)
+		}
+		seen[out] = true
+		if _, err := os.Stat(out); err != nil {
+			t.Fatalf("variant missing: %v", err)
+		}
+	}
+
+	after, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(orig, after) {
+		t.Fatalf("source file was modified by HandleJPEG")
+	}
+}
+
+func TestSettingHelpers(t *testing.T) {
+	s := map[string]string{"colors": "64", "bad": "x", "big": "999", "optimize": "1"}
+	if intSetting(s, "colors", 256, 2, 256) != 64 {
+		t.Fatalf("expected parsed colors")
+	}
+	if intSetting(s, "bad", 7, 0, 9) != 7 || intSetting(s, "big", 7, 0, 9) != 7 || intSetting(s, "missing", 7, 0, 9) != 7 {
+		t.Fatalf("expected defaults for invalid or missing values")
+	}
+	if !boolSetting(s, "optimize", false) || boolSetting(s, "missing", false) {
+		t.Fatalf("unexpected bool settings")
+	}
+	if got := ditherArgs(map[string]string{"dither": "none"}); len(got) != 1 || got[0] != "+dither" {
+		t.Fatalf("unexpected dither args %v", got)
+	}
+}
+
+func TestPNGAndGIFVariants(t *testing.T) {
+	requireMagick(t)
+	src := writeTestJPEG(t, t.TempDir(), 120, 90)
+	cases := []struct {
+		name     string
+		enc      Handler
+		settings map[string]string
+		magic    string
+	}{
+		{"png", HandlePNG, map[string]string{"width": "60", "height": "45", "colors": "32", "interlace": "true"}, "\x89PNG"},
+		{"gif", HandleGIF, map[string]string{"width": "60", "height": "45", "colors": "16", "dither": "none"}, "GIF8"},
+	}
+	for _, c := range cases {
+		out, err := c.enc(src, c.settings)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		want, _ := VariantPath(c.name, src, c.settings)
+		if out != want {
+			t.Fatalf("%s: output %q, want %q", c.name, out, want)
+		}
+		b, err := os.ReadFile(out)
+		if err != nil || !bytes.HasPrefix(b, []byte(c.magic)) {
+			t.Fatalf("%s: output is not a %s file (err=%v)", c.name, c.name, err)
+		}
+	}
+}
+
+func TestDistanceToQuality(t *testing.T) {
+	// any nonzero distance stays lossy
+	cases := map[float64]int{0: 100, 0.01: 99, 0.1: 99, 1.0: 90, 6.4: 30, 25: 0}
+	for d, want := range cases {
+		if got := distanceToQuality(d); got != want {
+			t.Fatalf("distanceToQuality(%v) = %d, want %d", d, got, want)
+		}
+	}
+}
+
+func TestJXLVariant(t *testing.T) {
+	requireDelegate(t, "JXL")
+	src := writeTestJPEG(t, t.TempDir(), 120, 90)
+	for _, settings := range []map[string]string{
+		{"width": "60", "height": "45", "distance": "1.5", "effort": "3"},
+		{"width": "30", "height": "20", "lossless": "true", "effort": "1"},
+	} {
+		out, err := HandleJXL(src, settings)
+		if err != nil {
+			t.Fatalf("HandleJXL(%v): %v", settings, err)
+		}
+		b, err := os.ReadFile(out)
+		// bare codestream or ISOBMFF container
+		if err != nil || !(bytes.HasPrefix(b, []byte{0xFF, 0x0A}) || bytes.HasPrefix(b, []byte("\x00\x00\x00\x0cJXL "))) {
+			t.Fatalf("output %s is not JPEG XL (err=%v)", out, err)
+		}
+	}
+	if _, err := HandleJXL(src, map[string]string{"width": "10", "losslessJpeg": "true"}); err == nil {
+		t.Fatalf("expected losslessJpeg with resize to fail")
+	}
+}
+
+func TestDecodeInputPassesThroughNonHEIC(t *testing.T) {
+	src := writeTestJPEG(t, t.TempDir(), 8, 8)
+	in, cleanup, err := decodeInput(src)
+	defer cleanup()
+	if err != nil || in != src {
+		t.Fatalf("decodeInput(%q) = %q, %v", src, in, err)
+	}
+}
+
+func TestHEICRoundTrip(t *testing.T) {
+	requireDelegate(t, "HEIC")
+	src := writeTestJPEG(t, t.TempDir(), 128, 96)
+	out, err := HandleHEIC(src, map[string]string{"width": "64", "height": "48", "chroma": "444", "quality": "60"})
+	if err != nil {
+		t.Fatalf("HandleHEIC: %v", err)
+	}
+	if typ, ok := sourceType(out); !ok || typ.Name != "heic" {
+		t.Fatalf("output %s sniffed as %+v", out, typ)
+	}
+	// and HEIC back in as a source
+	jpg, err := HandleJPEG(out, map[string]string{"width": "32", "height": "24"})
+	if err != nil {
+		t.Fatalf("HandleJPEG from heic: %v", err)
+	}
+	if typ, _ := sourceType(jpg); typ.Name != "jpeg" {
+		t.Fatalf("expected jpeg output, got %+v", typ)
+	}
+	if _, err := HandleHEIC(src, map[string]string{"chroma": "411"}); err == nil {
+		t.Fatalf("expected invalid chroma to fail")
+	}
+}
+
+func TestEngineSelection(t *testing.T) {
+	t.Setenv("ENCODER_ENGINE", "magick")
+	t.Setenv("ENCODER_ENGINE_PNG", "native")
+	if e := engineFor("jpg", nil); e != "magick" {
+		t.Fatalf("expected global engine, got %q", e)
+	}
+	if e := engineFor("png", nil); e != "native" {
+		t.Fatalf("expected per-encoder engine, got %q", e)
+	}
+	if e := engineFor("png", map[string]string{"engine": "magick"}); e != "magick" {
+		t.Fatalf("expected setting to win, got %q", e)
+	}
+	h, _ := Get("webp")
+	if _, err := h("x.png", map[string]string{"engine": "native"}); err == nil {
+		t.Fatalf("expected native webp to be rejected")
+	}
+}
+
+func TestNativeEngineVariants(t *testing.T) {
+	src := writeTestJPEG(t, t.TempDir(), 200, 100)
+	orig, _ := os.ReadFile(src)
+	cases := []struct {
+		enc      string
+		settings map[string]string
+		w, h     int
+	}{
+		{"jpg", map[string]string{"width": "100", "height": "100", "quality": "70"}, 100, 50},
+		{"png", map[string]string{"width": "50", "height": "0", "colors": "16"}, 50, 25},
+		{"gif", map[string]string{"width": "40", "height": "40", "filter": "catmullrom"}, 40, 20},
+	}
+	for _, c := range cases {
+		c.settings["engine"] = "native"
+		h, _ := Get(c.enc)
+		out, err := h(src, c.settings)
+		if err != nil {
+			t.Fatalf("%s: %v", c.enc, err)
+		}
+		want, _ := VariantPath(c.enc, src, c.settings)
+		if out != want {
+			t.Fatalf("%s: output %q, want %q", c.enc, out, want)
+		}
+		f, err := os.Open(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, format, err := image.DecodeConfig(f)
+		f.Close()
+		if err != nil || cfg.Width != c.w || cfg.Height != c.h {
+			t.Fatalf("%s: got %s %dx%d (err=%v), want %dx%d", c.enc, format, cfg.Width, cfg.Height, err, c.w, c.h)
+		}
+	}
+	after, _ := os.ReadFile(src)
+	if !bytes.Equal(orig, after) {
+		t.Fatalf("source modified by native engine")
+	}
+}
+
+func TestResizeArgs(t *testing.T) {
+	cases := []struct {
+		settings map[string]string
+		want     string
+	}{
+		{map[string]string{"width": "100", "height": "100"}, "-resize 100x50!"},
+		{map[string]string{"width": "400", "height": "400"}, ""},
+		{map[string]string{"width": "50", "height": "50", "resize": "cover", "gravity": "west"}, "-resize 100x50! -crop 50x50+0+0 +repage"},
+		{map[string]string{"width": "100", "height": "100", "resize": "pad", "background": "white"}, "-resize 100x50! -background #ffffffff -extent 100x100+0-25"},
+	}
+	for _, c := range cases {
+		args, err := resizeArgs(c.settings, 200, 100)
+		if err != nil || strings.Join(args, " ") != c.want {
+			t.Fatalf("%v: got %q (err=%v), want %q", c.settings, strings.Join(args, " "), err, c.want)
+		}
+	}
+	// unknown source size falls back to ImageMagick geometry flags
+	args, _ := resizeArgs(map[string]string{"width": "300"}, 0, 0)
+	if strings.Join(args, " ") != "-resize 300x>" {
+		t.Fatalf("unexpected fallback args %q", args)
+	}
+	if _, err := resizeArgs(map[string]string{"width": "10", "resize": "zoom"}, 200, 100); err == nil {
+		t.Fatalf("expected error for unknown mode")
+	}
+}
+
+func TestVariantPathModeSuffix(t *testing.T) {
+	p, _ := VariantPath("png", "/x/src.jpg", map[string]string{"width": "40", "height": "40", "resize": "cover", "gravity": "north"})
+	if p != "/x/src_40_40_cover-north.png" {
+		t.Fatalf("unexpected path %q", p)
+	}
+	p, _ = VariantPath("png", "/x/src.jpg", map[string]string{"width": "40", "height": "40", "resize": "fit", "density": "1"})
+	if p != "/x/src_40_40.png" {
+		t.Fatalf("plain 1x fit should keep the old name, got %q", p)
+	}
+	p, _ = VariantPath("png", "/x/src.jpg", map[string]string{"width": "80", "height": "80", "density": "2"})
+	if p != "/x/src_80_80@2x.png" {
+		t.Fatalf("unexpected density path %q", p)
+	}
+	p, _ = VariantPath("png", "/x/src.jpg", map[string]string{"width": "80", "height": "80", "density": "2", "variant": "3f9a0c12"})
+	if p != "/x/src_80_80_3f9a0c12@2x.png" {
+		t.Fatalf("unexpected variant path %q", p)
+	}
+}
+
+func TestNativeResizeModes(t *testing.T) {
+	src := writeTestJPEG(t, t.TempDir(), 200, 100)
+	cases := []struct {
+		settings map[string]string
+		w, h     int
+	}{
+		{map[string]string{"width": "60", "height": "60", "resize": "cover"}, 60, 60},
+		{map[string]string{"width": "80", "height": "80", "resize": "pad", "background": "#000"}, 80, 80},
+		{map[string]string{"width": "30", "height": "90", "resize": "stretch"}, 30, 90},
+		{map[string]string{"width": "1000"}, 200, 100},
+	}
+	for _, c := range cases {
+		c.settings["engine"] = "native"
+		h, _ := Get("png")
+		out, err := h(src, c.settings)
+		if err != nil {
+			t.Fatalf("%v: %v", c.settings, err)
+		}
+		f, err := os.Open(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, _, err := image.DecodeConfig(f)
+		f.Close()
+		if err != nil || cfg.Width != c.w || cfg.Height != c.h {
+			t.Fatalf("%v: got %dx%d (err=%v), want %dx%d", c.settings, cfg.Width, cfg.Height, err, c.w, c.h)
+		}
+	}
+}
+
+func TestTargetSSIMNative(t *testing.T) {
+	src := writeTestJPEG(t, t.TempDir(), 160, 120)
+	h, _ := Get("jpg")
+	settings := map[string]string{"engine": "native", "width": "80", "height": "60", "targetSSIM": "0.95", "minQuality": "20", "maxQuality": "90"}
+	out, err := h(src, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, ok := ReadOutcome(out)
+	if !ok {
+		t.Fatalf("no search outcome recorded for %s", out)
+	}
+	if res.Quality < 20 || res.Quality > 90 || (res.SSIM < 0.95 && res.Quality != 90) {
+		t.Fatalf("unexpected outcome %+v", res)
+	}
+	// re-encoding without a target must not leave a stale outcome behind
+	delete(settings, "targetSSIM")
+	if _, err := h(src, settings); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ReadOutcome(out); ok {
+		t.Fatalf("stale search outcome kept")
+	}
+
+	if _, err := h(src, map[string]string{"engine": "native", "targetSSIM": "2"}); err == nil {
+		t.Fatalf("expected error for out-of-range targetSSIM")
+	}
+	png, _ := Get("png")
+	if _, err := png(src, map[string]string{"engine": "native", "targetSSIM": "0.9"}); err == nil {
+		t.Fatalf("expected error for png targetSSIM")
+	}
+}
+
+func TestMaxBytesNative(t *testing.T) {
+	src := writeTestJPEG(t, t.TempDir(), 320, 240)
+	h, _ := Get("jpg")
+	encode := func(extra map[string]string) (string, error) {
+		s := map[string]string{"engine": "native", "width": "160", "height": "120"}
+		for k, v := range extra {
+			s[k] = v
+		}
+		return h(src, s)
+	}
+	sizeOf := func(p string) int64 {
+		st, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st.Size()
+	}
+	out, err := encode(map[string]string{"quality": "95"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	high := sizeOf(out)
+	out, _ = encode(map[string]string{"quality": "30"})
+	low := sizeOf(out)
+
+	// fits as requested
+	out, err = encode(map[string]string{"quality": "95", "maxBytes": strconv.FormatInt(high, 10)})
+	if o, _ := ReadOutcome(out); err != nil || o.Quality != 95 {
+		t.Fatalf("expected quality 95 to fit: %+v err=%v", o, err)
+	}
+	// needs a lower quality
+	limit := (high + low) / 2
+	out, err = encode(map[string]string{"quality": "95", "maxBytes": strconv.FormatInt(limit, 10)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o, _ := ReadOutcome(out); sizeOf(out) > limit || o.Quality < 30 || o.Quality >= 95 || o.Scale != 0 {
+		t.Fatalf("unexpected result: %d bytes, outcome %+v", sizeOf(out), o)
+	}
+	// only fits smaller
+	out, err = encode(map[string]string{"maxBytes": strconv.FormatInt(low*2/3, 10), "maxBytesResize": "true", "minScale": "10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o, _ := ReadOutcome(out); sizeOf(out) > low*2/3 || o.Scale == 0 || o.Scale >= 1 {
+		t.Fatalf("unexpected resized result %s: outcome %+v", out, o)
+	}
+	// named after the requested size, so it can't collide with a smaller
+	// resolution of the same source
+	if full, _ := VariantPath("jpg", src, map[string]string{"width": "160", "height": "120"}); out != full {
+		t.Fatalf("resized variant written to %s, want %s", out, full)
+	}
+	f, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, _, err := image.DecodeConfig(f)
+	f.Close()
+	if err != nil || cfg.Width >= 160 || cfg.Height >= 120 {
+		t.Fatalf("resized variant is %dx%d (err=%v)", cfg.Width, cfg.Height, err)
+	}
+	// can't fit at all
+	if _, err := encode(map[string]string{"maxBytes": "10"}); !errors.Is(err, ErrOverBudget) {
+		t.Fatalf("expected ErrOverBudget, got %v", err)
+	}
+	png, _ := Get("png")
+	if _, err := png(src, map[string]string{"engine": "native", "maxBytes": "1000"}); err == nil {
+		t.Fatalf("expected error for png maxBytes")
+	}
+}
+
+func TestAutoKeepsSmallest(t *testing.T) {
+	t.Setenv("ENCODER_ENGINE", "native")
+	src := writeTestJPEG(t, t.TempDir(), 160, 120)
+	h, ok := Get("auto")
+	if !ok {
+		t.Fatalf("auto encoder not registered")
+	}
+	out, err := h(src, map[string]string{"width": "80", "height": "60", "formats": "png,jpg", "fallback": "none"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, _ := ReadOutcome(out)
+	if len(o.Candidates) != 2 || len(o.Alternates) != 0 {
+		t.Fatalf("unexpected outcome %+v", o)
+	}
+	winner, loser := "jpg", "png"
+	if o.Candidates["png"] < o.Candidates["jpg"] {
+		winner, loser = loser, winner
+	}
+	if !strings.HasSuffix(out, "_80_60_auto."+winner) {
+		t.Fatalf("expected the %s candidate to win, got %s (%v)", winner, out, o.Candidates)
+	}
+	if p, _ := VariantPath(loser, src, map[string]string{"width": "80", "height": "60", "label": "auto"}); fileExists(p) {
+		t.Fatalf("losing candidate %s left behind", p)
+	}
+
+	// a flat image is smallest as PNG; the JPEG fallback is kept too
+	flat := filepath.Join(t.TempDir(), "flat.jpg")
+	img := image.NewRGBA(image.Rect(0, 0, 160, 120))
+	for i := range img.Pix {
+		img.Pix[i] = 200
+	}
+	f, err := os.Create(flat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := jpeg.Encode(f, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	out, err = h(flat, map[string]string{"width": "80", "height": "60", "formats": "png", "fallback": "jpg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, _ = ReadOutcome(out)
+	if !strings.HasSuffix(out, "_auto.png") || len(o.Alternates) != 1 || !strings.HasSuffix(o.Alternates[0], "_auto.jpg") || !fileExists(o.Alternates[0]) {
+		t.Fatalf("expected png winner plus jpg fallback, got %s %v (%v)", out, o.Alternates, o.Candidates)
+	}
+	if _, err := h(src, map[string]string{"formats": "bmp"}); err == nil {
+		t.Fatalf("expected error for unknown candidate format")
+	}
+}
+
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+func TestBatchDecodesOncePerEngine(t *testing.T) {
+	src := writeTestJPEG(t, t.TempDir(), 160, 120)
+	h, ok := GetBatch("jpeg")
+	if !ok {
+		t.Fatalf("expected jpeg batch handler")
+	}
+	settings := []map[string]string{
+		{"engine": "native", "width": "80", "height": "60"},
+		{"engine": "bogus", "width": "40", "height": "30"},
+		{"engine": "native", "width": "20", "height": "15", "quality": "50"},
+	}
+	outs, errs := h(src, settings)
+	if errs[0] != nil || errs[2] != nil {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+	if errs[1] == nil {
+		t.Fatalf("expected unknown engine to fail only its own variant")
+	}
+	for _, i := range []int{0, 2} {
+		want, _ := VariantPath("jpg", src, settings[i])
+		if outs[i] != want {
+			t.Fatalf("variant %d: %q, want %q", i, outs[i], want)
+		}
+	}
+}
+
+func TestMagickBatch(t *testing.T) {
+	requireMagick(t)
+	src := writeTestJPEG(t, t.TempDir(), 160, 120)
+	settings := []map[string]string{
+		{"width": "80", "height": "60", "quality": "60"},
+		{"width": "40", "height": "30", "lossless": "true"},
+		{"width": "20", "height": "15"},
+	}
+	outs, errs := encodeMagickBatch(webpFormat, src, settings)
+	for i := range settings {
+		if errs[i] != nil {
+			t.Fatalf("variant %d: %v", i, errs[i])
+		}
+		b, err := os.ReadFile(outs[i])
+		if err != nil || len(b) < 12 || string(b[8:12]) != "WEBP" {
+			t.Fatalf("variant %d: %s is not webp (err=%v)", i, outs[i], err)
+		}
+	}
+}
+
+// writeTaggedPNG writes a flat w x h PNG carrying the sRGB ICC profile.
+func writeTaggedPNG(t *testing.T, dir string, w, h int, c color.NRGBA) string {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	var buf bytes.Buffer
+	if err := native.EncodePNG(&buf, img, native.PNGOptions{Compression: 6}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := native.EmbedICC(buf.Bytes(), "png", native.SRGBProfile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, "tagged.png")
+	if err := os.WriteFile(p, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestColorArgs(t *testing.T) {
+	dir := t.TempDir()
+	plain := writeTestJPEG(t, dir, 8, 8)
+	tagged := writeTaggedPNG(t, dir, 8, 8, color.NRGBA{10, 20, 30, 255})
+	srgb, err := srgbProfilePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name, input   string
+		settings      map[string]string
+		before, after string
+	}{
+		{"jpg", plain, nil, "-colorspace sRGB", "+profile icc"},
+		{"jpg", tagged + "[0]", nil, "-profile " + srgb, "+profile icc"},
+		{"jpg", tagged, map[string]string{"embedProfile": "true"}, "-profile " + srgb, "-profile " + srgb},
+		{"webp", tagged, map[string]string{"colorProfile": "preserve"}, "", ""},
+		{"png", tagged, map[string]string{"colorProfile": "preserve"}, "-profile " + srgb, "+profile icc"},
+	}
+	for _, c := range cases {
+		before, after, err := colorArgs(c.name, c.input, c.settings)
+		if err != nil {
+			t.Fatalf("%s %v: %v", c.name, c.settings, err)
+		}
+		if strings.Join(before, " ") != c.before || strings.Join(after, " ") != c.after {
+			t.Fatalf("%s %v: got %v / %v, want %q / %q", c.name, c.settings, before, after, c.before, c.after)
+		}
+	}
+	if _, _, err := colorArgs("jpg", plain, map[string]string{"colorProfile": "p3"}); err == nil {
+		t.Fatalf("expected invalid colorProfile to fail")
+	}
+}
+
+func TestNativeEmbedProfile(t *testing.T) {
+	src := writeTaggedPNG(t, t.TempDir(), 16, 16, color.NRGBA{200, 100, 50, 255})
+	for _, enc := range []string{"jpg", "png"} {
+		h, _ := Get(enc)
+		for _, embed := range []string{"false", "true"} {
+			out, err := h(src, map[string]string{"engine": "native", "width": "8", "height": "8", "embedProfile": embed})
+			if err != nil {
+				t.Fatalf("%s: %v", enc, err)
+			}
+			if got := sourceProfile(out) != nil; strconv.FormatBool(got) != embed {
+				t.Fatalf("%s embedProfile=%s: output has profile %v", enc, embed, got)
+			}
+		}
+	}
+}
+
+// writeTaggedJPEG writes a w x h JPEG whose EXIF says it is rotated 90°
+// clockwise (orientation 6), names an artist and carries a GPS IFD.
+func writeTaggedJPEG(t *testing.T, dir string, w, h int) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, w, h)), nil); err != nil {
+		t.Fatal(err)
+	}
+	le := binary.LittleEndian
+	exif := []byte("Exif\x00\x00II*\x00\x08\x00\x00\x00")
+	exif = le.AppendUint16(exif, 3)
+	for _, e := range [][3]uint32{
+		{0x0112, 3<<16 | 1, 6},                            // orientation
+		{0x013B, 2<<16 | 4, le.Uint32([]byte("Ann\x00"))}, // artist
+		{0x8825, 4<<16 | 1, 50},                           // GPS IFD
+	} {
+		exif = le.AppendUint16(exif, uint16(e[0]))
+		exif = le.AppendUint16(exif, uint16(e[1]>>16))
+		exif = le.AppendUint32(exif, e[1]&0xffff)
+		exif = le.AppendUint32(exif, e[2])
+	}
+	exif = le.AppendUint32(exif, 0)
+	exif = append(exif, 0, 0, 0, 0, 0, 0)
+	data := append([]byte{0xFF, 0xD8, 0xFF, 0xE1}, byte((len(exif)+2)>>8), byte(len(exif)+2))
+	data = append(data, exif...)
+	data = append(data, buf.Bytes()[2:]...)
+	p := filepath.Join(dir, "tagged.jpg")
+	if err := os.WriteFile(p, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestKeptJPEG(t *testing.T) {
+	src := writeTaggedJPEG(t, t.TempDir(), 40, 20)
+	cases := []struct {
+		settings  map[string]string
+		creator   []string
+		copyright string
+	}{
+		{map[string]string{}, []string{"Ann"}, ""},
+		{map[string]string{"metadata": "strip", "copyright": "© Example"}, nil, "© Example"},
+		{map[string]string{"metadata": "strip"}, nil, ""},
+	}
+	for _, c := range cases {
+		p, cleanup, err := keptJPEG(src, c.settings)
+		if err != nil {
+			t.Fatalf("%v: %v", c.settings, err)
+		}
+		f, _ := os.Open(p)
+		_, _, err = image.DecodeConfig(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%v: rewritten jpeg unreadable: %v", c.settings, err)
+		}
+		info := sourceMetadata(p)
+		if info.Orientation != 6 || info.Copyright != c.copyright || strings.Join(info.Creator, ",") != strings.Join(c.creator, ",") {
+			t.Fatalf("%v: got %+v", c.settings, info)
+		}
+		// the GPS IFD pointer is gone with the rest of the source EXIF
+		f, _ = os.Open(p)
+		raw, _ := imagetype.ReadMetadata(f, imagetype.JPEG)
+		f.Close()
+		if bytes.Contains(raw.EXIF, []byte{0x88, 0x25}) {
+			t.Fatalf("%v: source exif survived", c.settings)
+		}
+		cleanup()
+	}
+}
+
+func TestMetadataPolicy(t *testing.T) {
+	for settings, want := range map[string]string{"": "safe", "safe": "safe", "strip": "strip"} {
+		if got, err := metadataPolicy(map[string]string{"metadata": settings}); err != nil || got != want {
+			t.Fatalf("metadata=%q: got %q, %v", settings, got, err)
+		}
+	}
+	if got, _ := metadataPolicy(map[string]string{"strip": "true"}); got != "strip" {
+		t.Fatalf("legacy strip=true: got %q", got)
+	}
+	if _, err := metadataPolicy(map[string]string{"metadata": "all"}); err == nil {
+		t.Fatalf("expected unknown policy to fail")
+	}
+}
+
+func TestNativeMetadata(t *testing.T) {
+	src := writeTaggedJPEG(t, t.TempDir(), 40, 20)
+	if w, h := sourceSize(src); w != 20 || h != 40 {
+		t.Fatalf("oriented size: %dx%d", w, h)
+	}
+	cases := []struct {
+		settings  map[string]string
+		creator   []string
+		copyright string
+	}{
+		{map[string]string{}, []string{"Ann"}, ""},
+		{map[string]string{"copyright": "© Example"}, []string{"Ann"}, "© Example"},
+		{map[string]string{"metadata": "strip", "copyright": "© Example"}, nil, "© Example"},
+		{map[string]string{"metadata": "strip"}, nil, ""},
+	}
+	for _, enc := range []string{"jpg", "png"} {
+		h, _ := Get(enc)
+		for _, c := range cases {
+			c.settings["engine"] = "native"
+			out, err := h(src, c.settings)
+			if err != nil {
+				t.Fatalf("%s %v: %v", enc, c.settings, err)
+			}
+			f, _ := os.Open(out)
+			cfg, _, err := image.DecodeConfig(f)
+			f.Close()
+			if err != nil || cfg.Width != 20 || cfg.Height != 40 {
+				t.Fatalf("%s: orientation not applied: %dx%d (%v)", enc, cfg.Width, cfg.Height, err)
+			}
+			info := sourceMetadata(out)
+			if info.Orientation != 0 || info.Copyright != c.copyright || strings.Join(info.Creator, ",") != strings.Join(c.creator, ",") {
+				t.Fatalf("%s %v: got %+v", enc, c.settings, info)
+			}
+			// the EXIF written holds the kept fields and nothing else
+			f, _ = os.Open(out)
+			typ, _ := sourceType(out)
+			raw, err := imagetype.ReadMetadata(f, typ)
+			f.Close()
+			if err != nil || !bytes.Equal(raw.EXIF, metadata.Info{Creator: c.creator, Copyright: c.copyright}.EXIF()) {
+				t.Fatalf("%s: unexpected exif block", enc)
+			}
+		}
+	}
+}
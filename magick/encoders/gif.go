@@ -0,0 +1,38 @@
+package encoders
+
+import (
+	"strconv"
+)
+
+// HandleGIF creates a GIF variant from input file. It writes a new file
+// named <base>_<width>_<height>.gif (or _orig when width/height are zero)
+// and returns its path. Animated sources stay animated: frames are
+// coalesced before resizing and re-optimized afterwards.
+// Supported settings:
+//   - colors: integer 2-256 (default 256)
+//   - dither: "none", "floyd-steinberg" (default) or "riemersma"
+//   - optimize: "true"/"false" frame optimization (default true)
+//   - interlace: "true" writes interlaced output
+//   - metadata: "safe" (default) or "strip", see metadataPolicy
+func HandleGIF(name string, settings map[string]string) (string, error) {
+	return encodeMagick(gifFormat, name, settings)
+}
+
+var gifFormat = magickFormat{name: "gif", pre: []string{"-coalesce"}, options: gifOptions}
+
+// gifOptions builds the ImageMagick options for one GIF variant.
+func gifOptions(settings map[string]string) (string, []string, error) {
+	colors := intSetting(settings, "colors", 256, 2, 256)
+	optimize := boolSetting(settings, "optimize", true)
+	interlace := boolSetting(settings, "interlace", false)
+
+	args := ditherArgs(settings)
+	args = append(args, "-colors", strconv.Itoa(colors))
+	if optimize {
+		args = append(args, "-layers", "Optimize")
+	}
+	if interlace {
+		args = append(args, "-interlace", "GIF")
+	}
+	return "gif", args, nil
+}
@@ -0,0 +1,39 @@
+package encoders
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// HandleHEIC creates a HEIC variant from input file. It writes a new file
+// named <base>_<width>_<height>.heic (or _orig when width/height are zero)
+// and returns its path. It needs ImageMagick built with libheif.
+// Supported settings:
+//   - quality: integer 0-100 (default 50)
+//   - chroma: chroma subsampling "420" (default), "422" or "444"
+//   - metadata: "safe" (default) or "strip", see metadataPolicy
+func HandleHEIC(name string, settings map[string]string) (string, error) {
+	return encodeMagick(heicFormat, name, settings)
+}
+
+var heicFormat = magickFormat{name: "heic", options: heicOptions}
+
+// heicOptions builds the ImageMagick options for one HEIC variant.
+func heicOptions(settings map[string]string) (string, []string, error) {
+	quality := intSetting(settings, "quality", 50, 0, 100)
+	chroma := settings["chroma"]
+	switch chroma {
+	case "":
+		chroma = "420"
+	case "420", "422", "444":
+	default:
+		return "", nil, fmt.Errorf("heic: invalid chroma %q", chroma)
+	}
+	if !magickCan("HEIC", 'w') {
+		return "", nil, fmt.Errorf("heic: imagemagick was built without HEIC write support")
+	}
+
+	args := []string{"-quality", strconv.Itoa(quality)}
+	args = append(args, "-define", "heic:chroma="+chroma)
+	return "heic", args, nil
+}
@@ -0,0 +1,126 @@
+package encoders
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"pixerver/internal/imagetype"
+	"pixerver/logger"
+)
+
+var (
+	formatsOnce sync.Once
+	formatModes map[string]string // "HEIC" -> "rw+"
+)
+
+// magickFormats lists the formats the installed ImageMagick supports with
+// their read/write modes, as reported by "magick -list format".
+func magickFormats() map[string]string {
+	formatsOnce.Do(func() {
+		formatModes = map[string]string{}
+		bin, err := magickBin()
+		if err != nil {
+			return
+		}
+		out, err := exec.Command(bin, "-list", "format").Output()
+		if err != nil {
+			logger.Warnf("listing imagemagick formats failed: %v", err)
+			return
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			// e.g. "      HEIC* HEIC      rw+   High Efficiency Image Format"
+			f := strings.Fields(line)
+			if len(f) >= 3 && strings.Trim(f[2], "rw+-") == "" {
+				formatModes[strings.TrimSuffix(f[0], "*")] = f[2]
+			}
+		}
+	})
+	return formatModes
+}
+
+// magickCan reports whether ImageMagick can read ('r') or write ('w')
+// format.
+func magickCan(format string, mode byte) bool {
+	return strings.IndexByte(magickFormats()[strings.ToUpper(format)], mode) >= 0
+}
+
+// sourceType sniffs the type of the file at name.
+func sourceType(name string) (imagetype.Type, bool) {
+	f, err := os.Open(name)
+	if err != nil {
+		return imagetype.Type{}, false
+	}
+	defer f.Close()
+	head := make([]byte, imagetype.SniffLen)
+	n, _ := f.Read(head)
+	return imagetype.Detect(head[:n])
+}
+
+// sourceSize probes the pixel size of an ImageMagick input argument as
+// displayed, i.e. after -auto-orient, ignoring any frame selector. It
+// returns zeros when the size is unknown, so callers fall back to
+// ImageMagick's own geometry.
+func sourceSize(input string) (int, int) {
+	if i := strings.LastIndexByte(input, '['); i > 0 && strings.HasSuffix(input, "]") {
+		input = input[:i]
+	}
+	t, ok := sourceType(input)
+	if !ok {
+		return 0, 0
+	}
+	f, err := os.Open(input)
+	if err != nil {
+		return 0, 0
+	}
+	defer f.Close()
+	w, h, err := imagetype.DisplaySize(f, t)
+	if err != nil || w <= 0 || h <= 0 {
+		return 0, 0
+	}
+	if sourceMetadata(input).Orientation >= 5 {
+		return h, w
+	}
+	return w, h
+}
+
+// decodeInput returns the input argument ImageMagick should read for name,
+// and a cleanup func to call once the encoder is done.
+//
+// HEIC containers can hold several images (bursts, depth maps, thumbnails);
+// only the primary image is wanted, which ImageMagick returns first. When
+// ImageMagick was built without libheif, the primary image is decoded with
+// libheif's own CLI into a temporary PNG instead.
+func decodeInput(name string) (string, func(), error) {
+	noop := func() {}
+	if t, ok := sourceType(name); !ok || t != imagetype.HEIC {
+		return name, noop, nil
+	}
+	if magickCan("HEIC", 'r') {
+		return name + "[0]", noop, nil
+	}
+	var bin string
+	for _, c := range []string{"heif-dec", "heif-convert"} {
+		if p, err := exec.LookPath(c); err == nil {
+			bin = p
+			break
+		}
+	}
+	if bin == "" {
+		return "", noop, fmt.Errorf("no HEIC decoder: imagemagick lacks libheif and heif-dec is not installed")
+	}
+	tmp, err := os.CreateTemp("", "heic-*.png")
+	if err != nil {
+		return "", noop, err
+	}
+	tmp.Close()
+	cleanup := func() { _ = os.Remove(tmp.Name()) }
+	// heif-dec writes the primary image unless told otherwise
+	if out, err := exec.Command(bin, name, tmp.Name()).CombinedOutput(); err != nil {
+		cleanup()
+		return "", noop, fmt.Errorf("decoding heic failed: %v: %s", err, string(out))
+	}
+	return tmp.Name(), cleanup, nil
+}
@@ -0,0 +1,155 @@
+package encoders
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"pixerver/internal/imagetype"
+	"pixerver/internal/metadata"
+)
+
+// HandleJXL creates a JPEG XL variant from input file. It writes a new file
+// named <base>_<width>_<height>.jxl (or _orig when width/height are zero)
+// and returns its path.
+// Supported settings:
+//   - distance: butteraugli distance 0-25 (1.0 is visually lossless);
+//     takes precedence over quality
+//   - quality: integer 0-100 (default 90)
+//   - effort: integer 1-9 (default 7)
+//   - lossless: "true" encodes mathematically lossless
+//   - losslessJpeg: "true" losslessly recompresses a JPEG source with cjxl;
+//     the source must be a JPEG and no resize may be requested
+func HandleJXL(name string, settings map[string]string) (string, error) {
+	if jxlAlone(settings) {
+		return recompressJPEGVariant(name, settings)
+	}
+	return encodeMagick(jxlFormat, name, settings)
+}
+
+var jxlFormat = magickFormat{name: "jxl", options: jxlOptions, alone: jxlAlone, single: recompressJPEGVariant}
+
+// jxlAlone reports variants that go through cjxl rather than ImageMagick.
+func jxlAlone(settings map[string]string) bool {
+	return boolSetting(settings, "losslessJpeg", false)
+}
+
+// jxlOptions builds the ImageMagick options for one JPEG XL variant.
+func jxlOptions(settings map[string]string) (string, []string, error) {
+	if jxlAlone(settings) {
+		return "", nil, fmt.Errorf("jxl: losslessJpeg is not an imagemagick mode")
+	}
+	quality := intSetting(settings, "quality", 90, 0, 100)
+	if d, ok := settings["distance"]; ok {
+		v, err := strconv.ParseFloat(d, 64)
+		if err != nil || v < 0 || v > 25 {
+			return "", nil, fmt.Errorf("jxl: invalid distance %q", d)
+		}
+		quality = distanceToQuality(v)
+	}
+	if boolSetting(settings, "lossless", false) {
+		quality = 100
+	}
+	effort := intSetting(settings, "effort", 7, 1, 9)
+	return "jxl", []string{"-quality", strconv.Itoa(quality), "-define", fmt.Sprintf("jxl:effort=%d", effort)}, nil
+}
+
+// recompressJPEGVariant handles the losslessJpeg mode of HandleJXL.
+func recompressJPEGVariant(name string, settings map[string]string) (string, error) {
+	if width, height := size(settings); width != 0 || height != 0 {
+		return "", fmt.Errorf("jxl: losslessJpeg cannot be combined with a resize")
+	}
+	outName, _ := VariantPath("jxl", name, settings)
+	tmp, err := tmpFor(outName)
+	if err != nil {
+		return "", err
+	}
+	out, err := recompressJPEG(name, tmp, outName, settings)
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return out, err
+}
+
+// recompressJPEG transcodes a JPEG into JPEG XL without re-encoding its
+// DCT coefficients, so the JPEG cjxl is given can be reconstructed
+// bit-exactly. That JPEG carries only the metadata settings keep.
+// ImageMagick can't do this; it needs libjxl's cjxl.
+func recompressJPEG(name, tmp, outName string, settings map[string]string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	head := make([]byte, imagetype.SniffLen)
+	n, _ := f.Read(head)
+	f.Close()
+	if t, ok := imagetype.Detect(head[:n]); !ok || t != imagetype.JPEG {
+		return "", fmt.Errorf("jxl: losslessJpeg requires a JPEG source")
+	}
+	bin, err := exec.LookPath("cjxl")
+	if err != nil {
+		return "", fmt.Errorf("jxl: losslessJpeg needs cjxl: %w", err)
+	}
+	src, cleanup, err := keptJPEG(name, settings)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+	args := []string{src, tmp, "--lossless_jpeg=1", "-e", strconv.Itoa(intSetting(settings, "effort", 7, 1, 9))}
+	return runMagick("jxl", bin, args, name, tmp, outName)
+}
+
+// keptJPEG writes a copy of the JPEG name whose EXIF, XMP and IPTC hold
+// only what settings' metadata policy keeps. The pixels aren't rotated, so
+// the orientation stays. cleanup removes the copy.
+func keptJPEG(name string, settings map[string]string) (string, func(), error) {
+	noop := func() {}
+	info, err := keptMetadata(name, settings)
+	if err != nil {
+		return "", noop, err
+	}
+	info.Orientation = sourceMetadata(name).Orientation
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return "", noop, err
+	}
+	if data, err = metadata.RewriteJPEG(data, info); err != nil {
+		return "", noop, err
+	}
+	f, err := os.CreateTemp("", "jxl-src-*.jpg")
+	if err != nil {
+		return "", noop, err
+	}
+	cleanup := func() { _ = os.Remove(f.Name()) }
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		cleanup()
+		return "", noop, err
+	}
+	return f.Name(), cleanup, nil
+}
+
+// distanceToQuality inverts libjxl's quality-to-distance mapping so a
+// distance can be passed through ImageMagick's -quality. Only distance 0
+// maps to 100, which ImageMagick encodes losslessly.
+func distanceToQuality(d float64) int {
+	if d <= 0 {
+		return 100
+	}
+	// for quality >= 30: distance = 0.1 + (100-quality)*0.09
+	if d <= 6.4 {
+		return min(99, int(math.Round(100-(d-0.1)/0.09)))
+	}
+	// below that: distance = 53/3000*q^2 - 23/20*q + 25, on the falling branch
+	a, b, c := 53.0/3000, -23.0/20, 25-d
+	q := (-b - math.Sqrt(b*b-4*a*c)) / (2 * a)
+	if math.IsNaN(q) || q < 0 {
+		return 0
+	}
+	return int(math.Round(q))
+}
@@ -0,0 +1,44 @@
+package encoders
+
+import (
+	"os"
+
+	"pixerver/internal/env"
+)
+
+// resourceLimits are the ImageMagick resources capped on every invocation,
+// with the environment variable that overrides each default.
+var resourceLimits = []struct {
+	resource string
+	envKey   string
+	def      string
+}{
+	{"memory", "MAGICK_LIMIT_MEMORY", "256MiB"},
+	{"map", "MAGICK_LIMIT_MAP", "512MiB"},
+	{"area", "MAGICK_LIMIT_AREA", "128MP"},
+	{"disk", "MAGICK_LIMIT_DISK", "1GiB"},
+	{"time", "MAGICK_LIMIT_TIME", "120"},
+}
+
+// limitArgs returns the "-limit <resource> <value>" arguments that must
+// precede the input file so the caps also apply while decoding.
+func limitArgs() []string {
+	var args []string
+	for _, l := range resourceLimits {
+		v := os.Getenv(l.envKey)
+		if v == "" {
+			v = l.def
+		}
+		args = append(args, "-limit", l.resource, v)
+	}
+	return args
+}
+
+// nativePixelBudget is the most pixels the native engine may hold decoded
+// for one source, summed over every coalesced frame of an animation
+// (NATIVE_LIMIT_PIXELS). The default of 64Mi pixels is 256MiB as RGBA,
+// ImageMagick's default memory cap; the native engine has no disk cache to
+// spill to, so past it the job fails.
+func nativePixelBudget() int64 {
+	return env.Int64("NATIVE_LIMIT_PIXELS", 64<<20)
+}
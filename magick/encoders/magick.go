@@ -0,0 +1,289 @@
+package encoders
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"pixerver/internal/geometry"
+)
+
+// magickFormat describes how an ImageMagick encoder turns a decoded input
+// into one variant. Splitting decoding from the per-variant options lets a
+// single invocation produce several variants of the same source.
+type magickFormat struct {
+	name string // registry name, used for VariantPath and logs
+	// frames selects input frames, e.g. "[0]" for the first one
+	frames string
+	// pre are operators applied once, right after decoding
+	pre []string
+	// options returns the output format prefix and the options that follow
+	// the resize for one variant
+	options func(settings map[string]string) (format string, opts []string, err error)
+	// post, if set, runs on each output before it is moved into place
+	post func(out string, settings map[string]string)
+	// alone reports settings that can't share an invocation; those are
+	// handed to single instead
+	alone  func(settings map[string]string) bool
+	single Handler
+}
+
+// resizeArgs returns the operators that bring a srcW x srcH input to the
+// requested size and resize mode. The geometry is planned in Go so the
+// ImageMagick and native engines crop and pad identically; when the source
+// size is unknown ImageMagick's own geometry flags are used instead.
+func resizeArgs(settings map[string]string, srcW, srcH int) ([]string, error) {
+	spec, err := geometry.FromSettings(settings)
+	if err != nil {
+		return nil, err
+	}
+	if spec.Width == 0 && spec.Height == 0 {
+		return nil, nil
+	}
+	if srcW == 0 || srcH == 0 {
+		return geometryArgs(spec), nil
+	}
+	p := spec.Plan(srcW, srcH)
+	var args []string
+	if p.Scaled(srcW, srcH) {
+		args = append(args, "-resize", fmt.Sprintf("%dx%d!", p.ScaleW, p.ScaleH))
+	}
+	if p.Cropped() {
+		args = append(args, "-crop", fmt.Sprintf("%dx%d+%d+%d", p.CropW, p.CropH, p.CropX, p.CropY), "+repage")
+	}
+	if p.Padded() {
+		args = append(args, padArgs(spec)...)
+		// a negative extent offset moves the image right and down
+		args = append(args, "-extent", fmt.Sprintf("%dx%d%+d%+d", p.CanvasW, p.CanvasH, -p.OffsetX, -p.OffsetY))
+	}
+	return args, nil
+}
+
+// geometryArgs expresses spec with ImageMagick geometry flags, for sources
+// whose size can't be probed.
+func geometryArgs(spec geometry.Spec) []string {
+	box := ""
+	if spec.Width > 0 {
+		box = strconv.Itoa(spec.Width)
+	}
+	box += "x"
+	if spec.Height > 0 {
+		box += strconv.Itoa(spec.Height)
+	}
+	extent := []string{"-gravity", spec.Gravity, "-extent", fmt.Sprintf("%dx%d", spec.Width, spec.Height), "+gravity"}
+	shrink := ""
+	if !spec.AllowUpscale {
+		shrink = ">"
+	}
+	switch spec.Mode {
+	case geometry.Cover:
+		return append([]string{"-resize", box + "^"}, extent...)
+	case geometry.Pad:
+		args := append([]string{"-resize", box + shrink}, padArgs(spec)...)
+		return append(args, extent...)
+	case geometry.Stretch:
+		return []string{"-resize", box + "!"}
+	}
+	return []string{"-resize", box + shrink}
+}
+
+// padArgs sets the padding color, adding an alpha channel when it is not
+// opaque.
+func padArgs(spec geometry.Spec) []string {
+	args := []string{"-background", geometry.Hex(spec.Background)}
+	if spec.Background.A < 255 {
+		args = append([]string{"-alpha", "set"}, args...)
+	}
+	return args
+}
+
+// magickInput prepares name for f and returns the input argument together
+// with a cleanup func.
+func magickInput(f magickFormat, name string) (string, func(), error) {
+	input, cleanup, err := decodeInput(name)
+	if err != nil {
+		return "", cleanup, err
+	}
+	if input == name {
+		input += f.frames
+	}
+	return input, cleanup, nil
+}
+
+// encodeMagick writes one variant of name.
+func encodeMagick(f magickFormat, name string, settings map[string]string) (string, error) {
+	bin, err := magickBin()
+	if err != nil {
+		return "", err
+	}
+	format, opts, err := f.options(settings)
+	if err != nil {
+		return "", err
+	}
+	input, cleanup, err := magickInput(f, name)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+	srcW, srcH := sourceSize(input)
+	resize, err := resizeArgs(settings, srcW, srcH)
+	if err != nil {
+		return "", err
+	}
+	colorBefore, colorAfter, err := colorArgs(f.name, input, settings)
+	if err != nil {
+		return "", err
+	}
+	meta, cleanupMeta, err := metadataArgs(f.name, input, settings)
+	if err != nil {
+		return "", err
+	}
+	defer cleanupMeta()
+
+	outName, _ := VariantPath(f.name, name, settings)
+	tmp, err := tmpFor(outName)
+	if err != nil {
+		return "", err
+	}
+
+	// resource caps go first so they apply while decoding the input
+	args := limitArgs()
+	args = append(args, input)
+	args = append(args, f.pre...)
+	args = append(args, "-auto-orient")
+	args = append(args, colorBefore...)
+	args = append(args, resize...)
+	args = append(args, opts...)
+	args = append(args, colorAfter...)
+	args = append(args, meta...)
+	args = append(args, tmpOutput(format, tmp))
+
+	if err := execMagick(f.name, bin, args); err != nil {
+		_ = os.Remove(tmp)
+		return "", err
+	}
+	if f.post != nil {
+		f.post(tmp, settings)
+	}
+	return moveIntoPlace(f.name, name, tmp, outName)
+}
+
+// encodeMagickBatch writes one variant of name per entry in settings from a
+// single ImageMagick invocation: the source is decoded once into mpr:
+// memory and every variant is cloned from it inside its own parentheses.
+// If the combined run fails each variant is retried on its own, so errors
+// are still reported per variant.
+func encodeMagickBatch(f magickFormat, name string, settings []map[string]string) ([]string, []error) {
+	outs := make([]string, len(settings))
+	errs := make([]error, len(settings))
+	if len(settings) == 1 && (f.alone == nil || !f.alone(settings[0])) {
+		outs[0], errs[0] = encodeMagick(f, name, settings[0])
+		return outs, errs
+	}
+	bin, err := magickBin()
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return outs, errs
+	}
+
+	var batch []int
+	for i, s := range settings {
+		if f.alone != nil && f.alone(s) {
+			outs[i], errs[i] = f.single(name, s)
+			continue
+		}
+		batch = append(batch, i)
+	}
+	if len(batch) == 0 {
+		return outs, errs
+	}
+
+	input, cleanup, err := magickInput(f, name)
+	if err != nil {
+		for _, i := range batch {
+			errs[i] = err
+		}
+		return outs, errs
+	}
+	defer cleanup()
+	srcW, srcH := sourceSize(input)
+
+	type variant struct {
+		i       int
+		tmp     string
+		outName string
+		args    []string
+	}
+	var vs []variant
+	for _, i := range batch {
+		s := settings[i]
+		format, opts, err := f.options(s)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		resize, err := resizeArgs(s, srcW, srcH)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		colorBefore, colorAfter, err := colorArgs(f.name, input, s)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		meta, cleanupMeta, err := metadataArgs(f.name, input, s)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		defer cleanupMeta()
+		outName, _ := VariantPath(f.name, name, s)
+		tmp, err := tmpFor(outName)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		args := append(colorBefore, resize...)
+		args = append(args, opts...)
+		args = append(args, colorAfter...)
+		args = append(args, meta...)
+		vs = append(vs, variant{i: i, tmp: tmp, outName: outName, args: append(args, "-write", tmpOutput(format, tmp))})
+	}
+	if len(vs) == 0 {
+		return outs, errs
+	}
+
+	// resource caps go first so they apply while decoding the input
+	args := limitArgs()
+	args = append(args, "-respect-parentheses", input)
+	args = append(args, f.pre...)
+	// -delete 0--1 drops every frame of a coalesced animation; +delete
+	// would only drop the last
+	args = append(args, "-auto-orient", "-write", "mpr:source", "-delete", "0--1")
+	for _, v := range vs {
+		args = append(args, "(", "mpr:source")
+		args = append(args, v.args...)
+		args = append(args, "-delete", "0--1", ")")
+	}
+	// every variant was written and dropped, all frames, inside its
+	// parentheses
+	args = append(args, "null:")
+
+	if err := execMagick(f.name, bin, args); err != nil {
+		for _, v := range vs {
+			_ = os.Remove(v.tmp)
+			outs[v.i], errs[v.i] = encodeMagick(f, name, settings[v.i])
+		}
+		return outs, errs
+	}
+	for _, v := range vs {
+		if f.post != nil {
+			f.post(v.tmp, settings[v.i])
+		}
+		outs[v.i], errs[v.i] = moveIntoPlace(f.name, name, v.tmp, v.outName)
+	}
+	return outs, errs
+}
@@ -1,15 +1,156 @@
 package encoders
 
-type Encoder map[string]func(input string, settings map[string]string) error
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
 
-func (e *Encoder) registerEncoder(name string, handler func(input string, settings map[string]string) error) {
-	(*e)[name] = handler
+	"pixerver/internal/geometry"
+)
+
+// Handler encodes input according to settings and returns the path of the
+// variant it wrote. Handlers never modify input.
+type Handler func(input string, settings map[string]string) (string, error)
+
+// BatchHandler encodes several variants of one input, decoding it once.
+// It returns an output path or an error per entry in settings.
+type BatchHandler func(input string, settings []map[string]string) ([]string, []error)
+
+type Encoder map[string]Handler
+
+// registerEncoder registers the ImageMagick encoder described by f under
+// name, routed through dispatch so encoders with a native counterpart can
+// switch engine, and through withSearch so targetSSIM and maxBytes are
+// honoured on either engine.
+func (e *Encoder) registerEncoder(name string, handler Handler, f magickFormat) {
+	h := withSearch(name, dispatch(name, handler))
+	(*e)[name] = h
+	batchers[name] = searchBatch(h, dispatchBatch(name, f))
+}
+
+var (
+	encoders = make(Encoder)
+	batchers = map[string]BatchHandler{}
+)
+
+// outputExt is the file extension each registered encoder writes.
+var outputExt = map[string]string{
+	"jpg":  "jpg",
+	"webp": "webp",
+	"avif": "avif",
+	"png":  "png",
+	"gif":  "gif",
+	"jxl":  "jxl",
+	"heic": "heic",
 }
 
-var encoders = make(Encoder)
+// tmpOutput names the temporary output file with an explicit format prefix,
+// since ImageMagick would otherwise pick the format from the ".tmp"
+// extension.
+func tmpOutput(ext, tmp string) string {
+	return ext + ":" + tmp
+}
+
+// aliases maps alternative type names used in tokens to registered names.
+var aliases = map[string]string{
+	"jpeg":   "jpg",
+	"jpegxl": "jxl",
+	"heif":   "heic",
+}
 
 func init() {
-	encoders.registerEncoder("jpg", HandleJPEG)
-	encoders.registerEncoder("webp", HandleWEBP)
-	encoders.registerEncoder("avif", HandleAVIF)
+	encoders.registerEncoder("jpg", HandleJPEG, jpegFormat)
+	encoders.registerEncoder("webp", HandleWEBP, webpFormat)
+	encoders.registerEncoder("avif", HandleAVIF, avifFormat)
+	encoders.registerEncoder("png", HandlePNG, pngFormat)
+	encoders.registerEncoder("gif", HandleGIF, gifFormat)
+	encoders.registerEncoder("jxl", HandleJXL, jxlFormat)
+	encoders.registerEncoder("heic", HandleHEIC, heicFormat)
+	encoders["auto"] = HandleAuto
+	batchers["auto"] = eachBatch(HandleAuto)
+}
+
+// canonical resolves aliases to the registered encoder name.
+func canonical(name string) string {
+	if a, ok := aliases[name]; ok {
+		return a
+	}
+	return name
+}
+
+// Get returns the handler registered under name (or one of its aliases).
+func Get(name string) (Handler, bool) {
+	h, ok := encoders[canonical(name)]
+	return h, ok
+}
+
+// GetBatch returns the batch handler registered under name (or one of its
+// aliases).
+func GetBatch(name string) (BatchHandler, bool) {
+	h, ok := batchers[canonical(name)]
+	return h, ok
+}
+
+// VariantPath returns the file the encoder registered under name writes for
+// input and settings: <base>_<width>_<height>.<ext>, or <base>_orig.<ext>
+// when no size is requested. Resize modes other than a plain fit add a
+// suffix, e.g. <base>_400_400_cover-north.<ext>, so resolutions that differ
+// only in mode don't overwrite each other. The "label" and "variant"
+// settings follow when set; the worker fills "variant" with a short hash of
+// the job's spec, so jobs that differ only in other settings get their own
+// file. A "density" other than 1 is appended last as @<density>x, e.g.
+// <base>_800_600_3f9a0c12@2x.<ext>.
+func VariantPath(name, input string, settings map[string]string) (string, bool) {
+	ext, ok := outputExt[canonical(name)]
+	if !ok {
+		return "", false
+	}
+	if f := settings["format"]; f != "" && canonical(name) == "jpg" {
+		ext = f
+	}
+	width, _ := strconv.Atoi(settings["width"])
+	height, _ := strconv.Atoi(settings["height"])
+	sizeSuffix := "orig"
+	if width != 0 || height != 0 {
+		sizeSuffix = fmt.Sprintf("%d_%d", width, height)
+		if m := modeSuffix(settings); m != "" {
+			sizeSuffix += "_" + m
+		}
+	}
+	if l := settings["label"]; l != "" {
+		sizeSuffix += "_" + l
+	}
+	if v := settings["variant"]; v != "" {
+		sizeSuffix += "_" + v
+	}
+	if d := settings["density"]; d != "" && d != "1" && (width != 0 || height != 0) {
+		sizeSuffix += "@" + d + "x"
+	}
+	base := filepath.Base(input)
+	base = base[:len(base)-len(filepath.Ext(base))]
+	return filepath.Join(filepath.Dir(input), fmt.Sprintf("%s_%s.%s", base, sizeSuffix, ext)), true
+}
+
+// modeSuffix names the resize settings that change a variant's pixels
+// beyond its size; empty for a plain no-upscale fit.
+func modeSuffix(settings map[string]string) string {
+	spec, err := geometry.FromSettings(settings)
+	if err != nil {
+		return ""
+	}
+	var parts []string
+	if spec.Mode != geometry.Fit {
+		parts = append(parts, spec.Mode)
+	}
+	if (spec.Mode == geometry.Cover || spec.Mode == geometry.Pad) && spec.Gravity != "center" {
+		parts = append(parts, spec.Gravity)
+	}
+	if spec.Mode == geometry.Pad && settings["background"] != "" {
+		parts = append(parts, strings.TrimPrefix(geometry.Hex(spec.Background), "#"))
+	}
+	if spec.AllowUpscale {
+		parts = append(parts, "up")
+	}
+	return strings.Join(parts, "-")
 }
@@ -0,0 +1,149 @@
+package encoders
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"pixerver/internal/metadata"
+	"pixerver/logger"
+)
+
+// metadataPolicy validates the "metadata" setting, shared by every
+// encoder and engine:
+//   - "safe" (default): keep the IPTC Core fields metadata.Info holds
+//     (creator, copyright, credit, source, title, headline, caption,
+//     keywords, ...) from the source's EXIF, IPTC and XMP; drop everything
+//     else
+//   - "strip": keep nothing from the source
+//
+// Either way orientation is applied to the pixels, GPS positions and
+// serial numbers are dropped, and a "copyright" setting (filled from the
+// token's copyright) is written as the copyright. Kept fields go out as
+// XMP in every format, plus EXIF artist and copyright where the format has
+// EXIF and IPTC-IIM in JPEGs. Lossless JPEG XL transcodes (losslessJpeg)
+// keep the source's pixels and so its orientation tag. The older boolean "strip" setting maps to
+// "strip"/"safe" when "metadata" is unset.
+func metadataPolicy(settings map[string]string) (string, error) {
+	switch p := settings["metadata"]; p {
+	case "":
+		if boolSetting(settings, "strip", false) {
+			return "strip", nil
+		}
+		return "safe", nil
+	case "safe", "strip":
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid metadata policy %q: want safe or strip", p)
+	}
+}
+
+// sourceMetadata reads the metadata of an ImageMagick input argument,
+// ignoring any frame selector. Unreadable metadata counts as none.
+func sourceMetadata(input string) metadata.Info {
+	if i := strings.LastIndexByte(input, '['); i > 0 && strings.HasSuffix(input, "]") {
+		input = input[:i]
+	}
+	info, err := metadata.Read(input)
+	if err != nil {
+		logger.Warnf("reading metadata of %s failed: %v", input, err)
+	}
+	return info
+}
+
+// keptMetadata returns what a variant of input carries under settings'
+// policy.
+func keptMetadata(input string, settings map[string]string) (metadata.Info, error) {
+	policy, err := metadataPolicy(settings)
+	if err != nil {
+		return metadata.Info{}, err
+	}
+	info := metadata.Info{}
+	if policy == "safe" {
+		info = sourceMetadata(input)
+		info.Orientation = 0
+	}
+	if c := settings["copyright"]; c != "" {
+		info.Copyright = c
+	}
+	return info, nil
+}
+
+// metadataArgs returns the ImageMagick operators that replace whatever
+// metadata the output would inherit with the kept fields; they go after
+// the format and color options. Only the ICC profile is left alone, as
+// colorArgs owns it. cleanup removes the profile files the arguments name.
+func metadataArgs(name, input string, settings map[string]string) ([]string, func(), error) {
+	cleanup := func() {}
+	info, err := keptMetadata(input, settings)
+	if err != nil {
+		return nil, cleanup, err
+	}
+	args := []string{"+profile", "!icc,*", "+set", "comment"}
+	exif, xmp, ps := info.EXIF(), info.XMP(), info.Photoshop()
+	if name != "jpg" {
+		// elsewhere ImageMagick would write an 8BIM profile as a raw text
+		// chunk nobody reads; XMP carries the same fields
+		ps = nil
+	}
+	if exif == nil && xmp == nil {
+		return args, cleanup, nil
+	}
+	dir, err := os.MkdirTemp("", "metadata-*")
+	if err != nil {
+		return nil, cleanup, err
+	}
+	cleanup = func() { _ = os.RemoveAll(dir) }
+	write := func(name string, data []byte) error {
+		return os.WriteFile(filepath.Join(dir, name), data, 0o600)
+	}
+	if exif != nil {
+		if err := write("exif", append([]byte("Exif\x00\x00"), exif...)); err != nil {
+			cleanup()
+			return nil, func() {}, err
+		}
+		args = append(args, "-profile", "exif:"+filepath.Join(dir, "exif"))
+	}
+	if xmp != nil {
+		if err := write("xmp", xmp); err != nil {
+			cleanup()
+			return nil, func() {}, err
+		}
+		args = append(args, "-profile", "xmp:"+filepath.Join(dir, "xmp"))
+	}
+	if ps != nil {
+		if err := write("8bim", ps); err != nil {
+			cleanup()
+			return nil, func() {}, err
+		}
+		args = append(args, "-profile", "8bim:"+filepath.Join(dir, "8bim"))
+	}
+	return args, cleanup, nil
+}
+
+// withMetadata wraps a native encode so its output carries the metadata
+// settings keep from input.
+func withMetadata(format, input string, settings map[string]string, encode func(io.Writer) error) (func(io.Writer) error, error) {
+	info, err := keptMetadata(input, settings)
+	if err != nil {
+		return nil, err
+	}
+	if info.Empty() {
+		return encode, nil
+	}
+	return func(w io.Writer) error {
+		var buf bytes.Buffer
+		if err := encode(&buf); err != nil {
+			return err
+		}
+		data, err := metadata.Embed(buf.Bytes(), format, info)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}, nil
+}
@@ -0,0 +1,282 @@
+package encoders
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"pixerver/internal/geometry"
+	"pixerver/internal/imagetype"
+	"pixerver/logger"
+	"pixerver/native"
+)
+
+// nativeSource is a decoded source shared by every variant produced from
+// it. GIF sources are kept as coalesced frames so animations survive.
+type nativeSource struct {
+	img  image.Image
+	anim *native.Animation
+}
+
+// decodeNative decodes input once for the native encoders.
+func decodeNative(input string) (*nativeSource, error) {
+	if t, ok := sourceType(input); ok && t == imagetype.GIF {
+		a, err := native.DecodeAnimation(input, nativePixelBudget())
+		if err != nil {
+			return nil, err
+		}
+		return &nativeSource{img: a.Frames[0], anim: a}, nil
+	}
+	img, err := native.Decode(input)
+	if err != nil {
+		return nil, err
+	}
+	img = native.Orient(img, sourceMetadata(input).Orientation)
+	return &nativeSource{img: nativeToSRGB(input, img)}, nil
+}
+
+// nativeEncoder writes one variant of input from its decoded source.
+type nativeEncoder func(input string, src *nativeSource, settings map[string]string) (string, error)
+
+// nativeEncoders are the encoders the pure-Go engine can stand in for.
+var nativeEncoders = map[string]nativeEncoder{
+	"jpg": nativeJPEG,
+	"png": nativePNG,
+	"gif": nativeGIF,
+}
+
+// nativeBatch decodes input once and writes one variant per settings.
+func nativeBatch(name, input string, settings []map[string]string) ([]string, []error) {
+	outs := make([]string, len(settings))
+	errs := make([]error, len(settings))
+	enc, ok := nativeEncoders[name]
+	var src *nativeSource
+	err := fmt.Errorf("native engine does not support %s", name)
+	if ok {
+		src, err = decodeNative(input)
+	}
+	for i, s := range settings {
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		outs[i], errs[i] = enc(input, src, s)
+	}
+	return outs, errs
+}
+
+// engineFor picks the engine for encoder name: the "engine" setting, then
+// ENCODER_ENGINE_<NAME> (e.g. ENCODER_ENGINE_JPG), then ENCODER_ENGINE.
+// "auto" (the default) uses ImageMagick when it is installed and the native
+// engine otherwise.
+func engineFor(name string, settings map[string]string) string {
+	e := settings["engine"]
+	if e == "" {
+		e = os.Getenv("ENCODER_ENGINE_" + strings.ToUpper(name))
+	}
+	if e == "" {
+		e = os.Getenv("ENCODER_ENGINE")
+	}
+	if e == "" || e == "auto" {
+		if _, ok := nativeEncoders[name]; ok && !haveMagick() {
+			return "native"
+		}
+		return "magick"
+	}
+	return e
+}
+
+func haveMagick() bool {
+	if _, err := exec.LookPath("magick"); err == nil {
+		return true
+	}
+	_, err := exec.LookPath("convert")
+	return err == nil
+}
+
+// dispatch wraps the ImageMagick handler for name so each call can be
+// routed to the native engine instead.
+func dispatch(name string, h Handler) Handler {
+	return func(input string, settings map[string]string) (string, error) {
+		switch e := engineFor(name, settings); e {
+		case "magick":
+			return h(input, settings)
+		case "native":
+			outs, errs := nativeBatch(name, input, []map[string]string{settings})
+			return outs[0], errs[0]
+		default:
+			return "", fmt.Errorf("unknown encoder engine %q", e)
+		}
+	}
+}
+
+// dispatchBatch is dispatch for BatchHandlers: variants are split by engine
+// and each engine decodes the source once for its share.
+func dispatchBatch(name string, f magickFormat) BatchHandler {
+	return func(input string, settings []map[string]string) ([]string, []error) {
+		outs := make([]string, len(settings))
+		errs := make([]error, len(settings))
+		byEngine := map[string][]int{}
+		for i, s := range settings {
+			e := engineFor(name, s)
+			byEngine[e] = append(byEngine[e], i)
+		}
+		for e, idx := range byEngine {
+			part := make([]map[string]string, len(idx))
+			for k, i := range idx {
+				part[k] = settings[i]
+			}
+			var po []string
+			var pe []error
+			switch e {
+			case "magick":
+				po, pe = encodeMagickBatch(f, input, part)
+			case "native":
+				po, pe = nativeBatch(name, input, part)
+			default:
+				po, pe = make([]string, len(part)), make([]error, len(part))
+				for k := range pe {
+					pe[k] = fmt.Errorf("unknown encoder engine %q", e)
+				}
+			}
+			for k, i := range idx {
+				outs[i], errs[i] = po[k], pe[k]
+			}
+		}
+		return outs, errs
+	}
+}
+
+// resampleFilter returns the "filter" setting's filter, Lanczos3 by default.
+func resampleFilter(settings map[string]string) native.Filter {
+	if f, ok := native.FilterByName(settings["filter"]); ok {
+		return f
+	}
+	return native.Lanczos3
+}
+
+// nativeResize brings img to the requested size and resize mode, using the
+// same geometry plan as the ImageMagick engine.
+func nativeResize(img image.Image, settings map[string]string) (image.Image, error) {
+	spec, err := geometry.FromSettings(settings)
+	if err != nil {
+		return nil, err
+	}
+	if spec.Width == 0 && spec.Height == 0 {
+		return img, nil
+	}
+	b := img.Bounds()
+	p := spec.Plan(b.Dx(), b.Dy())
+	out := img
+	if p.Scaled(b.Dx(), b.Dy()) {
+		out = native.Resize(img, p.ScaleW, p.ScaleH, resampleFilter(settings))
+	}
+	if p.Cropped() {
+		rgba := native.ToRGBA(out)
+		o := rgba.Bounds().Min
+		out = rgba.SubImage(image.Rect(p.CropX, p.CropY, p.CropX+p.CropW, p.CropY+p.CropH).Add(o))
+	}
+	if p.Padded() {
+		canvas := image.NewRGBA(image.Rect(0, 0, p.CanvasW, p.CanvasH))
+		draw.Draw(canvas, canvas.Bounds(), image.NewUniform(spec.Background), image.Point{}, draw.Src)
+		at := image.Rect(p.OffsetX, p.OffsetY, p.OffsetX+p.CropW, p.OffsetY+p.CropH)
+		draw.Draw(canvas, at, out, out.Bounds().Min, draw.Over)
+		out = canvas
+	}
+	return out, nil
+}
+
+// writeVariant writes a variant of input through encode into its variant
+// path, via a temp file so readers never see a partial file.
+func writeVariant(name, input string, settings map[string]string, encode func(io.Writer) error) (string, error) {
+	outName, _ := VariantPath(name, input, settings)
+	tmp, err := os.CreateTemp(filepath.Dir(outName), filepath.Base(outName)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if err := encode(tmp); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("native %s encode failed: %w", name, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), outName); err != nil {
+		return "", fmt.Errorf("failed to move %s output into place: %v", name, err)
+	}
+	logger.Debugf("native %s created: %s", name, outName)
+	return outName, nil
+}
+
+// nativeJPEG is HandleJPEG on the native engine. "progressive" and
+// "optimize" are ignored.
+func nativeJPEG(input string, src *nativeSource, settings map[string]string) (string, error) {
+	img, err := nativeResize(src.img, settings)
+	if err != nil {
+		return "", err
+	}
+	quality := intSetting(settings, "quality", 80, 1, 100)
+	encode, err := withMetadata("jpeg", input, settings, withProfile("jpeg", settings, func(w io.Writer) error {
+		return native.EncodeJPEG(w, img, quality)
+	}))
+	if err != nil {
+		return "", err
+	}
+	return writeVariant("jpg", input, settings, encode)
+}
+
+// nativePNG is HandlePNG on the native engine; "interlace" and "optimize"
+// are ignored.
+func nativePNG(input string, src *nativeSource, settings map[string]string) (string, error) {
+	img, err := nativeResize(src.img, settings)
+	if err != nil {
+		return "", err
+	}
+	opts := native.PNGOptions{
+		Compression: intSetting(settings, "compression", 9, 0, 9),
+		Colors:      intSetting(settings, "colors", 0, 2, 256),
+		Dither:      ditherOn(settings),
+	}
+	encode, err := withMetadata("png", input, settings, withProfile("png", settings, func(w io.Writer) error {
+		return native.EncodePNG(w, img, opts)
+	}))
+	if err != nil {
+		return "", err
+	}
+	return writeVariant("png", input, settings, encode)
+}
+
+// nativeGIF is HandleGIF on the native engine. Animated GIF sources keep
+// their frames; other sources become a single frame.
+func nativeGIF(input string, src *nativeSource, settings map[string]string) (string, error) {
+	anim := &native.Animation{Frames: []*image.RGBA{native.ToRGBA(src.img)}, Delay: []int{0}}
+	if src.anim != nil {
+		anim = &native.Animation{Delay: src.anim.Delay, LoopCount: src.anim.LoopCount}
+		anim.Frames = append(anim.Frames, src.anim.Frames...)
+	}
+	// frames are replaced, not modified, so the shared source stays intact
+	for i, fr := range anim.Frames {
+		img, err := nativeResize(fr, settings)
+		if err != nil {
+			return "", err
+		}
+		anim.Frames[i] = native.ToRGBA(img)
+	}
+	opts := native.GIFOptions{
+		Colors: intSetting(settings, "colors", 256, 2, 256),
+		Dither: ditherOn(settings),
+	}
+	encode, err := withMetadata("gif", input, settings, func(w io.Writer) error {
+		return native.EncodeGIF(w, anim, opts)
+	})
+	if err != nil {
+		return "", err
+	}
+	return writeVariant("gif", input, settings, encode)
+}
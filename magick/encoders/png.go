@@ -0,0 +1,80 @@
+package encoders
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+
+	"pixerver/logger"
+)
+
+// HandlePNG creates a PNG variant from input file. It writes a new file
+// named <base>_<width>_<height>.png (or _orig when width/height are zero)
+// and returns its path. Animated sources contribute their first frame.
+// Supported settings:
+//   - colors: integer 2-256; quantizes to a palette (PNG8) when set
+//   - dither: "none", "floyd-steinberg" (default) or "riemersma"
+//   - compression: zlib level 0-9 (default 9)
+//   - optimize: "true" runs zopflipng or oxipng when installed, otherwise
+//     tries every row filter at the highest compression level
+//   - interlace: "true" writes Adam7 interlaced output
+//   - metadata: "safe" (default) or "strip", see metadataPolicy
+func HandlePNG(name string, settings map[string]string) (string, error) {
+	return encodeMagick(pngFormat, name, settings)
+}
+
+var pngFormat = magickFormat{
+	name: "png",
+	// animated sources contribute their first frame
+	frames:  "[0]",
+	options: pngOptions,
+	post: func(out string, settings map[string]string) {
+		if boolSetting(settings, "optimize", false) {
+			optimizePNG(out)
+		}
+	},
+}
+
+// pngOptions builds the ImageMagick options for one PNG variant.
+func pngOptions(settings map[string]string) (string, []string, error) {
+	colors := intSetting(settings, "colors", 0, 2, 256)
+	compression := intSetting(settings, "compression", 9, 0, 9)
+	optimize := boolSetting(settings, "optimize", false)
+	interlace := boolSetting(settings, "interlace", false)
+
+	var args []string
+	if colors > 0 {
+		args = append(args, ditherArgs(settings)...)
+		args = append(args, "-colors", strconv.Itoa(colors))
+	}
+	if interlace {
+		args = append(args, "-interlace", "PNG")
+	}
+	args = append(args, "-define", fmt.Sprintf("png:compression-level=%d", compression))
+	if optimize {
+		// filter 5 = adaptive; strategy 1 = filtered. Close to what an
+		// external optimizer finds when none is available.
+		args = append(args, "-define", "png:compression-filter=5", "-define", "png:compression-strategy=1")
+	}
+	format := "png"
+	if colors > 0 {
+		format = "png8"
+	}
+	return format, args, nil
+}
+
+// optimizePNG recompresses path in place with zopflipng or oxipng if one is
+// on PATH. Failures are logged and leave the ImageMagick output in place.
+func optimizePNG(path string) {
+	if bin, err := exec.LookPath("zopflipng"); err == nil {
+		if out, err := exec.Command(bin, "-y", "--lossy_transparent", "--keepchunks=iCCP,eXIf,iTXt", path, path).CombinedOutput(); err != nil {
+			logger.Warnf("zopflipng failed on %s: %v: %s", path, err, string(out))
+		}
+		return
+	}
+	if bin, err := exec.LookPath("oxipng"); err == nil {
+		if out, err := exec.Command(bin, "-o", "4", "--quiet", path).CombinedOutput(); err != nil {
+			logger.Warnf("oxipng failed on %s: %v: %s", path, err, string(out))
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package encoders
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// Outcome records how a variant's final encoding parameters were chosen
+// by a targetSSIM, maxBytes or auto search.
+type Outcome struct {
+	Quality int `json:"quality"`
+	// SSIM is the score a targetSSIM search achieved.
+	SSIM float64 `json:"ssim,omitempty"`
+	// Scale is the factor a maxBytes search shrank the dimensions by.
+	Scale float64 `json:"scale,omitempty"`
+	// Candidates maps each format an "auto" job tried to its size in
+	// bytes; Alternates are the extra files it kept, e.g. its fallback.
+	Candidates map[string]int64 `json:"candidates,omitempty"`
+	Alternates []string         `json:"alternates,omitempty"`
+}
+
+// outcomePath is where the search outcome for the variant at out is kept.
+func outcomePath(out string) string {
+	return out + ".outcome.json"
+}
+
+// ReadOutcome returns the search outcome recorded for the variant at out,
+// if it was encoded with targetSSIM or maxBytes.
+func ReadOutcome(out string) (Outcome, bool) {
+	b, err := os.ReadFile(outcomePath(out))
+	if err != nil {
+		return Outcome{}, false
+	}
+	var o Outcome
+	if err := json.Unmarshal(b, &o); err != nil {
+		return Outcome{}, false
+	}
+	return o, true
+}
+
+// writeOutcome records o for the variant at out, replacing the sidecar in
+// one rename so a concurrent search never leaves a torn one.
+func writeOutcome(out string, o Outcome) error {
+	b, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	tmp, err := tmpFor(outcomePath(out))
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, outcomePath(out)); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// clearOutcome drops an outcome left at out by an earlier search, once out
+// has been rewritten without one.
+func clearOutcome(out string, err error) {
+	if err == nil && out != "" {
+		_ = os.Remove(outcomePath(out))
+	}
+}
+
+// searching reports whether settings ask for encoding parameters to be
+// searched rather than used as given.
+func searching(settings map[string]string) bool {
+	return settings["targetSSIM"] != "" || settings["maxBytes"] != ""
+}
+
+// withSearch wraps h with the targetSSIM and maxBytes searches. A maxBytes
+// search starts from whatever the targetSSIM search settled on.
+func withSearch(name string, h Handler) Handler {
+	search := withBudget(name, withTarget(name, h), h)
+	return func(input string, settings map[string]string) (string, error) {
+		if searching(settings) {
+			return search(input, settings)
+		}
+		out, err := h(input, settings)
+		clearOutcome(out, err)
+		return out, err
+	}
+}
+
+// searchBatch takes variants that need a search out of the batch, since
+// each encodes several candidates on its own; the rest are encoded
+// together by b.
+func searchBatch(single Handler, b BatchHandler) BatchHandler {
+	return func(input string, settings []map[string]string) ([]string, []error) {
+		outs := make([]string, len(settings))
+		errs := make([]error, len(settings))
+		var rest []int
+		for i, s := range settings {
+			if searching(s) {
+				outs[i], errs[i] = single(input, s)
+				continue
+			}
+			rest = append(rest, i)
+		}
+		if len(rest) == 0 {
+			return outs, errs
+		}
+		part := make([]map[string]string, len(rest))
+		for k, i := range rest {
+			part[k] = settings[i]
+		}
+		po, pe := b(input, part)
+		for k, i := range rest {
+			outs[i], errs[i] = po[k], pe[k]
+			clearOutcome(outs[i], errs[i])
+		}
+		return outs, errs
+	}
+}
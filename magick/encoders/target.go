@@ -0,0 +1,173 @@
+package encoders
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"maps"
+	"os"
+	"strconv"
+
+	"pixerver/logger"
+	"pixerver/native"
+)
+
+// targetFormats are the encoders whose quality a "targetSSIM" setting can
+// search.
+var targetFormats = map[string]bool{"jpg": true, "webp": true, "avif": true}
+
+// targetSetting parses "targetSSIM"; ok is false when it is unset.
+func targetSetting(settings map[string]string) (float64, bool, error) {
+	v, ok := settings["targetSSIM"]
+	if !ok || v == "" {
+		return 0, false, nil
+	}
+	t, err := strconv.ParseFloat(v, 64)
+	if err != nil || t <= 0 || t >= 1 {
+		return 0, false, fmt.Errorf("invalid targetSSIM %q: want a number between 0 and 1", v)
+	}
+	return t, true, nil
+}
+
+// withTarget wraps h so variants with a "targetSSIM" setting search for the
+// lowest quality that reaches it.
+func withTarget(name string, h Handler) Handler {
+	return func(input string, settings map[string]string) (string, error) {
+		target, ok, err := targetSetting(settings)
+		switch {
+		case err != nil:
+			return "", err
+		case !ok:
+			return h(input, settings)
+		case !targetFormats[name]:
+			return "", fmt.Errorf("targetSSIM is not supported by the %s encoder", name)
+		}
+		return searchQuality(name, input, settings, target, h)
+	}
+}
+
+// searchQuality binary-searches "quality" between the "minQuality" (default
+// 30) and "maxQuality" (default 95) settings for the lowest value whose
+// output scores at least target against a lossless rendering at the same
+// size. When no quality reaches the target, maxQuality is used. The chosen
+// quality and its score are recorded next to the output for ReadOutcome.
+func searchQuality(name, input string, settings map[string]string, target float64, encode Handler) (string, error) {
+	ref, err := referenceImage(name, input, settings)
+	if err != nil {
+		return "", fmt.Errorf("building %s reference: %w", name, err)
+	}
+	lo := intSetting(settings, "minQuality", 30, 1, 100)
+	hi := intSetting(settings, "maxQuality", 95, lo, 100)
+
+	scores := map[int]float64{}
+	try := func(q int) (string, error) {
+		s := maps.Clone(settings)
+		s["quality"] = strconv.Itoa(q)
+		out, err := encode(input, s)
+		if err != nil {
+			return "", err
+		}
+		img, err := decodeForMetric(out)
+		if err != nil {
+			return "", fmt.Errorf("decoding %s candidate: %w", name, err)
+		}
+		if scores[q], err = native.SSIM(ref, img); err != nil {
+			return "", err
+		}
+		logger.Debugf("%s target search: quality=%d ssim=%.5f", name, q, scores[q])
+		return out, nil
+	}
+
+	best, last := hi, 0
+	var out string
+	for l, h := lo, hi; l <= h; {
+		q := (l + h) / 2
+		if out, err = try(q); err != nil {
+			return "", err
+		}
+		last = q
+		if scores[q] >= target {
+			best, h = q, q-1
+		} else {
+			l = q + 1
+		}
+	}
+	// every candidate overwrites the same file, so re-encode the winner
+	if last != best {
+		if out, err = try(best); err != nil {
+			return "", err
+		}
+	}
+	if scores[best] < target {
+		logger.Warnf("%s target search: ssim %.5f at maximum quality %d is below target %.5f", name, scores[best], best, target)
+	}
+
+	if err := writeOutcome(out, Outcome{Quality: best, SSIM: scores[best]}); err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+// referenceImage renders input at the size and resize mode settings ask
+// for, without lossy compression, on the engine the variant uses.
+func referenceImage(name, input string, settings map[string]string) (image.Image, error) {
+	if engineFor(name, settings) == "native" {
+		src, err := decodeNative(input)
+		if err != nil {
+			return nil, err
+		}
+		return nativeResize(src.img, settings)
+	}
+	bin, err := magickBin()
+	if err != nil {
+		return nil, err
+	}
+	in, cleanup, err := magickInput(magickFormat{frames: "[0]"}, input)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	srcW, srcH := sourceSize(in)
+	resize, err := resizeArgs(settings, srcW, srcH)
+	if err != nil {
+		return nil, err
+	}
+	colorBefore, _, err := colorArgs(name, in, settings)
+	if err != nil {
+		return nil, err
+	}
+	ops := append([]string{"-auto-orient"}, colorBefore...)
+	return magickToImage(name, bin, in, append(ops, resize...))
+}
+
+// decodeForMetric decodes an encoded candidate, through ImageMagick for
+// formats the standard library can't read.
+func decodeForMetric(p string) (image.Image, error) {
+	img, err := native.Decode(p)
+	if !errors.Is(err, native.ErrUnsupported) {
+		return img, err
+	}
+	bin, err := magickBin()
+	if err != nil {
+		return nil, err
+	}
+	return magickToImage("metric", bin, p+"[0]", nil)
+}
+
+// magickToImage runs input through ops into a temporary PNG and decodes it.
+func magickToImage(name, bin, input string, ops []string) (image.Image, error) {
+	tmp, err := os.CreateTemp("", "metric-*.png")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	args := limitArgs()
+	args = append(args, input)
+	args = append(args, ops...)
+	args = append(args, "png:"+tmp.Name())
+	if err := execMagick(name, bin, args); err != nil {
+		return nil, err
+	}
+	return native.Decode(tmp.Name())
+}
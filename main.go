@@ -1,12 +1,40 @@
 package main
 
 import (
+	"context"
+	"net/http"
 	"os"
+	"strconv"
 
+	"pixerver/database/apikeys"
+	"pixerver/database/credentials"
+	"pixerver/database/dedup"
+	"pixerver/database/history"
+	"pixerver/database/tasks"
+	"pixerver/handlers"
 	"pixerver/internal/env"
 	"pixerver/logger"
+	"pixerver/ratelimit"
+	"pixerver/worker"
 )
 
+const (
+	queueStream = "pixerver:jobs"
+	queueGroup  = "workers"
+)
+
+// consumerName identifies this process in the queue's consumer group.
+func consumerName() string {
+	if c := os.Getenv("QUEUE_CONSUMER"); c != "" {
+		return c
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "pixerver"
+	}
+	return host + "-" + strconv.Itoa(os.Getpid())
+}
+
 func main() {
 	// load .env early (if present) so other packages can rely on env vars
 	if _, err := os.Stat(".env"); err == nil {
@@ -24,8 +52,83 @@ func main() {
 	cfg.Debug.Enabled = &trueVal
 	logger.Init(cfg)
 
-	logger.Debug("debug message: starting application")
-	logger.Info("info message: application running")
-	logger.Warn("warn message: demo warning")
-	logger.Error("error message: demo error")
+	if len(os.Args) > 1 && os.Args[1] == "apikey" {
+		os.Exit(runAPIKeyCommand(os.Args[2:]))
+	}
+
+	if _, err := apikeys.CreateDB(); err != nil {
+		logger.Errorf("failed to open api key store: %v", err)
+		os.Exit(1)
+	}
+	defer apikeys.CloseDB()
+	if _, err := tasks.CreateDB(); err != nil {
+		logger.Errorf("failed to open task store: %v", err)
+		os.Exit(1)
+	}
+	defer tasks.CloseDB()
+	if _, err := history.CreateDB(); err != nil {
+		logger.Errorf("failed to open history store: %v", err)
+		os.Exit(1)
+	}
+	defer history.CloseDB()
+	if _, err := credentials.CreateDB(); err != nil {
+		logger.Errorf("failed to open credentials store: %v", err)
+		os.Exit(1)
+	}
+	defer credentials.CloseDB()
+
+	if _, err := tasks.CreateQueue(queueStream, queueGroup, consumerName()); err != nil {
+		logger.Errorf("failed to open task queue: %v", err)
+		os.Exit(1)
+	}
+	defer tasks.CloseQueue()
+	if _, err := dedup.CreateDB(); err != nil {
+		logger.Errorf("failed to open dedup store: %v", err)
+		os.Exit(1)
+	}
+	defer dedup.CloseDB()
+
+	limiter, err := ratelimit.New("ratelimit:", ratelimit.DefaultsFromEnv())
+	if err != nil {
+		logger.Errorf("failed to start rate limiter: %v", err)
+		os.Exit(1)
+	}
+	defer limiter.Close()
+
+	// WORKER_CONCURRENCY=0 runs an API-only process
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if wopts := worker.OptionsFromEnv(limiter); wopts.Concurrency > 0 {
+		go worker.Run(ctx, wopts)
+		logger.Infof("worker started with %d slots", wopts.Concurrency)
+	}
+	go handlers.RunTusExpiry(ctx)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /upload", handlers.Authenticate(handlers.RateLimit(limiter, handlers.PostFormHandler)))
+	mux.HandleFunc("POST /ingest", handlers.Authenticate(handlers.RateLimit(limiter, handlers.IngestHandler)))
+	mux.HandleFunc("POST /bulk", handlers.Authenticate(handlers.RateLimit(limiter, handlers.BulkHandler)))
+	mux.HandleFunc("GET /img/{signature}/{options}/{sourceKey...}", handlers.RateLimit(limiter, handlers.ImageHandler))
+	mux.HandleFunc("GET /assets/{sha}/{resolution}", handlers.RateLimit(limiter, handlers.AssetsHandler))
+	mux.HandleFunc("GET /assets/{tenant}/{sha}/{resolution}", handlers.RateLimit(limiter, handlers.AssetsHandler))
+	mux.HandleFunc("OPTIONS /files/", handlers.TusOptionsHandler)
+	mux.HandleFunc("POST /files/", handlers.Authenticate(handlers.RateLimit(limiter, handlers.TusCreateHandler)))
+	mux.HandleFunc("HEAD /files/{id}", handlers.Authenticate(handlers.TusHeadHandler))
+	mux.HandleFunc("PATCH /files/{id}", handlers.Authenticate(handlers.RateLimit(limiter, handlers.TusPatchHandler)))
+	mux.HandleFunc("DELETE /files/{id}", handlers.Authenticate(handlers.TusDeleteHandler))
+	mux.HandleFunc("GET /tasks", handlers.Authenticate(handlers.TaskListHandler))
+	mux.HandleFunc("GET /tasks/{id}", handlers.Authenticate(handlers.TaskStatusHandler))
+	mux.HandleFunc("GET /requests/{id}", handlers.Authenticate(handlers.RequestStatusHandler))
+	mux.HandleFunc("GET /admin/quota", handlers.AdminOnly(handlers.QuotaHandler(limiter)))
+	mux.HandleFunc("PUT /admin/limits", handlers.AdminOnly(handlers.LimitsHandler(limiter)))
+
+	addr := os.Getenv("LISTEN_ADDR")
+	if addr == "" {
+		addr = ":8080"
+	}
+	logger.Infof("listening on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Errorf("server stopped: %v", err)
+		os.Exit(1)
+	}
 }
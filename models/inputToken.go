@@ -2,9 +2,15 @@ package models
 
 import (
 	"errors"
+	"fmt"
+	"math"
 	"net/url"
 )
 
+// MaxDensity is the highest device pixel ratio a variant may be produced
+// at, by a token's densities or an /img dpr.
+const MaxDensity = 4
+
 // ConversionJob describes a single conversion to perform.
 type ConversionJob struct {
 	Type                string   `json:"type"`
@@ -12,16 +18,39 @@ type ConversionJob struct {
 	Transformers        []string `json:"transformers"`
 	DestinationBackends []string `json:"destinationBackends"`
 	KeepOriginal        bool     `json:"keepOriginal"`
+	// Densities lists device pixel ratios (e.g. 1, 2, 3) to produce for
+	// every resolution; each density becomes its own job with the
+	// resolution scaled by it. Empty means 1x only; each must be in
+	// (0, MaxDensity].
+	Densities []float64 `json:"densities,omitempty"`
 	// Settings is a map[string]string with values encoded as strings to match
 	// the expected Go types. Numeric values in JSON should be quoted so they
 	// unmarshal as strings (e.g. "quality": "80").
 	Settings map[string]string `json:"settings"`
 }
 
-// Resolution represents an image size.
+// Resolution represents an image size. Either Width or Height may be zero
+// to follow the source aspect ratio. Mode is one of "fit" (default),
+// "cover" (fill the box and crop at Gravity), "pad" (fit and pad to the box
+// with Background) or "stretch"; sources are never enlarged unless
+// AllowUpscale is set.
 type Resolution struct {
-	Width  int `json:"width"`
-	Height int `json:"height"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	Mode         string `json:"mode,omitempty"`
+	Gravity      string `json:"gravity,omitempty"`
+	Background   string `json:"background,omitempty"`
+	AllowUpscale bool   `json:"allowUpscale,omitempty"`
+}
+
+// Scale returns r with its size multiplied by d, rounded to whole pixels.
+func (r Resolution) Scale(d float64) Resolution {
+	if d == 1 {
+		return r
+	}
+	r.Width = int(math.Round(float64(r.Width) * d))
+	r.Height = int(math.Round(float64(r.Height) * d))
+	return r
 }
 
 // InputToken is the top-level structure of baseToken.json supplied to the service.
@@ -31,6 +60,9 @@ type InputToken struct {
 	Transformers   map[string]string     `json:"transformers"`
 	Resolutions    map[string]Resolution `json:"resolutions"`
 	ConversionJobs []ConversionJob       `json:"conversionJobs"`
+	// Copyright, if set, is written into every variant's EXIF and XMP
+	// unless a conversion job sets its own "copyright" setting.
+	Copyright string `json:"copyright,omitempty"`
 }
 
 // Validate performs basic sanity checks on the token.
@@ -50,6 +82,13 @@ func (t *InputToken) Validate() error {
 	if len(t.ConversionJobs) == 0 {
 		return errors.New("at least one conversion job is required")
 	}
+	for i, cj := range t.ConversionJobs {
+		for _, d := range cj.Densities {
+			if !(d > 0 && d <= MaxDensity) {
+				return fmt.Errorf("conversion job %d: density %v out of range (0, %d]", i, d, MaxDensity)
+			}
+		}
+	}
 	return nil
 }
 
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"math"
 	"testing"
 )
 
@@ -29,6 +30,19 @@ func TestInputToken_ValidateErrors(t *testing.T) {
 	if err := tkn5.Validate(); err == nil {
 		t.Fatalf("expected error for missing conversion jobs")
 	}
+
+	for _, ds := range [][]float64{{0}, {1, -2}, {50}, {math.NaN()}} {
+		tkn := &InputToken{CallbackURL: "https://example.local/callback", Backends: map[string]string{"b": "v"},
+			ConversionJobs: []ConversionJob{{Densities: ds}}}
+		if err := tkn.Validate(); err == nil {
+			t.Fatalf("expected error for densities %v", ds)
+		}
+	}
+	ok := &InputToken{CallbackURL: "https://example.local/callback", Backends: map[string]string{"b": "v"},
+		ConversionJobs: []ConversionJob{{Densities: []float64{1, 1.5, 4}}}}
+	if err := ok.Validate(); err != nil {
+		t.Fatalf("valid densities rejected: %v", err)
+	}
 }
 
 func TestInputToken_GetResolutionAndBackend(t *testing.T) {
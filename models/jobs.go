@@ -11,14 +11,67 @@ that the system processes. and jobs are just broken up combintions of resolution
 and types (we have not broken up destination backends as its pointless to rencode images just for writing them to different storage backends).
 */
 type Job struct {
-	ID                    string            `json:"id"`
-	SourceFileName        string            `json:"sourceFileName"`
+	ID             string `json:"id"`
+	RequestID      string `json:"requestId,omitempty"`
+	Tenant         string `json:"tenant,omitempty"`
+	QuotaKey       string `json:"quotaKey,omitempty"`
+	SourceFileName string `json:"sourceFileName"`
+	SourceSHA256   string `json:"sourceSha256,omitempty"`
+	// Source is a "backend:key" reference to an original in one of the
+	// token's backends; the worker fetches it before encoding.
+	Source                string            `json:"source,omitempty"`
 	Type                  string            `json:"type"`
 	Status                string            `json:"status"`
 	Settings              map[string]string `json:"settings"`
 	TransformerID         string            `json:"transformerId"`
 	Resolution            Resolution        `json:"resolution"`
 	DestinationBackendIDs []string          `json:"destinationBackendIds"`
+	Outputs               []Output          `json:"outputs,omitempty"`
+	Error                 string            `json:"error,omitempty"`
+	// Density is the device pixel ratio Resolution was scaled by, set
+	// when the conversion job asked for densities.
+	Density float64 `json:"density,omitempty"`
+	// Variant describes the file the job produced, once it is done.
+	Variant *Variant `json:"variant,omitempty"`
+	// Alternates are files kept besides the main output, e.g. the JPEG
+	// fallback of an "auto" job.
+	Alternates []Alternate `json:"alternates,omitempty"`
+	// ResolutionName is the token resolution the job renders.
+	ResolutionName string `json:"resolutionName,omitempty"`
+}
+
+// Alternate is an extra file a job delivered, with where it went.
+type Alternate struct {
+	Variant
+	Outputs []Output `json:"outputs"`
+}
+
+// Output is one file a job wrote to a destination backend. URL is set when
+// the backend has a public URL.
+type Output struct {
+	Backend string `json:"backend"`
+	Key     string `json:"key"`
+	URL     string `json:"url,omitempty"`
+}
+
+// Variant describes an encoded file. Width and Height are the actual pixel
+// size, which can be smaller than requested when upscaling is off.
+type Variant struct {
+	Format      string `json:"format"`
+	ContentType string `json:"contentType"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Bytes       int64  `json:"bytes"`
+	SHA256      string `json:"sha256,omitempty"`
+	// Quality, SSIM and Scale are what a targetSSIM or maxBytes search
+	// settled on: the quality, the score it achieved and the factor the
+	// dimensions were shrunk by.
+	Quality int     `json:"quality,omitempty"`
+	SSIM    float64 `json:"ssim,omitempty"`
+	Scale   float64 `json:"scale,omitempty"`
+	// Candidates maps every format an "auto" job encoded to its size in
+	// bytes.
+	Candidates map[string]int64 `json:"candidates,omitempty"`
 }
 
 // ConversionJobs is a convenience alias for a slice of ConversionJob
@@ -44,21 +97,44 @@ func (cjs ConversionJobs) ToJobs(resMap map[string]Resolution) []Job {
 				continue
 			}
 
-			job := Job{
-				ID:                    uuidv7.New(),
-				Type:                  cj.Type,
-				Status:                "pending",
-				Settings:              cj.Settings,
-				TransformerID:         "",
-				Resolution:            res,
-				DestinationBackendIDs: cj.DestinationBackends,
-			}
+			for _, d := range densities(cj.Densities, res) {
+				job := Job{
+					ID:                    uuidv7.New(),
+					Type:                  cj.Type,
+					Status:                "pending",
+					Settings:              cj.Settings,
+					TransformerID:         "",
+					Resolution:            res.Scale(d),
+					ResolutionName:        rname,
+					DestinationBackendIDs: cj.DestinationBackends,
+				}
+				if len(cj.Densities) > 0 {
+					job.Density = d
+				}
 
-			if len(cj.Transformers) > 0 {
-				job.TransformerID = cj.Transformers[0]
+				if len(cj.Transformers) > 0 {
+					job.TransformerID = cj.Transformers[0]
+				}
+
+				out = append(out, job)
 			}
+		}
+	}
+	return out
+}
 
-			out = append(out, job)
+// densities returns the distinct positive densities to produce for res, in
+// the order given. A resolution without a size (the original) only has 1x.
+func densities(list []float64, res Resolution) []float64 {
+	if len(list) == 0 || (res.Width == 0 && res.Height == 0) {
+		return []float64{1}
+	}
+	var out []float64
+	seen := map[float64]bool{}
+	for _, d := range list {
+		if d > 0 && !seen[d] {
+			seen[d] = true
+			out = append(out, d)
 		}
 	}
 	return out
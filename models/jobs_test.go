@@ -79,3 +79,31 @@ func TestConversionJobs_ToJobs(t *testing.T) {
 		}
 	}
 }
+
+func TestConversionJobs_ToJobsDensities(t *testing.T) {
+	res := map[string]Resolution{
+		"medium":   {Width: 400, Height: 300, Mode: "cover"},
+		"original": {},
+	}
+	cjs := ConversionJobs{{Type: "webp", Resolutions: []string{"medium", "original"}, Densities: []float64{1, 2, 1.5, 2, 0}}}
+	jobs := cjs.ToJobs(res)
+	if len(jobs) != 4 {
+		t.Fatalf("expected 3 densities for medium and 1 for original, got %d jobs", len(jobs))
+	}
+	want := []struct {
+		w, h    int
+		density float64
+	}{{400, 300, 1}, {800, 600, 2}, {600, 450, 1.5}, {0, 0, 1}}
+	for i, w := range want {
+		j := jobs[i]
+		if j.Resolution.Width != w.w || j.Resolution.Height != w.h || j.Density != w.density {
+			t.Fatalf("job %d: got %dx%d@%v, want %dx%d@%v", i, j.Resolution.Width, j.Resolution.Height, j.Density, w.w, w.h, w.density)
+		}
+	}
+	if jobs[1].Resolution.Mode != "cover" {
+		t.Fatalf("scaling must keep the resize mode")
+	}
+	if jobs := (ConversionJobs{{Type: "webp", Resolutions: []string{"medium"}}}).ToJobs(res); len(jobs) != 1 || jobs[0].Density != 0 {
+		t.Fatalf("no densities should give one unlabeled job, got %+v", jobs)
+	}
+}
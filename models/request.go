@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+)
+
+// Request is one submitted source together with the token that describes
+// what to produce from it. All jobs expanded from the token share the
+// request's ID, which is what status queries and callbacks refer to.
+type Request struct {
+	ID             string     `json:"id"`
+	Tenant         string     `json:"tenant,omitempty"`
+	SourceFileName string     `json:"sourceFileName"`
+	SourceSHA256   string     `json:"sourceSha256"`
+	Source         string     `json:"source,omitempty"`
+	ContentType    string     `json:"contentType"`
+	Token          InputToken `json:"token"`
+	JobIDs         []string   `json:"jobIds"`
+	Status         string     `json:"status"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	// Originals lists where the untouched source was stored for
+	// conversion jobs with keepOriginal set.
+	Originals []Output `json:"originals,omitempty"`
+}
@@ -0,0 +1,408 @@
+package native
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"math"
+	"sync"
+)
+
+// ErrUnsupportedProfile is returned by ToSRGB for profiles it can't apply:
+// anything but an RGB matrix/TRC profile, such as CMYK or LUT-based ones.
+var ErrUnsupportedProfile = errors.New("native: unsupported icc profile")
+
+// srgbPrimaries are the sRGB red, green and blue colorants adapted to the
+// D50 profile connection space, as ICC profiles store them.
+var srgbPrimaries = [3][3]float64{
+	{0.4360747, 0.2225045, 0.0139322},
+	{0.3850649, 0.7168786, 0.0971045},
+	{0.1430804, 0.0606169, 0.7141733},
+}
+
+// d50 is the PCS illuminant.
+var d50 = [3]float64{0.9642, 1.0, 0.8249}
+
+var (
+	srgbOnce    sync.Once
+	srgbProfile []byte
+)
+
+// SRGBProfile returns a compact ICC v2 sRGB display profile (under 1 KB),
+// suitable for embedding in variants.
+func SRGBProfile() []byte {
+	srgbOnce.Do(func() { srgbProfile = buildSRGBProfile() })
+	return srgbProfile
+}
+
+func buildSRGBProfile() []byte {
+	trc := make([]uint16, 256)
+	for i := range trc {
+		trc[i] = uint16(math.Round(srgbToLinear(float64(i)/255) * 65535))
+	}
+	curv := append([]byte("curv\x00\x00\x00\x00"), be32(uint32(len(trc)))...)
+	for _, v := range trc {
+		curv = binary.BigEndian.AppendUint16(curv, v)
+	}
+	tags := []struct {
+		sig  string
+		data []byte
+	}{
+		{"desc", iccDesc("sRGB")},
+		{"cprt", append([]byte("text\x00\x00\x00\x00"), "No copyright, use freely\x00"...)},
+		{"wtpt", iccXYZ(d50)},
+		{"rXYZ", iccXYZ(srgbPrimaries[0])},
+		{"gXYZ", iccXYZ(srgbPrimaries[1])},
+		{"bXYZ", iccXYZ(srgbPrimaries[2])},
+		{"rTRC", curv},
+		{"gTRC", curv},
+		{"bTRC", curv},
+	}
+
+	offset := 128 + 4 + 12*len(tags)
+	table := be32(uint32(len(tags)))
+	var data []byte
+	placed := map[string]int{}
+	for _, t := range tags {
+		// the three curves are identical, so they share one copy
+		at, ok := placed[string(t.data)]
+		if !ok {
+			at = offset + len(data)
+			placed[string(t.data)] = at
+			data = append(data, t.data...)
+			for len(data)%4 != 0 {
+				data = append(data, 0)
+			}
+		}
+		table = append(table, t.sig...)
+		table = append(table, be32(uint32(at))...)
+		table = append(table, be32(uint32(len(t.data)))...)
+	}
+
+	hdr := make([]byte, 128)
+	binary.BigEndian.PutUint32(hdr[0:], uint32(128+len(table)+len(data)))
+	binary.BigEndian.PutUint32(hdr[8:], 0x02100000)
+	copy(hdr[12:], "mntrRGB XYZ ")
+	// creation date: 2024-01-01 00:00:00
+	binary.BigEndian.PutUint16(hdr[24:], 2024)
+	binary.BigEndian.PutUint16(hdr[26:], 1)
+	binary.BigEndian.PutUint16(hdr[28:], 1)
+	copy(hdr[36:], "acsp")
+	copy(hdr[68:], iccXYZ(d50)[8:])
+
+	out := append(hdr, table...)
+	return append(out, data...)
+}
+
+func be32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+
+// iccXYZ encodes an XYZType tag.
+func iccXYZ(v [3]float64) []byte {
+	b := []byte("XYZ \x00\x00\x00\x00")
+	for _, c := range v {
+		b = binary.BigEndian.AppendUint32(b, uint32(int32(math.Round(c*65536))))
+	}
+	return b
+}
+
+// iccDesc encodes an ASCII-only textDescriptionType tag.
+func iccDesc(s string) []byte {
+	b := []byte("desc\x00\x00\x00\x00")
+	b = append(b, be32(uint32(len(s)+1))...)
+	b = append(b, s...)
+	b = append(b, 0)
+	// no Unicode or ScriptCode description
+	return append(b, make([]byte, 4+4+2+1+67)...)
+}
+
+func srgbToLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// ProfileColorSpace returns the data color space an ICC profile declares,
+// e.g. "RGB", "CMYK" or "GRAY"; "" when p is too short to be a profile.
+func ProfileColorSpace(p []byte) string {
+	if len(p) < 20 {
+		return ""
+	}
+	return string(bytes.TrimRight(p[16:20], " "))
+}
+
+// rgbProfile is the part of an RGB matrix/TRC profile ToSRGB needs.
+type rgbProfile struct {
+	matrix [3][3]float64 // columns are the red, green and blue colorants
+	trc    [3][256]float64
+}
+
+// parseRGBProfile reads the colorants and tone curves of p.
+func parseRGBProfile(p []byte) (*rgbProfile, error) {
+	if len(p) < 132 || ProfileColorSpace(p) != "RGB" {
+		return nil, ErrUnsupportedProfile
+	}
+	tags := map[string][]byte{}
+	n := int(binary.BigEndian.Uint32(p[128:]))
+	for i := 0; i < n && 132+12*i+12 <= len(p); i++ {
+		e := p[132+12*i:]
+		off, size := int(binary.BigEndian.Uint32(e[4:])), int(binary.BigEndian.Uint32(e[8:]))
+		if off < 0 || size < 0 || off+size > len(p) || off+size < off {
+			return nil, fmt.Errorf("native: icc tag %q out of bounds", e[:4])
+		}
+		tags[string(e[:4])] = p[off : off+size]
+	}
+	var rp rgbProfile
+	for c, sig := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		t := tags[sig]
+		if len(t) < 20 || string(t[:4]) != "XYZ " {
+			return nil, ErrUnsupportedProfile
+		}
+		for k := 0; k < 3; k++ {
+			rp.matrix[k][c] = float64(int32(binary.BigEndian.Uint32(t[8+4*k:]))) / 65536
+		}
+	}
+	for c, sig := range []string{"rTRC", "gTRC", "bTRC"} {
+		curve, err := parseTRC(tags[sig])
+		if err != nil {
+			return nil, err
+		}
+		for i := range rp.trc[c] {
+			rp.trc[c][i] = curve(float64(i) / 255)
+		}
+	}
+	return &rp, nil
+}
+
+// parseTRC returns the tone curve of a curveType or parametricCurveType
+// tag, mapping encoded values in [0,1] to linear light.
+func parseTRC(t []byte) (func(float64) float64, error) {
+	if len(t) < 12 {
+		return nil, ErrUnsupportedProfile
+	}
+	switch string(t[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(t[8:]))
+		if len(t) < 12+2*n {
+			return nil, ErrUnsupportedProfile
+		}
+		switch n {
+		case 0:
+			return func(v float64) float64 { return v }, nil
+		case 1:
+			g := float64(binary.BigEndian.Uint16(t[12:])) / 256
+			return func(v float64) float64 { return math.Pow(v, g) }, nil
+		}
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(t[12+2*i:])) / 65535
+		}
+		return func(v float64) float64 {
+			x := v * float64(n-1)
+			i := min(int(x), n-2)
+			return table[i] + (table[i+1]-table[i])*(x-float64(i))
+		}, nil
+	case "para":
+		counts := []int{1, 3, 4, 5, 7}
+		fn := int(binary.BigEndian.Uint16(t[8:]))
+		if fn >= len(counts) || len(t) < 12+4*counts[fn] {
+			return nil, ErrUnsupportedProfile
+		}
+		// g, a, b, c, d, e, f as in ICC.1 parametricCurveType
+		var k [7]float64
+		for i := 0; i < counts[fn]; i++ {
+			k[i] = float64(int32(binary.BigEndian.Uint32(t[12+4*i:]))) / 65536
+		}
+		g, a, b, c, d, e, f := k[0], k[1], k[2], k[3], k[4], k[5], k[6]
+		return func(v float64) float64 {
+			switch fn {
+			case 0:
+				return math.Pow(v, g)
+			case 1:
+				if v >= -b/a {
+					return math.Pow(a*v+b, g)
+				}
+				return 0
+			case 2:
+				if v >= -b/a {
+					return math.Pow(a*v+b, g) + c
+				}
+				return c
+			case 3:
+				if v >= d {
+					return math.Pow(a*v+b, g)
+				}
+				return c * v
+			default:
+				if v >= d {
+					return math.Pow(a*v+b, g) + e
+				}
+				return c*v + f
+			}
+		}, nil
+	}
+	return nil, ErrUnsupportedProfile
+}
+
+// ToSRGB converts img, whose colors are described by the ICC profile p, to
+// sRGB. Only RGB matrix/TRC profiles (sRGB, Display P3, Adobe RGB and the
+// like) are supported; others return ErrUnsupportedProfile. Profiles that
+// already match sRGB return img unchanged.
+func ToSRGB(img image.Image, p []byte) (image.Image, error) {
+	rp, err := parseRGBProfile(p)
+	if err != nil {
+		return nil, err
+	}
+	m := mul3(inv3(transpose3(srgbPrimaries)), rp.matrix)
+	if isSRGB(rp, m) {
+		return img, nil
+	}
+
+	var enc [4096]uint8
+	for i := range enc {
+		enc[i] = uint8(math.Round(linearToSRGB(float64(i)/4095) * 255))
+	}
+	encode := func(v float64) uint8 {
+		return enc[int(math.Round(min(max(v, 0), 1)*4095))]
+	}
+
+	src := toNRGBA(img)
+	out := image.NewNRGBA(src.Rect)
+	for i := 0; i+3 < len(src.Pix); i += 4 {
+		r, g, b := rp.trc[0][src.Pix[i]], rp.trc[1][src.Pix[i+1]], rp.trc[2][src.Pix[i+2]]
+		out.Pix[i] = encode(m[0][0]*r + m[0][1]*g + m[0][2]*b)
+		out.Pix[i+1] = encode(m[1][0]*r + m[1][1]*g + m[1][2]*b)
+		out.Pix[i+2] = encode(m[2][0]*r + m[2][1]*g + m[2][2]*b)
+		out.Pix[i+3] = src.Pix[i+3]
+	}
+	return out, nil
+}
+
+// isSRGB reports whether a profile is sRGB to within 8-bit precision: the
+// conversion matrix m is about identity and the curves match.
+func isSRGB(rp *rgbProfile, m [3][3]float64) bool {
+	for r := 0; r < 3; r++ {
+		for c := 0; c < 3; c++ {
+			want := 0.0
+			if r == c {
+				want = 1
+			}
+			if math.Abs(m[r][c]-want) > 0.002 {
+				return false
+			}
+		}
+	}
+	for c := range rp.trc {
+		for i, v := range rp.trc[c] {
+			if math.Abs(v-srgbToLinear(float64(i)/255)) > 0.002 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// toNRGBA returns img as a tightly packed NRGBA with a zero origin.
+func toNRGBA(img image.Image) *image.NRGBA {
+	b := img.Bounds()
+	out := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			out.Set(x, y, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return out
+}
+
+func transpose3(a [3][3]float64) [3][3]float64 {
+	var t [3][3]float64
+	for r := 0; r < 3; r++ {
+		for c := 0; c < 3; c++ {
+			t[r][c] = a[c][r]
+		}
+	}
+	return t
+}
+
+func mul3(a, b [3][3]float64) [3][3]float64 {
+	var m [3][3]float64
+	for r := 0; r < 3; r++ {
+		for c := 0; c < 3; c++ {
+			for k := 0; k < 3; k++ {
+				m[r][c] += a[r][k] * b[k][c]
+			}
+		}
+	}
+	return m
+}
+
+func inv3(a [3][3]float64) [3][3]float64 {
+	det := a[0][0]*(a[1][1]*a[2][2]-a[1][2]*a[2][1]) -
+		a[0][1]*(a[1][0]*a[2][2]-a[1][2]*a[2][0]) +
+		a[0][2]*(a[1][0]*a[2][1]-a[1][1]*a[2][0])
+	var m [3][3]float64
+	m[0][0] = (a[1][1]*a[2][2] - a[1][2]*a[2][1]) / det
+	m[0][1] = (a[0][2]*a[2][1] - a[0][1]*a[2][2]) / det
+	m[0][2] = (a[0][1]*a[1][2] - a[0][2]*a[1][1]) / det
+	m[1][0] = (a[1][2]*a[2][0] - a[1][0]*a[2][2]) / det
+	m[1][1] = (a[0][0]*a[2][2] - a[0][2]*a[2][0]) / det
+	m[1][2] = (a[0][2]*a[1][0] - a[0][0]*a[1][2]) / det
+	m[2][0] = (a[1][0]*a[2][1] - a[1][1]*a[2][0]) / det
+	m[2][1] = (a[0][1]*a[2][0] - a[0][0]*a[2][1]) / det
+	m[2][2] = (a[0][0]*a[1][1] - a[0][1]*a[1][0]) / det
+	return m
+}
+
+// EmbedICC returns an encoded JPEG or PNG with profile p added: as APP2
+// segments after the SOI marker, or an iCCP chunk after IHDR.
+func EmbedICC(data []byte, format string, p []byte) ([]byte, error) {
+	switch format {
+	case "jpeg", "jpg":
+		if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+			return nil, fmt.Errorf("native: not a jpeg")
+		}
+		const chunk = 65535 - 2 - 14
+		count := (len(p) + chunk - 1) / chunk
+		if count > 255 {
+			return nil, fmt.Errorf("native: icc profile too large for jpeg")
+		}
+		out := append([]byte{}, data[:2]...)
+		for i := 0; i < count; i++ {
+			part := p[i*chunk : min((i+1)*chunk, len(p))]
+			out = append(out, 0xFF, 0xE2)
+			out = binary.BigEndian.AppendUint16(out, uint16(2+14+len(part)))
+			out = append(out, "ICC_PROFILE\x00"...)
+			out = append(out, byte(i+1), byte(count))
+			out = append(out, part...)
+		}
+		return append(out, data[2:]...), nil
+	case "png":
+		// signature, then the 25-byte IHDR chunk
+		const ihdrEnd = 8 + 25
+		if len(data) < ihdrEnd || string(data[12:16]) != "IHDR" {
+			return nil, fmt.Errorf("native: not a png")
+		}
+		var z bytes.Buffer
+		zw := zlib.NewWriter(&z)
+		zw.Write(p)
+		zw.Close()
+		body := append([]byte("iCCPICC profile\x00\x00"), z.Bytes()...)
+		out := append([]byte{}, data[:ihdrEnd]...)
+		out = binary.BigEndian.AppendUint32(out, uint32(len(body)-4))
+		out = append(out, body...)
+		out = binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(body))
+		return append(out, data[ihdrEnd:]...), nil
+	}
+	return nil, fmt.Errorf("native: can't embed an icc profile in %s", format)
+}
@@ -0,0 +1,190 @@
+// Package native is a pure-Go image pipeline: decode with the standard
+// image packages, resample, and encode JPEG, PNG and GIF. It lets those
+// formats be produced without an ImageMagick binary.
+package native
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+
+	"pixerver/internal/imagetype"
+)
+
+// ErrUnsupported is returned for sources the standard decoders can't read.
+var ErrUnsupported = errors.New("native: unsupported source format")
+
+// ErrTooLarge is returned when decoding a source would hold more pixels
+// in memory than allowed.
+var ErrTooLarge = errors.New("native: source exceeds the decoded pixel budget")
+
+// Decode reads the first (or only) image in the file at path.
+func Decode(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(bufio.NewReader(f))
+	if errors.Is(err, image.ErrFormat) {
+		return nil, ErrUnsupported
+	}
+	return img, err
+}
+
+// Animation is a decoded GIF with every frame coalesced to the full canvas.
+type Animation struct {
+	Frames    []*image.RGBA
+	Delay     []int
+	LoopCount int
+}
+
+// DecodeAnimation reads all frames of a GIF, compositing each onto the
+// canvas according to the previous frame's disposal so every frame is a
+// complete picture that can be resized on its own. Every coalesced frame
+// is a full-canvas RGBA image, so when maxPixels > 0 the headers are read
+// first and a GIF whose frames times canvas area exceeds it fails with
+// ErrTooLarge before anything is decoded.
+func DecodeAnimation(path string, maxPixels int64) (*Animation, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if maxPixels > 0 {
+		info, err := imagetype.Probe(f, imagetype.GIF)
+		if err != nil {
+			return nil, err
+		}
+		if total := info.Pixels() * int64(info.Frames); total > maxPixels {
+			return nil, fmt.Errorf("%w: %d frames of %dx%d are %d pixels, limit %d",
+				ErrTooLarge, info.Frames, info.Width, info.Height, total, maxPixels)
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+	g, err := gif.DecodeAll(bufio.NewReader(f))
+	if err != nil {
+		return nil, err
+	}
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	canvas := image.NewRGBA(bounds)
+	a := &Animation{LoopCount: g.LoopCount}
+	for i, fr := range g.Image {
+		var restore *image.RGBA
+		if i < len(g.Disposal) && g.Disposal[i] == gif.DisposalPrevious {
+			restore = cloneRGBA(canvas)
+		}
+		draw.Draw(canvas, fr.Bounds(), fr, fr.Bounds().Min, draw.Over)
+		a.Frames = append(a.Frames, cloneRGBA(canvas))
+		a.Delay = append(a.Delay, g.Delay[i])
+		if i < len(g.Disposal) {
+			switch g.Disposal[i] {
+			case gif.DisposalBackground:
+				draw.Draw(canvas, fr.Bounds(), image.Transparent, image.Point{}, draw.Src)
+			case gif.DisposalPrevious:
+				canvas = restore
+			}
+		}
+	}
+	return a, nil
+}
+
+func cloneRGBA(m *image.RGBA) *image.RGBA {
+	c := image.NewRGBA(m.Rect)
+	copy(c.Pix, m.Pix)
+	return c
+}
+
+// EncodeJPEG writes img as a baseline JPEG. The standard encoder has no
+// progressive mode and writes no metadata.
+func EncodeJPEG(w io.Writer, img image.Image, quality int) error {
+	return jpeg.Encode(w, flatten(img), &jpeg.Options{Quality: quality})
+}
+
+// flatten composites img over white, since JPEG has no alpha.
+func flatten(img image.Image) image.Image {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+		return img
+	}
+	b := img.Bounds()
+	dst := image.NewRGBA(b)
+	draw.Draw(dst, b, image.White, image.Point{}, draw.Src)
+	draw.Draw(dst, b, img, b.Min, draw.Over)
+	return dst
+}
+
+// PNGOptions controls EncodePNG.
+type PNGOptions struct {
+	// Compression is a zlib level 0-9.
+	Compression int
+	// Colors > 0 quantizes to a palette of at most that many colors.
+	Colors int
+	Dither bool
+}
+
+// EncodePNG writes img as PNG.
+func EncodePNG(w io.Writer, img image.Image, opts PNGOptions) error {
+	enc := png.Encoder{CompressionLevel: pngLevel(opts.Compression)}
+	if opts.Colors > 0 {
+		img = quantize(img, opts.Colors, opts.Dither)
+	}
+	return enc.Encode(w, img)
+}
+
+func pngLevel(level int) png.CompressionLevel {
+	switch {
+	case level <= 0:
+		return png.NoCompression
+	case level <= 3:
+		return png.BestSpeed
+	case level >= 9:
+		return png.BestCompression
+	}
+	return png.DefaultCompression
+}
+
+// quantize maps img onto a median-cut palette of at most n colors.
+func quantize(img image.Image, n int, dither bool) *image.Paletted {
+	pal := MedianCut{}.Quantize(make(color.Palette, 0, n), img)
+	dst := image.NewPaletted(img.Bounds(), pal)
+	var d draw.Drawer = draw.Src
+	if dither {
+		d = draw.FloydSteinberg
+	}
+	d.Draw(dst, dst.Rect, img, img.Bounds().Min)
+	return dst
+}
+
+// GIFOptions controls EncodeGIF.
+type GIFOptions struct {
+	Colors int // 2-256
+	Dither bool
+}
+
+// EncodeGIF writes the frames of a as a GIF, each quantized separately.
+func EncodeGIF(w io.Writer, a *Animation, opts GIFOptions) error {
+	if len(a.Frames) == 0 {
+		return fmt.Errorf("native: no frames to encode")
+	}
+	colors := opts.Colors
+	if colors < 2 || colors > 256 {
+		colors = 256
+	}
+	g := &gif.GIF{LoopCount: a.LoopCount}
+	for i, fr := range a.Frames {
+		g.Image = append(g.Image, quantize(fr, colors, opts.Dither))
+		g.Delay = append(g.Delay, a.Delay[i])
+		g.Disposal = append(g.Disposal, gif.DisposalNone)
+	}
+	return gif.EncodeAll(w, g)
+}
@@ -0,0 +1,274 @@
+package native
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"pixerver/internal/imagetype"
+)
+
+func TestFit(t *testing.T) {
+	cases := []struct{ sw, sh, w, h, ww, wh int }{
+		{400, 300, 200, 200, 200, 150},
+		{400, 300, 0, 150, 200, 150},
+		{400, 300, 100, 0, 100, 75},
+		{400, 300, 0, 0, 400, 300},
+		{300, 400, 800, 800, 600, 800},
+	}
+	for _, c := range cases {
+		if w, h := Fit(c.sw, c.sh, c.w, c.h); w != c.ww || h != c.wh {
+			t.Fatalf("Fit(%d,%d,%d,%d) = %dx%d, want %dx%d", c.sw, c.sh, c.w, c.h, w, h, c.ww, c.wh)
+		}
+	}
+}
+
+func TestResizeKeepsFlatColor(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 97, 61))
+	fill := color.RGBA{200, 40, 90, 255}
+	for i := 0; i < len(src.Pix); i += 4 {
+		src.Pix[i], src.Pix[i+1], src.Pix[i+2], src.Pix[i+3] = fill.R, fill.G, fill.B, fill.A
+	}
+	for _, f := range []Filter{Lanczos3, CatmullRom, Linear} {
+		for _, sz := range [][2]int{{30, 20}, {200, 150}} {
+			dst := Resize(src, sz[0], sz[1], f)
+			if dst.Rect.Dx() != sz[0] || dst.Rect.Dy() != sz[1] {
+				t.Fatalf("%s: got %v", f.Name, dst.Rect)
+			}
+			if got := dst.RGBAAt(sz[0]/2, sz[1]/2); got != fill {
+				t.Fatalf("%s %v: center %v, want %v", f.Name, sz, got, fill)
+			}
+			if got := dst.RGBAAt(0, 0); got != fill {
+				t.Fatalf("%s %v: corner %v, want %v", f.Name, sz, got, fill)
+			}
+		}
+	}
+}
+
+func TestMedianCutLimitsPalette(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 4), 128, 255})
+		}
+	}
+	p := MedianCut{}.Quantize(make(color.Palette, 0, 16), img)
+	if len(p) != 16 {
+		t.Fatalf("expected 16 colors, got %d", len(p))
+	}
+	two := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for i := 0; i < 16; i++ {
+		c := color.RGBA{255, 0, 0, 255}
+		if i%2 == 0 {
+			c = color.RGBA{0, 0, 255, 255}
+		}
+		two.Set(i%4, i/4, c)
+	}
+	p = MedianCut{}.Quantize(make(color.Palette, 0, 256), two)
+	if len(p) != 2 {
+		t.Fatalf("expected exactly the 2 source colors, got %d", len(p))
+	}
+}
+
+func TestDecodeAnimationCoalesces(t *testing.T) {
+	pal := color.Palette{color.Transparent, color.RGBA{255, 0, 0, 255}, color.RGBA{0, 255, 0, 255}}
+	full := image.NewPaletted(image.Rect(0, 0, 8, 8), pal)
+	for i := range full.Pix {
+		full.Pix[i] = 1
+	}
+	// second frame only covers the top-left corner
+	part := image.NewPaletted(image.Rect(0, 0, 2, 2), pal)
+	for i := range part.Pix {
+		part.Pix[i] = 2
+	}
+	var buf bytes.Buffer
+	err := gif.EncodeAll(&buf, &gif.GIF{
+		Image:    []*image.Paletted{full, part},
+		Delay:    []int{10, 20},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalNone},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(t.TempDir(), "a.gif")
+	if err := os.WriteFile(p, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	a, err := DecodeAnimation(p, 0)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	// two 8x8 frames coalesce to 128 pixels
+	if _, err := DecodeAnimation(p, 127); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("expected ErrTooLarge, got %v", err)
+	}
+	if _, err := DecodeAnimation(p, 128); err != nil {
+		t.Fatalf("decode within budget: %v", err)
+	}
+	if len(a.Frames) != 2 || a.Delay[1] != 20 {
+		t.Fatalf("unexpected animation %+v", a)
+	}
+	f := a.Frames[1]
+	if f.Rect.Dx() != 8 || f.RGBAAt(0, 0) != (color.RGBA{0, 255, 0, 255}) || f.RGBAAt(7, 7) != (color.RGBA{255, 0, 0, 255}) {
+		t.Fatalf("frame 2 not coalesced onto frame 1")
+	}
+
+	var out bytes.Buffer
+	if err := EncodeGIF(&out, a, GIFOptions{Colors: 4}); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	g, err := gif.DecodeAll(&out)
+	if err != nil || len(g.Image) != 2 {
+		t.Fatalf("re-decode: %v", err)
+	}
+}
+
+func TestEncodeJPEGFlattensAlpha(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 8)) // fully transparent
+	var buf bytes.Buffer
+	if err := EncodeJPEG(&buf, img, 90); err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(t.TempDir(), "a.jpg")
+	_ = os.WriteFile(p, buf.Bytes(), 0o644)
+	dec, err := Decode(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, g, b, _ := dec.At(4, 4).RGBA(); r>>8 < 250 || g>>8 < 250 || b>>8 < 250 {
+		t.Fatalf("expected transparent pixels to become white, got %d %d %d", r>>8, g>>8, b>>8)
+	}
+}
+
+func TestSSIM(t *testing.T) {
+	a := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			a.Set(x, y, color.RGBA{uint8(x * 8), uint8(y * 8), 128, 255})
+		}
+	}
+	if s, err := SSIM(a, a); err != nil || s < 0.9999 {
+		t.Fatalf("identical images: ssim=%v err=%v", s, err)
+	}
+	b := image.NewRGBA(a.Rect)
+	copy(b.Pix, a.Pix)
+	for i := 0; i < len(b.Pix); i += 4 * 3 {
+		b.Pix[i] ^= 0x40
+	}
+	s, err := SSIM(a, b)
+	if err != nil || s >= 0.99 || s <= 0 {
+		t.Fatalf("noisy image: ssim=%v err=%v", s, err)
+	}
+	if _, err := SSIM(a, image.NewRGBA(image.Rect(0, 0, 8, 8))); err == nil {
+		t.Fatalf("expected error for differing sizes")
+	}
+}
+
+// withPrimaries returns a copy of the sRGB profile with other colorants.
+func withPrimaries(t *testing.T, prim [3][3]float64) []byte {
+	t.Helper()
+	p := append([]byte{}, SRGBProfile()...)
+	n := int(binary.BigEndian.Uint32(p[128:]))
+	for i := 0; i < n; i++ {
+		e := p[132+12*i:]
+		for c, sig := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+			if string(e[:4]) == sig {
+				copy(p[binary.BigEndian.Uint32(e[4:]):], iccXYZ(prim[c]))
+			}
+		}
+	}
+	return p
+}
+
+func TestToSRGB(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	src.SetNRGBA(0, 0, color.NRGBA{200, 100, 50, 255})
+	src.SetNRGBA(1, 0, color.NRGBA{128, 128, 128, 128})
+
+	// an sRGB profile leaves the image alone
+	if out, err := ToSRGB(src, SRGBProfile()); err != nil || out != image.Image(src) {
+		t.Fatalf("srgb: %v %v", out, err)
+	}
+
+	displayP3 := [3][3]float64{{0.5151, 0.2412, -0.0011}, {0.2920, 0.6922, 0.0419}, {0.1571, 0.0666, 0.7841}}
+	out, err := ToSRGB(src, withPrimaries(t, displayP3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := out.(*image.NRGBA)
+	// P3 is wider, so the same values are more saturated in sRGB
+	if c := got.NRGBAAt(0, 0); c.R <= 200 || c.G >= 100 || c.B >= 50 {
+		t.Fatalf("p3 orange became %v", c)
+	}
+	// same white point: grays stay gray, alpha is untouched
+	if c := got.NRGBAAt(1, 0); c.R != c.G || c.G != c.B || c.A != 128 || c.R < 127 || c.R > 129 {
+		t.Fatalf("p3 gray became %v", c)
+	}
+
+	cmyk := append([]byte{}, SRGBProfile()...)
+	copy(cmyk[16:], "CMYK")
+	if _, err := ToSRGB(src, cmyk); !errors.Is(err, ErrUnsupportedProfile) {
+		t.Fatalf("cmyk: expected ErrUnsupportedProfile, got %v", err)
+	}
+}
+
+func TestEmbedICC(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	profile := SRGBProfile()
+	if ProfileColorSpace(profile) != "RGB" || len(profile) > 1024 {
+		t.Fatalf("unexpected profile: %q, %d bytes", ProfileColorSpace(profile), len(profile))
+	}
+	for _, format := range []string{"jpeg", "png"} {
+		var buf bytes.Buffer
+		var err error
+		if format == "jpeg" {
+			err = EncodeJPEG(&buf, img, 80)
+		} else {
+			err = EncodePNG(&buf, img, PNGOptions{Compression: 6})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := EmbedICC(buf.Bytes(), format, profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		typ, _ := imagetype.Detect(data)
+		got, err := imagetype.ICCProfile(bytes.NewReader(data), typ)
+		if err != nil || !bytes.Equal(got, profile) {
+			t.Fatalf("%s: profile not read back (%v)", format, err)
+		}
+		if _, _, err := image.Decode(bytes.NewReader(data)); err != nil {
+			t.Fatalf("%s: embedding broke the file: %v", format, err)
+		}
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// 3x2 with a marked top-left pixel
+	src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	mark := color.RGBA{255, 0, 0, 255}
+	src.SetRGBA(0, 0, mark)
+	cases := map[int]struct{ w, h, x, y int }{
+		1: {3, 2, 0, 0},
+		2: {3, 2, 2, 0},
+		3: {3, 2, 2, 1},
+		4: {3, 2, 0, 1},
+		5: {2, 3, 0, 0},
+		6: {2, 3, 1, 0},
+		7: {2, 3, 1, 2},
+		8: {2, 3, 0, 2},
+	}
+	for o, c := range cases {
+		out := ToRGBA(Orient(src, o))
+		if out.Rect.Dx() != c.w || out.Rect.Dy() != c.h || out.RGBAAt(c.x, c.y) != mark {
+			t.Fatalf("orientation %d: %v, mark at (%d,%d) = %v", o, out.Rect, c.x, c.y, out.RGBAAt(c.x, c.y))
+		}
+	}
+}
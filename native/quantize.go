@@ -0,0 +1,115 @@
+package native
+
+import (
+	"image"
+	"image/color"
+	"sort"
+)
+
+// MedianCut is a draw.Quantizer that splits the color space into boxes
+// along their widest channel until it has the requested number of colors.
+// It beats the fixed Plan9 palette image/gif falls back to on photos.
+type MedianCut struct{}
+
+type colorBox struct {
+	pix []color.NRGBA
+}
+
+// span returns the widest channel of the box and its range.
+func (b colorBox) span() (int, int) {
+	lo := [4]uint8{255, 255, 255, 255}
+	var hi [4]uint8
+	for _, c := range b.pix {
+		v := [4]uint8{c.R, c.G, c.B, c.A}
+		for i := range v {
+			lo[i] = min(lo[i], v[i])
+			hi[i] = max(hi[i], v[i])
+		}
+	}
+	ch, r := 0, -1
+	for i := range lo {
+		if d := int(hi[i]) - int(lo[i]); d > r {
+			ch, r = i, d
+		}
+	}
+	return ch, r
+}
+
+func (b colorBox) mean() color.Color {
+	var s [4]int
+	for _, c := range b.pix {
+		s[0] += int(c.R)
+		s[1] += int(c.G)
+		s[2] += int(c.B)
+		s[3] += int(c.A)
+	}
+	n := len(b.pix)
+	return color.NRGBA{uint8(s[0] / n), uint8(s[1] / n), uint8(s[2] / n), uint8(s[3] / n)}
+}
+
+func channel(c color.NRGBA, ch int) uint8 {
+	switch ch {
+	case 0:
+		return c.R
+	case 1:
+		return c.G
+	case 2:
+		return c.B
+	}
+	return c.A
+}
+
+// sampleLimit bounds how many pixels feed the quantizer.
+const sampleLimit = 1 << 16
+
+// Quantize appends up to cap(p)-len(p) colors representative of m to p.
+func (MedianCut) Quantize(p color.Palette, m image.Image) color.Palette {
+	want := cap(p) - len(p)
+	if want <= 0 {
+		return p
+	}
+	b := m.Bounds()
+	step := 1
+	if n := b.Dx() * b.Dy(); n > sampleLimit {
+		step = n / sampleLimit
+	}
+	var pix []color.NRGBA
+	i := 0
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if i%step == 0 {
+				pix = append(pix, color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA))
+			}
+			i++
+		}
+	}
+	if len(pix) == 0 {
+		return p
+	}
+
+	boxes := []colorBox{{pix: pix}}
+	for len(boxes) < want {
+		// split the box with the widest range
+		bi, ch, best := -1, 0, 0
+		for i, bx := range boxes {
+			if len(bx.pix) < 2 {
+				continue
+			}
+			if c, r := bx.span(); r > best {
+				bi, ch, best = i, c, r
+			}
+		}
+		if bi < 0 {
+			break
+		}
+		bx := boxes[bi].pix
+		sort.Slice(bx, func(i, j int) bool { return channel(bx[i], ch) < channel(bx[j], ch) })
+		mid := len(bx) / 2
+		boxes[bi] = colorBox{pix: bx[:mid]}
+		boxes = append(boxes, colorBox{pix: bx[mid:]})
+	}
+	for _, bx := range boxes {
+		p = append(p, bx.mean())
+	}
+	return p
+}
@@ -0,0 +1,195 @@
+package native
+
+import (
+	"image"
+	"image/draw"
+	"math"
+)
+
+// Filter is a separable resampling kernel.
+type Filter struct {
+	Name    string
+	Support float64 // kernel radius at scale 1
+	Kernel  func(x float64) float64
+}
+
+var (
+	// Lanczos3 is the sharpest filter here and the default for downscaling
+	// photos.
+	Lanczos3 = Filter{"lanczos", 3, func(x float64) float64 {
+		if x == 0 {
+			return 1
+		}
+		if x <= -3 || x >= 3 {
+			return 0
+		}
+		px := math.Pi * x
+		return 3 * math.Sin(px) * math.Sin(px/3) / (px * px)
+	}}
+	// CatmullRom is a cubic with less ringing than Lanczos3.
+	CatmullRom = Filter{"catmullrom", 2, func(x float64) float64 {
+		x = math.Abs(x)
+		switch {
+		case x < 1:
+			return 1.5*x*x*x - 2.5*x*x + 1
+		case x < 2:
+			return -0.5*x*x*x + 2.5*x*x - 4*x + 2
+		}
+		return 0
+	}}
+	// Linear is a tent filter, cheap and soft.
+	Linear = Filter{"linear", 1, func(x float64) float64 {
+		x = math.Abs(x)
+		if x < 1 {
+			return 1 - x
+		}
+		return 0
+	}}
+)
+
+// FilterByName returns the filter called name ("lanczos", "catmullrom" or
+// "linear").
+func FilterByName(name string) (Filter, bool) {
+	for _, f := range []Filter{Lanczos3, CatmullRom, Linear} {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return Filter{}, false
+}
+
+// Fit returns the size of a sw x sh image scaled to fit inside w x h while
+// keeping its aspect ratio, like ImageMagick's -resize WxH. A zero w or h
+// leaves that axis free; both zero keeps the source size.
+func Fit(sw, sh, w, h int) (int, int) {
+	switch {
+	case w == 0 && h == 0:
+		return sw, sh
+	case w == 0:
+		return max(1, int(math.Round(float64(sw)*float64(h)/float64(sh)))), h
+	case h == 0:
+		return w, max(1, int(math.Round(float64(sh)*float64(w)/float64(sw))))
+	}
+	s := math.Min(float64(w)/float64(sw), float64(h)/float64(sh))
+	return max(1, int(math.Round(float64(sw)*s))), max(1, int(math.Round(float64(sh)*s)))
+}
+
+// weights holds, for one output pixel, the first contributing source index
+// and the normalized kernel weights from there.
+type weights struct {
+	start int
+	w     []float32
+}
+
+// computeWeights precomputes the contributions for resampling a line of
+// srcLen pixels to dstLen.
+func computeWeights(srcLen, dstLen int, f Filter) []weights {
+	scale := float64(srcLen) / float64(dstLen)
+	// widen the kernel when shrinking so every source pixel contributes
+	fscale := math.Max(scale, 1)
+	support := f.Support * fscale
+	out := make([]weights, dstLen)
+	for i := range out {
+		center := (float64(i)+0.5)*scale - 0.5
+		start := int(math.Ceil(center - support))
+		end := int(math.Floor(center + support))
+		var ws []float32
+		var sum float64
+		for j := start; j <= end; j++ {
+			v := f.Kernel((float64(j) - center) / fscale)
+			ws = append(ws, float32(v))
+			sum += v
+		}
+		if sum != 0 {
+			for k := range ws {
+				ws[k] = float32(float64(ws[k]) / sum)
+			}
+		}
+		out[i] = weights{start: start, w: ws}
+	}
+	return out
+}
+
+func clampIndex(i, n int) int {
+	if i < 0 {
+		return 0
+	}
+	if i >= n {
+		return n - 1
+	}
+	return i
+}
+
+func clamp8(v float32) uint8 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 255 {
+		return 255
+	}
+	return uint8(v + 0.5)
+}
+
+// ToRGBA returns src as a premultiplied *image.RGBA with its origin at 0,0.
+func ToRGBA(src image.Image) *image.RGBA {
+	if r, ok := src.(*image.RGBA); ok && r.Rect.Min == (image.Point{}) {
+		return r
+	}
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Rect, src, b.Min, draw.Src)
+	return dst
+}
+
+// Resize resamples src to exactly w x h with filter f. Resampling is done
+// on premultiplied values so transparent pixels don't bleed color.
+func Resize(src image.Image, w, h int, f Filter) *image.RGBA {
+	s := ToRGBA(src)
+	sw, sh := s.Rect.Dx(), s.Rect.Dy()
+	if sw == w && sh == h {
+		return s
+	}
+
+	// horizontal pass: sh rows of w pixels
+	xw := computeWeights(sw, w, f)
+	tmp := make([]float32, sh*w*4)
+	for y := 0; y < sh; y++ {
+		row := s.Pix[y*s.Stride:]
+		for x, wt := range xw {
+			var r, g, b, a float32
+			for k, c := range wt.w {
+				i := clampIndex(wt.start+k, sw) * 4
+				r += c * float32(row[i])
+				g += c * float32(row[i+1])
+				b += c * float32(row[i+2])
+				a += c * float32(row[i+3])
+			}
+			o := (y*w + x) * 4
+			tmp[o], tmp[o+1], tmp[o+2], tmp[o+3] = r, g, b, a
+		}
+	}
+
+	// vertical pass
+	yw := computeWeights(sh, h, f)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y, wt := range yw {
+		for x := 0; x < w; x++ {
+			var r, g, b, a float32
+			for k, c := range wt.w {
+				i := (clampIndex(wt.start+k, sh)*w + x) * 4
+				r += c * tmp[i]
+				g += c * tmp[i+1]
+				b += c * tmp[i+2]
+				a += c * tmp[i+3]
+			}
+			o := y*dst.Stride + x*4
+			av := clamp8(a)
+			// premultiplied channels may not exceed alpha after ringing
+			dst.Pix[o] = min(clamp8(r), av)
+			dst.Pix[o+1] = min(clamp8(g), av)
+			dst.Pix[o+2] = min(clamp8(b), av)
+			dst.Pix[o+3] = av
+		}
+	}
+	return dst
+}
@@ -0,0 +1,85 @@
+package native
+
+import (
+	"fmt"
+	"image"
+)
+
+// ssimWindow and ssimStride set the sliding window SSIM is averaged over.
+const (
+	ssimWindow = 8
+	ssimStride = 4
+)
+
+// SSIM returns the mean structural similarity of the luma of a and b, in
+// [-1, 1] with 1 meaning identical. Both images are composited onto white
+// first, so transparent areas compare the way a flattened JPEG shows them.
+// The images must be the same size.
+func SSIM(a, b image.Image) (float64, error) {
+	if a.Bounds().Size() != b.Bounds().Size() {
+		return 0, fmt.Errorf("native: ssim of %v and %v: sizes differ", a.Bounds().Size(), b.Bounds().Size())
+	}
+	la, w, h := luma(a)
+	lb, _, _ := luma(b)
+	if w == 0 || h == 0 {
+		return 1, nil
+	}
+
+	win := min(ssimWindow, w, h)
+	const (
+		c1 = (0.01 * 255) * (0.01 * 255)
+		c2 = (0.03 * 255) * (0.03 * 255)
+	)
+	var sum float64
+	var n int
+	for y := 0; y+win <= h; y += ssimStride {
+		for x := 0; x+win <= w; x += ssimStride {
+			var ma, mb float64
+			for j := y; j < y+win; j++ {
+				for i := x; i < x+win; i++ {
+					ma += la[j*w+i]
+					mb += lb[j*w+i]
+				}
+			}
+			count := float64(win * win)
+			ma /= count
+			mb /= count
+			var va, vb, cov float64
+			for j := y; j < y+win; j++ {
+				for i := x; i < x+win; i++ {
+					da, db := la[j*w+i]-ma, lb[j*w+i]-mb
+					va += da * da
+					vb += db * db
+					cov += da * db
+				}
+			}
+			va /= count
+			vb /= count
+			cov /= count
+			sum += ((2*ma*mb + c1) * (2*cov + c2)) / ((ma*ma + mb*mb + c1) * (va + vb + c2))
+			n++
+		}
+	}
+	if n == 0 {
+		return 1, nil
+	}
+	return sum / float64(n), nil
+}
+
+// luma returns the Rec. 601 luma of img over white, row-major.
+func luma(img image.Image) ([]float64, int, int) {
+	rgba := ToRGBA(img)
+	w, h := rgba.Rect.Dx(), rgba.Rect.Dy()
+	out := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		row := rgba.Pix[y*rgba.Stride:]
+		for x := 0; x < w; x++ {
+			p := row[x*4 : x*4+4]
+			// premultiplied, so "over white" just adds the uncovered part
+			bg := float64(255 - p[3])
+			r, g, b := float64(p[0])+bg, float64(p[1])+bg, float64(p[2])+bg
+			out[y*w+x] = 0.299*r + 0.587*g + 0.114*b
+		}
+	}
+	return out, w, h
+}
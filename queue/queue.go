@@ -63,6 +63,31 @@ func (q *Queue) Produce(values map[string]interface{}) (string, error) {
 	return id, nil
 }
 
+// ProduceAll appends every message in values to the stream in one
+// MULTI/EXEC transaction, so either all of them are queued or none are.
+// Returns the message IDs in order.
+func (q *Queue) ProduceAll(values []map[string]interface{}) ([]string, error) {
+	if q == nil || q.client == nil {
+		return nil, fmt.Errorf("queue: not initialized")
+	}
+	ctx := context.Background()
+	cmds := make([]*redis.StringCmd, len(values))
+	_, err := q.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		for i, v := range values {
+			cmds[i] = p.XAdd(ctx, &redis.XAddArgs{Stream: q.stream, Values: v})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(cmds))
+	for i, c := range cmds {
+		ids[i] = c.Val()
+	}
+	return ids, nil
+}
+
 // ReadNext reads messages for this consumer using XREADGROUP. Block indicates the
 // maximum blocking duration; use 0 for no blocking. Count limits number of messages.
 func (q *Queue) ReadNext(block time.Duration, count int) ([]redis.XMessage, error) {
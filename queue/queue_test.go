@@ -40,3 +40,34 @@ func TestQueueProduceReadAck(t *testing.T) {
 		t.Fatalf("Ack failed: %v", err)
 	}
 }
+
+// Integration test for the transactional produce. Skips if Redis not available.
+func TestQueueProduceAll(t *testing.T) {
+	q, err := New("test-stream-all", "test-group", "consumer-1")
+	if err != nil {
+		t.Skipf("redis not available: %v", err)
+	}
+	defer q.Close()
+
+	ids, err := q.ProduceAll([]map[string]interface{}{{"k": "a"}, {"k": "b"}})
+	if err != nil {
+		t.Fatalf("ProduceAll failed: %v", err)
+	}
+	if len(ids) != 2 || ids[0] == "" || ids[1] == "" {
+		t.Fatalf("unexpected ids %v", ids)
+	}
+	msgs, err := q.ReadNext(500*time.Millisecond, 10)
+	if err != nil {
+		t.Fatalf("ReadNext failed: %v", err)
+	}
+	if len(msgs) < 2 {
+		t.Fatalf("expected both messages, got %d", len(msgs))
+	}
+	var acked []string
+	for _, m := range msgs {
+		acked = append(acked, m.ID)
+	}
+	if err := q.Ack(acked...); err != nil {
+		t.Fatalf("Ack failed: %v", err)
+	}
+}
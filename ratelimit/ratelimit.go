@@ -0,0 +1,321 @@
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"pixerver/internal/env"
+	"pixerver/internal/redisclient"
+	"pixerver/logger"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Limits describes the quotas applied to a single tenant. A zero value for
+// any field means that dimension is unlimited.
+type Limits struct {
+	RequestsPerMinute int   `json:"requestsPerMinute"`
+	Burst             int   `json:"burst"`
+	BytesPerDay       int64 `json:"bytesPerDay"`
+	OutstandingJobs   int64 `json:"outstandingJobs"`
+}
+
+// Decision is the outcome of a limit check. RetryAfter is only meaningful
+// when Allowed is false.
+type Decision struct {
+	Allowed    bool
+	RetryAfter time.Duration
+	Reason     string
+}
+
+// Usage is a snapshot of a tenant's counters, used for the admin endpoint
+// and billing exports.
+type Usage struct {
+	Tenant          string `json:"tenant"`
+	Day             string `json:"day"`
+	RequestsToday   int64  `json:"requestsToday"`
+	BytesToday      int64  `json:"bytesToday"`
+	OutstandingJobs int64  `json:"outstandingJobs"`
+	Limits          Limits `json:"limits"`
+}
+
+// Limiter is a Redis-backed token-bucket limiter with per-tenant quotas.
+// All keys live under prefix, e.g. "ratelimit:bucket:<tenant>".
+type Limiter struct {
+	client   *redis.Client
+	prefix   string
+	defaults Limits
+	now      func() time.Time
+}
+
+// tokenBucket refills the bucket stored at KEYS[1] and tries to take one
+// token. ARGV: refill rate (tokens/ms), capacity, now (ms).
+// Returns {allowed, wait_ms}.
+var tokenBucket = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local state = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil then
+  tokens = capacity
+  ts = now
+end
+local elapsed = math.max(0, now - ts)
+tokens = math.min(capacity, tokens + elapsed * rate)
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+else
+  wait = math.ceil((1 - tokens) / rate)
+end
+redis.call("HSET", KEYS[1], "tokens", tokens, "ts", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(capacity / rate) + 1000)
+return {allowed, wait}
+`)
+
+// New creates a Limiter namespaced under prefix. defaults are applied to
+// tenants that have no explicit limits stored.
+func New(prefix string, defaults Limits) (*Limiter, error) {
+	client, err := redisclient.NewClient()
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("ratelimit: ready prefix=%s defaults=%+v", prefix, defaults)
+	return &Limiter{client: client, prefix: prefix, defaults: defaults, now: time.Now}, nil
+}
+
+// DefaultsFromEnv reads the default limits from RATELIMIT_REQUESTS_PER_MINUTE,
+// RATELIMIT_BURST, RATELIMIT_BYTES_PER_DAY and RATELIMIT_OUTSTANDING_JOBS.
+func DefaultsFromEnv() Limits {
+	return Limits{
+		RequestsPerMinute: env.Int("RATELIMIT_REQUESTS_PER_MINUTE", 60),
+		Burst:             env.Int("RATELIMIT_BURST", 0),
+		BytesPerDay:       env.Int64("RATELIMIT_BYTES_PER_DAY", 0),
+		OutstandingJobs:   env.Int64("RATELIMIT_OUTSTANDING_JOBS", 0),
+	}
+}
+
+// Close closes the underlying Redis client.
+func (l *Limiter) Close() error {
+	if l == nil || l.client == nil {
+		return nil
+	}
+	return l.client.Close()
+}
+
+func (l *Limiter) key(parts ...string) string {
+	k := l.prefix
+	for i, p := range parts {
+		if i > 0 {
+			k += ":"
+		}
+		k += p
+	}
+	return k
+}
+
+// day returns the UTC day bucket used for daily counters.
+func (l *Limiter) day() string {
+	return l.now().UTC().Format("20060102")
+}
+
+// untilMidnight returns the time left until daily counters reset.
+func untilMidnight(now time.Time) time.Duration {
+	now = now.UTC()
+	next := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	return next.Sub(now)
+}
+
+// SetLimits stores explicit limits for tenant, overriding the defaults.
+func (l *Limiter) SetLimits(tenant string, lim Limits) error {
+	if l == nil || l.client == nil {
+		return fmt.Errorf("ratelimit: not initialized")
+	}
+	b, err := json.Marshal(lim)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if err := l.client.Set(ctx, l.key("limits", tenant), b, 0).Err(); err != nil {
+		return err
+	}
+	return l.client.SAdd(ctx, l.key("tenants"), tenant).Err()
+}
+
+// GetLimits returns the limits in effect for tenant.
+func (l *Limiter) GetLimits(tenant string) (Limits, error) {
+	if l == nil || l.client == nil {
+		return Limits{}, fmt.Errorf("ratelimit: not initialized")
+	}
+	b, err := l.client.Get(context.Background(), l.key("limits", tenant)).Bytes()
+	if err == redis.Nil {
+		return l.defaults, nil
+	}
+	if err != nil {
+		return Limits{}, err
+	}
+	var lim Limits
+	if err := json.Unmarshal(b, &lim); err != nil {
+		return Limits{}, err
+	}
+	return lim, nil
+}
+
+// AllowRequest takes one token from the tenant's request bucket and counts
+// the request towards today's usage.
+func (l *Limiter) AllowRequest(tenant string) (Decision, error) {
+	lim, err := l.GetLimits(tenant)
+	if err != nil {
+		return Decision{}, err
+	}
+	ctx := context.Background()
+	if err := l.client.SAdd(ctx, l.key("tenants"), tenant).Err(); err != nil {
+		return Decision{}, err
+	}
+	if lim.RequestsPerMinute > 0 {
+		capacity := lim.Burst
+		if capacity <= 0 {
+			capacity = lim.RequestsPerMinute
+		}
+		rate := float64(lim.RequestsPerMinute) / float64(time.Minute/time.Millisecond)
+		res, err := tokenBucket.Run(ctx, l.client, []string{l.key("bucket", tenant)},
+			strconv.FormatFloat(rate, 'f', -1, 64), capacity, l.now().UnixMilli()).Int64Slice()
+		if err != nil {
+			return Decision{}, err
+		}
+		if res[0] != 1 {
+			return Decision{RetryAfter: time.Duration(res[1]) * time.Millisecond, Reason: "request rate exceeded"}, nil
+		}
+	}
+	reqKey := l.key("requests", tenant, l.day())
+	pipe := l.client.TxPipeline()
+	pipe.Incr(ctx, reqKey)
+	pipe.Expire(ctx, reqKey, 48*time.Hour)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return Decision{}, err
+	}
+	return Decision{Allowed: true}, nil
+}
+
+// AllowBytes charges n bytes to the tenant's daily quota. When the charge
+// would exceed the quota it is rolled back and the request is refused until
+// the next UTC day.
+func (l *Limiter) AllowBytes(tenant string, n int64) (Decision, error) {
+	lim, err := l.GetLimits(tenant)
+	if err != nil {
+		return Decision{}, err
+	}
+	ctx := context.Background()
+	k := l.key("bytes", tenant, l.day())
+	total, err := l.client.IncrBy(ctx, k, n).Result()
+	if err != nil {
+		return Decision{}, err
+	}
+	_ = l.client.Expire(ctx, k, 48*time.Hour).Err()
+	if lim.BytesPerDay > 0 && total > lim.BytesPerDay {
+		_ = l.client.DecrBy(ctx, k, n).Err()
+		return Decision{RetryAfter: untilMidnight(l.now()), Reason: "daily byte quota exceeded"}, nil
+	}
+	return Decision{Allowed: true}, nil
+}
+
+// CheckOutstanding reports whether the tenant may submit more work given the
+// number of jobs it currently has queued or running.
+func (l *Limiter) CheckOutstanding(tenant string) (Decision, error) {
+	lim, err := l.GetLimits(tenant)
+	if err != nil {
+		return Decision{}, err
+	}
+	if lim.OutstandingJobs <= 0 {
+		return Decision{Allowed: true}, nil
+	}
+	cur, err := l.client.Get(context.Background(), l.key("outstanding", tenant)).Int64()
+	if err != nil && err != redis.Nil {
+		return Decision{}, err
+	}
+	if cur >= lim.OutstandingJobs {
+		return Decision{RetryAfter: 30 * time.Second, Reason: "too many outstanding jobs"}, nil
+	}
+	return Decision{Allowed: true}, nil
+}
+
+// AcquireJobs reserves n outstanding job slots for tenant. The reservation
+// is refused (and not applied) when it would exceed the tenant's limit.
+func (l *Limiter) AcquireJobs(tenant string, n int64) (Decision, error) {
+	lim, err := l.GetLimits(tenant)
+	if err != nil {
+		return Decision{}, err
+	}
+	ctx := context.Background()
+	k := l.key("outstanding", tenant)
+	total, err := l.client.IncrBy(ctx, k, n).Result()
+	if err != nil {
+		return Decision{}, err
+	}
+	if lim.OutstandingJobs > 0 && total > lim.OutstandingJobs {
+		_ = l.client.DecrBy(ctx, k, n).Err()
+		return Decision{RetryAfter: 30 * time.Second, Reason: "too many outstanding jobs"}, nil
+	}
+	return Decision{Allowed: true}, nil
+}
+
+// ReleaseJobs frees n outstanding job slots, typically when jobs finish.
+func (l *Limiter) ReleaseJobs(tenant string, n int64) error {
+	if l == nil || l.client == nil {
+		return fmt.Errorf("ratelimit: not initialized")
+	}
+	ctx := context.Background()
+	k := l.key("outstanding", tenant)
+	v, err := l.client.DecrBy(ctx, k, n).Result()
+	if err != nil {
+		return err
+	}
+	if v < 0 {
+		// never let the counter drift negative after a crash or double release
+		return l.client.Set(ctx, k, 0, 0).Err()
+	}
+	return nil
+}
+
+// Usage returns today's counters for tenant.
+func (l *Limiter) Usage(tenant string) (Usage, error) {
+	lim, err := l.GetLimits(tenant)
+	if err != nil {
+		return Usage{}, err
+	}
+	ctx := context.Background()
+	day := l.day()
+	u := Usage{Tenant: tenant, Day: day, Limits: lim}
+	get := func(k string) (int64, error) {
+		v, err := l.client.Get(ctx, k).Int64()
+		if err == redis.Nil {
+			return 0, nil
+		}
+		return v, err
+	}
+	if u.RequestsToday, err = get(l.key("requests", tenant, day)); err != nil {
+		return Usage{}, err
+	}
+	if u.BytesToday, err = get(l.key("bytes", tenant, day)); err != nil {
+		return Usage{}, err
+	}
+	if u.OutstandingJobs, err = get(l.key("outstanding", tenant)); err != nil {
+		return Usage{}, err
+	}
+	return u, nil
+}
+
+// Tenants returns every tenant the limiter has seen.
+func (l *Limiter) Tenants() ([]string, error) {
+	if l == nil || l.client == nil {
+		return nil, fmt.Errorf("ratelimit: not initialized")
+	}
+	return l.client.SMembers(context.Background(), l.key("tenants")).Result()
+}
@@ -0,0 +1,64 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"pixerver/internal/uuidv7"
+)
+
+func TestUntilMidnight(t *testing.T) {
+	now := time.Date(2024, 3, 1, 23, 59, 30, 0, time.UTC)
+	if got := untilMidnight(now); got != 30*time.Second {
+		t.Fatalf("untilMidnight: want 30s got %v", got)
+	}
+}
+
+// Integration test; skips if Redis is not available.
+func TestLimiterQuotas(t *testing.T) {
+	l, err := New("test:ratelimit:", Limits{RequestsPerMinute: 2, BytesPerDay: 100, OutstandingJobs: 1})
+	if err != nil {
+		t.Skipf("redis not available: %v", err)
+	}
+	defer l.Close()
+	tenant := uuidv7.New()
+
+	for i := 0; i < 2; i++ {
+		d, err := l.AllowRequest(tenant)
+		if err != nil || !d.Allowed {
+			t.Fatalf("request %d: expected allowed, got %+v err=%v", i, d, err)
+		}
+	}
+	d, err := l.AllowRequest(tenant)
+	if err != nil {
+		t.Fatalf("AllowRequest: %v", err)
+	}
+	if d.Allowed || d.RetryAfter <= 0 {
+		t.Fatalf("expected third request to be limited with retry-after, got %+v", d)
+	}
+
+	if d, _ := l.AllowBytes(tenant, 80); !d.Allowed {
+		t.Fatalf("expected 80 bytes to fit the quota")
+	}
+	if d, _ := l.AllowBytes(tenant, 30); d.Allowed {
+		t.Fatalf("expected 110 bytes to exceed the quota")
+	}
+
+	if d, _ := l.AcquireJobs(tenant, 1); !d.Allowed {
+		t.Fatalf("expected first job slot")
+	}
+	if d, _ := l.AcquireJobs(tenant, 1); d.Allowed {
+		t.Fatalf("expected second job slot to be refused")
+	}
+	if err := l.ReleaseJobs(tenant, 1); err != nil {
+		t.Fatalf("ReleaseJobs: %v", err)
+	}
+
+	u, err := l.Usage(tenant)
+	if err != nil {
+		t.Fatalf("Usage: %v", err)
+	}
+	if u.RequestsToday != 2 || u.BytesToday != 80 || u.OutstandingJobs != 0 {
+		t.Fatalf("unexpected usage: %+v", u)
+	}
+}
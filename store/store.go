@@ -34,6 +34,46 @@ func New(prefix string) (*Store, error) {
 	return s, nil
 }
 
+// WithPrefix returns a Store that shares s's Redis client but namespaces its
+// keys (and index) under prefix instead. The derived store must not be
+// closed on its own; closing either store closes the shared client.
+func (s *Store) WithPrefix(prefix string) *Store {
+	if s == nil {
+		return nil
+	}
+	return &Store{client: s.client, prefix: prefix, idxKey: prefix + "index"}
+}
+
+// Prefix returns the key prefix this store writes under.
+func (s *Store) Prefix() string {
+	if s == nil {
+		return ""
+	}
+	return s.prefix
+}
+
+// Key returns the Redis key a value stored under key lives at.
+func (s *Store) Key(key []byte) string {
+	return s.prefix + hex.EncodeToString(key)
+}
+
+// IndexKey returns the Redis set listing this store's keys (hex-encoded).
+func (s *Store) IndexKey() string {
+	return s.idxKey
+}
+
+// Run runs script with keys and args on the store's client, for updates
+// that must be atomic across keys. Keys are Redis keys, see Key and
+// IndexKey; the script maintains the index itself.
+func (s *Store) Run(script *redis.Script, keys []string, args ...interface{}) *redis.Cmd {
+	if s == nil || s.client == nil {
+		cmd := redis.NewCmd(context.Background())
+		cmd.SetErr(fmt.Errorf("store: client not initialized"))
+		return cmd
+	}
+	return script.Run(context.Background(), s.client, keys, args...)
+}
+
 // Close closes the underlying Redis client.
 func (s *Store) Close() error {
 	if s == nil || s.client == nil {
@@ -121,3 +161,39 @@ func (s *Store) List() ([]KV, error) {
 	}
 	return out, nil
 }
+
+// SetNX stores value only when key does not exist yet. It reports whether
+// the value was written.
+func (s *Store) SetNX(key, value []byte) (bool, error) {
+	if s == nil || s.client == nil {
+		return false, fmt.Errorf("store: client not initialized")
+	}
+	hexk := hex.EncodeToString(key)
+	ctx := context.Background()
+	ok, err := s.client.SetNX(ctx, s.prefix+hexk, value, 0).Result()
+	if err != nil || !ok {
+		return ok, err
+	}
+	if err := s.client.SAdd(ctx, s.idxKey, hexk).Err(); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// IncrBy atomically adds delta to the integer stored at key and returns the
+// new value. Missing keys start at zero.
+func (s *Store) IncrBy(key []byte, delta int64) (int64, error) {
+	if s == nil || s.client == nil {
+		return 0, fmt.Errorf("store: client not initialized")
+	}
+	hexk := hex.EncodeToString(key)
+	ctx := context.Background()
+	v, err := s.client.IncrBy(ctx, s.prefix+hexk, delta).Result()
+	if err != nil {
+		return 0, err
+	}
+	if err := s.client.SAdd(ctx, s.idxKey, hexk).Err(); err != nil {
+		return v, err
+	}
+	return v, nil
+}
@@ -61,3 +61,32 @@ func TestStoreSetGetListDel(t *testing.T) {
 		t.Log("REDIS_ADDR not set locally - tests used the default environment")
 	}
 }
+
+func TestStoreSetNXAndIncrBy(t *testing.T) {
+	s, err := New("test:store:")
+	if err != nil {
+		t.Skipf("redis not available: %v", err)
+	}
+	defer s.Close()
+
+	key := []byte("nx")
+	defer s.Del(key)
+	if ok, err := s.SetNX(key, []byte("first")); err != nil || !ok {
+		t.Fatalf("first SetNX should write: %v %v", ok, err)
+	}
+	if ok, err := s.SetNX(key, []byte("second")); err != nil || ok {
+		t.Fatalf("second SetNX should not write: %v %v", ok, err)
+	}
+	if got, _ := s.Get(key); string(got) != "first" {
+		t.Fatalf("SetNX overwrote value: %q", got)
+	}
+
+	ctr := []byte("ctr")
+	defer s.Del(ctr)
+	if v, err := s.IncrBy(ctr, 2); err != nil || v != 2 {
+		t.Fatalf("IncrBy: %d %v", v, err)
+	}
+	if v, err := s.IncrBy(ctr, -1); err != nil || v != 1 {
+		t.Fatalf("IncrBy: %d %v", v, err)
+	}
+}
@@ -0,0 +1,100 @@
+package worker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"pixerver/internal/env"
+	"pixerver/internal/safehttp"
+	"pixerver/logger"
+	"pixerver/models"
+)
+
+// callbackPayload is POSTed to the token's callbackUrl when a request
+// finishes.
+type callbackPayload struct {
+	RequestID    string          `json:"requestId"`
+	Status       string          `json:"status"`
+	Source       string          `json:"source,omitempty"`
+	SourceSHA256 string          `json:"sourceSha256"`
+	Originals    []models.Output `json:"originals,omitempty"`
+	Jobs         []models.Job    `json:"jobs"`
+	Manifest     *Manifest       `json:"manifest,omitempty"`
+}
+
+// buildCallback assembles the payload for req from its final job records.
+func buildCallback(req models.Request, jobs []models.Job, m *Manifest) callbackPayload {
+	if jobs == nil {
+		jobs = []models.Job{}
+	}
+	return callbackPayload{
+		RequestID:    req.ID,
+		Status:       req.Status,
+		Source:       req.Source,
+		SourceSHA256: req.SourceSHA256,
+		Originals:    req.Originals,
+		Jobs:         jobs,
+		Manifest:     m,
+	}
+}
+
+// callbackClient builds the outbound client from CALLBACK_TIMEOUT (seconds)
+// and CALLBACK_ALLOW_CIDRS, with the same SSRF guard as ingest.
+func callbackClient() (*http.Client, error) {
+	allow, err := safehttp.ParsePrefixes(env.List("CALLBACK_ALLOW_CIDRS", nil))
+	if err != nil {
+		return nil, err
+	}
+	return safehttp.NewClient(safehttp.Options{
+		Timeout:      time.Duration(env.Int("CALLBACK_TIMEOUT", 10)) * time.Second,
+		MaxRedirects: 0,
+		Allow:        allow,
+	}), nil
+}
+
+// sendCallback POSTs p to url, retrying a few times on failure.
+func sendCallback(client *http.Client, url string, p callbackPayload) error {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	attempts := env.Int("CALLBACK_ATTEMPTS", 3)
+	for i := 0; ; i++ {
+		err = postCallback(client, url, body)
+		if err == nil || i+1 >= attempts {
+			return err
+		}
+		time.Sleep(time.Duration(1<<i) * time.Second)
+	}
+}
+
+func postCallback(client *http.Client, url string, body []byte) error {
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("callback returned %s", resp.Status)
+	}
+	return nil
+}
+
+// notify delivers p to url, logging rather than failing on errors: the
+// request record is already final.
+func notify(p callbackPayload, url string) {
+	if url == "" {
+		return
+	}
+	client, err := callbackClient()
+	if err != nil {
+		logger.Errorf("worker: invalid CALLBACK_ALLOW_CIDRS: %v", err)
+		return
+	}
+	if err := sendCallback(client, url, p); err != nil {
+		logger.Warnf("worker: callback for request %s failed: %v", p.RequestID, err)
+	}
+}
@@ -0,0 +1,206 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"pixerver/backends"
+	"pixerver/logger"
+	"pixerver/models"
+)
+
+// Manifest lists every variant produced from a request's source, together
+// with srcset and <picture> markup built from them. It is written next to
+// the variants in each destination backend and included in the callback.
+type Manifest struct {
+	RequestID    string            `json:"requestId"`
+	Source       string            `json:"source,omitempty"`
+	SourceSHA256 string            `json:"sourceSha256"`
+	Variants     []ManifestVariant `json:"variants"`
+	// Srcset maps each format to a width-descriptor srcset string.
+	Srcset  map[string]string `json:"srcset"`
+	Picture []PictureSource   `json:"picture"`
+}
+
+// ManifestVariant is one delivered file and the token resolution it renders.
+type ManifestVariant struct {
+	models.Variant
+	Resolution string          `json:"resolution,omitempty"`
+	Density    float64         `json:"density,omitempty"`
+	Outputs    []models.Output `json:"outputs"`
+}
+
+// PictureSource is one <source> element of a <picture>.
+type PictureSource struct {
+	Type   string `json:"type"`
+	Srcset string `json:"srcset"`
+	HTML   string `json:"html"`
+}
+
+// formatPreference orders formats for <picture>: browsers take the first
+// <source> they support, so smaller modern formats go first.
+var formatPreference = []string{"avif", "jxl", "webp", "heic", "jpeg", "png", "gif"}
+
+func formatRank(format string) int {
+	if i := slices.Index(formatPreference, format); i >= 0 {
+		return i
+	}
+	return len(formatPreference)
+}
+
+// href is the address a variant is referenced by in markup: its first
+// public URL, else its first key.
+func (v ManifestVariant) href() string {
+	for _, o := range v.Outputs {
+		if o.URL != "" {
+			return o.URL
+		}
+	}
+	if len(v.Outputs) > 0 {
+		return v.Outputs[0].Key
+	}
+	return ""
+}
+
+// buildManifest collects the delivered variants of req's done jobs.
+func buildManifest(req models.Request, jobs []models.Job) *Manifest {
+	m := &Manifest{
+		RequestID:    req.ID,
+		Source:       req.Source,
+		SourceSHA256: req.SourceSHA256,
+		Variants:     []ManifestVariant{},
+		Srcset:       map[string]string{},
+		Picture:      []PictureSource{},
+	}
+	for _, j := range jobs {
+		if j.Status != "done" || j.Variant == nil || len(j.Outputs) == 0 {
+			continue
+		}
+		m.Variants = append(m.Variants, ManifestVariant{Variant: *j.Variant, Resolution: j.ResolutionName, Density: j.Density, Outputs: j.Outputs})
+		for _, a := range j.Alternates {
+			m.Variants = append(m.Variants, ManifestVariant{Variant: a.Variant, Resolution: j.ResolutionName, Density: j.Density, Outputs: a.Outputs})
+		}
+	}
+	slices.SortStableFunc(m.Variants, func(a, b ManifestVariant) int {
+		if r := formatRank(a.Format) - formatRank(b.Format); r != 0 {
+			return r
+		}
+		return a.Width - b.Width
+	})
+
+	var formats []string
+	entries := map[string][]string{}
+	widths := map[string]map[int]bool{}
+	mimes := map[string]string{}
+	for _, v := range m.Variants {
+		if v.Width == 0 {
+			continue
+		}
+		if widths[v.Format] == nil {
+			widths[v.Format] = map[int]bool{}
+			formats = append(formats, v.Format)
+			mimes[v.Format] = v.ContentType
+		}
+		// one candidate per width; crops of the same width would be ambiguous
+		if widths[v.Format][v.Width] {
+			continue
+		}
+		widths[v.Format][v.Width] = true
+		entries[v.Format] = append(entries[v.Format], v.href()+" "+strconv.Itoa(v.Width)+"w")
+	}
+	for _, f := range formats {
+		srcset := strings.Join(entries[f], ", ")
+		m.Srcset[f] = srcset
+		m.Picture = append(m.Picture, PictureSource{
+			Type:   mimes[f],
+			Srcset: srcset,
+			HTML:   fmt.Sprintf(`<source type="%s" srcset="%s">`, html.EscapeString(mimes[f]), html.EscapeString(srcset)),
+		})
+	}
+	return m
+}
+
+// ManifestKey is the object key of req's manifest: beside a backend
+// source's variants as <OutputDir>/<name>.manifest.json. Uploads of the same content share a
+// directory across requests, tokens and tenants, so each request's
+// manifest gets its own key under ManifestPrefix and none replaces another.
+func ManifestKey(req models.Request) string {
+	if ref, err := backends.ParseRef(req.Source); err == nil {
+		name := strings.TrimSuffix(path.Base(ref.Key), path.Ext(ref.Key))
+		return path.Join(path.Dir(ref.Key), OutputDir, name+".manifest.json")
+	}
+	return ManifestPrefix(req.Tenant, req.SourceSHA256) + req.ID + ".json"
+}
+
+// ManifestPrefix is the key prefix of the manifests written for uploads
+// of sha by tenantID's requests: <sha256>/manifests/[<tenant>/].
+func ManifestPrefix(tenantID, sha string) string {
+	return path.Join(sha, "manifests", tenantID) + "/"
+}
+
+// UploadManifests lists the keys of the manifests tenantID's requests
+// wrote for uploads of sha in b, newest request first; request ids are
+// UUIDv7, so they sort by creation time.
+func UploadManifests(ctx context.Context, b backends.Backend, tenantID, sha string) ([]string, error) {
+	prefix := ManifestPrefix(tenantID, sha)
+	keys, err := b.List(ctx, prefix, 0)
+	if err != nil {
+		return nil, err
+	}
+	// other tenants' manifests live in subdirectories of the default one
+	keys = slices.DeleteFunc(keys, func(k string) bool {
+		rest := strings.TrimPrefix(k, prefix)
+		return strings.Contains(rest, "/") || !strings.HasSuffix(rest, ".json")
+	})
+	slices.Sort(keys)
+	slices.Reverse(keys)
+	return keys, nil
+}
+
+// writeManifest stores m in every backend that received a variant.
+func writeManifest(ctx context.Context, req models.Request, m *Manifest) error {
+	body, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	key := ManifestKey(req)
+	seen := map[string]bool{}
+	for _, v := range m.Variants {
+		for _, o := range v.Outputs {
+			if seen[o.Backend] {
+				continue
+			}
+			seen[o.Backend] = true
+			b, err := resolve(req.Tenant, req.Token, o.Backend)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(ctx, key, bytes.NewReader(body), int64(len(body)), "application/json", nil); err != nil {
+				return fmt.Errorf("writing manifest to backend %q: %w", o.Backend, err)
+			}
+			logger.Debugf("worker: manifest for request %s written to %s:%s", req.ID, o.Backend, key)
+		}
+	}
+	return nil
+}
+
+// ReadManifest loads the manifest stored under key in b.
+func ReadManifest(ctx context.Context, b backends.Backend, key string) (*Manifest, error) {
+	rc, err := b.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	var m Manifest
+	if err := json.NewDecoder(rc).Decode(&m); err != nil {
+		return nil, fmt.Errorf("decoding manifest %s: %w", key, err)
+	}
+	return &m, nil
+}
@@ -0,0 +1,130 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"pixerver/backends"
+	"pixerver/database/dedup"
+	"pixerver/internal/imagetype"
+	"pixerver/logger"
+	"pixerver/models"
+)
+
+// originalDestinations returns the backends that should receive the
+// untouched source: the union of DestinationBackends over conversion jobs
+// with keepOriginal set, in token order.
+func originalDestinations(token models.InputToken) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, cj := range token.ConversionJobs {
+		if !cj.KeepOriginal {
+			continue
+		}
+		for _, b := range cj.DestinationBackends {
+			if !seen[b] {
+				seen[b] = true
+				out = append(out, b)
+			}
+		}
+	}
+	return out
+}
+
+// originalKey is the object key the untouched source is stored under:
+// the source's own key for backend sources, <sha256>/original<ext> for
+// uploads.
+func originalKey(req models.Request, ext string) string {
+	if ref, err := backends.ParseRef(req.Source); err == nil {
+		return ref.Key
+	}
+	return path.Join(req.SourceSHA256, "original"+ext)
+}
+
+// keepOriginal writes the request's source byte-for-byte to every backend
+// that asked for it and records the locations on req. It runs once per
+// request, after the last job.
+func keepOriginal(ctx context.Context, opts Options, req *models.Request) error {
+	dests := originalDestinations(req.Token)
+	if len(dests) == 0 {
+		return nil
+	}
+
+	src, sum, ct := req.SourceFileName, req.SourceSHA256, req.ContentType
+	var ref backends.Ref
+	if req.Source != "" {
+		var err error
+		if ref, err = backends.ParseRef(req.Source); err != nil {
+			return err
+		}
+		if src, sum, err = fetchSource(ctx, opts, req.Tenant, req.Token, req.Source, scratchDir(opts, req.ID)); err != nil {
+			return err
+		}
+		req.SourceSHA256 = sum
+	}
+	if ct == "" {
+		ct = sniffContentType(src)
+	}
+	key := originalKey(*req, filepath.Ext(src))
+
+	req.Originals = req.Originals[:0]
+	for _, name := range dests {
+		// already sitting there: nothing to copy
+		if req.Source != "" && name == ref.Backend {
+			req.Originals = append(req.Originals, models.Output{Backend: name, Key: ref.Key})
+			continue
+		}
+		if err := putOriginal(ctx, req.Tenant, req.Token, name, key, src, ct, sum); err != nil {
+			return fmt.Errorf("storing original in backend %q: %w", name, err)
+		}
+		req.Originals = append(req.Originals, models.Output{Backend: name, Key: key})
+	}
+	return nil
+}
+
+func putOriginal(ctx context.Context, tenantID string, token models.InputToken, name, key, p, ct, sum string) error {
+	b, err := resolve(tenantID, token, name)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return b.Put(ctx, key, f, st.Size(), ct, map[string]string{"sha256": sum})
+}
+
+// sniffContentType returns the MIME type detected from the file at p.
+func sniffContentType(p string) string {
+	f, err := os.Open(p)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer f.Close()
+	head := make([]byte, imagetype.SniffLen)
+	n, _ := io.ReadFull(f, head)
+	if t, ok := imagetype.Detect(head[:n]); ok {
+		return t.MIME
+	}
+	return "application/octet-stream"
+}
+
+// releaseSource drops req's reference to its uploaded source, removing the
+// file once no other request holds it. Backend sources are left alone.
+func releaseSource(req models.Request) {
+	if req.Source != "" || req.SourceSHA256 == "" || !dedup.Open() {
+		return
+	}
+	if err := dedup.ReleasePath(req.Tenant, req.SourceSHA256, req.SourceFileName); err != nil {
+		logger.Warnf("worker: releasing source of request %s failed: %v", req.ID, err)
+	}
+}
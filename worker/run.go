@@ -0,0 +1,550 @@
+package worker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"pixerver/backends"
+	"pixerver/database/dedup"
+	"pixerver/database/history"
+	"pixerver/database/tasks"
+	"pixerver/internal/env"
+	"pixerver/internal/imagetype"
+	"pixerver/logger"
+	"pixerver/magick/encoders"
+	"pixerver/models"
+	"pixerver/ratelimit"
+)
+
+// Options configures Run.
+type Options struct {
+	// Limiter, when set, gets each finished job's outstanding slot back.
+	Limiter *ratelimit.Limiter
+	// ScratchDir holds sources fetched from backends and their variants,
+	// one directory per request, removed once the request finishes.
+	ScratchDir string
+	// MaxSourceBytes caps how much is read from a source backend.
+	MaxSourceBytes int64
+	// Concurrency is the number of jobs processed at once.
+	Concurrency int
+	// Block is how long a read waits for new messages.
+	Block time.Duration
+	// ReclaimIdle is how long a delivered message may stay unacked before
+	// another worker takes it over.
+	ReclaimIdle time.Duration
+}
+
+// OptionsFromEnv reads SCRATCH_DIR, SOURCE_MAX_BYTES, WORKER_CONCURRENCY and
+// WORKER_RECLAIM_IDLE (seconds).
+func OptionsFromEnv(l *ratelimit.Limiter) Options {
+	dir := os.Getenv("SCRATCH_DIR")
+	if dir == "" {
+		dir = filepath.Join("uploads", "scratch")
+	}
+	return Options{
+		Limiter:        l,
+		ScratchDir:     dir,
+		MaxSourceBytes: env.Int64("SOURCE_MAX_BYTES", 100<<20),
+		Concurrency:    env.Int("WORKER_CONCURRENCY", 1),
+		Block:          5 * time.Second,
+		ReclaimIdle:    time.Duration(env.Int("WORKER_RECLAIM_IDLE", 300)) * time.Second,
+	}
+}
+
+// Run consumes jobs from the task queue until ctx is cancelled. Messages
+// left unacked by a crashed worker are reclaimed after ReclaimIdle.
+func Run(ctx context.Context, opts Options) {
+	n := opts.Concurrency
+	if n < 1 {
+		n = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			loop(ctx, opts)
+		}()
+	}
+	wg.Wait()
+}
+
+func loop(ctx context.Context, opts Options) {
+	for ctx.Err() == nil {
+		msgs, err := tasks.Reclaim(opts.ReclaimIdle, 1)
+		if err == nil && len(msgs) == 0 {
+			msgs, err = tasks.ReadNext(opts.Block, 1)
+		}
+		if err != nil {
+			logger.Errorf("worker: reading queue failed: %v", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		for _, m := range msgs {
+			handle(ctx, opts, m)
+			if err := tasks.Ack(m.ID); err != nil {
+				logger.Errorf("worker: ack %s failed: %v", m.ID, err)
+			}
+		}
+	}
+}
+
+// messageJobs decodes a queue message: "jobs" carries a group of jobs that
+// share a source and encoder, "job" a single one.
+func messageJobs(m tasks.TaskMessage) ([]models.Job, error) {
+	if raw, ok := m.Values["jobs"].(string); ok {
+		var jobs []models.Job
+		err := json.Unmarshal([]byte(raw), &jobs)
+		return jobs, err
+	}
+	raw, _ := m.Values["job"].(string)
+	var job models.Job
+	if err := json.Unmarshal([]byte(raw), &job); err != nil {
+		return nil, err
+	}
+	return []models.Job{job}, nil
+}
+
+// handle runs the jobs of one queue message and records their outcomes.
+func handle(ctx context.Context, opts Options, m tasks.TaskMessage) {
+	queued, err := messageJobs(m)
+	if err != nil {
+		logger.Errorf("worker: dropping malformed message %s: %v", m.ID, err)
+		return
+	}
+	var jobs []models.Job
+	for _, job := range queued {
+		// a reclaimed message may hold jobs that already finished before
+		// their worker died; don't run or count them twice
+		if stored, err := tasks.GetJob(job.Tenant, job.ID); err == nil {
+			if stored.Status == "done" || stored.Status == "failed" {
+				continue
+			}
+			job = stored
+		}
+		job.Status = "running"
+		if err := tasks.SaveJob(job); err != nil {
+			logger.Warnf("worker: saving job %s failed: %v", job.ID, err)
+		}
+		jobs = append(jobs, job)
+	}
+	if len(jobs) == 0 {
+		return
+	}
+
+	errs := runJobs(ctx, opts, jobs)
+	for i, job := range jobs {
+		if errs[i] != nil {
+			job.Status = "failed"
+			job.Error = errs[i].Error()
+			logger.Warnf("worker: job %s failed: %v", job.ID, errs[i])
+		} else {
+			job.Status = "done"
+			logger.Infof("worker: job %s done (%d outputs)", job.ID, len(job.Outputs))
+		}
+		finishJob(ctx, opts, job)
+	}
+}
+
+// runJobs fetches sources where needed, encodes every job (one decode per
+// shared source and encoder) and writes each variant to the job's
+// destination backends. It returns an error per job.
+func runJobs(ctx context.Context, opts Options, jobs []models.Job) []error {
+	errs := make([]error, len(jobs))
+	tokens := map[string]models.InputToken{}
+	type fetched struct {
+		path, sum string
+		err       error
+	}
+	sources := map[string]fetched{}
+
+	var ready []int
+	for i := range jobs {
+		job := &jobs[i]
+		token, ok := tokens[job.RequestID]
+		if !ok && job.RequestID != "" {
+			req, err := tasks.GetRequest(job.Tenant, job.RequestID)
+			if err != nil {
+				errs[i] = fmt.Errorf("loading request %s: %w", job.RequestID, err)
+				continue
+			}
+			token = req.Token
+			tokens[job.RequestID] = token
+		}
+		if job.Source != "" {
+			f, ok := sources[job.Source]
+			if !ok {
+				f.path, f.sum, f.err = fetchSource(ctx, opts, job.Tenant, token, job.Source, scratchDir(opts, job.RequestID))
+				sources[job.Source] = f
+			}
+			if f.err != nil {
+				errs[i] = f.err
+				continue
+			}
+			job.SourceFileName, job.SourceSHA256 = f.path, f.sum
+		}
+		ready = append(ready, i)
+	}
+
+	batch := make([]models.Job, len(ready))
+	for k, i := range ready {
+		batch[k] = jobs[i]
+	}
+	outs, perrs := ProcessBatch(batch)
+	for k, i := range ready {
+		if perrs[k] != nil {
+			errs[i] = perrs[k]
+			continue
+		}
+		errs[i] = deliver(ctx, &jobs[i], tokens[jobs[i].RequestID], outs[k])
+	}
+	return errs
+}
+
+// deliver writes the variant at out to every destination backend of job.
+func deliver(ctx context.Context, job *models.Job, token models.InputToken, out string) error {
+	v, err := describeVariant(out)
+	if err != nil {
+		return err
+	}
+	job.Variant = &v
+	if job.Outputs, err = deliverFile(ctx, *job, token, out); err != nil {
+		return err
+	}
+	job.Alternates = job.Alternates[:0]
+	o, _ := encoders.ReadOutcome(out)
+	for _, alt := range o.Alternates {
+		a := models.Alternate{}
+		if a.Variant, err = describeVariant(alt); err != nil {
+			return err
+		}
+		if a.Outputs, err = deliverFile(ctx, *job, token, alt); err != nil {
+			return err
+		}
+		job.Alternates = append(job.Alternates, a)
+	}
+	return nil
+}
+
+// deliverFile writes the file at p to each of job's destination backends.
+func deliverFile(ctx context.Context, job models.Job, token models.InputToken, p string) ([]models.Output, error) {
+	var outs []models.Output
+	key := variantKey(job, p)
+	for _, name := range job.DestinationBackendIDs {
+		u, err := putFile(ctx, job.Tenant, token, name, key, p, job.SourceSHA256)
+		if err != nil {
+			return nil, fmt.Errorf("writing to backend %q: %w", name, err)
+		}
+		outs = append(outs, models.Output{Backend: name, Key: key, URL: u})
+	}
+	return outs, nil
+}
+
+// describeVariant reports the format, pixel size and byte size of the
+// encoded file at p, and the outcome of a targetSSIM or maxBytes search if
+// one ran.
+// Formats that can't be probed keep a zero size.
+func describeVariant(p string) (models.Variant, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return models.Variant{}, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return models.Variant{}, err
+	}
+	v := models.Variant{Format: strings.TrimPrefix(filepath.Ext(p), "."), ContentType: "application/octet-stream", Bytes: st.Size()}
+	if t, ok := imagetype.ByExt(filepath.Ext(p)); ok {
+		v.Format, v.ContentType = t.Name, t.MIME
+	}
+	head := make([]byte, imagetype.SniffLen)
+	n, _ := io.ReadFull(f, head)
+	if t, ok := imagetype.Detect(head[:n]); ok {
+		if info, err := imagetype.Probe(f, t); err == nil {
+			v.Width, v.Height = info.Width, info.Height
+		}
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return models.Variant{}, err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return models.Variant{}, err
+	}
+	v.SHA256 = hex.EncodeToString(h.Sum(nil))
+	if o, ok := encoders.ReadOutcome(p); ok {
+		v.Quality, v.SSIM, v.Scale, v.Candidates = o.Quality, o.SSIM, o.Scale, o.Candidates
+	}
+	return v, nil
+}
+
+// finishJob persists the outcome, returns quota and, for the last job of a
+// request, settles the request.
+func finishJob(ctx context.Context, opts Options, job models.Job) {
+	if err := tasks.SaveJob(job); err != nil {
+		logger.Errorf("worker: saving job %s failed: %v", job.ID, err)
+	}
+	recordHistory(job)
+	if opts.Limiter != nil && job.QuotaKey != "" {
+		if err := opts.Limiter.ReleaseJobs(job.QuotaKey, 1); err != nil {
+			logger.Warnf("worker: releasing quota for %s failed: %v", job.QuotaKey, err)
+		}
+	}
+	if job.RequestID == "" {
+		return
+	}
+	left, err := tasks.CompleteJob(job.Tenant, job.RequestID)
+	if err != nil {
+		logger.Errorf("worker: completing job %s of request %s failed: %v", job.ID, job.RequestID, err)
+		return
+	}
+	if left == 0 {
+		finishRequest(ctx, opts, job.Tenant, job.RequestID)
+	}
+}
+
+// finishRequest stores the original where keepOriginal asked for it, marks
+// the request done (or failed when any job failed), sends the callback and
+// removes the request's scratch directory and its reference to an uploaded
+// source.
+func finishRequest(ctx context.Context, opts Options, tenantID, requestID string) {
+	defer os.RemoveAll(scratchDir(opts, requestID))
+	req, err := tasks.GetRequest(tenantID, requestID)
+	if err != nil {
+		logger.Errorf("worker: loading request %s failed: %v", requestID, err)
+		return
+	}
+	req.Status = "done"
+	jobs := make([]models.Job, 0, len(req.JobIDs))
+	for _, id := range req.JobIDs {
+		j, err := tasks.GetJob(tenantID, id)
+		if err != nil || j.Status != "done" {
+			req.Status = "failed"
+		}
+		if err == nil {
+			jobs = append(jobs, j)
+		}
+	}
+	if err := keepOriginal(ctx, opts, &req); err != nil {
+		logger.Warnf("worker: keeping original of request %s failed: %v", requestID, err)
+		req.Status = "failed"
+	}
+	releaseSource(req)
+	m := buildManifest(req, jobs)
+	if err := writeManifest(ctx, req, m); err != nil {
+		logger.Warnf("worker: writing manifest of request %s failed: %v", requestID, err)
+	}
+	if err := tasks.SaveRequest(req); err != nil {
+		logger.Errorf("worker: saving request %s failed: %v", requestID, err)
+	}
+	logger.Infof("worker: request %s %s", requestID, req.Status)
+	notify(buildCallback(req, jobs, m), req.Token.CallbackURL)
+}
+
+// recordHistory appends the finished job to the success or failure history
+// of its tenant.
+func recordHistory(job models.Job) {
+	if history.HistoryBase == nil {
+		return
+	}
+	success, failure := history.SuccessStore, history.FailureStore
+	if job.Tenant != "" {
+		ts, err := history.ForTenant(job.Tenant)
+		if err != nil {
+			logger.Warnf("worker: history for tenant %q unavailable: %v", job.Tenant, err)
+			return
+		}
+		success, failure = ts.Success, ts.Failure
+	}
+	b, err := json.Marshal(job)
+	if err != nil {
+		return
+	}
+	s := success
+	if job.Status != "done" {
+		s = failure
+	}
+	if err := s.Set([]byte(job.ID), b); err != nil {
+		logger.Warnf("worker: recording history for job %s failed: %v", job.ID, err)
+	}
+}
+
+// scratchDir is where a request's fetched source and variants live.
+func scratchDir(opts Options, requestID string) string {
+	if requestID == "" {
+		requestID = "adhoc"
+	}
+	return filepath.Join(opts.ScratchDir, requestID)
+}
+
+// OutputDir is the directory beside a backend source that its variants
+// and manifest are written to, so a later bulk run over the same prefix
+// can tell them apart from originals.
+const OutputDir = "_variants"
+
+// IsOutputKey reports whether key lies in an OutputDir.
+func IsOutputKey(key string) bool {
+	return slices.Contains(strings.Split(key, "/"), OutputDir)
+}
+
+// variantKey is the object key a variant is stored under. Variants of a
+// backend source land in OutputDir next to it so re-processed trees keep
+// their layout; uploads are grouped by source hash.
+func variantKey(job models.Job, out string) string {
+	if ref, err := backends.ParseRef(job.Source); err == nil {
+		return path.Join(path.Dir(ref.Key), OutputDir, filepath.Base(out))
+	}
+	return path.Join(job.SourceSHA256, filepath.Base(out))
+}
+
+// resolve opens the backend the token calls name.
+func resolve(tenantID string, token models.InputToken, name string) (backends.Backend, error) {
+	credKey, ok := token.GetBackend(name)
+	if !ok {
+		return nil, fmt.Errorf("token has no backend %q", name)
+	}
+	return backends.Resolve(tenantID, credKey)
+}
+
+// ErrSourceTooLarge marks a backend source above the size limit.
+var ErrSourceTooLarge = errors.New("source exceeds size limit")
+
+// fetchSource copies the object named by ref ("backend:key") into dir and
+// returns its path and sha256. Jobs of the same request share the copy.
+func fetchSource(ctx context.Context, opts Options, tenantID string, token models.InputToken, ref, dir string) (string, string, error) {
+	r, err := backends.ParseRef(ref)
+	if err != nil {
+		return "", "", err
+	}
+	dst := filepath.Join(dir, path.Base(r.Key))
+	if _, err := os.Stat(dst); err == nil {
+		sum, err := dedup.FileSHA256(dst)
+		return dst, sum, err
+	}
+
+	b, err := resolve(tenantID, token, r.Backend)
+	if err != nil {
+		return "", "", err
+	}
+	sum, err := Fetch(ctx, b, r.Key, dst, opts.MaxSourceBytes)
+	if err != nil {
+		return "", "", fmt.Errorf("source %s: %w", ref, err)
+	}
+	return dst, sum, nil
+}
+
+// Fetch copies key from b to dst and returns its sha256. The bytes go
+// through the same type allowlist and header limits as uploads, and are
+// refused past maxBytes (0 for no limit). dst only appears once complete.
+func Fetch(ctx context.Context, b backends.Backend, key, dst string, maxBytes int64) (string, error) {
+	rc, err := b.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	dir := filepath.Dir(dst)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(dir, "fetch-*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	src := io.Reader(rc)
+	if maxBytes > 0 {
+		// read one byte past the limit to tell "exactly max" from "too big"
+		src = io.LimitReader(rc, maxBytes+1)
+	}
+	n, err := io.Copy(io.MultiWriter(h, tmp), src)
+	if err == nil && maxBytes > 0 && n > maxBytes {
+		err = ErrSourceTooLarge
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := checkSource(tmp); err != nil {
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// ErrUnsupportedSource marks a source refused by the type allowlist or the
+// header limits.
+var ErrUnsupportedSource = errors.New("unsupported source")
+
+// checkSource applies the upload allowlist and probe limits to f.
+func checkSource(f *os.File) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	head := make([]byte, imagetype.SniffLen)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	typ, ok := imagetype.Detect(head[:n])
+	if !ok || !imagetype.AllowlistFromEnv().Allows(typ) {
+		return fmt.Errorf("%w: media type %q", ErrUnsupportedSource, typ.Name)
+	}
+	info, err := imagetype.Probe(f, typ)
+	if err == nil {
+		err = imagetype.LimitsFromEnv().Check(info)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUnsupportedSource, err)
+	}
+	return nil
+}
+
+// putFile uploads the file at p to the token's backend name under key and
+// returns its public URL, if the backend has one.
+func putFile(ctx context.Context, tenantID string, token models.InputToken, name, key, p, sourceSHA string) (string, error) {
+	b, err := resolve(tenantID, token, name)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	ct := "application/octet-stream"
+	if t, ok := imagetype.ByExt(filepath.Ext(p)); ok {
+		ct = t.MIME
+	}
+	if err := b.Put(ctx, key, f, st.Size(), ct, map[string]string{"source-sha256": sourceSHA}); err != nil {
+		return "", err
+	}
+	return backends.URL(b, key), nil
+}
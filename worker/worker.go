@@ -0,0 +1,144 @@
+package worker
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+
+	"pixerver/database/dedup"
+	"pixerver/logger"
+	"pixerver/magick/encoders"
+	"pixerver/models"
+)
+
+// specSettings returns a copy of the job settings with the target size
+// and resize mode filled in from the job's resolution, and its density.
+func specSettings(job models.Job) map[string]string {
+	res := job.Resolution
+	s := make(map[string]string, len(job.Settings)+6)
+	for k, v := range job.Settings {
+		s[k] = v
+	}
+	s["width"] = strconv.Itoa(res.Width)
+	s["height"] = strconv.Itoa(res.Height)
+	if res.Mode != "" {
+		s["resize"] = res.Mode
+	}
+	if res.Gravity != "" {
+		s["gravity"] = res.Gravity
+	}
+	if res.Background != "" {
+		s["background"] = res.Background
+	}
+	if res.AllowUpscale {
+		s["upscale"] = "true"
+	}
+	if job.Density != 0 {
+		s["density"] = strconv.FormatFloat(job.Density, 'f', -1, 64)
+	}
+	return s
+}
+
+// encoderSettings is specSettings plus a "variant" key derived from job's
+// result spec. VariantPath adds it to the output name, so jobs on one source
+// that differ only in settings the name doesn't spell out (quality,
+// metadata, copyright, ...) never write the same file.
+func encoderSettings(job models.Job) map[string]string {
+	s := specSettings(job)
+	s["variant"] = hex.EncodeToString(dedup.ResultKey(resultSpec(job)))[:8]
+	return s
+}
+
+// resultSpec describes everything that determines job's output.
+func resultSpec(job models.Job) dedup.Spec {
+	var tr []string
+	if job.TransformerID != "" {
+		tr = []string{job.TransformerID}
+	}
+	return dedup.Spec{
+		SourceSHA256: job.SourceSHA256,
+		Encoder:      job.Type,
+		Width:        job.Resolution.Width,
+		Height:       job.Resolution.Height,
+		Transformers: tr,
+		Settings:     specSettings(job),
+	}
+}
+
+// Process encodes job's source file and returns the output path. When the
+// source hash is known and the dedup stores are open, a previous output for
+// an identical spec is returned without running the encoder again.
+func Process(job models.Job) (string, error) {
+	outs, errs := ProcessBatch([]models.Job{job})
+	return outs[0], errs[0]
+}
+
+// ProcessBatch is Process for several jobs at once. Jobs that share a
+// source file and encoder are handed to the encoder together so the source
+// is decoded once for all of their resolutions. Outputs and errors are
+// reported per job, in order.
+func ProcessBatch(jobs []models.Job) ([]string, []error) {
+	outs := make([]string, len(jobs))
+	errs := make([]error, len(jobs))
+	keys := make([][]byte, len(jobs))
+
+	type group struct {
+		source string
+		enc    encoders.BatchHandler
+		idx    []int
+	}
+	groups := map[string]*group{}
+	var order []string
+	for i, job := range jobs {
+		enc, ok := encoders.GetBatch(job.Type)
+		if !ok {
+			errs[i] = fmt.Errorf("worker: unknown encoder %q", job.Type)
+			continue
+		}
+		if job.SourceSHA256 != "" && dedup.Open() {
+			keys[i] = dedup.ResultKey(resultSpec(job))
+			r, ok, err := dedup.LookupResult(keys[i])
+			if err != nil {
+				logger.Warnf("worker: result cache lookup for job %s failed: %v", job.ID, err)
+			} else if ok {
+				logger.Infof("worker: job %s served from result cache: %s", job.ID, r.Path)
+				outs[i] = r.Path
+				continue
+			}
+		}
+		gk := job.SourceFileName + "\x00" + job.Type + "\x00" + job.TransformerID
+		g, ok := groups[gk]
+		if !ok {
+			g = &group{source: job.SourceFileName, enc: enc}
+			groups[gk] = g
+			order = append(order, gk)
+		}
+		g.idx = append(g.idx, i)
+	}
+
+	for _, gk := range order {
+		g := groups[gk]
+		settings := make([]map[string]string, len(g.idx))
+		for k, i := range g.idx {
+			settings[k] = encoderSettings(jobs[i])
+		}
+		gouts, gerrs := g.enc(g.source, settings)
+		for k, i := range g.idx {
+			outs[i], errs[i] = gouts[k], gerrs[k]
+			if errs[i] != nil {
+				continue
+			}
+			if _, err := os.Stat(outs[i]); err != nil {
+				outs[i], errs[i] = "", fmt.Errorf("worker: encoder %s produced no output at %s", jobs[i].Type, gouts[k])
+				continue
+			}
+			if keys[i] != nil {
+				if _, err := dedup.StoreResult(keys[i], outs[i]); err != nil {
+					logger.Warnf("worker: caching result for job %s failed: %v", jobs[i].ID, err)
+				}
+			}
+		}
+	}
+	return outs, errs
+}
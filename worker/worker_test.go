@@ -0,0 +1,177 @@
+package worker
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"pixerver/database/dedup"
+	"pixerver/magick/encoders"
+	"pixerver/models"
+)
+
+func TestResultSpecKeyIgnoresSettingsOrder(t *testing.T) {
+	a := models.Job{ID: "a", SourceSHA256: "abc", Type: "webp", Resolution: models.Resolution{Width: 10, Height: 5},
+		Settings: map[string]string{"quality": "80", "method": "4"}}
+	b := a
+	b.ID = "b"
+	b.Settings = map[string]string{"method": "4", "quality": "80"}
+	if !bytes.Equal(dedup.ResultKey(resultSpec(a)), dedup.ResultKey(resultSpec(b))) {
+		t.Fatalf("expected equal specs to share a cache key")
+	}
+	b.Settings = map[string]string{"method": "4", "quality": "70"}
+	if bytes.Equal(dedup.ResultKey(resultSpec(a)), dedup.ResultKey(resultSpec(b))) {
+		t.Fatalf("expected different settings to change the cache key")
+	}
+}
+
+func TestEncoderSettingsAddsSize(t *testing.T) {
+	job := models.Job{Resolution: models.Resolution{Width: 400, Height: 300}, Settings: map[string]string{"quality": "75"}}
+	s := encoderSettings(job)
+	if s["width"] != "400" || s["height"] != "300" || s["quality"] != "75" {
+		t.Fatalf("unexpected settings %+v", s)
+	}
+	if _, ok := job.Settings["width"]; ok {
+		t.Fatalf("encoderSettings must not mutate the job settings")
+	}
+	job.Resolution = models.Resolution{Width: 400, Mode: "pad", Gravity: "north", Background: "#fff", AllowUpscale: true}
+	s = encoderSettings(job)
+	if s["resize"] != "pad" || s["gravity"] != "north" || s["background"] != "#fff" || s["upscale"] != "true" {
+		t.Fatalf("resize mode not passed through: %+v", s)
+	}
+}
+
+func TestEncoderSettingsVariantKey(t *testing.T) {
+	a := models.Job{Type: "webp", SourceSHA256: "abc", Resolution: models.Resolution{Width: 400, Height: 300},
+		Settings: map[string]string{"quality": "80"}}
+	b := a
+	b.Settings = map[string]string{"quality": "60"}
+	pa, _ := encoders.VariantPath(a.Type, "/src/abc.jpg", encoderSettings(a))
+	pb, _ := encoders.VariantPath(b.Type, "/src/abc.jpg", encoderSettings(b))
+	if pa == pb {
+		t.Fatalf("jobs differing only in quality share output %q", pa)
+	}
+	if again, _ := encoders.VariantPath(a.Type, "/src/abc.jpg", encoderSettings(a)); again != pa {
+		t.Fatalf("equal specs should share an output: %q vs %q", again, pa)
+	}
+}
+
+func TestProcessUnknownEncoder(t *testing.T) {
+	if _, err := Process(models.Job{Type: "nope"}); err == nil {
+		t.Fatalf("expected error for unknown encoder")
+	}
+}
+
+func TestVariantKey(t *testing.T) {
+	job := models.Job{Source: "archive:2024/cats/tom.jpg", SourceSHA256: "abc"}
+	if got := variantKey(job, "/scratch/r1/tom_400_300.webp"); got != "2024/cats/_variants/tom_400_300.webp" {
+		t.Fatalf("unexpected backend variant key %q", got)
+	}
+	job.Source = ""
+	if got := variantKey(job, "uploads/abc_x_y_400_300.webp"); got != "abc/abc_x_y_400_300.webp" {
+		t.Fatalf("unexpected upload variant key %q", got)
+	}
+	if !IsOutputKey("2024/cats/_variants/tom_400_300.webp") || IsOutputKey("2024/cats/tom.jpg") {
+		t.Fatalf("IsOutputKey misclassifies keys")
+	}
+}
+
+func TestOriginalDestinationsAndKey(t *testing.T) {
+	token := models.InputToken{ConversionJobs: []models.ConversionJob{
+		{Type: "jpg", KeepOriginal: true, DestinationBackends: []string{"s3", "disk"}},
+		{Type: "webp", KeepOriginal: true, DestinationBackends: []string{"disk", "cdn"}},
+		{Type: "avif", DestinationBackends: []string{"cold"}},
+	}}
+	got := originalDestinations(token)
+	if len(got) != 3 || got[0] != "s3" || got[1] != "disk" || got[2] != "cdn" {
+		t.Fatalf("unexpected destinations %v", got)
+	}
+	if k := originalKey(models.Request{SourceSHA256: "abc"}, ".png"); k != "abc/original.png" {
+		t.Fatalf("unexpected upload key %q", k)
+	}
+	if k := originalKey(models.Request{Source: "archive:a/b.jpg"}, ".jpg"); k != "a/b.jpg" {
+		t.Fatalf("unexpected backend key %q", k)
+	}
+}
+
+func TestProcessBatchReportsPerJob(t *testing.T) {
+	t.Setenv("ENCODER_ENGINE", "native")
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.png")
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(src, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := []models.Job{
+		{ID: "a", Type: "jpg", SourceFileName: src, Resolution: models.Resolution{Width: 32, Height: 24}},
+		{ID: "b", Type: "nope", SourceFileName: src},
+		{ID: "c", Type: "jpg", SourceFileName: src, Resolution: models.Resolution{Width: 16, Height: 12}},
+		{ID: "d", Type: "png", SourceFileName: src, Resolution: models.Resolution{Width: 8, Height: 6}},
+	}
+	outs, errs := ProcessBatch(jobs)
+	if errs[1] == nil {
+		t.Fatalf("expected unknown encoder to fail")
+	}
+	for _, i := range []int{0, 2, 3} {
+		if errs[i] != nil {
+			t.Fatalf("job %s: %v", jobs[i].ID, errs[i])
+		}
+		if _, err := os.Stat(outs[i]); err != nil {
+			t.Fatalf("job %s: %v", jobs[i].ID, err)
+		}
+	}
+	if outs[0] == outs[2] {
+		t.Fatalf("expected distinct outputs per resolution")
+	}
+}
+
+func TestBuildManifest(t *testing.T) {
+	out := func(key string) []models.Output {
+		return []models.Output{{Backend: "cdn", Key: key, URL: "https://cdn/" + key}}
+	}
+	jobs := []models.Job{
+		{Status: "done", Variant: &models.Variant{Format: "jpeg", ContentType: "image/jpeg", Width: 800, Height: 600}, Outputs: out("a_800.jpg")},
+		{Status: "done", Variant: &models.Variant{Format: "webp", ContentType: "image/webp", Width: 800, Height: 600}, Density: 2, Outputs: out("a_800.webp")},
+		{Status: "done", Variant: &models.Variant{Format: "webp", ContentType: "image/webp", Width: 400, Height: 300}, Density: 1, Outputs: out("a_400.webp")},
+		{Status: "done", Variant: &models.Variant{Format: "avif", ContentType: "image/avif", Width: 400, Height: 300}, Outputs: out("a_400.avif")},
+		{Status: "failed", Variant: &models.Variant{Format: "png", ContentType: "image/png", Width: 10, Height: 10}},
+	}
+	m := buildManifest(models.Request{ID: "r1", SourceSHA256: "abc"}, jobs)
+	if len(m.Variants) != 4 {
+		t.Fatalf("expected 4 variants, got %d", len(m.Variants))
+	}
+	if got := m.Srcset["webp"]; got != "https://cdn/a_400.webp 400w, https://cdn/a_800.webp 800w" {
+		t.Fatalf("unexpected webp srcset %q", got)
+	}
+	var order []string
+	for _, p := range m.Picture {
+		order = append(order, p.Type)
+	}
+	if !reflect.DeepEqual(order, []string{"image/avif", "image/webp", "image/jpeg"}) {
+		t.Fatalf("unexpected picture order %v", order)
+	}
+	if m.Picture[0].HTML != `<source type="image/avif" srcset="https://cdn/a_400.avif 400w">` {
+		t.Fatalf("unexpected source element %q", m.Picture[0].HTML)
+	}
+	if k := ManifestKey(models.Request{ID: "r1", SourceSHA256: "abc"}); k != "abc/manifests/r1.json" {
+		t.Fatalf("unexpected upload manifest key %q", k)
+	}
+	if k := ManifestKey(models.Request{ID: "r1", Tenant: "acme", SourceSHA256: "abc"}); k != "abc/manifests/acme/r1.json" {
+		t.Fatalf("unexpected tenant manifest key %q", k)
+	}
+	if k := ManifestKey(models.Request{Source: "archive:2024/cats/tom.jpg"}); k != "2024/cats/_variants/tom.manifest.json" {
+		t.Fatalf("unexpected backend manifest key %q", k)
+	}
+}